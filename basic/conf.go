@@ -7,6 +7,12 @@ type SpiderEngineConf struct {
 	DataDir       	    string    //数据目录(存放数据文件)
 	PartPersistMinCnt   int
 	PartMergeMinCnt     int
+	WalSyncPolicy       string    //WAL刷盘策略: always, interval, none
+	WalSyncInterval     int       //WAL定时刷盘的周期(秒)
+	PartMergeFactor     int       //分层合并的层级倍数
+	MergeIoRateLimit    int       //后台合并的IO限速(MB/s), 0表示不限速
+	FlushMaxAge         int       //内存分区中的数据最长多久落地一次(秒), 0表示不限
+	FlushMaxBytes       int       //内存分区最多占用多少内存就落地(MB), 0表示不限
 
 	LogPath             string    //日志路径
 	LogLevel            string    //日志级别
@@ -32,7 +38,7 @@ func ParseConfig(confPath string) (*SpiderEngineConf, error) {
 		panic("Load conf dataDir failed!")
 	}
 
-	if c.PartPersistMinCnt, err = cfg.Int("spider", "partitionPersistMinDocCnt"); err != nil {
+	if c.PartPersistMinCnt, err = cfg.Int("spider", "partitionPersistMinDocCnt"); err != nil || c.PartPersistMinCnt <= 0 {
 		panic("Load conf PartPersistMinCnt failed!")
 	}
 
@@ -40,6 +46,36 @@ func ParseConfig(confPath string) (*SpiderEngineConf, error) {
 		panic("Load conf PartPersistMinCnt failed!")
 	}
 
+	//WAL配置可选, 老的配置文件没有则使用默认值
+	c.WalSyncPolicy = cfg.MustValue("spider", "walSyncPolicy", WAL_SYNC_INTERVAL)
+	if c.WalSyncPolicy != WAL_SYNC_ALWAYS && c.WalSyncPolicy != WAL_SYNC_INTERVAL && c.WalSyncPolicy != WAL_SYNC_NONE {
+		panic("Load conf walSyncPolicy failed!")
+	}
+	c.WalSyncInterval = cfg.MustInt("spider", "walSyncInterval", 1)
+	if c.WalSyncInterval <= 0 {
+		panic("Load conf walSyncInterval failed!")
+	}
+
+	//合并配置可选, 老的配置文件没有则使用默认值
+	c.PartMergeFactor = cfg.MustInt("spider", "partitionMergeFactor", 10)
+	if c.PartMergeFactor < 2 {
+		panic("Load conf partitionMergeFactor failed!")
+	}
+	c.MergeIoRateLimit = cfg.MustInt("spider", "mergeIoRateLimit", 0)
+	if c.MergeIoRateLimit < 0 {
+		panic("Load conf mergeIoRateLimit failed!")
+	}
+
+	//落地配置可选, 老的配置文件没有则使用默认值
+	c.FlushMaxAge = cfg.MustInt("spider", "flushMaxAge", 300)
+	if c.FlushMaxAge < 0 {
+		panic("Load conf flushMaxAge failed!")
+	}
+	c.FlushMaxBytes = cfg.MustInt("spider", "flushMaxBytes", 256)
+	if c.FlushMaxBytes < 0 {
+		panic("Load conf flushMaxBytes failed!")
+	}
+
 	if c.LogPath, err = cfg.GetValue("log", "logPath"); err != nil {
 		panic("Load conf logPath failed!")
 	}
@@ -10,8 +10,10 @@ type DocNode struct {
 }
 
 type DocInfo struct {
-	Key    string
-	Detail map[string]interface{}
+	Key     string
+	Detail  map[string]interface{}
+	Version uint64 `json:",omitempty"` //文档的版本, 每次变更加1, 用于乐观并发控制
+	Cursor  string `json:",omitempty"` //搜索结果的游标, 作为search_after参数获取下一页
 }
 
 var DOC_NODE_SIZE int
@@ -33,6 +35,9 @@ const (
 	FILT_STR_PREFIX  = 11 //前缀, 仅数字字符
 	FILT_STR_SUFFIX  = 12 //后缀, 仅数字字符
 	FILT_STR_CONTAIN = 13 //包含
+
+	FILT_CONTAIN_ANY = 21 //包含任意一个元素, 仅列表支持
+	FILT_CONTAIN_ALL = 22 //包含全部元素, 仅列表支持
 )
 
 var FilterTypeMap = map[string]int{
@@ -47,6 +52,9 @@ var FilterTypeMap = map[string]int{
 	"prefix" 	: FILT_STR_PREFIX,
 	"suffix" 	: FILT_STR_SUFFIX,
 	"contain" 	: FILT_STR_CONTAIN,
+
+	"contain any" : FILT_CONTAIN_ANY,
+	"contain all" : FILT_CONTAIN_ALL,
 }
 
 const (
@@ -56,23 +64,65 @@ const (
 	IDX_FILENAME_SUFFIX_INVERT = ".ivt"
 	IDX_FILENAME_SUFFIX_META   = ".meta"
 	IDX_FILENAME_SUFFIX_BITMAP = ".btmp"
+	IDX_FILENAME_SUFFIX_WAL    = ".wal"
 )
 
 type SearchFilter struct {
 	FieldName       string   `json:"field"`   //需要过滤的字段，和搜索字段不是一个东西
-	FilterType      string   `json:"type"` 	  //过滤类型: =, !=, >, <, in, not in, between, prefix, suffix, contain
+	FilterType      string   `json:"type"` 	  //过滤类型: =, !=, >, <, in, not in, between, prefix, suffix, contain, contain any, contain all
 	StrVal          string   `json:"str"` 	  //用于字符的==/!=, prefix, suffix
 	IntVal          int64    `json:"int"` 	  //用于数字的==/!=/>/<
 	Begin           int64    `json:"begin"`   //用于数字between
 	End             int64    `json:"end"` 	  //用于数字between
 	RangeNums       []int64  `json:"iranges"` //用于数字in或not in
-	RangeStrs       []string `json:"sranges"` //用于字符in或not in
+	RangeStrs       []string `json:"sranges"` //用于字符in或not in, 列表contain any或contain all
+	FloatVal        float64   `json:"float"`   //用于浮点的==/!=/>/<
+	FloatBegin      float64   `json:"fbegin"`  //用于浮点between
+	FloatEnd        float64   `json:"fend"`    //用于浮点between
+	RangeFloats     []float64 `json:"franges"` //用于浮点in或not in
+}
+
+//按相关性得分排序时使用的字段名
+const SORT_BY_SCORE = "_score"
+
+type SearchSort struct {
+	FieldName       string   `json:"field"`   //排序字段, number或time类型的字段, 或者_score表示相关性得分
+	Order           string   `json:"order"`   //排序方向: asc, desc, 默认desc
+}
+
+//聚合类型
+const (
+	AGG_TERMS          = "terms"          //按值计数, 仅whole类型
+	AGG_MIN            = "min"            //最小值, 仅number类型
+	AGG_MAX            = "max"            //最大值, 仅number类型
+	AGG_AVG            = "avg"            //平均值, 仅number类型
+	AGG_SUM            = "sum"            //求和, 仅number类型
+	AGG_DATE_HISTOGRAM = "date_histogram" //按时间间隔计数, 仅time类型
+)
+
+type SearchAgg struct {
+	FieldName       string   `json:"field"`    //聚合字段
+	AggType         string   `json:"type"`     //聚合类型: terms, min, max, avg, sum, date_histogram
+	Size            int      `json:"size"`     //用于terms, 返回计数最多的前size个值, 默认10
+	Interval        string   `json:"interval"` //用于date_histogram, 时间间隔: hour, day, week, month, year, 默认day
+}
+
+type AggBucket struct {
+	Key             string   `json:"key"`
+	Count           int      `json:"count"`
+}
+
+type AggResult struct {
+	Count           int         `json:"count"`             //有值的文档数
+	Value           *float64    `json:"value,omitempty"`   //用于min, max, avg, sum, 没有值的时候为空
+	Buckets         []AggBucket `json:"buckets,omitempty"` //用于terms, date_histogram
 }
 
 const (
 	RET_CODE_OK  = iota
 	RET_CODE_FAILED
 	RET_CODE_ERROR
+	RET_CODE_CONFLICT
 )
 
 //Http response body
@@ -98,6 +148,14 @@ func NewFailedResult(data interface{}) *Result {
 	}
 }
 
+func NewConflictResult(data interface{}) *Result {
+	return &Result{
+		Code: RET_CODE_CONFLICT,
+		Msg: "conflict",
+		Data:data,
+	}
+}
+
 func NewErrorResult(data interface{}) *Result {
 	return &Result{
 		Code: RET_CODE_ERROR,
@@ -122,10 +180,14 @@ type SpiderResponse struct {
 const (
 	REQ_TYPE_DDL_ADD_FIELD = 10
 	REQ_TYPE_DDL_DEL_FIELD = 11
+	REQ_TYPE_DDL_SETTINGS  = 12
 
 	REQ_TYPE_DML_ADD_DOC   = 20
 	REQ_TYPE_DML_DEL_DOC   = 21
 	REQ_TYPE_DML_EDIT_DOC  = 22
+	REQ_TYPE_DML_BULK      = 23
+	REQ_TYPE_DML_PATCH_DOC = 24
+	REQ_TYPE_DML_BY_QUERY  = 25
 )
 
 func NewRequest(typ uint8, p interface{}) *SpiderRequest {
@@ -147,8 +209,24 @@ func NewResponse(err error, data interface{}) *SpiderResponse {
 var (
 	PART_PERSIST_MIN_DOC_CNT uint32  //1w个文档，内存分区满1w个文档，就落地一次
 	PART_MERGE_MIN_DOC_CNT   uint32  //10w个文档，分区合并的一个参考值，合并一个分区至少拥有10w个Doc
+	PART_MERGE_FACTOR        = 10    //分层合并的层级倍数, 同一层级相邻的分区达到这个个数就合并成上一层级的分区
+	MERGE_IO_RATE_LIMIT      = 0     //后台合并的IO限速(MB/s), 0表示不限速
+	FLUSH_MAX_AGE_SEC        = 300   //内存分区中最早的未落地数据超过这个时间(秒)就落地, 0表示不限
+	FLUSH_MAX_BYTES          = 256   //内存分区的索引占用内存超过这个大小(MB)就落地, 0表示不限
 
 	//Test
 	//PART_PERSIST_MIN_DOC_CNT uint32 = 2
 	//PART_MERGE_MIN_DOC_CNT uint32 = 6
+)
+
+//WAL刷盘策略
+const (
+	WAL_SYNC_ALWAYS   = "always"   //每次写入都刷盘, 最安全, 性能最差
+	WAL_SYNC_INTERVAL = "interval" //定时刷盘, 宕机最多丢失一个周期的数据
+	WAL_SYNC_NONE     = "none"     //不主动刷盘, 交给操作系统, 进程崩溃不丢数据, 机器宕机可能丢失
+)
+
+var (
+	WAL_SYNC_POLICY       = WAL_SYNC_INTERVAL
+	WAL_SYNC_INTERVAL_SEC = 1
 )
\ No newline at end of file
@@ -16,7 +16,7 @@ import (
 //建库
 func CreateDatabase(w http.ResponseWriter, req *http.Request) {
 	//参数读取与解析
-	url := strings.Trim(req.URL.String(), "/")
+	url := strings.Trim(req.URL.Path, "/")
 	parts := strings.Split(url, "/")
 	partLen := len(parts)
 	if partLen != 1 {
@@ -42,7 +42,7 @@ func CreateDatabase(w http.ResponseWriter, req *http.Request) {
 //删除库
 func DropDatabase(w http.ResponseWriter, req *http.Request) {
 	//参数读取与解析
-	url := strings.Trim(req.URL.String(), "/")
+	url := strings.Trim(req.URL.Path, "/")
 	parts := strings.Split(url, "/")
 	partLen := len(parts)
 	if partLen != 1 {
@@ -69,7 +69,7 @@ func DropDatabase(w http.ResponseWriter, req *http.Request) {
 //建表
 func CreateTable(w http.ResponseWriter, req *http.Request) {
 	//参数读取与解析
-	url := strings.Trim(req.URL.String(), "/")
+	url := strings.Trim(req.URL.Path, "/")
 	parts := strings.Split(url, "/")
 	partLen := len(parts)
 	if partLen != 2 {
@@ -85,20 +85,23 @@ func CreateTable(w http.ResponseWriter, req *http.Request) {
 		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
 		return
 	}
-	p := engine.FieldsParam{}
-	err = json.Unmarshal(body, &p)
+	//body可以是字段列表, 也可以是同时包含字段列表和表设置的对象: {"fields":[...], "settings":{...}}
+	p := engine.CreateTableParam{}
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		err = json.Unmarshal(body, &p.Fileds)
+	} else {
+		err = json.Unmarshal(body, &p)
+	}
 	if err != nil {
 		log.Errf("CreateDatabase Error: %v", err)
 		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
 		return
 	}
+	p.Database = db
+	p.Table = table
 
 	//操作
-	err = engine.SpdInstance().CreateTable(&engine.CreateTableParam{
-		Database: db,
-		Table: table,
-		Fileds: p,
-	})
+	err = engine.SpdInstance().CreateTable(&p)
 	if err != nil {
 		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
 		return
@@ -111,7 +114,7 @@ func CreateTable(w http.ResponseWriter, req *http.Request) {
 //删除表
 func DropTable(w http.ResponseWriter, req *http.Request) {
 	//参数读取与解析
-	url := strings.Trim(req.URL.String(), "/")
+	url := strings.Trim(req.URL.Path, "/")
 	parts := strings.Split(url, "/")
 	partLen := len(parts)
 	if partLen != 2 {
@@ -134,10 +137,62 @@ func DropTable(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
+//手动落地表的内存分区
+func FlushTable(w http.ResponseWriter, req *http.Request) {
+	//参数读取与解析
+	url := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(url, "/")
+	partLen := len(parts)
+	if partLen != 3 {
+		log.Errf("FlushTable Param Error: %v", url)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult("Param Error")))
+		return
+	}
+
+	//操作
+	err := engine.SpdInstance().FlushTable(&engine.CreateTableParam{
+		Database: parts[0],
+		Table: parts[1],
+	})
+	if err != nil {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+
+	io.WriteString(w, helper.JsonEncode(basic.NewOkResult("")))
+	return
+}
+
+//在线校验表
+func VerifyTable(w http.ResponseWriter, req *http.Request) {
+	//参数读取与解析
+	url := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(url, "/")
+	partLen := len(parts)
+	if partLen != 3 {
+		log.Errf("VerifyTable Param Error: %v", url)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult("Param Error")))
+		return
+	}
+
+	//操作
+	report, err := engine.SpdInstance().VerifyTable(&engine.CreateTableParam{
+		Database: parts[0],
+		Table: parts[1],
+	})
+	if err != nil {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+
+	io.WriteString(w, helper.JsonEncode(basic.NewOkResult(report)))
+	return
+}
+
 //删除表
 func AlterTable(w http.ResponseWriter, req *http.Request) {
 	//参数读取与解析
-	url := strings.Trim(req.URL.String(), "/")
+	url := strings.Trim(req.URL.Path, "/")
 	parts := strings.Split(url, "/")
 	partLen := len(parts)
 	if partLen != 2 {
@@ -161,11 +216,19 @@ func AlterTable(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if p.Type != "addField" && p.Type != "delField" {
+	if p.Type != "addField" && p.Type != "delField" && p.Type != "settings" {
 		log.Errf("No support opType: %v", p.Type)
 		io.WriteString(w, helper.JsonEncode(fmt.Sprintf("No support opType: %v", p.Type)))
 		return
 	}
+	if p.Type == "settings" {
+		updateSettings(w, &engine.TableSettingsParam{
+			Database: db,
+			Table: table,
+			Settings: p.Settings,
+		})
+		return
+	}
 
 	ap := engine.AlterFieldParam{
 		Table: table,
@@ -204,3 +267,16 @@ func deleteField(w http.ResponseWriter, ap *engine.AlterFieldParam) {
 	io.WriteString(w, helper.JsonEncode(basic.NewOkResult("")))
 	return
 }
+
+//修改表的设置
+func updateSettings(w http.ResponseWriter, sp *engine.TableSettingsParam) {
+	//操作
+	settings, err := engine.SpdInstance().UpdateSettings(sp)
+	if err != nil {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+
+	io.WriteString(w, helper.JsonEncode(basic.NewOkResult(settings)))
+	return
+}
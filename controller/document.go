@@ -2,20 +2,27 @@ package controller
 
 import (
 	"io"
+	"fmt"
+	"bytes"
+	"bufio"
+	"encoding/csv"
+	"errors"
 	"net/http"
 	"io/ioutil"
 	"encoding/json"
 	"github.com/hq-cml/spider-engine/utils/helper"
 	"github.com/hq-cml/spider-engine/basic"
 	"github.com/hq-cml/spider-engine/engine"
+	"github.com/hq-cml/spider-engine/core/table"
 	"github.com/hq-cml/spider-engine/utils/log"
 	"strings"
+	"strconv"
 )
 
 //新增Doc
 func AddDoc(w http.ResponseWriter, req *http.Request) {
 	//参数读取与解析
-	url := strings.Trim(req.URL.String(), "/")
+	url := strings.Trim(req.URL.Path, "/")
 	parts := strings.Split(url, "/")
 	partLen := len(parts)
 	if partLen != 3 {
@@ -58,7 +65,7 @@ func AddDoc(w http.ResponseWriter, req *http.Request) {
 //获取Doc
 func GetDoc(w http.ResponseWriter, req *http.Request) {
 	//参数读取与解析
-	url := strings.Trim(req.URL.String(), "/")
+	url := strings.Trim(req.URL.Path, "/")
 	parts := strings.Split(url, "/")
 	partLen := len(parts)
 	if partLen != 3 {
@@ -83,7 +90,7 @@ func GetDoc(w http.ResponseWriter, req *http.Request) {
 //改变doc
 func UpdateDoc(w http.ResponseWriter, req *http.Request) {
 	//参数读取与解析
-	url := strings.Trim(req.URL.String(), "/")
+	url := strings.Trim(req.URL.Path, "/")
 	parts := strings.Split(url, "/")
 	partLen := len(parts)
 	if partLen != 3 {
@@ -107,26 +114,88 @@ func UpdateDoc(w http.ResponseWriter, req *http.Request) {
 		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
 		return
 	}
-
-	err = engine.SpdInstance().UpdateDoc(&engine.DocParam{
-		Database: db,
-		Table:  table,
-		Primary: primaryKey,
-		Content: p,
-	})
+	ifVersion, err := getIfVersion(req)
 	if err != nil {
 		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
 		return
 	}
 
+	//op_type=create时只新增, 主键已经存在则失败
+	if req.URL.Query().Get("op_type") == "create" {
+		_, err = engine.SpdInstance().AddDoc(&engine.DocParam{
+			Database: db,
+			Table:  table,
+			Primary: primaryKey,
+			Content: p,
+		})
+	} else {
+		err = engine.SpdInstance().UpdateDoc(&engine.DocParam{
+			Database: db,
+			Table:  table,
+			Primary: primaryKey,
+			Content: p,
+			IfVersion: ifVersion,
+		})
+	}
+	if err != nil {
+		io.WriteString(w, helper.JsonEncode(errorResult(err)))
+		return
+	}
+
 	io.WriteString(w, helper.JsonEncode(basic.NewOkResult("")))
 	return
 }
 
+//局部更新doc, 请求体形如 {"doc": {...}, "incr": {"views": 1}, "upsert": true}
+func PatchDoc(w http.ResponseWriter, req *http.Request) {
+	//参数读取与解析
+	url := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(url, "/")
+	partLen := len(parts)
+	if partLen != 3 {
+		log.Errf("PatchDoc Param Error: %v", url)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult("Param Error")))
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Errf("PatchDoc Error: %v", err)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+	p := engine.PatchDocParam{}
+	err = json.Unmarshal(body, &p)
+	if err != nil {
+		log.Errf("PatchDoc Error: %v", err)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+	p.Database = parts[0]
+	p.Table = parts[1]
+	p.PrimaryKey = parts[2]
+	if p.IfVersion, err = getIfVersion(req); err != nil {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+
+	created, err := engine.SpdInstance().PatchDoc(&p)
+	if err != nil {
+		io.WriteString(w, helper.JsonEncode(errorResult(err)))
+		return
+	}
+
+	status := table.BULK_STATUS_UPDATED
+	if created {
+		status = table.BULK_STATUS_CREATED
+	}
+	io.WriteString(w, helper.JsonEncode(basic.NewOkResult(status)))
+	return
+}
+
 //删除Doc
 func DeleteDoc(w http.ResponseWriter, req *http.Request) {
 	//参数读取与解析
-	url := strings.Trim(req.URL.String(), "/")
+	url := strings.Trim(req.URL.Path, "/")
 	parts := strings.Split(url, "/")
 	partLen := len(parts)
 	if partLen != 3 {
@@ -134,15 +203,21 @@ func DeleteDoc(w http.ResponseWriter, req *http.Request) {
 		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult("Param Error")))
 		return
 	}
+	ifVersion, err := getIfVersion(req)
+	if err != nil {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
 	p := engine.DelDocParam{
 		Database: parts[0],
 		Table: parts[1],
 		PrimaryKey:parts[2],
+		IfVersion: ifVersion,
 	}
 
-	err := engine.SpdInstance().DeleteDoc(&p)
+	err = engine.SpdInstance().DeleteDoc(&p)
 	if err != nil {
-		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		io.WriteString(w, helper.JsonEncode(errorResult(err)))
 		return
 	}
 
@@ -150,6 +225,89 @@ func DeleteDoc(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
+//批量写入, 请求体为NDJSON格式, 每个操作一行元信息, 除了delete之外再跟一行文档内容
+func Bulk(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Errf("Bulk Error: %v", err)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+	actions, err := parseBulk(body)
+	if err != nil {
+		log.Errf("Bulk Error: %v", err)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+
+	results, err := engine.SpdInstance().Bulk(actions)
+	if err != nil {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+
+	hasError := false
+	for _, result := range results {
+		if result.Error != "" {
+			hasError = true
+			break
+		}
+	}
+	io.WriteString(w, helper.JsonEncode(basic.NewOkResult(map[string]interface{}{
+		"errors": hasError,
+		"items": results,
+	})))
+	return
+}
+
+//批量操作的元信息行, 如 {"index": {"database": "sp_db", "table": "user", "primaryKey": "10001"}}
+type bulkMeta struct {
+	Database   string `json:"database"`
+	Table      string `json:"table"`
+	PrimaryKey string `json:"primaryKey"`
+	IfVersion  uint64 `json:"ifVersion"`
+}
+
+//解析NDJSON, 任意一行格式错误则整个请求失败
+func parseBulk(body []byte) ([]*engine.BulkAction, error) {
+	lines := [][]byte{}
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	actions := []*engine.BulkAction{}
+	for i := 0; i < len(lines); i++ {
+		meta := map[string]bulkMeta{}
+		if err := json.Unmarshal(lines[i], &meta); err != nil || len(meta) != 1 {
+			return nil, errors.New(fmt.Sprintf("Bulk line %v: invalid action", i + 1))
+		}
+		for op, m := range meta {
+			act := &engine.BulkAction{Op: op, Database: m.Database, Table: m.Table, PrimaryKey: m.PrimaryKey, IfVersion: m.IfVersion}
+			switch op {
+			case table.BULK_OP_INDEX, table.BULK_OP_CREATE, table.BULK_OP_UPDATE:
+				i++
+				if i >= len(lines) {
+					return nil, errors.New(fmt.Sprintf("Bulk line %v: missing doc", i))
+				}
+				if err := json.Unmarshal(lines[i], &act.Content); err != nil {
+					return nil, errors.New(fmt.Sprintf("Bulk line %v: %v", i + 1, err))
+				}
+			case table.BULK_OP_DELETE:
+				if m.PrimaryKey == "" {
+					return nil, errors.New(fmt.Sprintf("Bulk line %v: delete needs primaryKey", i + 1))
+				}
+			default:
+				return nil, errors.New(fmt.Sprintf("Bulk line %v: unsupport action %v", i + 1, op))
+			}
+			actions = append(actions, act)
+		}
+	}
+	return actions, nil
+}
+
 //搜索
 func SearchDocs(w http.ResponseWriter, req *http.Request) {
 	body, err := ioutil.ReadAll(req.Body)
@@ -166,15 +324,123 @@ func SearchDocs(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	docs, total, err := engine.SpdInstance().SearchDocs(&p)
+	docs, total, aggs, err := engine.SpdInstance().SearchDocs(&p)
 	if err != nil {
 		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
 		return
 	}
 
-	io.WriteString(w, helper.JsonEncode(basic.NewOkResult(map[string]interface{}{
+	ret := map[string]interface{}{
 		"docs": docs,
 		"total": total,
-	})))
+	}
+	if len(p.Aggs) > 0 {
+		ret["aggs"] = aggs
+	}
+	io.WriteString(w, helper.JsonEncode(basic.NewOkResult(ret)))
+	return
+}
+
+//url参数中的if_version, 没有则为0(不校验版本)
+func getIfVersion(req *http.Request) (uint64, error) {
+	str := req.URL.Query().Get("if_version")
+	if str == "" {
+		return 0, nil
+	}
+	ifVersion, err := strconv.ParseUint(str, 10, 64)
+	if err != nil || ifVersion == 0 {
+		return 0, errors.New("Invalid if_version: " + str)
+	}
+	return ifVersion, nil
+}
+
+//写入出错的返回结果, 版本冲突使用单独的返回码
+func errorResult(err error) *basic.Result {
+	if table.IsVersionConflict(err) {
+		return basic.NewConflictResult(err.Error())
+	}
+	return basic.NewErrorResult(err.Error())
+}
+
+//导出全表, 每行一个文档: format=ndjson(默认)时每行是一个json, format=csv时第一行是表头, fields指定导出的字段(逗号分隔)
+//开始输出之后再出错只能中断输出, 此时记录日志
+func ExportDocs(w http.ResponseWriter, req *http.Request) {
+	//参数读取与解析
+	url := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(url, "/")
+	if len(parts) != 3 {
+		log.Errf("ExportDocs Param Error: %v", url)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult("Param Error")))
+		return
+	}
+	var fields []string
+	if str := req.URL.Query().Get("fields"); str != "" {
+		fields = strings.Split(str, ",")
+	}
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "ndjson" && format != "csv" {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult("Unsupport format: " + format)))
+		return
+	}
+	if format == "csv" && len(fields) == 0 {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult("Csv needs fields!")))
+		return
+	}
+
+	//表头先写入缓冲, 空表也有表头; 导出开始之前出错(比如字段不存在)则丢弃, 返回错误信息
+	buf := bufio.NewWriter(w)
+	csvWriter := csv.NewWriter(buf)
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		csvWriter.Write(fields)
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	started := false
+	err := engine.SpdInstance().ExportDocs(parts[0], parts[1], fields, func(doc *basic.DocInfo) error {
+		started = true
+		if format == "csv" {
+			record := make([]string, len(fields))
+			for i, fieldName := range fields {
+				record[i] = csvValue(doc.Detail[fieldName])
+			}
+			return csvWriter.Write(record)
+		}
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		return buf.WriteByte('\n')
+	})
+	if err != nil && !started {
+		w.Header().Del("Content-Type")
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+	csvWriter.Flush()
+	buf.Flush()
+	if err != nil {
+		log.Errf("ExportDocs Error: %v", err)
+	}
 	return
 }
+
+//csv中的字段值, 列表用逗号连接
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ",")
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
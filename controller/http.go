@@ -21,7 +21,7 @@ type spiderHttpMux struct {
 //spiderHttpMux实现http.Handler接口
 func (spdMux *spiderHttpMux)ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	fmt.Println(r.Method, r.URL.String())
-	url := strings.Trim(r.URL.String(), "/")
+	url := strings.Trim(r.URL.Path, "/")
 	parts := strings.Split(url, "/")
 	partLen := len(parts)
 	switch r.Method {
@@ -30,6 +30,18 @@ func (spdMux *spiderHttpMux)ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Status(w, r)
 		} else if partLen == 1 && parts[0] == "_search" {
 			SearchDocs(w, r)
+		} else if partLen == 1 && parts[0] == engine.SNAPSHOT_DIR {
+			ListSnapshots(w, r)
+		} else if partLen == 2 && parts[0] == engine.SNAPSHOT_DIR {
+			GetSnapshot(w, r)
+		} else if partLen == 1 && parts[0] == "_tasks" {
+			ListTasks(w, r)
+		} else if partLen == 2 && parts[0] == "_tasks" {
+			GetTask(w, r)
+		} else if partLen == 3 && parts[2] == "_export" {
+			ExportDocs(w, r)
+		} else if partLen == 3 && parts[2] == "_verify" {
+			VerifyTable(w, r)
 		} else if partLen == 3 {
 			GetDoc(w, r)
 		} else {
@@ -37,10 +49,24 @@ func (spdMux *spiderHttpMux)ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintln(w, "404 Not Found")
 		}
 	case "POST":
-		if partLen == 1 {
+		if partLen == 2 && parts[0] == engine.SNAPSHOT_DIR {
+			CreateSnapshot(w, r)
+		} else if partLen == 3 && parts[0] == engine.SNAPSHOT_DIR && parts[2] == "_restore" {
+			RestoreSnapshot(w, r)
+		} else if partLen == 3 && parts[0] == "_tasks" && parts[2] == "_cancel" {
+			CancelTask(w, r)
+		} else if partLen == 1 && parts[0] == "_bulk" {
+			Bulk(w, r)
+		} else if partLen == 1 {
 			CreateDatabase(w, r)
 		} else if partLen == 2 {
 			CreateTable(w, r)
+		} else if partLen == 3 && parts[2] == "_flush" {
+			FlushTable(w, r)
+		} else if partLen == 3 && parts[2] == "_delete_by_query" {
+			DeleteByQuery(w, r)
+		} else if partLen == 3 && parts[2] == "_update_by_query" {
+			UpdateByQuery(w, r)
 		} else if partLen == 3 {
 			AddDoc(w, r)
 		} else {
@@ -55,7 +81,9 @@ func (spdMux *spiderHttpMux)ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintln(w, "404 Not Found")
 		}
 	case "DELETE":
-		if partLen == 1 {
+		if partLen == 2 && parts[0] == engine.SNAPSHOT_DIR {
+			DeleteSnapshot(w, r)
+		} else if partLen == 1 {
 			DropDatabase(w, r)
 		} else if partLen == 2 {
 			DropTable(w, r)
@@ -68,6 +96,8 @@ func (spdMux *spiderHttpMux)ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "PATCH":
 		if partLen == 2 {
 			AlterTable(w, r)
+		} else if partLen == 3 {
+			PatchDoc(w, r)
 		} else {
 			w.WriteHeader(http.StatusNotFound)
 			fmt.Fprintln(w, "404 Not Found")
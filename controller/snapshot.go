@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+	"github.com/hq-cml/spider-engine/utils/log"
+	"github.com/hq-cml/spider-engine/utils/helper"
+	"github.com/hq-cml/spider-engine/basic"
+	"github.com/hq-cml/spider-engine/engine"
+	"strings"
+)
+
+//生成快照
+func CreateSnapshot(w http.ResponseWriter, req *http.Request) {
+	//参数读取与解析
+	url := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(url, "/")
+	partLen := len(parts)
+	if partLen != 2 {
+		log.Errf("CreateSnapshot Param Error: %v", url)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult("Param Error")))
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Errf("CreateSnapshot Error: %v", err)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+	p := engine.SnapshotParam{}
+	err = json.Unmarshal(body, &p)
+	if err != nil {
+		log.Errf("CreateSnapshot Error: %v", err)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+	p.Name = parts[1]
+
+	//操作
+	info, err := engine.SpdInstance().CreateSnapshot(&p)
+	if err != nil {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+
+	io.WriteString(w, helper.JsonEncode(basic.NewOkResult(info)))
+	return
+}
+
+//快照列表
+func ListSnapshots(w http.ResponseWriter, req *http.Request) {
+	snapshots, err := engine.SpdInstance().ListSnapshots()
+	if err != nil {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+
+	io.WriteString(w, helper.JsonEncode(basic.NewOkResult(snapshots)))
+	return
+}
+
+//获取快照
+func GetSnapshot(w http.ResponseWriter, req *http.Request) {
+	//参数读取与解析
+	url := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(url, "/")
+	partLen := len(parts)
+	if partLen != 2 {
+		log.Errf("GetSnapshot Param Error: %v", url)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult("Param Error")))
+		return
+	}
+
+	//操作
+	info, err := engine.SpdInstance().GetSnapshot(parts[1])
+	if err != nil {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+
+	io.WriteString(w, helper.JsonEncode(basic.NewOkResult(info)))
+	return
+}
+
+//删除快照
+func DeleteSnapshot(w http.ResponseWriter, req *http.Request) {
+	//参数读取与解析
+	url := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(url, "/")
+	partLen := len(parts)
+	if partLen != 2 {
+		log.Errf("DeleteSnapshot Param Error: %v", url)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult("Param Error")))
+		return
+	}
+
+	//操作
+	err := engine.SpdInstance().DeleteSnapshot(parts[1])
+	if err != nil {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+
+	io.WriteString(w, helper.JsonEncode(basic.NewOkResult("")))
+	return
+}
+
+//从快照恢复, body可以为空, 表示恢复到原有的库和表
+func RestoreSnapshot(w http.ResponseWriter, req *http.Request) {
+	//参数读取与解析
+	url := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(url, "/")
+	partLen := len(parts)
+	if partLen != 3 {
+		log.Errf("RestoreSnapshot Param Error: %v", url)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult("Param Error")))
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Errf("RestoreSnapshot Error: %v", err)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+	p := engine.RestoreParam{}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		err = json.Unmarshal(body, &p)
+		if err != nil {
+			log.Errf("RestoreSnapshot Error: %v", err)
+			io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+			return
+		}
+	}
+	p.Name = parts[1]
+
+	//操作
+	err = engine.SpdInstance().RestoreSnapshot(&p)
+	if err != nil {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+
+	io.WriteString(w, helper.JsonEncode(basic.NewOkResult("")))
+	return
+}
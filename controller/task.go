@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"io/ioutil"
+	"encoding/json"
+	"github.com/hq-cml/spider-engine/utils/log"
+	"github.com/hq-cml/spider-engine/utils/helper"
+	"github.com/hq-cml/spider-engine/basic"
+	"github.com/hq-cml/spider-engine/engine"
+	"strings"
+)
+
+//按查询删除
+func DeleteByQuery(w http.ResponseWriter, req *http.Request) {
+	byQuery(w, req, engine.SpdInstance().DeleteByQuery)
+}
+
+//按查询更新
+func UpdateByQuery(w http.ResponseWriter, req *http.Request) {
+	byQuery(w, req, engine.SpdInstance().UpdateByQuery)
+}
+
+//按查询删除/更新的公共流程
+//默认等待任务结束之后返回结果, wait_for_completion=false时立即返回任务id, 通过_tasks接口查看进度
+func byQuery(w http.ResponseWriter, req *http.Request, start func(p *engine.ByQueryParam) (*engine.Task, error)) {
+	//参数读取与解析
+	url := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(url, "/")
+	partLen := len(parts)
+	if partLen != 3 {
+		log.Errf("ByQuery Param Error: %v", url)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult("Param Error")))
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Errf("ByQuery Error: %v", err)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+	p := engine.ByQueryParam{}
+	err = json.Unmarshal(body, &p)
+	if err != nil {
+		log.Errf("ByQuery Error: %v", err)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+	p.Database = parts[0]
+	p.Table = parts[1]
+
+	task, err := start(&p)
+	if err != nil {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+	if req.URL.Query().Get("wait_for_completion") != "false" {
+		task.Wait()
+	}
+
+	info := task.Info()
+	if info.Status == engine.TASK_STATUS_FAILED {
+		io.WriteString(w, helper.JsonEncode(basic.NewFailedResult(info)))
+		return
+	}
+	io.WriteString(w, helper.JsonEncode(basic.NewOkResult(info)))
+	return
+}
+
+//任务列表
+func ListTasks(w http.ResponseWriter, req *http.Request) {
+	io.WriteString(w, helper.JsonEncode(basic.NewOkResult(engine.SpdInstance().ListTasks())))
+}
+
+//任务详情
+func GetTask(w http.ResponseWriter, req *http.Request) {
+	url := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(url, "/")
+	if len(parts) != 2 {
+		log.Errf("GetTask Param Error: %v", url)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult("Param Error")))
+		return
+	}
+
+	info, err := engine.SpdInstance().GetTask(parts[1])
+	if err != nil {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+
+	io.WriteString(w, helper.JsonEncode(basic.NewOkResult(info)))
+	return
+}
+
+//取消任务, 等到任务停止之后返回
+func CancelTask(w http.ResponseWriter, req *http.Request) {
+	url := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(url, "/")
+	if len(parts) != 3 {
+		log.Errf("CancelTask Param Error: %v", url)
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult("Param Error")))
+		return
+	}
+
+	info, err := engine.SpdInstance().CancelTask(parts[1])
+	if err != nil {
+		io.WriteString(w, helper.JsonEncode(basic.NewErrorResult(err.Error())))
+		return
+	}
+
+	io.WriteString(w, helper.JsonEncode(basic.NewOkResult(info)))
+	return
+}
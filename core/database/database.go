@@ -9,6 +9,8 @@ import (
 	"github.com/hq-cml/spider-engine/basic"
 	"encoding/json"
 	"github.com/hq-cml/spider-engine/utils/log"
+	"github.com/hq-cml/spider-engine/core/query"
+	"os"
 )
 
 /**
@@ -68,7 +70,7 @@ func LoadDatabase(path, name string) (*Database, error) {
 	}
 	db := Database{Path:path, DbName:name}
 	metaFileName := db.genMetaName()
-	buffer, err := helper.ReadFile(metaFileName)
+	buffer, err := helper.ReadManifest(metaFileName)
 	if err != nil {
 		return nil, err
 	}
@@ -96,7 +98,7 @@ func (db *Database) storeMeta() error {
 	metaFileName := db.genMetaName()
 	data := helper.JsonEncodeIndent(db)
 	if data != "" {
-		if err := helper.OverWriteToFile([]byte(data), metaFileName); err != nil {
+		if err := helper.WriteManifest([]byte(data), metaFileName); err != nil {
 			return err
 		}
 	} else {
@@ -125,6 +127,11 @@ func (db *Database) DoClose() error {
 
 //建表
 func (db *Database) CreateTable(tableName string, fields []field.BasicField) (*table.Table, error) {
+	return db.CreateTableWithSettings(tableName, fields, table.TableSettings{})
+}
+
+//建表, 同时指定表的设置
+func (db *Database) CreateTableWithSettings(tableName string, fields []field.BasicField, settings table.TableSettings) (*table.Table, error) {
 	path := fmt.Sprintf("%s%s", db.Path, tableName)
 
 	//路径校验
@@ -139,8 +146,39 @@ func (db *Database) CreateTable(tableName string, fields []field.BasicField) (*t
 	}
 
 	//创建表和字段
-	tab, err := table.CreateTable(path, tableName, fields)
+	tab, err := table.CreateTableWithSettings(path, tableName, fields, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	//关联进入db
+	db.TableMap[tableName] = tab
+	db.TableList = append(db.TableList, tableName)
+
+	//存meta
+	db.storeMeta()
+	return tab, nil
+}
+
+//从快照恢复表, 快照在srcDir目录中, 表名为srcName
+func (db *Database) RestoreTable(srcDir, srcName, tableName string) (*table.Table, error) {
+	path := fmt.Sprintf("%s%s", db.Path, tableName)
+
+	//路径校验
+	_, exist := db.TableMap[tableName]
+	if exist || helper.Exist(path) {
+		return nil, errors.New("The table already exist!")
+	}
+
+	//创建目录, 每一个Table都有独立的目录
+	if ok := helper.Mkdir(path); !ok {
+		return nil, errors.New("Failed create dir!")
+	}
+
+	//恢复表, 失败则清理掉恢复了一半的目录
+	tab, err := table.RestoreTable(srcDir, srcName, path, tableName)
 	if err != nil {
+		os.RemoveAll(path)
 		return nil, err
 	}
 
@@ -219,6 +257,11 @@ func (db *Database) GetDoc(tableName string, primaryKey string) (*basic.DocInfo,
 
 //改变doc
 func (db *Database) UpdateDoc(tableName string, content map[string]interface{}, primaryVal string) (uint32, error) {
+	return db.UpdateDocWithVersion(tableName, content, primaryVal, 0)
+}
+
+//改变Doc, ifVersion非0时校验文档的当前版本
+func (db *Database) UpdateDocWithVersion(tableName string, content map[string]interface{}, primaryVal string, ifVersion uint64) (uint32, error) {
 	tab, exist := db.TableMap[tableName]
 	if !exist {
 		return 0, errors.New("Table not exist!")
@@ -234,7 +277,18 @@ func (db *Database) UpdateDoc(tableName string, content map[string]interface{},
 		}
 	}
 
-	return tab.UpdateDoc(content)
+	return tab.UpdateDocWithVersion(content, ifVersion)
+}
+
+//局部更新Doc
+func (db *Database) PatchDoc(tableName, primaryKey string, fields map[string]interface{}, incr map[string]float64,
+		upsert bool, ifVersion uint64) (uint32, bool, error) {
+	tab, exist := db.TableMap[tableName]
+	if !exist {
+		return 0, false, errors.New("Table not exist!")
+	}
+
+	return tab.PatchDoc(primaryKey, fields, incr, upsert, ifVersion)
 }
 
 //删除Doc
@@ -247,6 +301,26 @@ func (db *Database) DeleteDoc(tableName string, primaryKey string) (bool) {
 	return tab.DelDoc(primaryKey)
 }
 
+//删除Doc, ifVersion非0时校验文档的当前版本, 返回文档是否存在
+func (db *Database) DeleteDocWithVersion(tableName string, primaryKey string, ifVersion uint64) (bool, error) {
+	tab, exist := db.TableMap[tableName]
+	if !exist {
+		return false, errors.New("Table not exist!")
+	}
+
+	return tab.DelDocWithVersion(primaryKey, ifVersion)
+}
+
+//批量写入
+func (db *Database) BulkDocs(tableName string, items []*table.BulkItem) ([]*table.BulkResult, error) {
+	tab, exist := db.TableMap[tableName]
+	if !exist {
+		return nil, errors.New("Table not exist!")
+	}
+
+	return tab.BulkDocs(items)
+}
+
 //搜索
 func (db *Database) SearchDocs(tableName, fieldName, keyWord string,
 		filters []basic.SearchFilter, offset, size int32) ([]basic.DocInfo, int, bool, error) {
@@ -258,6 +332,63 @@ func (db *Database) SearchDocs(tableName, fieldName, keyWord string,
 	return tab.SearchDocs(fieldName, keyWord, filters, offset, size)
 }
 
+//搜索, 指定分词后多个词项之间的合并方式(and/or)
+func (db *Database) SearchDocsWithOp(tableName, fieldName, keyWord, op string, filters []basic.SearchFilter, sorts []basic.SearchSort,
+		aggs map[string]basic.SearchAgg, searchAfter string, offset, size int32) ([]basic.DocInfo, int, map[string]*basic.AggResult, bool, error) {
+	tab, exist := db.TableMap[tableName]
+	if !exist {
+		return nil, 0, nil, false, errors.New("The Table Not Exist!")
+	}
+
+	return tab.SearchDocsWithOp(fieldName, keyWord, op, filters, sorts, aggs, searchAfter, offset, size)
+}
+
+//按查询语法树搜索
+func (db *Database) SearchQuery(tableName string, node *query.Node, defaultField string, filters []basic.SearchFilter, sorts []basic.SearchSort,
+		aggs map[string]basic.SearchAgg, searchAfter string, offset, size int32) ([]basic.DocInfo, int, map[string]*basic.AggResult, bool, error) {
+	tab, exist := db.TableMap[tableName]
+	if !exist {
+		return nil, 0, nil, false, errors.New("The Table Not Exist!")
+	}
+
+	return tab.SearchQuery(node, defaultField, filters, sorts, aggs, searchAfter, offset, size)
+}
+
+//按查询找出命中的全部文档, node非空时按查询语法树搜索, 否则按词项搜索
+func (db *Database) MatchDocIds(tableName string, node *query.Node, fieldName, keyWord, op string,
+		filters []basic.SearchFilter) ([]uint32, error) {
+	tab, exist := db.TableMap[tableName]
+	if !exist {
+		return nil, errors.New("The Table Not Exist!")
+	}
+
+	if node != nil {
+		return tab.MatchDocIdsQuery(node, fieldName, filters)
+	}
+	return tab.MatchDocIdsWithOp(fieldName, keyWord, op, filters)
+}
+
+//按docId批量删除
+func (db *Database) DeleteByDocIds(tableName string, docIds []uint32) (*table.ByQueryResult, error) {
+	tab, exist := db.TableMap[tableName]
+	if !exist {
+		return nil, errors.New("Table not exist!")
+	}
+
+	return tab.DeleteByDocIds(docIds)
+}
+
+//按docId批量局部更新
+func (db *Database) PatchByDocIds(tableName string, docIds []uint32, fields map[string]interface{},
+		incr map[string]float64) (*table.ByQueryResult, error) {
+	tab, exist := db.TableMap[tableName]
+	if !exist {
+		return nil, errors.New("Table not exist!")
+	}
+
+	return tab.PatchByDocIds(docIds, fields, incr)
+}
+
 //增减字段
 func (db *Database) AddField(tableName string, basicField field.BasicField) error {
 	tab, exist := db.TableMap[tableName]
@@ -277,6 +408,69 @@ func (db *Database) DeleteField(tableName string, fieldName string) error {
 	return tab.DeleteField(fieldName)
 }
 
+//修改表的设置
+func (db *Database) UpdateSettings(tableName string, patch []byte) (table.TableSettings, error) {
+	tab, exist := db.TableMap[tableName]
+	if !exist {
+		return table.TableSettings{}, errors.New("Table not exist!")
+	}
+
+	return tab.UpdateSettings(patch)
+}
+
+//手动落地表的内存分区
+func (db *Database) FlushTable(tableName string) error {
+	tab, exist := db.TableMap[tableName]
+	if !exist {
+		return errors.New("Table not exist!")
+	}
+
+	return tab.Flush()
+}
+
+//在线校验表
+func (db *Database) VerifyTable(tableName string) (*table.VerifyReport, error) {
+	tab, exist := db.TableMap[tableName]
+	if !exist {
+		return nil, errors.New("Table not exist!")
+	}
+
+	return tab.Verify()
+}
+
+//离线校验库中的表, tableName为空表示全部的表, repair为true时修复发现的问题
+//Note: 库不能处于加载状态
+func VerifyDatabase(path, name, tableName string, repair bool) ([]*table.VerifyReport, error) {
+	if string(path[len(path)-1]) != "/" {
+		path = path + "/"
+	}
+	db := Database{Path:path, DbName:name}
+	buffer, err := helper.ReadManifest(db.genMetaName())
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(buffer, &db)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []*table.VerifyReport{}
+	for _, tblName := range db.TableList {
+		if tableName != "" && tblName != tableName {
+			continue
+		}
+		report, err := table.VerifyTable(db.Path + tblName, tblName, repair)
+		if err != nil {
+			return reports, errors.New(fmt.Sprintf("Verify table %v error: %v", tblName, err))
+		}
+		reports = append(reports, report)
+	}
+	if tableName != "" && len(reports) == 0 {
+		return nil, errors.New("Table not exist!")
+	}
+	return reports, nil
+}
+
 func (db *Database) genMetaName() string {
 	return fmt.Sprintf("%v%v%v", db.Path, db.DbName, basic.IDX_FILENAME_SUFFIX_META)
 }
@@ -299,7 +493,7 @@ func (db *Database) Destory() error {
 
 	//删除残留的文件和目录
 	metaPath := db.genMetaName()
-	if err := helper.Remove(metaPath); err != nil {	return err }
+	if err := helper.RemoveManifest(metaPath); err != nil {	return err }
 	if err := helper.Remove(db.Path); err != nil {	return err }
 
 	return nil
@@ -7,11 +7,13 @@ package field
 import (
 	"errors"
 	"github.com/hq-cml/spider-engine/core/index"
+	"github.com/hq-cml/spider-engine/core/query"
 	"github.com/hq-cml/spider-engine/utils/btree"
 	"github.com/hq-cml/spider-engine/utils/mmap"
 	"github.com/hq-cml/spider-engine/utils/log"
 	"github.com/hq-cml/spider-engine/basic"
 	"fmt"
+	"sort"
 )
 
 //字段的结构定义
@@ -23,6 +25,9 @@ type Field struct {
 	inMemory   bool
 	IvtIdx     *index.InvertedIndex `json:"-"`           //倒排索引
 	FwdIdx     *index.ForwardIndex  `json:"-"`           //正排索引
+	LenIdx     *index.ForwardIndex  `json:"-"`           //文档长度, 数字型正排, 和正排存在同一个文件中, 仅有倒排的字段才有
+	NumIdx     *index.NumericIndex  `json:"-"`           //数字索引, 用于范围查询, 和正排存在同一个文件中, 仅磁盘态的数字字段才有
+	idMap      *index.DocIdMap                             //文档Id映射, 分区合并剔除了删除文档时才有, 同一个分区的字段共用
 	btdb       btree.Btree          `json:"-"`
 }
 
@@ -30,12 +35,15 @@ type Field struct {
 type BasicField struct {
 	FieldName string `json:"fieldName"`
 	IndexType uint16  `json:"indexType"`
+	Positions bool    `json:"positions,omitempty"` //倒排是否记录词项位置, 仅对分词类型有效, 用于短语查询
 }
 
 // 字段的核心描述信息，用于分区的落盘与加载
 type CoreField struct {
 	BasicField
-	FwdOffset uint64 `json:"fwdOffset"` //正排索引的偏移量
+	FwdOffset uint64 `json:"fwdOffset"`           //正排索引的偏移量
+	LenOffset uint64 `json:"lenOffset,omitempty"` //文档长度在正排文件中的偏移量, 0表示没有记录(老版本的分区)
+	NumOffset uint64 `json:"numOffset,omitempty"` //数字索引在正排文件中的偏移量, 0表示没有(老版本的分区)
 }
 
 type BasicStatus struct {
@@ -64,6 +72,10 @@ func NewFakeField(fieldname string, start uint32, next uint32, indexType uint16,
 		indexType == index.IDX_TYPE_GOD {
 		ivtIdx = index.NewFakeInvertedIndex(indexType, start, fieldname)
 	}
+	var lenIdx *index.ForwardIndex
+	if ivtIdx != nil {
+		lenIdx = index.NewFakeForwardIndex(index.IDX_TYPE_INTEGER, docCnt, next)
+	}
 
 	return &Field {
 		FieldName:  fieldname,
@@ -72,6 +84,7 @@ func NewFakeField(fieldname string, start uint32, next uint32, indexType uint16,
 		IndexType:  indexType,
 		FwdIdx:     fwdIdx,    //主要是为了这个假索引
 		IvtIdx:     ivtIdx,    //主要是为了这个假索引
+		LenIdx:     lenIdx,
 	}
 }
 
@@ -87,6 +100,11 @@ func NewEmptyField(fieldName string, start uint32, indexType uint16) *Field {
 	}
 	//建立正向索引
 	fwdIdx := index.NewEmptyForwardIndex(indexType, start)
+	//有倒排的字段, 记录文档长度
+	var lenIdx *index.ForwardIndex
+	if ivtIdx != nil {
+		lenIdx = index.NewEmptyForwardIndex(index.IDX_TYPE_INTEGER, start)
+	}
 
 	return &Field{
 		FieldName:  fieldName,
@@ -96,6 +114,7 @@ func NewEmptyField(fieldName string, start uint32, indexType uint16) *Field {
 		inMemory:   true,
 		IvtIdx:     ivtIdx,
 		FwdIdx:     fwdIdx,
+		LenIdx:     lenIdx,
 		btdb:       nil,
 	}
 }
@@ -112,12 +131,14 @@ func NewEmptyGodField(fieldName string, start uint32) *Field {
 		IndexType:  index.IDX_TYPE_GOD,
 		inMemory:   true,
 		IvtIdx:     ivtIdx,
+		LenIdx:     index.NewEmptyForwardIndex(index.IDX_TYPE_INTEGER, start),
 	}
 }
 
 //加载字段索引
 //这里并未真的从磁盘加载，mmap都是从外部直接传入的，因为同一个分区的各个字段的正、倒排公用同一套文件(btdb, ivt, fwd, ext)
-func LoadField(fieldname string, startDocId, nextDocId uint32, indexType uint16, fwdOffset uint64,
+//lenOffset为0表示分区没有记录文档长度, numOffset为0表示分区没有数字索引
+func LoadField(fieldname string, startDocId, nextDocId uint32, indexType uint16, fwdOffset, lenOffset, numOffset uint64,
 	fwdDocCnt uint32, baseMmap, extMmap, ivtMmap *mmap.Mmap, btdb btree.Btree) *Field {
 
 	//加载倒排
@@ -136,6 +157,18 @@ func LoadField(fieldname string, startDocId, nextDocId uint32, indexType uint16,
 		fwdIdx = index.LoadForwardIndex(indexType, baseMmap, extMmap, fwdOffset, fwdDocCnt, nextDocId)
 	}
 
+	//加载文档长度
+	var lenIdx *index.ForwardIndex
+	if ivtIdx != nil && lenOffset > 0 {
+		lenIdx = index.LoadForwardIndex(index.IDX_TYPE_INTEGER, baseMmap, nil, lenOffset, fwdDocCnt, nextDocId)
+	}
+
+	//加载数字索引
+	var numIdx *index.NumericIndex
+	if numOffset > 0 {
+		numIdx = index.LoadNumericIndex(baseMmap, numOffset)
+	}
+
 	return &Field{
 		FieldName:  fieldname,
 		StartDocId: startDocId,
@@ -144,6 +177,8 @@ func LoadField(fieldname string, startDocId, nextDocId uint32, indexType uint16,
 		inMemory:   false,
 		IvtIdx:     ivtIdx,
 		FwdIdx:     fwdIdx,
+		LenIdx:     lenIdx,
+		NumIdx:     numIdx,
 		btdb:       btdb,
 	}
 }
@@ -167,6 +202,11 @@ func (fld *Field) AddDocument(docId uint32, content interface{}) error {
 		checkErr = errors.New("Field AddDoc. Wrong docId.")
 	}
 
+	//列表类型, json数组统一转成分号分隔的字符串
+	if fld.IndexType == index.IDX_TYPE_STR_LIST {
+		content = index.ListContent(content)
+	}
+
 	//正排新增(上帝视角没有正排)
 	if fld.IndexType != index.IDX_TYPE_GOD {
 		fwdErr = fld.FwdIdx.AddDocument(docId, content)
@@ -177,8 +217,7 @@ func (fld *Field) AddDocument(docId uint32, content interface{}) error {
 	}
 
 	//倒排新增: 数字型和时间型不添加倒排索引, 纯文本模式也不需要倒排
-	if fld.IndexType != index.IDX_TYPE_INTEGER &&
-		fld.IndexType != index.IDX_TYPE_DATE &&
+	if !index.IsNumericType(fld.IndexType) &&
 		fld.IndexType != index.IDX_TYPE_PURE_TEXT &&
 		fld.IndexType != index.IDX_TYPE_PK &&      //主键只在高层Table起作用
 		fld.IvtIdx != nil {
@@ -189,11 +228,16 @@ func (fld *Field) AddDocument(docId uint32, content interface{}) error {
 			contentStr = ""
 		}
 
-		err := fld.IvtIdx.AddDocument(docId, contentStr)
+		docLen, err := fld.IvtIdx.AddDocumentWithLen(docId, contentStr)
 		if err != nil {
 			ivtErr = errors.New(fmt.Sprintf("Add Invert Doc Error %v", err.Error()))
 			log.Warnf(fmt.Sprintf("Add Invert Doc Error %v", err.Error()))
 		}
+
+		//文档长度, 出错的时候也要占位
+		if fld.LenIdx != nil {
+			fld.LenIdx.AddDocument(docId, docLen)
+		}
 	}
 
 	if checkErr == nil && fwdErr == nil && ivtErr == nil {
@@ -211,6 +255,21 @@ func (fld *Field) AddDocument(docId uint32, content interface{}) error {
 	}
 }
 
+//内存态的字段占用的内存(估算值), 包括正排、倒排和文档长度
+func (fld *Field) MemBytes() uint64 {
+	var bytes uint64
+	if fld.FwdIdx != nil {
+		bytes += fld.FwdIdx.MemBytes()
+	}
+	if fld.IvtIdx != nil {
+		bytes += fld.IvtIdx.MemBytes()
+	}
+	if fld.LenIdx != nil {
+		bytes += fld.LenIdx.MemBytes()
+	}
+	return bytes
+}
+
 //其他字段增加文档出现失败的时候，用来将当前字段回滚
 //Note:
 // 目前来讲回滚啥卵事没干，先预留
@@ -237,8 +296,7 @@ func (fld *Field) AddDocRollback(docId uint32) error {
 //给定一个查询词query，找出doc的列表
 //Note：这个就是利用倒排索引
 func (fld *Field) Query(key interface{}) ([]basic.DocNode, bool) {
-	if fld.IndexType == index.IDX_TYPE_INTEGER ||
-		fld.IndexType == index.IDX_TYPE_DATE ||
+	if index.IsNumericType(fld.IndexType) ||
 		fld.IndexType == index.IDX_TYPE_PURE_TEXT ||
 		fld.IndexType == index.IDX_TYPE_PK ||  //主键只在高层Table起作用
 		fld.IvtIdx == nil {
@@ -249,12 +307,170 @@ func (fld *Field) Query(key interface{}) ([]basic.DocNode, bool) {
 	return nodes, ok
 }
 
+//多词查询, 分词类型的字段将查询串切分成多个词项, 逐个查找倒排
+//列表类型按分号切分成多个元素, 单字类型切分成单个的字
+//各个词项的倒排链按照op合并(and求交集, or求并集), 权重累加; 其他类型的字段整体作为一个词项查询
+//scoring非空时, 各个词项的权重换算成相关性得分
+func (fld *Field) QueryWords(keyWord string, op string, scoring *query.Scoring) ([]basic.DocNode, bool) {
+	if fld.IvtIdx == nil {
+		return nil, false
+	}
+	mustAll := op == query.OP_AND
+	var terms []string
+	switch fld.IndexType {
+	case index.IDX_TYPE_STR_SPLITER, index.IDX_TYPE_GOD:
+		terms = index.SplitQueryWords(keyWord, mustAll)
+	case index.IDX_TYPE_STR_LIST:
+		terms = index.SplitList(keyWord)
+	case index.IDX_TYPE_STR_WORD:
+		terms = index.SplitRunes(keyWord)
+	default:
+		nodes, ok := fld.Query(keyWord)
+		return fld.score(keyWord, nodes, scoring), ok
+	}
+	if len(terms) == 0 {
+		return nil, false
+	}
+	//求交集时借助倒排链的迭代器跳跃, 不需要把高频词项的倒排链全部解码出来
+	if mustAll {
+		return fld.IvtIdx.IntersectTerms(terms, func(term string, node basic.DocNode) uint32 {
+			return fld.scoreNode(term, node, scoring)
+		})
+	}
+	var retDocs []basic.DocNode
+	for i, term := range terms {
+		nodes, _ := fld.IvtIdx.QueryTerm(term)
+		nodes = fld.score(term, nodes, scoring)
+		if i == 0 {
+			retDocs = nodes
+		} else {
+			retDocs = query.Union(retDocs, nodes)
+		}
+	}
+	return retDocs, len(retDocs) > 0
+}
+
+//短语查询, slop表示允许的额外间隔
+//分词类型的字段按照词项位置匹配, 其他类型的字段将短语整体作为一个词项查询
+//scoring非空时, 短语的得分为其中各个词项的得分之和
+func (fld *Field) QueryPhrase(phrase string, slop int, scoring *query.Scoring) ([]basic.DocNode, bool) {
+	if fld.IvtIdx == nil {
+		return nil, false
+	}
+	if fld.IndexType != index.IDX_TYPE_STR_SPLITER && fld.IndexType != index.IDX_TYPE_GOD {
+		nodes, ok := fld.Query(phrase)
+		return fld.score(phrase, nodes, scoring), ok
+	}
+
+	terms, positions := index.SplitPhrase(phrase)
+	docs, ok := fld.IvtIdx.QueryPhrase(terms, positions, slop)
+	if !ok || scoring == nil {
+		return docs, ok
+	}
+
+	//命中的文档必然包含全部词项, 所以和各个词项求交集即可累加出得分
+	for i := range docs {
+		docs[i].Weight = 0
+	}
+	scored := map[string]bool{}
+	for _, term := range terms {
+		if scored[term] {
+			continue
+		}
+		scored[term] = true
+		nodes, _ := fld.IvtIdx.QueryTerm(term)
+		docs = query.Intersect(docs, fld.score(term, nodes, scoring))
+	}
+	return docs, len(docs) > 0
+}
+
+//将倒排中的权重(词频)换算成相关性得分
+func (fld *Field) score(term string, nodes []basic.DocNode, scoring *query.Scoring) []basic.DocNode {
+	if scoring == nil {
+		return nodes
+	}
+	for i := range nodes {
+		nodes[i].Weight = fld.scoreNode(term, nodes[i], scoring)
+	}
+	return nodes
+}
+
+//单个文档的相关性得分, scoring为空则直接返回倒排中的权重
+func (fld *Field) scoreNode(term string, node basic.DocNode, scoring *query.Scoring) uint32 {
+	if scoring == nil {
+		return node.Weight
+	}
+	docLen := fld.GetDocLen(node.DocId)
+	tf := index.TermCount(node.Weight, docLen)
+	return scoring.Weight(fld.FieldName, term, tf, docLen)
+}
+
+//获取文档在本字段的长度(词项个数), 0表示未知
+func (fld *Field) GetDocLen(docId uint32) uint32 {
+	if fld.LenIdx == nil {
+		return 0
+	}
+	pos, ok := fld.pos(docId)
+	if !ok {
+		return 0
+	}
+	val, ok := fld.LenIdx.GetInt(pos)
+	if !ok || val < 0 || val == index.MaxInt64 {
+		return 0
+	}
+	return uint32(val)
+}
+
+//文档长度在正排文件中的偏移量, 0表示没有
+func (fld *Field) GetLenOffset() uint64 {
+	if fld.LenIdx == nil {
+		return 0
+	}
+	return fld.LenIdx.GetFwdOffset()
+}
+
+//设置倒排是否记录词项位置
+func (fld *Field) SetPositional(positional bool) {
+	if fld.IvtIdx != nil {
+		fld.IvtIdx.SetPositional(positional)
+	}
+}
+
+//docId在本字段索引中的位置
+//没有文档Id映射时就是(docId - startDocId), 否则通过映射查找, 已被剔除的文档返回false
+func (fld *Field) pos(docId uint32) (uint32, bool) {
+	if docId < fld.StartDocId || docId >= fld.NextDocId {
+		return 0, false
+	}
+	if fld.idMap == nil {
+		return docId - fld.StartDocId, true
+	}
+	return fld.idMap.Pos(docId)
+}
+
+//本字段拥有的全部docId, 升序排列
+func (fld *Field) docIds() []uint32 {
+	if fld.idMap != nil {
+		return fld.idMap.DocIds()
+	}
+	docIds := make([]uint32, 0, fld.NextDocId - fld.StartDocId)
+	for docId := fld.StartDocId; docId < fld.NextDocId; docId++ {
+		docIds = append(docIds, docId)
+	}
+	return docIds
+}
+
+//设置文档Id映射
+func (fld *Field) SetIdMap(idMap *index.DocIdMap) {
+	fld.idMap = idMap
+}
+
 //获取字符值
 //Note：利用正排索引
 func (fld *Field) GetString(docId uint32) (string, bool) {
 	//Pos是docId在本索引中的位置
-	pos := docId - fld.StartDocId
-	if docId >= fld.StartDocId && docId < fld.NextDocId && fld.FwdIdx != nil {
+	pos, ok := fld.pos(docId)
+	if ok && fld.FwdIdx != nil {
 		return fld.FwdIdx.GetString(pos)
 	}
 
@@ -263,17 +479,38 @@ func (fld *Field) GetString(docId uint32) (string, bool) {
 
 func (fld *Field) GetInt(docId uint32) (int64, bool) {
 	//Pos是docId在本索引中的位置
-	pos := docId - fld.StartDocId
-	if docId >= fld.StartDocId && docId < fld.NextDocId && fld.FwdIdx != nil {
+	pos, ok := fld.pos(docId)
+	if ok && fld.FwdIdx != nil {
 		return fld.FwdIdx.GetInt(pos)
 	}
 
 	return index.MaxInt64, false
 }
 
+//获取浮点值, 整数类型也转成浮点返回
+func (fld *Field) GetFloat(docId uint32) (float64, bool) {
+	//Pos是docId在本索引中的位置
+	pos, ok := fld.pos(docId)
+	if ok && fld.FwdIdx != nil {
+		return fld.FwdIdx.GetFloat(pos)
+	}
+
+	return 0, false
+}
+
 func (fld *Field) GetValue(docId uint32) (interface{}, bool) {
 	//Pos是docId在本索引中的位置
-	if fld.IndexType == index.IDX_TYPE_INTEGER || fld.IndexType == index.IDX_TYPE_DATE {
+	if fld.IndexType == index.IDX_TYPE_FLOAT {
+		//没有值的和整数类型一样返回MaxInt64, 重新写入时仍然是没有值
+		if value, ok := fld.GetFloat(docId); ok {
+			return value, true
+		}
+		return int64(index.MaxInt64), false
+	} else if fld.IndexType == index.IDX_TYPE_STR_LIST {
+		//列表类型以数组形式返回
+		str, ok := fld.GetString(docId)
+		return index.SplitList(str), ok
+	} else if index.IsNumericType(fld.IndexType) {
 		return fld.GetInt(docId)
 	} else {
 		return fld.GetString(docId)
@@ -296,6 +533,12 @@ func (fld *Field) SetBaseMmap(mmap *mmap.Mmap) {
 	if fld.FwdIdx != nil {
 		fld.FwdIdx.SetBaseMmap(mmap)
 	}
+	if fld.LenIdx != nil {
+		fld.LenIdx.SetBaseMmap(mmap)
+	}
+	if fld.NumIdx != nil {
+		fld.NumIdx.SetBaseMmap(mmap)
+	}
 }
 
 func (fld *Field) SetExtMmap(mmap *mmap.Mmap) {
@@ -330,7 +573,12 @@ func (fld *Field) Persist(partitionPathName string, btdb btree.Btree) (uint64, u
 	var err error
 	var docCnt uint32
 	var fwdOffset uint64
+	var values []int64
 	if fld.FwdIdx != nil {
+		//数字字段先取出全部的值, 用于生成数字索引
+		if fld.isNumeric() {
+			values = numValues(fld)
+		}
 		//落地, 并设置了field的信息
 		fwdOffset, docCnt, err = fld.FwdIdx.Persist(partitionPathName)
 		if err != nil {
@@ -349,13 +597,30 @@ func (fld *Field) Persist(partitionPathName string, btdb btree.Btree) (uint64, u
 		}
 	}
 
+	//文档长度紧跟在正排之后落地, 偏移量通过GetLenOffset获取
+	if fld.LenIdx != nil {
+		if _, _, err = fld.LenIdx.Persist(partitionPathName); err != nil {
+			log.Errf("Field--> Persist. Error %v", err)
+			return 0, 0, err
+		}
+	}
+
+	//数字索引同样追加到正排文件, 偏移量通过GetNumOffset获取
+	if len(values) > 0 {
+		if fld.NumIdx, err = index.PersistNumericIndex(values, partitionPathName); err != nil {
+			log.Errf("Field--> Persist. Error %v", err)
+			return 0, 0, err
+		}
+	}
+
 	log.Infof("Field[%v]--> Persist OK...", fld.FieldName)
 	return fwdOffset, docCnt, nil
 }
 
 //字段归并
 //和底层逻辑一致，同样mmap不会加载，其他控制数据包括btdb会加载
-func (fld *Field) MergePersistField(fields []*Field, partitionName string, btdb btree.Btree) (uint64, uint32, error) {
+//docIds是合并后需要保留的文档(升序), 已删除的文档不再写入; nil表示全部保留
+func (fld *Field) MergePersistField(fields []*Field, docIds []uint32, partitionName string, btdb btree.Btree) (uint64, uint32, error) {
 	//一些校验, index的类型，顺序必须完整正确
 	if fields == nil || len(fields) == 0 {
 		return 0, 0, errors.New("Nil []*Field")
@@ -369,13 +634,29 @@ func (fld *Field) MergePersistField(fields []*Field, partitionName string, btdb
 	var err error
 	var docCnt uint32
 	var fwdOffset uint64
+
+	//各个字段需要保留的文档, 以及它们在各自索引中的位置
+	keepIds := make([][]uint32, l)
+	poses := make([][]uint32, l)
+	for i, fd := range fields {
+		keepIds[i] = fd.keepDocIds(docIds)
+		poses[i] = make([]uint32, 0, len(keepIds[i]))
+		for _, docId := range keepIds[i] {
+			pos, ok := fd.pos(docId)
+			if !ok {
+				return 0, 0, errors.New(fmt.Sprintf("Doc %v not found in field %v", docId, fd.FieldName))
+			}
+			poses[i] = append(poses[i], pos)
+		}
+	}
+
 	//合并正排索引(上帝字段没有正排索引)
 	if fld.IndexType != index.IDX_TYPE_GOD {
 		fwds := make([]*index.ForwardIndex, 0)
 		for _, fd := range fields {
 			fwds = append(fwds, fd.FwdIdx)
 		}
-		fwdOffset, docCnt, err = fld.FwdIdx.MergePersistFwdIndex(fwds, partitionName)
+		fwdOffset, docCnt, err = fld.FwdIdx.MergePersistFwdIndex(fwds, poses, partitionName)
 		//fmt.Println("B--------", partitionName, fields[0].FieldName, offset, docCnt, nextId)
 		if err != nil {
 			log.Errf("Field--> mergeField. Serialization Error %v", err)
@@ -399,7 +680,7 @@ func (fld *Field) MergePersistField(fields []*Field, partitionName string, btdb
 				panic("invert is nil")
 			}
 		}
-		err := fld.IvtIdx.MergePersistIvtIndex(ivts, partitionName, btdb)
+		err := fld.IvtIdx.MergePersistIvtIndex(ivts, docIds, partitionName, btdb)
 		if  err != nil {
 			//如果此处出错，则会不一致...
 			log.Errf("MergePersistIvtIndex Error: ", err, ". Danger!!!!")
@@ -407,6 +688,43 @@ func (fld *Field) MergePersistField(fields []*Field, partitionName string, btdb
 		}
 	}
 
+	//合并文档长度, 老版本的分区没有记录长度, 用假索引占位
+	if fld.LenIdx != nil {
+		lens := make([]*index.ForwardIndex, 0)
+		for _, fd := range fields {
+			if fd.LenIdx != nil {
+				lens = append(lens, fd.LenIdx)
+			} else {
+				lens = append(lens, index.NewFakeForwardIndex(index.IDX_TYPE_INTEGER,
+					fd.NextDocId - fd.StartDocId, fd.NextDocId))
+			}
+		}
+		if _, _, err = fld.LenIdx.MergePersistFwdIndex(lens, poses, partitionName); err != nil {
+			log.Errf("Field--> mergeField. Merge doc length Error %v", err)
+			return 0, 0, err
+		}
+	}
+
+	//根据合并之后的值重新生成数字索引
+	if fld.isNumeric() {
+		values := []int64{}
+		for i, fd := range fields {
+			for _, docId := range keepIds[i] {
+				v, ok := fd.GetInt(docId)
+				if !ok {
+					v = index.MaxInt64
+				}
+				values = append(values, v)
+			}
+		}
+		if len(values) > 0 {
+			if fld.NumIdx, err = index.PersistNumericIndex(values, partitionName); err != nil {
+				log.Errf("Field--> mergeField. Merge numeric index Error %v", err)
+				return 0, 0, err
+			}
+		}
+	}
+
 	//加载回控制数据
 	fld.btdb = btdb
 	fld.StartDocId = fields[0].StartDocId
@@ -416,11 +734,72 @@ func (fld *Field) MergePersistField(fields []*Field, partitionName string, btdb
 }
 
 
+//合并时本字段需要保留的文档, docIds为nil表示全部保留
+func (fld *Field) keepDocIds(docIds []uint32) []uint32 {
+	if docIds == nil {
+		return fld.docIds()
+	}
+	lo := sort.Search(len(docIds), func(i int) bool { return docIds[i] >= fld.StartDocId })
+	hi := sort.Search(len(docIds), func(i int) bool { return docIds[i] >= fld.NextDocId })
+	return docIds[lo:hi]
+}
+
+//是否是数字(包括时间)类型的字段
+func (fld *Field) isNumeric() bool {
+	return index.IsNumericType(fld.IndexType)
+}
+
+//按位置取出字段的全部数字值, 没有值的为MaxInt64
+func numValues(fld *Field) []int64 {
+	values := make([]int64, 0, fld.NextDocId - fld.StartDocId)
+	for docId := fld.StartDocId; docId < fld.NextDocId; docId++ {
+		v, ok := fld.GetInt(docId)
+		if !ok {
+			v = index.MaxInt64
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+//获取数字索引的偏移量, 0表示没有数字索引
+func (fld *Field) GetNumOffset() uint64 {
+	if fld.NumIdx == nil {
+		return 0
+	}
+	return fld.NumIdx.GetOffset()
+}
+
+//通过数字索引统计取值在[begin, end]之间的文档数, 没有数字索引则返回false
+func (fld *Field) RangeCount(begin, end int64) (int, bool) {
+	if fld.NumIdx == nil {
+		return 0, false
+	}
+	lo, hi := fld.NumIdx.Range(begin, end)
+	return hi - lo, true
+}
+
+//通过数字索引找出取值在[begin, end]之间的文档, 按docId升序排列
+func (fld *Field) RangeDocs(begin, end int64) ([]basic.DocNode, bool) {
+	if fld.NumIdx == nil {
+		return nil, false
+	}
+	lo, hi := fld.NumIdx.Range(begin, end)
+	docs := make([]basic.DocNode, 0, hi - lo)
+	for _, pos := range fld.NumIdx.Positions(lo, hi) {
+		if fld.idMap != nil {
+			docs = append(docs, basic.DocNode{DocId: fld.idMap.DocId(pos)})
+		} else {
+			docs = append(docs, basic.DocNode{DocId: fld.StartDocId + pos})
+		}
+	}
+	return docs, true
+}
+
 //过滤（针对的是正排索引）
 func (fld *Field) Filter(docId uint32, filter basic.SearchFilter) bool {
-	if docId >= fld.StartDocId && docId < fld.NextDocId && fld.FwdIdx != nil {
-		//Pos是docId在本索引中的位置
-		pos := docId - fld.StartDocId
+	//Pos是docId在本索引中的位置
+	if pos, ok := fld.pos(docId); ok && fld.FwdIdx != nil {
 		return fld.FwdIdx.Filter(pos, filter)
 	}
 	return false
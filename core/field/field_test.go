@@ -93,7 +93,7 @@ func TestLoad(t *testing.T) {
 		panic(err)
 	}
 
-	field := LoadField(TEST_FIELD, 0, 3, index.IDX_TYPE_STR_SPLITER, 0, 3, mmp1, mmp2, ivtMmap, btdb)
+	field := LoadField(TEST_FIELD, 0, 3, index.IDX_TYPE_STR_SPLITER, 0, 0, 0, 3, mmp1, mmp2, ivtMmap, btdb)
 	//测试query
 	tmp, b := field.Query("天安门")
 	if !b {
@@ -177,7 +177,7 @@ func TestMerge(t *testing.T) {
 		panic(err)
 	}
 
-	field1 := LoadField(TEST_FIELD, 0, 2, index.IDX_TYPE_STR_SPLITER, 0, 2, mmp11, mmp21, ivtMmap1, btdb1)
+	field1 := LoadField(TEST_FIELD, 0, 2, index.IDX_TYPE_STR_SPLITER, 0, 0, 0, 2, mmp11, mmp21, ivtMmap1, btdb1)
 
 	//加载field2
 	btdb2 := btree.NewBtree("xx", "/tmp/spider/spider2" + basic.IDX_FILENAME_SUFFIX_BTREE)
@@ -194,13 +194,13 @@ func TestMerge(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	field2 := LoadField(TEST_FIELD, 2, 4, index.IDX_TYPE_STR_SPLITER, 0, 2, mmp12, mmp22, ivtMmap2, btdb2)
+	field2 := LoadField(TEST_FIELD, 2, 4, index.IDX_TYPE_STR_SPLITER, 0, 0, 0, 2, mmp12, mmp22, ivtMmap2, btdb2)
 
 	//准备合并
 	treedb := btree.NewBtree("xx", "/tmp/spider/spider" + basic.IDX_FILENAME_SUFFIX_BTREE)
 	defer treedb.Close()
 	field := NewEmptyField(TEST_FIELD, 0, index.IDX_TYPE_STR_SPLITER)
-	_, _, err = field.MergePersistField([]*Field{field1, field2}, "/tmp/spider/Partition", treedb)
+	_, _, err = field.MergePersistField([]*Field{field1, field2}, nil, "/tmp/spider/Partition", treedb)
 	if err != nil {
 		panic(err)
 	}
@@ -277,7 +277,7 @@ func TestLoadMerge(t *testing.T) {
 		panic(err)
 	}
 
-	field := LoadField(TEST_FIELD, 0, 3, index.IDX_TYPE_STR_SPLITER, 0, 3, mmp1, mmp2, ivtMmap, btdb)
+	field := LoadField(TEST_FIELD, 0, 3, index.IDX_TYPE_STR_SPLITER, 0, 0, 0, 3, mmp1, mmp2, ivtMmap, btdb)
 
 	field.btdb.Display(TEST_FIELD)
 
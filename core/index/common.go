@@ -4,6 +4,10 @@ import (
 	"github.com/hq-cml/spider-engine/splitter"
 	"github.com/hq-cml/spider-engine/basic"
 	"strings"
+	"math"
+	"fmt"
+	"errors"
+	"unicode"
 )
 
 // 索引类型说明
@@ -16,6 +20,7 @@ const (
 	IDX_TYPE_STR_WORD      = 204 //字符型索引, 单字切词，倒排搜索，自然语言单个字母或者汉字
 
 	IDX_TYPE_INTEGER       = 301 //数字型索引，只支持整数，数字型索引只建立正排
+	IDX_TYPE_FLOAT         = 302 //浮点型索引，数字类型的变种，只建立正排，转成保序的整数存储
 
 	IDX_TYPE_DATE          = 401 //日期型索引，数字类型的变种，只建立正排，转成时间戳存储
 
@@ -32,6 +37,9 @@ const (
 	IDX_TYPE_NAME_PURE  = "pure"
 	IDX_TYPE_NAME_TIME  = "time"
 	IDX_TYPE_NAME_INT   = "number"
+	IDX_TYPE_NAME_FLOAT = "float"
+	IDX_TYPE_NAME_LIST  = "list"
+	IDX_TYPE_NAME_CHARS = "chars"
 )
 
 var IDX_MAP = map[string]uint16 {
@@ -41,6 +49,9 @@ var IDX_MAP = map[string]uint16 {
 	IDX_TYPE_NAME_PURE  : IDX_TYPE_PURE_TEXT,
 	IDX_TYPE_NAME_TIME  : IDX_TYPE_DATE,
 	IDX_TYPE_NAME_INT   : IDX_TYPE_INTEGER,
+	IDX_TYPE_NAME_FLOAT : IDX_TYPE_FLOAT,
+	IDX_TYPE_NAME_LIST  : IDX_TYPE_STR_LIST,
+	IDX_TYPE_NAME_CHARS : IDX_TYPE_STR_WORD,
 }
 
 var RE_IDX_MAP = map[uint16]string {
@@ -50,6 +61,47 @@ var RE_IDX_MAP = map[uint16]string {
 	IDX_TYPE_PURE_TEXT : IDX_TYPE_NAME_PURE,
 	IDX_TYPE_DATE : IDX_TYPE_NAME_TIME,
 	IDX_TYPE_INTEGER : IDX_TYPE_NAME_INT,
+	IDX_TYPE_FLOAT : IDX_TYPE_NAME_FLOAT,
+	IDX_TYPE_STR_LIST : IDX_TYPE_NAME_LIST,
+	IDX_TYPE_STR_WORD : IDX_TYPE_NAME_CHARS,
+}
+
+//是否是数字类型(整数、浮点、时间), 数字类型只有正排, 按int64存储
+func IsNumericType(indexType uint16) bool {
+	return indexType == IDX_TYPE_INTEGER || indexType == IDX_TYPE_FLOAT || indexType == IDX_TYPE_DATE
+}
+
+//浮点数转成保序的int64, 两个浮点数的大小关系和转换后的整数一致, 所以排序、过滤、数字索引都可以直接按整数处理
+//负数的位模式是反序的, 翻转除符号位之外的所有位即可; -0统一成0, 避免和占位值冲突
+func Float2Sortable(f float64) int64 {
+	if f == 0 {
+		f = 0
+	}
+	i := int64(math.Float64bits(f))
+	if i < 0 {
+		i ^= MaxInt64
+	}
+	return i
+}
+
+//保序的int64还原成浮点数
+func Sortable2Float(i int64) float64 {
+	if i < 0 {
+		i ^= MaxInt64
+	}
+	return math.Float64frombits(uint64(i))
+}
+
+//浮点字段的过滤器转换成等价的整数过滤器
+func FloatFilter(filter basic.SearchFilter) basic.SearchFilter {
+	filter.IntVal = Float2Sortable(filter.FloatVal)
+	filter.Begin = Float2Sortable(filter.FloatBegin)
+	filter.End = Float2Sortable(filter.FloatEnd)
+	filter.RangeNums = make([]int64, 0, len(filter.RangeFloats))
+	for _, f := range filter.RangeFloats {
+		filter.RangeNums = append(filter.RangeNums, Float2Sortable(f))
+	}
+	return filter
 }
 
 //全局分词器
@@ -74,6 +126,17 @@ var punctuationMap = map[string]bool {
 	"【":true, "】":true,
 }
 
+//停用词, 查询时忽略, 它们几乎出现在所有文档中, 对检索没有意义
+var stopWordMap = map[string]bool {
+	"的":true, "了":true, "着":true, "地":true, "得":true,
+	"和":true, "与":true, "及":true, "或":true, "而":true,
+	"是":true, "也":true, "都":true, "就":true, "把":true, "被":true,
+	"吗":true, "呢":true, "吧":true, "啊":true, "呀":true,
+	"之":true, "其":true, "这":true, "那":true,
+	"a":true, "an":true, "the":true, "of":true, "to":true,
+	"and":true, "or":true, "is":true, "are":true,
+}
+
 const (
 	BIGGER_MULTIPLE = 10000 //词频放大倍数，存储浮点不太方便，将词频放大10000倍取整存储，使用的时候再缩减回来
 )
@@ -93,9 +156,12 @@ func SplitWholeWords(docId uint32, content string) map[string]basic.DocNode {
 	return m
 }
 
+//列表的分隔符
+const LIST_SEPARATOR = ";"
+
 //分号分词
 func SplitSemicolonWords(docId uint32, content string) map[string]basic.DocNode {
-	terms := strings.Split(content, ";")
+	terms := SplitList(content)
 	m := map[string]basic.DocNode {}
 	for _, term := range terms {
 		node := basic.DocNode {
@@ -106,6 +172,72 @@ func SplitSemicolonWords(docId uint32, content string) map[string]basic.DocNode
 	return m
 }
 
+//列表切分成元素, 去掉元素两端的空白, 过滤掉空元素和重复的元素
+func SplitList(content string) []string {
+	terms := []string{}
+	exist := map[string]bool{}
+	for _, term := range strings.Split(content, LIST_SEPARATOR) {
+		term = strings.TrimSpace(term)
+		if term == "" || exist[term] {
+			continue
+		}
+		exist[term] = true
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+//列表类型的内容统一转换成分号分隔的字符串
+//支持json数组和分号分隔的字符串两种形式, 其他类型原样返回
+func ListContent(content interface{}) interface{} {
+	items, ok := listItems(content)
+	if !ok {
+		return content
+	}
+	return strings.Join(items, LIST_SEPARATOR)
+}
+
+//校验json数组形式的列表, 元素中不能含有分隔符, 否则会被切分成多个元素
+func CheckListContent(content interface{}) error {
+	items, _ := listItems(content)
+	for _, item := range items {
+		if strings.Contains(item, LIST_SEPARATOR) {
+			return errors.New(fmt.Sprintf("List item can not contain '%v': %v", LIST_SEPARATOR, item))
+		}
+	}
+	return nil
+}
+
+//json数组形式的列表元素
+func listItems(content interface{}) ([]string, bool) {
+	var items []string
+	switch v := content.(type) {
+	case []string:
+		items = v
+	case []interface{}:
+		for _, item := range v {
+			items = append(items, fmt.Sprintf("%v", item))
+		}
+	default:
+		return nil, false
+	}
+	return items, true
+}
+
+//字符串切分成单个的字(去重), 保持原有顺序
+func SplitRunes(content string) []string {
+	terms := []string{}
+	exist := map[rune]bool{}
+	for _, r := range content {
+		if unicode.IsSpace(r) || exist[r] {
+			continue
+		}
+		exist[r] = true
+		terms = append(terms, string(r))
+	}
+	return terms
+}
+
 //单个词模式分词, 将一个string分解成为一个个的rune (去重), 计算词频TF=0
 func SplitRuneWords(docId uint32, content string) map[string]basic.DocNode {
 	rstr := []rune(content)
@@ -131,6 +263,56 @@ func SplitTrueWords(docId uint32, content string) map[string]basic.DocNode {
 	terms :=  Splitter.DoSplit(content, false) //TODO true config
 
 	terms = trimPunctuation(terms) //过滤无意义的标点
+	return countTermFreq(docId, terms)
+}
+
+//真分词, 计算词频TF的同时, 记录每个词项在文档中出现的位置(用于短语查询)
+//位置即分词结果中的序号, 标点虽然被过滤但是仍然占位, 以免短语跨越标点匹配
+func SplitTrueWordsWithPos(docId uint32, content string) (map[string]basic.DocNode, map[string][]uint32) {
+	terms, positions := SplitPhrase(content)
+	posMap := map[string][]uint32{}
+	for i, term := range terms {
+		posMap[term] = append(posMap[term], positions[i])
+	}
+	return countTermFreq(docId, terms), posMap
+}
+
+//短语分词, 返回去除标点之后的词项, 以及各个词项的位置
+//查询侧和索引侧使用同样的切分方式, 保证位置可以对齐
+//Note: 空白不占位置, 其他标点占一个位置(跨越标点的短语不能精确匹配)
+func SplitPhrase(content string) ([]string, []uint32) {
+	terms := []string{}
+	positions := []uint32{}
+	pos := uint32(0)
+	for _, term := range Splitter.DoSplit(content, false) {
+		if strings.TrimSpace(term) == "" {
+			continue
+		}
+		if _, ok := punctuationMap[term]; !ok {
+			terms = append(terms, term)
+			positions = append(positions, pos)
+		}
+		pos++
+	}
+	return terms, positions
+}
+
+//根据倒排中的权重(词频放大10000倍)和字段长度, 还原出词项在文档中出现的次数
+//全词、分号、单字模式的权重为0, 按出现1次计算; 长度未知(0)时同样按1次计算
+//Note: 权重是截断存储的, 所以向上取整还原, 字段长度不超过10000时是精确的
+func TermCount(weight uint32, docLen uint32) float64 {
+	if weight == 0 || docLen == 0 {
+		return 1
+	}
+	cnt := math.Ceil(float64(weight) * float64(docLen) / BIGGER_MULTIPLE - 1e-9)
+	if cnt < 1 {
+		cnt = 1
+	}
+	return cnt
+}
+
+//统计单词term的个数, 计算词频
+func countTermFreq(docId uint32, terms []string) map[string]basic.DocNode {
 	totalCnt := len(terms)
 
 	//统计单词term的个数
@@ -153,6 +335,48 @@ func SplitTrueWords(docId uint32, content string) map[string]basic.DocNode {
 	return m
 }
 
+//查询串分词, 使用分词器的搜索模式, 过滤掉标点、停用词以及重复的词项
+//搜索模式会将长词再切出子词(比如"北京大学" => 北京, 大学, 北京大学), 而索引侧不会
+//所以mustAll(AND语义)为true时, 去掉被其他词项包含的子词, 否则文档必须同时命中长词和子词
+//Note: 如果查询串全部由停用词组成, 则保留停用词, 以免什么都查不到
+func SplitQueryWords(content string, mustAll bool) []string {
+	terms := []string{}
+	stopWords := []string{}
+	exist := map[string]bool{}
+	for _, term := range trimPunctuation(Splitter.DoSplit(content, true)) {
+		if strings.TrimSpace(term) == "" || exist[term] {
+			continue
+		}
+		exist[term] = true
+		if stopWordMap[strings.ToLower(term)] {
+			stopWords = append(stopWords, term)
+			continue
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 0 {
+		terms = stopWords
+	}
+	if !mustAll {
+		return terms
+	}
+
+	ret := []string{}
+	for _, term := range terms {
+		sub := false
+		for _, other := range terms {
+			if other != term && strings.Contains(other, term) {
+				sub = true
+				break
+			}
+		}
+		if !sub {
+			ret = append(ret, term)
+		}
+	}
+	return ret
+}
+
 //去除掉标点符号, 空格等
 func trimPunctuation(in []string) []string {
 	out := []string{}
@@ -0,0 +1,107 @@
+package index
+
+/*
+ * 文档Id映射类, 用于合并时剔除了删除文档的分区
+ * 分区合并时, 已删除(包括变更之后被替换掉)的文档不再写入新分区, 新分区的正排只保存存活的文档,
+ * 所以docId和正排中的位置不再是简单的(docId - startDocId), 需要通过本映射转换
+ *
+ * 本质上是按docId升序排列的存活文档数组, 数组下标即文档在正排中的位置, docId => 位置通过二分查找
+ * 映射只存在于磁盘态, 追加写在分区的正排文件中, 格式如：
+ *     [cnt][docId][docId][docId]...
+ *
+ * Note：
+ * 没有映射的分区(内存分区和老版本的分区), 位置仍然是(docId - startDocId)
+ **/
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/hq-cml/spider-engine/basic"
+	"github.com/hq-cml/spider-engine/utils/log"
+	"github.com/hq-cml/spider-engine/utils/mmap"
+	"os"
+	"sort"
+)
+
+type DocIdMap struct {
+	offset   uint64     //本映射在正排文件中的起始偏移
+	baseMmap *mmap.Mmap //分区的正排mmap
+}
+
+//加载文档Id映射, mmap从外部传入, 和正排索引共用
+func LoadDocIdMap(baseMmap *mmap.Mmap, offset uint64) *DocIdMap {
+	return &DocIdMap{
+		offset:   offset,
+		baseMmap: baseMmap,
+	}
+}
+
+//将存活文档的docId(升序)追加写入正排文件
+func PersistDocIdMap(docIds []uint32, partitionPathName string) (*DocIdMap, error) {
+	//打开正排文件
+	fwdFileName := partitionPathName + basic.IDX_FILENAME_SUFFIX_FWD
+	fwdFd, err := os.OpenFile(fwdFileName, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer fwdFd.Close()
+	fi, err := fwdFd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := fi.Size()
+
+	buffer := make([]byte, DATA_BYTE_CNT + len(docIds) * DATA_BYTE_CNT)
+	binary.LittleEndian.PutUint64(buffer, uint64(len(docIds)))
+	for i, docId := range docIds {
+		binary.LittleEndian.PutUint64(buffer[DATA_BYTE_CNT + i * DATA_BYTE_CNT:], uint64(docId))
+	}
+	n, err := fwdFd.Write(buffer)
+	if err != nil || n != len(buffer) {
+		log.Errf(fmt.Sprintf("Write err:%v, len:%v, len:%v", err, n, len(buffer)))
+		return nil, errors.New("Write Error")
+	}
+
+	return &DocIdMap{offset: uint64(offset)}, nil
+}
+
+func (idMap *DocIdMap) SetBaseMmap(mmap *mmap.Mmap) {
+	idMap.baseMmap = mmap
+}
+
+func (idMap *DocIdMap) GetOffset() uint64 {
+	return idMap.offset
+}
+
+//存活的文档数
+func (idMap *DocIdMap) Count() int {
+	if idMap.baseMmap == nil || int(idMap.offset + DATA_BYTE_CNT) > idMap.baseMmap.Boundary() {
+		return 0
+	}
+	return int(idMap.baseMmap.ReadUInt64(idMap.offset))
+}
+
+//位置pos上的docId
+func (idMap *DocIdMap) DocId(pos uint32) uint32 {
+	return uint32(idMap.baseMmap.ReadUInt64(idMap.offset + DATA_BYTE_CNT + uint64(pos) * DATA_BYTE_CNT))
+}
+
+//docId在正排中的位置, 文档已被剔除则返回false
+func (idMap *DocIdMap) Pos(docId uint32) (uint32, bool) {
+	cnt := idMap.Count()
+	i := sort.Search(cnt, func(i int) bool { return idMap.DocId(uint32(i)) >= docId })
+	if i < cnt && idMap.DocId(uint32(i)) == docId {
+		return uint32(i), true
+	}
+	return 0, false
+}
+
+//全部存活的docId, 升序排列
+func (idMap *DocIdMap) DocIds() []uint32 {
+	cnt := idMap.Count()
+	docIds := make([]uint32, 0, cnt)
+	for i := 0; i < cnt; i++ {
+		docIds = append(docIds, idMap.DocId(uint32(i)))
+	}
+	return docIds
+}
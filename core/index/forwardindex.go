@@ -23,6 +23,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"reflect"
 	"strconv"
@@ -46,6 +47,7 @@ type ForwardIndex struct {
 	fake       bool                     //标记位, 用于占位，高层的分区缺少某个字段时候，用此占位
 	memoryNum  []int64    `json:"-"`    //内存态本正排索引(数字)
 	memoryStr  []string   `json:"-"`    //内存态本正排索引(字符串)
+	memBytes   uint64     `json:"-"`    //内存态索引占用的内存(估算值)
 	baseMmap   *mmap.Mmap `json:"-"`    //底层mmap文件, 用于存储磁盘态正排索引
 	extMmap    *mmap.Mmap `json:"-"`    //用于补充性的mmap, 主要存磁盘态正排索引string的实际内容
 }
@@ -123,7 +125,16 @@ func (fwdIdx *ForwardIndex) AddDocument(docId uint32, content interface{}) error
 	}
 
 	switch vtype.Name() {
-	case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64", "float64":
+	case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64", "float32", "float64":
+		//浮点类型, 转成保序的整数存储
+		if fwdIdx.indexType == IDX_TYPE_FLOAT {
+			valueInt, err = parseFloat(content)
+			if err != nil {
+				goto FAIL
+			}
+			fwdIdx.memoryNum = append(fwdIdx.memoryNum, valueInt)
+			break
+		}
 		//golang json mashal的小坑, 整型会被升级为float64, 此时要回转
 		if vtype.Name() == "float64" {
 			content = int(content.(float64))
@@ -151,6 +162,12 @@ func (fwdIdx *ForwardIndex) AddDocument(docId uint32, content interface{}) error
 				goto FAIL
 			}
 			fwdIdx.memoryNum = append(fwdIdx.memoryNum, valueInt)
+		} else if fwdIdx.indexType == IDX_TYPE_FLOAT { //浮点类型也允许以字符形式传入
+			valueInt, err = parseFloat(content)
+			if err != nil {
+				goto FAIL
+			}
+			fwdIdx.memoryNum = append(fwdIdx.memoryNum, valueInt)
 		} else {
 			fwdIdx.memoryStr = append(fwdIdx.memoryStr, fmt.Sprintf("%v", content))
 		}
@@ -167,22 +184,47 @@ func (fwdIdx *ForwardIndex) AddDocument(docId uint32, content interface{}) error
 
 	fwdIdx.nextDocId++
 	fwdIdx.docCnt ++
+	fwdIdx.addMemBytes()
 	log.Debugf("Forward AddDoc--> DocId: %v ,Content: %v", docId, content)
 	return nil
 
 FAIL:
 	//即便出错，底层也将错就错，高层会做废弃
-	if fwdIdx.indexType == IDX_TYPE_INTEGER || fwdIdx.indexType == IDX_TYPE_DATE {
+	if IsNumericType(fwdIdx.indexType) {
 		fwdIdx.memoryNum = append(fwdIdx.memoryNum, MaxInt64)
 	} else {
 		fwdIdx.memoryStr = append(fwdIdx.memoryStr, "") //插一个“”占位
 	}
 	fwdIdx.nextDocId++
 	fwdIdx.docCnt ++
+	fwdIdx.addMemBytes()
 	log.Warnf("Forward AddDocument Error. DocId: %v, Content: %v, Error:%v", docId, content, err.Error())
 	return err
 }
 
+//解析浮点数, 返回保序的整数
+//MaxInt64是没有值的标记(见Field.GetValue), 原样保留
+func parseFloat(content interface{}) (int64, error) {
+	switch value := content.(type) {
+	case int64:
+		if value == MaxInt64 {
+			return MaxInt64, nil
+		}
+	case float64:
+		if value == float64(MaxInt64) { //经过json(比如WAL)之后变成了浮点
+			return MaxInt64, nil
+		}
+	}
+	valueFloat, err := strconv.ParseFloat(fmt.Sprintf("%v", content), 64)
+	if err != nil {
+		return MaxInt64, errors.New(fmt.Sprintf("strconv.ParseFloat Error: %v, %v", content, err.Error()))
+	}
+	if math.IsNaN(valueFloat) {
+		return MaxInt64, errors.New(fmt.Sprintf("Wrong Float: %v", content))
+	}
+	return Float2Sortable(valueFloat), nil
+}
+
 //更高层采用先删后增的方式，变相得实现了update
 //更新文档
 //Note:
@@ -305,13 +347,14 @@ func (fwdIdx *ForwardIndex) GetString(pos uint32) (string, bool) {
 
 //获取值 (以数值形式)
 //参数Pos: 通常索引内引用元素，比如dockId - startId
+//Note: 浮点类型返回的是保序的整数
 func (fwdIdx *ForwardIndex) GetInt(pos uint32) (int64, bool) {
 	if fwdIdx.fake {  //占位假索引, 直接返回占位数据
 		return MaxInt64, true
 	}
 
 	//类型校验
-	if fwdIdx.indexType != IDX_TYPE_INTEGER && fwdIdx.indexType != IDX_TYPE_DATE {
+	if !IsNumericType(fwdIdx.indexType) {
 		return MaxInt64, false
 	}
 
@@ -336,6 +379,18 @@ func (fwdIdx *ForwardIndex) GetInt(pos uint32) (int64, bool) {
 	}
 }
 
+//获取浮点值, 整数类型也转成浮点返回; 没有值的返回false
+func (fwdIdx *ForwardIndex) GetFloat(pos uint32) (float64, bool) {
+	value, ok := fwdIdx.GetInt(pos)
+	if !ok || value == MaxInt64 {
+		return 0, false
+	}
+	if fwdIdx.indexType == IDX_TYPE_FLOAT {
+		return Sortable2Float(value), true
+	}
+	return float64(value), true
+}
+
 //销毁
 // Note: 只销毁内存部分，mmap因为是公用，需要在高层统一销毁
 func (fwdIdx *ForwardIndex) DoClose() {
@@ -356,6 +411,23 @@ func (fwdIdx *ForwardIndex) SetInMemory(in bool) {
 	fwdIdx.inMemory = in
 }
 
+//累加最新一个文档占用的内存, 数字8个字节, 字符串算上string的头部
+func (fwdIdx *ForwardIndex) addMemBytes() {
+	if IsNumericType(fwdIdx.indexType) {
+		fwdIdx.memBytes += DATA_BYTE_CNT
+	} else if l := len(fwdIdx.memoryStr); l > 0 {
+		fwdIdx.memBytes += uint64(len(fwdIdx.memoryStr[l-1])) + 16
+	}
+}
+
+//内存态索引占用的内存(估算值), 磁盘态的索引为0
+func (fwdIdx *ForwardIndex) MemBytes() uint64 {
+	if !fwdIdx.inMemory {
+		return 0
+	}
+	return fwdIdx.memBytes
+}
+
 func (fwdIdx *ForwardIndex) GetNextId() uint32{
 	return fwdIdx.nextDocId
 }
@@ -389,7 +461,7 @@ func (fwdIdx *ForwardIndex) Persist(partitionPathName string) (uint64, uint32, e
 	offset := fi.Size()
 
 	var cnt int
-	if fwdIdx.indexType == IDX_TYPE_INTEGER || fwdIdx.indexType == IDX_TYPE_DATE {
+	if IsNumericType(fwdIdx.indexType) {
 		buffer := make([]byte, DATA_BYTE_CNT)
 		for _, num := range fwdIdx.memoryNum {
 			binary.LittleEndian.PutUint64(buffer, uint64(num))
@@ -458,7 +530,9 @@ func (fwdIdx *ForwardIndex) Persist(partitionPathName string) (uint64, uint32, e
 //Note:
 // 一个设计的问题，因为同一个分区的各个字段的正、倒排公用同一套文件(btdb, ivt, fwd, ext)
 // 所以mmap并不会加载回来，但是其他几个控制字段nextId， docCnt，offset被加载回来了
-func (fwdIdx *ForwardIndex) MergePersistFwdIndex(idxList []*ForwardIndex, partitionPathName string) (uint64, uint32, error) {
+//Note:
+// poses[i]是idxList[i]中需要保留的文档位置(升序), 用于剔除已删除的文档; poses为nil或者poses[i]为nil表示全部保留
+func (fwdIdx *ForwardIndex) MergePersistFwdIndex(idxList []*ForwardIndex, poses [][]uint32, partitionPathName string) (uint64, uint32, error) {
 	//一些校验, index的类型，顺序必须完整正确
 	if idxList == nil || len(idxList) == 0 {
 		return 0, 0, errors.New("Nil []*ForwardIndex")
@@ -474,6 +548,9 @@ func (fwdIdx *ForwardIndex) MergePersistFwdIndex(idxList []*ForwardIndex, partit
 			return 0, 0, errors.New("Indexes order wrong")
 		}
 	}
+	if poses != nil && len(poses) != l {
+		return 0, 0, errors.New("Positions not consistent")
+	}
 
 	//打开正排文件
 	fwdFileName := fmt.Sprintf("%v" + basic.IDX_FILENAME_SUFFIX_FWD, partitionPathName)
@@ -488,10 +565,10 @@ func (fwdIdx *ForwardIndex) MergePersistFwdIndex(idxList []*ForwardIndex, partit
 	offset := fi.Size()
 
 	cnt := 0
-	if indexType == IDX_TYPE_INTEGER || indexType == IDX_TYPE_DATE {
+	if IsNumericType(indexType) {
 		buffer := make([]byte, DATA_BYTE_CNT)
-		for _, idx := range idxList {
-			for i := uint32(0); i < uint32(idx.docCnt); i++ {
+		for k, idx := range idxList {
+			for _, i := range keepPositions(idx, poses, k) {
 				val, _ := idx.GetInt(i)
 				binary.LittleEndian.PutUint64(buffer, uint64(val))
 				n, err := fwdFd.Write(buffer)
@@ -518,8 +595,8 @@ func (fwdIdx *ForwardIndex) MergePersistFwdIndex(idxList []*ForwardIndex, partit
 		extOffset := fi.Size()
 
 		buffer := make([]byte, DATA_BYTE_CNT)
-		for _, idx := range idxList {
-			for i := uint32(0); i < uint32(idx.docCnt); i++ {
+		for k, idx := range idxList {
+			for _, i := range keepPositions(idx, poses, k) {
 				strContent, _ := idx.GetString(i)
 				strLen := len(strContent)
 				binary.LittleEndian.PutUint64(buffer, uint64(strLen))
@@ -558,6 +635,18 @@ func (fwdIdx *ForwardIndex) MergePersistFwdIndex(idxList []*ForwardIndex, partit
 	return fwdIdx.fwdOffset, fwdIdx.docCnt, nil
 }
 
+//合并时第k个索引需要保留的文档位置
+func keepPositions(idx *ForwardIndex, poses [][]uint32, k int) []uint32 {
+	if poses != nil && poses[k] != nil {
+		return poses[k]
+	}
+	all := make([]uint32, idx.docCnt)
+	for i := range all {
+		all[i] = uint32(i)
+	}
+	return all
+}
+
 //过滤操作
 // 判断pos指向的dco是否满足条件，pos指的是在当前分区中的位置，即(docId-startDocId)
 // 返回true的doc，将会保留，否则，将会被剔除
@@ -566,8 +655,13 @@ func (fwdIdx *ForwardIndex) Filter(pos uint32, filter basic.SearchFilter) bool {
 		return false
 	}
 
+	//浮点类型转成等价的整数过滤器
+	if fwdIdx.indexType == IDX_TYPE_FLOAT {
+		filter = FloatFilter(filter)
+	}
+
 	filterType := basic.FilterTypeMap[filter.FilterType]
-	if fwdIdx.indexType == IDX_TYPE_INTEGER || fwdIdx.indexType == IDX_TYPE_DATE {
+	if IsNumericType(fwdIdx.indexType) {
 		//数字类型, 现获取值
 		value, ok := fwdIdx.GetInt(pos)
 		if !ok {
@@ -635,6 +729,21 @@ func (fwdIdx *ForwardIndex) Filter(pos uint32, filter basic.SearchFilter) bool {
 				}
 			}
 			return true
+		case basic.FILT_CONTAIN_ANY, basic.FILT_CONTAIN_ALL:
+			//列表类型, 按元素匹配
+			items := map[string]bool{}
+			for _, item := range SplitList(value) {
+				items[item] = true
+			}
+			for _, str := range filter.RangeStrs {
+				if items[str] && filterType == basic.FILT_CONTAIN_ANY {
+					return true
+				}
+				if !items[str] && filterType == basic.FILT_CONTAIN_ALL {
+					return false
+				}
+			}
+			return filterType == basic.FILT_CONTAIN_ALL && len(filter.RangeStrs) > 0
 		default:
 			return false
 		}
@@ -1,6 +1,9 @@
 package index
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"testing"
@@ -8,6 +11,9 @@ import (
 	"github.com/hq-cml/spider-engine/utils/mmap"
 	"github.com/hq-cml/spider-engine/utils/btree"
 	"encoding/json"
+	"fmt"
+	"github.com/hq-cml/spider-engine/utils/helper"
+	"math"
 )
 
 const TEST_TREE = "user_name"
@@ -32,6 +38,24 @@ func TestSplitWordsRune(t *testing.T) {
 	t.Log("\n\n")
 }
 
+func TestSplitList(t *testing.T) {
+	ret := SplitList(" 红色;蓝色;;红色 ; 白色 ")
+	if helper.JsonEncode(ret) != `["红色","蓝色","白色"]` {
+		panic("Wrong list: " + helper.JsonEncode(ret))
+	}
+	if ListContent([]interface{}{"红色", "蓝色", 3}) != "红色;蓝色;3" || ListContent("红色;蓝色") != "红色;蓝色" {
+		panic("Wrong list content")
+	}
+	if CheckListContent([]interface{}{"红色", "蓝色;白色"}) == nil || CheckListContent([]string{"红色"}) != nil || CheckListContent("红色;蓝色") != nil {
+		panic("Wrong list check")
+	}
+	if helper.JsonEncode(SplitRunes("手机 手套")) != `["手","机","套"]` {
+		panic("Wrong runes: " + helper.JsonEncode(SplitRunes("手机 手套")))
+	}
+	t.Log(helper.JsonEncode(ret))
+	t.Log("\n\n")
+}
+
 func TestSplitWords(t *testing.T) {
 	ret := SplitTrueWords(0, "我爱北京天安门, Hello world!")
 	r, _ := json.Marshal(ret)
@@ -39,6 +63,33 @@ func TestSplitWords(t *testing.T) {
 	t.Log("\n\n")
 }
 
+func TestSplitQueryWords(t *testing.T) {
+	ret := SplitQueryWords("喜欢秋香的人", false)
+	t.Log(helper.JsonEncode(ret))
+	if helper.JsonEncode(ret) != `["喜欢","秋香","人"]` {
+		panic("Wrong stop words")
+	}
+
+	//OR语义保留子词, AND语义去掉子词
+	ret = SplitQueryWords("北京大学", false)
+	t.Log(helper.JsonEncode(ret))
+	if len(ret) != 3 {
+		panic("Wrong search mode")
+	}
+	ret = SplitQueryWords("北京大学, 北京大学!", true)
+	t.Log(helper.JsonEncode(ret))
+	if helper.JsonEncode(ret) != `["北京大学"]` {
+		panic("Wrong sub words")
+	}
+
+	//全部是停用词
+	ret = SplitQueryWords("的", true)
+	if helper.JsonEncode(ret) != `["的"]` {
+		panic("Wrong only stop words")
+	}
+	t.Log("\n\n")
+}
+
 //********************* 倒排索引 *********************
 func TestAddDoc(t *testing.T) {
 	rIdx := NewEmptyInvertedIndex(IDX_TYPE_STR_SPLITER, 0, TEST_TREE)
@@ -167,7 +218,7 @@ func TestMergeIndex(t *testing.T) {
 	tree := btree.NewBtree("xx", "/tmp/spider/spider" + basic.IDX_FILENAME_SUFFIX_BTREE)
 	defer tree.Close()
 	rIdx0 := NewEmptyInvertedIndex(IDX_TYPE_STR_LIST, 0, TEST_TREE)
-	err = rIdx0.MergePersistIvtIndex([]*InvertedIndex{rIdx1, rIdx2, rIdx3}, "/tmp/spider/Partition", tree)
+	err = rIdx0.MergePersistIvtIndex([]*InvertedIndex{rIdx1, rIdx2, rIdx3}, nil, "/tmp/spider/Partition", tree)
 	if err != nil {
 		panic(err)
 	}
@@ -208,6 +259,151 @@ func TestMergeIndex(t *testing.T) {
 }
 
 
+func TestPositionalIndex(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	rIdx1 := NewEmptyInvertedIndex(IDX_TYPE_STR_SPLITER, 0, TEST_TREE)
+	rIdx1.SetPositional(true)
+	rIdx1.AddDocument(0, "我爱北京天安门")
+	rIdx1.AddDocument(1, "我爱北京的天安门")
+	rIdx1.AddDocument(2, "天安门在北京")
+
+	//从内存读取位置
+	nodes, posList, exist := rIdx1.QueryTermPositions("北京")
+	if !exist || len(nodes) != 3 || len(posList) != 3 {
+		panic("Wrong positions")
+	}
+	t.Log("从内存访问 北京: ", helper.JsonEncode(nodes), helper.JsonEncode(posList))
+
+	terms, positions := SplitPhrase("北京 天安门")
+	docs, _ := rIdx1.QueryPhrase(terms, positions, 0)
+	if len(docs) != 1 || docs[0].DocId != 0 {
+		panic("Wrong phrase in memory: " + helper.JsonEncode(docs))
+	}
+	docs, _ = rIdx1.QueryPhrase(terms, positions, 1)
+	if len(docs) != 2 {
+		panic("Wrong slop in memory: " + helper.JsonEncode(docs))
+	}
+
+	//落地 => 加载
+	tree1 := btree.NewBtree("xx", "/tmp/spider/spider_1" + basic.IDX_FILENAME_SUFFIX_BTREE)
+	defer tree1.Close()
+	if err := rIdx1.Persist("/tmp/spider/Partition_1", tree1); err != nil {
+		panic(err)
+	}
+	rIdx1.ivtMmap, err = mmap.NewMmap("/tmp/spider/Partition_1" + basic.IDX_FILENAME_SUFFIX_INVERT, true, 0)
+	if err != nil {
+		panic(err)
+	}
+	docs, _ = rIdx1.QueryPhrase(terms, positions, 0)
+	if len(docs) != 1 || docs[0].DocId != 0 {
+		panic("Wrong phrase in file: " + helper.JsonEncode(docs))
+	}
+
+	//合并 => 短语查询
+	tree2 := btree.NewBtree("xx", "/tmp/spider/spider_2" + basic.IDX_FILENAME_SUFFIX_BTREE)
+	defer tree2.Close()
+	rIdx2 := NewEmptyInvertedIndex(IDX_TYPE_STR_SPLITER, 3, TEST_TREE)
+	rIdx2.SetPositional(true)
+	rIdx2.AddDocument(3, "去北京天安门")
+	rIdx2.Persist("/tmp/spider/Partition_2", tree2)
+	rIdx2.ivtMmap, err = mmap.NewMmap("/tmp/spider/Partition_2" + basic.IDX_FILENAME_SUFFIX_INVERT, true, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	tree := btree.NewBtree("xx", "/tmp/spider/spider" + basic.IDX_FILENAME_SUFFIX_BTREE)
+	defer tree.Close()
+	rIdx0 := NewEmptyInvertedIndex(IDX_TYPE_STR_SPLITER, 0, TEST_TREE)
+	rIdx0.SetPositional(true)
+	err = rIdx0.MergePersistIvtIndex([]*InvertedIndex{rIdx1, rIdx2}, nil, "/tmp/spider/Partition", tree)
+	if err != nil {
+		panic(err)
+	}
+	ivtMmap, err := mmap.NewMmap("/tmp/spider/Partition" + basic.IDX_FILENAME_SUFFIX_INVERT, true, 0)
+	if err != nil {
+		panic(err)
+	}
+	rIdx0.SetIvtMmap(ivtMmap)
+	docs, _ = rIdx0.QueryPhrase(terms, positions, 0)
+	if len(docs) != 2 || docs[0].DocId != 0 || docs[1].DocId != 3 {
+		panic("Wrong phrase after merge: " + helper.JsonEncode(docs))
+	}
+	t.Log("合并后短语查询: ", helper.JsonEncode(docs))
+	t.Log("\n\n")
+}
+
+//没有位置信息的老分区合并进开启位置信息的分区, 短语查询退化为词项同时出现
+func TestMergeLegacyPositions(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	//老格式的分区, 没有位置信息
+	tree1 := btree.NewBtree("xx", "/tmp/spider/spider_1" + basic.IDX_FILENAME_SUFFIX_BTREE)
+	defer tree1.Close()
+	rIdx1 := NewEmptyInvertedIndex(IDX_TYPE_STR_SPLITER, 0, TEST_TREE)
+	rIdx1.AddDocument(0, "我爱北京天安门")
+	rIdx1.AddDocument(1, "天安门在北京")
+	rIdx1.AddDocument(2, "我爱上海")
+	if err := rIdx1.Persist("/tmp/spider/Partition_1", tree1); err != nil {
+		panic(err)
+	}
+	rIdx1.ivtMmap, err = mmap.NewMmap("/tmp/spider/Partition_1" + basic.IDX_FILENAME_SUFFIX_INVERT, true, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	//新格式的分区
+	tree2 := btree.NewBtree("xx", "/tmp/spider/spider_2" + basic.IDX_FILENAME_SUFFIX_BTREE)
+	defer tree2.Close()
+	rIdx2 := NewEmptyInvertedIndex(IDX_TYPE_STR_SPLITER, 3, TEST_TREE)
+	rIdx2.SetPositional(true)
+	rIdx2.AddDocument(3, "去北京天安门")
+	rIdx2.AddDocument(4, "天安门在北京")
+	if err := rIdx2.Persist("/tmp/spider/Partition_2", tree2); err != nil {
+		panic(err)
+	}
+	rIdx2.ivtMmap, err = mmap.NewMmap("/tmp/spider/Partition_2" + basic.IDX_FILENAME_SUFFIX_INVERT, true, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	//合并, 剔除掉文档0, 新的分区开启位置信息
+	tree := btree.NewBtree("xx", "/tmp/spider/spider" + basic.IDX_FILENAME_SUFFIX_BTREE)
+	defer tree.Close()
+	rIdx0 := NewEmptyInvertedIndex(IDX_TYPE_STR_SPLITER, 0, TEST_TREE)
+	rIdx0.SetPositional(true)
+	err = rIdx0.MergePersistIvtIndex([]*InvertedIndex{rIdx1, rIdx2}, []uint32{1, 2, 3, 4}, "/tmp/spider/Partition", tree)
+	if err != nil {
+		panic(err)
+	}
+	ivtMmap, err := mmap.NewMmap("/tmp/spider/Partition" + basic.IDX_FILENAME_SUFFIX_INVERT, true, 0)
+	if err != nil {
+		panic(err)
+	}
+	rIdx0.SetIvtMmap(ivtMmap)
+
+	//老分区的文档1只要求词项同时出现, 新分区的文档4仍然按位置匹配
+	terms, positions := SplitPhrase("北京 天安门")
+	docs, _ := rIdx0.QueryPhrase(terms, positions, 0)
+	if len(docs) != 2 || docs[0].DocId != 1 || docs[1].DocId != 3 {
+		panic("Wrong phrase after merging legacy partition: " + helper.JsonEncode(docs))
+	}
+	docs, _ = rIdx0.QueryPhrase(terms, positions, 1)
+	if len(docs) != 2 || docs[0].DocId != 1 || docs[1].DocId != 3 {
+		panic("Wrong slop after merging legacy partition: " + helper.JsonEncode(docs))
+	}
+	t.Log("合并老分区后短语查询: ", helper.JsonEncode(docs))
+	t.Log("\n\n")
+}
+
 //********************* 正排索引 *********************
 func TestNewAndAddDoc(t *testing.T) {
 	idx1 := NewEmptyForwardIndex(IDX_TYPE_INTEGER, 0) //数字型存入数字
@@ -376,7 +572,7 @@ func TestMergeFwdIndex(t *testing.T) {
 	if err := idx2.AddDocument(4, 456); err != nil {panic(err) }
 
 	idx0 := NewEmptyForwardIndex(IDX_TYPE_INTEGER, 9999) //9999没用，会被覆盖
-	_, _, err := idx0.MergePersistFwdIndex([]*ForwardIndex{idx1, idx2},"/tmp/spider/Partition.int.fwd.merge")
+	_, _, err := idx0.MergePersistFwdIndex([]*ForwardIndex{idx1, idx2}, nil, "/tmp/spider/Partition.int.fwd.merge")
 	if err != nil {
 		panic(err)
 	}
@@ -434,7 +630,7 @@ func TestMergeFwdIndexString(t *testing.T) {
 
 	idx0 := NewEmptyForwardIndex(IDX_TYPE_STR_WHOLE, 9999) //9999没用，会被覆盖
 
-	_, _, err := idx0.MergePersistFwdIndex([]*ForwardIndex{idx1, idx2}, "/tmp/spider/Partition.string.fwd.merge")
+	_, _, err := idx0.MergePersistFwdIndex([]*ForwardIndex{idx1, idx2}, nil, "/tmp/spider/Partition.string.fwd.merge")
 	if err != nil {
 		panic(err)
 	}
@@ -481,3 +677,214 @@ func TestMergeFwdIndexString(t *testing.T) {
 	t.Log("3: ", iv)
 	t.Log("\n\n")
 }
+
+func TestNumericIndex(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/Partition.num*`)
+	cmd.Output()
+
+	//没有值的文档(MaxInt64)不进入索引
+	values := []int64{50, 10, MaxInt64, 30, 10, -5, 70}
+	numIdx, err := PersistNumericIndex(values, "/tmp/spider/Partition.num")
+	if err != nil {
+		panic(err)
+	}
+	mmp, err := mmap.NewMmap("/tmp/spider/Partition.num" + basic.IDX_FILENAME_SUFFIX_FWD, true, 0)
+	if err != nil {
+		panic(err)
+	}
+	numIdx = LoadNumericIndex(mmp, numIdx.GetOffset())
+
+	cases := []struct {
+		begin, end int64
+		expect     string
+	}{
+		{10, 30, "[1,3,4]"},
+		{-100, 0, "[5]"},
+		{10, 10, "[1,4]"},
+		{31, 49, "[]"},
+		{60, MaxInt64 - 1, "[6]"},
+		{30, 10, "[]"},
+	}
+	for _, c := range cases {
+		lo, hi := numIdx.Range(c.begin, c.end)
+		poses := numIdx.Positions(lo, hi)
+		if helper.JsonEncode(poses) != c.expect {
+			panic(fmt.Sprintf("Wrong range [%v, %v]: %v", c.begin, c.end, helper.JsonEncode(poses)))
+		}
+	}
+	lo, hi := numIdx.Range(-MaxInt64 - 1, MaxInt64 - 1)
+	if hi - lo != 6 {
+		panic("Wrong count")
+	}
+	mmp.Unmap()
+	t.Log("\n\n")
+}
+
+func TestDocIdMap(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/Partition.idmap*`)
+	cmd.Output()
+
+	idMap, err := PersistDocIdMap([]uint32{3, 5, 6, 10}, "/tmp/spider/Partition.idmap")
+	if err != nil {
+		panic(err)
+	}
+	mmp, err := mmap.NewMmap("/tmp/spider/Partition.idmap" + basic.IDX_FILENAME_SUFFIX_FWD, true, 0)
+	if err != nil {
+		panic(err)
+	}
+	idMap = LoadDocIdMap(mmp, idMap.GetOffset())
+
+	if idMap.Count() != 4 || helper.JsonEncode(idMap.DocIds()) != "[3,5,6,10]" {
+		panic("Wrong doc ids: " + helper.JsonEncode(idMap.DocIds()))
+	}
+	for docId, expect := range map[uint32]int{3: 0, 6: 2, 10: 3, 0: -1, 4: -1, 11: -1} {
+		pos, ok := idMap.Pos(docId)
+		if (expect < 0 && ok) || (expect >= 0 && (!ok || pos != uint32(expect))) {
+			panic(fmt.Sprintf("Wrong pos %v: %v, %v", docId, pos, ok))
+		}
+	}
+	mmp.Unmap()
+	t.Log("\n\n")
+}
+
+func TestFloatSortable(t *testing.T) {
+	//转换之后的整数和原浮点数保序
+	floats := []float64{math.Inf(-1), -1e300, -2.5, -1, -0.001, 0, 0.001, 1, 2.5, 1e300, math.Inf(1)}
+	for i, f := range floats {
+		v := Float2Sortable(f)
+		if Sortable2Float(v) != f {
+			panic(fmt.Sprintf("Wrong convert: %v, %v", f, Sortable2Float(v)))
+		}
+		if MaxInt64 & v == MaxInt64 {
+			panic(fmt.Sprintf("Conflict with MaxInt64: %v", f))
+		}
+		if i > 0 && Float2Sortable(floats[i-1]) >= v {
+			panic(fmt.Sprintf("Wrong order: %v, %v", floats[i-1], f))
+		}
+	}
+	if Float2Sortable(math.Copysign(0, -1)) != Float2Sortable(0) {
+		panic("Wrong -0")
+	}
+
+	//正排支持数字和字符形式的浮点, NaN非法
+	fwdIdx := NewEmptyForwardIndex(IDX_TYPE_FLOAT, 0)
+	if err := fwdIdx.AddDocument(0, 1.5); err != nil {
+		panic(err)
+	}
+	if err := fwdIdx.AddDocument(1, "-3.25"); err != nil {
+		panic(err)
+	}
+	if err := fwdIdx.AddDocument(2, "NaN"); err == nil {
+		panic("NaN should fail")
+	}
+	if v, ok := fwdIdx.GetFloat(1); !ok || v != -3.25 {
+		panic(fmt.Sprintf("Wrong float: %v", v))
+	}
+	if _, ok := fwdIdx.GetFloat(2); ok {
+		panic("Should be missing")
+	}
+	t.Log("\n\n")
+}
+
+func TestPostingCodec(t *testing.T) {
+	//构造倒排链, docId间隔不均匀, 跨越多个块
+	nodes := []basic.DocNode{}
+	others := []basic.DocNode{}
+	docId := uint32(0)
+	for i := 0; i < 1000; i++ {
+		docId += uint32(i % 7 + 1)
+		nodes = append(nodes, basic.DocNode{DocId: docId, Weight: uint32(i * 37 % 10001)})
+		if i % 3 == 0 {
+			others = append(others, basic.DocNode{DocId: docId, Weight: 1})
+		} else if i % 7 != 6 {
+			others = append(others, basic.DocNode{DocId: docId + 1, Weight: 1}) //下一个文档的间隔至少为2, 不会命中
+		}
+	}
+
+	//编解码一致
+	buf := encodePostings(nodes)
+	if uint64(len(buf)) != postingsLen(buf, uint64(len(nodes))) || len(buf) >= len(nodes) * basic.DOC_NODE_SIZE {
+		panic(fmt.Sprintf("Wrong postings len: %v", len(buf)))
+	}
+	decoded := newCompressedIterator(buf, uint64(len(nodes))).ReadAll()
+	if helper.JsonEncode(decoded) != helper.JsonEncode(nodes) {
+		panic("Decode wrong")
+	}
+
+	//跳跃
+	it := newCompressedIterator(buf, uint64(len(nodes)))
+	node, ok := it.Advance(nodes[500].DocId)
+	if !ok || node != nodes[500] {
+		panic(fmt.Sprintf("Advance wrong: %v", node))
+	}
+	node, ok = it.Advance(nodes[500].DocId + 1)
+	if !ok || node != nodes[501] {
+		panic(fmt.Sprintf("Advance wrong: %v", node))
+	}
+	if _, ok = it.Advance(docId + 1); ok {
+		panic("Should be over")
+	}
+
+	//压缩的和未压缩的链求交集
+	ret := IntersectPostings([]*PostingIterator{
+		newCompressedIterator(buf, uint64(len(nodes))),
+		NewPostingIterator(others),
+	}, nil)
+	expect := []basic.DocNode{}
+	for _, a := range nodes {
+		for _, b := range others {
+			if a.DocId == b.DocId {
+				expect = append(expect, basic.DocNode{DocId: a.DocId, Weight: a.Weight + b.Weight})
+			}
+		}
+	}
+	if len(ret) != 334 || helper.JsonEncode(ret) != helper.JsonEncode(expect) {
+		panic(fmt.Sprintf("Intersect wrong: %v, %v", len(ret), len(expect)))
+	}
+}
+
+func TestQueryTermLegacyFormat(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	//老格式的倒排文件: [nodeCnt|node list], 没有压缩标记
+	nodes := []basic.DocNode{{DocId: 1, Weight: 10}, {DocId: 5, Weight: 20}}
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.LittleEndian, uint64(len(nodes)))
+	binary.Write(buffer, binary.LittleEndian, nodes)
+	if err := ioutil.WriteFile("/tmp/spider/Partition0" + basic.IDX_FILENAME_SUFFIX_INVERT, buffer.Bytes(), 0644); err != nil {
+		panic(err)
+	}
+	tree := btree.NewBtree("xx", "/tmp/spider/spider" + basic.IDX_FILENAME_SUFFIX_BTREE)
+	defer tree.Close()
+	tree.AddTree(TEST_TREE)
+	tree.Set(TEST_TREE, "old", "0")
+
+	//新格式追加在后面
+	rIdx := NewEmptyInvertedIndex(IDX_TYPE_STR_WHOLE, 0, TEST_TREE)
+	rIdx.AddDocument(0, "new")
+	rIdx.AddDocument(1, "new")
+	if err := rIdx.Persist("/tmp/spider/Partition0", tree); err != nil {
+		panic(err)
+	}
+	rIdx.ivtMmap, err = mmap.NewMmap("/tmp/spider/Partition0" + basic.IDX_FILENAME_SUFFIX_INVERT, true, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	old, ok := rIdx.QueryTerm("old")
+	if !ok || helper.JsonEncode(old) != helper.JsonEncode(nodes) {
+		panic(fmt.Sprintf("Legacy wrong: %v", old))
+	}
+	cur, ok := rIdx.QueryTerm("new")
+	if !ok || len(cur) != 2 || cur[1].DocId != 1 {
+		panic(fmt.Sprintf("Compressed wrong: %v", cur))
+	}
+	ret, ok := rIdx.IntersectTerms([]string{"old", "new"}, nil)
+	if !ok || len(ret) != 1 || ret[0].DocId != 1 || ret[0].Weight != 10 {
+		panic(fmt.Sprintf("Intersect wrong: %v", ret))
+	}
+}
@@ -9,14 +9,18 @@ package index
  *
  * B+树（由bolt实现）: key是term, val则是term在倒排文件中的offset
  * 倒排文件: 由mmap实现，顺序的数据块, 每块数据长这个个样子
- * [nodeCnt(8Byte)|nodeStruct1|nodeStruct2|....][nodeCnt(8Byte)|nodeStruct1|nodeStruct3|....]....
+ * [nodeCnt(8Byte)|postings][nodeCnt(8Byte)|postings]....
+ * postings是压缩编码的倒排链, 格式详见posting.go, nodeCnt的最高位是压缩标记
+ * 老版本的倒排文件没有压缩标记, postings是未压缩的node list: [nodeStruct1|nodeStruct2|....]
  * nodeStuct:{docId: xx, weight: xx}
+ * 如果开启了位置信息(positional), 每块数据在postings之后, 紧跟着位置信息:
+ * [nodeCnt(8Byte)|postings|posLen(8Byte)|posList1|posList2|....]
+ * posList: [posCnt(4Byte)|pos1(4Byte)|pos2(4Byte)|....], 和node一一对应
  *
  * Note：
  * 同一个分区的各个字段的正、倒排公用同一套文件(btdb, ivt, fwd, ext)
  */
 import (
-	"bytes"
 	"errors"
 	"os"
 	"unsafe"
@@ -27,6 +31,8 @@ import (
 	"github.com/hq-cml/spider-engine/utils/btree"
 	"github.com/hq-cml/spider-engine/utils/log"
 	"fmt"
+	"sort"
+	"unicode/utf8"
 )
 
 //倒排索引
@@ -38,11 +44,15 @@ type InvertedIndex struct {
 	fieldName string                     //本索引所属字段
 	fake      bool                       //标记位, 用于占位，高层的分区缺少某个字段时候，用此占位
 	termMap   map[string][]basic.DocNode //索引的内存容器
+	positional bool                      //是否记录词项在文档中的位置, 用于短语查询
+	posMap    map[string][][]uint32      //位置信息的内存容器, 和termMap中的node一一对应
+	memBytes  uint64                     //内存容器占用的内存(估算值)
 	ivtMmap   *mmap.Mmap                 //倒排文件(以mmap的形式)
 	btdb      btree.Btree                //B+树
 }
 
 const DOCNODE_BYTE_CNT = 8
+const TERM_MEM_OVERHEAD = 64      //termMap中每个词项的额外开销(map的条目、string和slice的头部), 用于估算内存
 
 //新建空的倒排索引
 func NewEmptyInvertedIndex(indexType uint16, nextDocId uint32, fieldName string) *InvertedIndex {
@@ -52,6 +62,7 @@ func NewEmptyInvertedIndex(indexType uint16, nextDocId uint32, fieldName string)
 		indexType: indexType,
 		fake:      false,
 		termMap:   make(map[string][]basic.DocNode),
+		posMap:    make(map[string][][]uint32),
 		inMemory:  true,                            	//新索引都是从内存态开始
 		ivtMmap:   nil,
 		btdb:      nil,
@@ -93,8 +104,17 @@ func LoadInvertedIndex(btdb btree.Btree, indexType uint16, fieldname string, ivt
 //Note:
 // 为了保证和正排以及其他字段的一致性，所以无论成功与否，nextDocId都会自增！！
 func (rIdx *InvertedIndex) AddDocument(docId uint32, content string) error {
+	_, err := rIdx.AddDocumentWithLen(docId, content)
+	return err
+}
+
+//增加一个doc文档, 同时返回文档的长度(切分出的词项个数), 用于相关性打分时的长度归一
+//Note:
+// 全词匹配模式长度为1, 分号切割模式为切分后的词项数, 单个词模式为字符数
+func (rIdx *InvertedIndex) AddDocumentWithLen(docId uint32, content string) (uint32, error) {
 	var nodes map[string]basic.DocNode
 	var err error
+	var docLen uint32
 	//校验必须是内存态和DocId
 	if !rIdx.inMemory || docId != rIdx.nextDocId {
 		err = errors.New(fmt.Sprintf("Inverted-->AddDocument. Wrong DocId or MemStatus. DocId:%v, NextId:%v, Mem:%v",
@@ -108,18 +128,37 @@ func (rIdx *InvertedIndex) AddDocument(docId uint32, content string) error {
 		goto SUCC
 	}
 
+	//需要记录位置的, 单独处理
+	if rIdx.positional && (rIdx.indexType == IDX_TYPE_STR_SPLITER || rIdx.indexType == IDX_TYPE_GOD) {
+		var posMap map[string][]uint32
+		nodes, posMap = SplitTrueWordsWithPos(docId, content)
+		for term, node := range nodes {
+			if _, exist := rIdx.termMap[term]; !exist {
+				rIdx.memBytes += uint64(len(term)) + TERM_MEM_OVERHEAD * 2
+			}
+			rIdx.termMap[term] = append(rIdx.termMap[term], node)
+			rIdx.posMap[term] = append(rIdx.posMap[term], posMap[term])
+			docLen += uint32(len(posMap[term]))
+			rIdx.memBytes += DOCNODE_BYTE_CNT + 24 + uint64(len(posMap[term])) * 4
+		}
+		goto SUCC
+	}
+
 	//根据type进行分词
 	switch rIdx.indexType {
 	case IDX_TYPE_STR_WHOLE: 			            //全词匹配模式
 		nodes = SplitWholeWords(docId, content)
+		docLen = 1
 	case IDX_TYPE_STR_LIST: 					    //分号切割模式
 		nodes = SplitSemicolonWords(docId, content)
+		docLen = uint32(len(nodes))
 	case IDX_TYPE_STR_WORD: 				        //单个词模式
 		nodes = SplitRuneWords(docId, content)
-	case IDX_TYPE_STR_SPLITER:   			        //分词模式
-		nodes = SplitTrueWords(docId, content)
-	case IDX_TYPE_GOD:     						    //上帝模式--按分词处理
-		nodes = SplitTrueWords(docId, content)
+		docLen = uint32(utf8.RuneCountInString(content))
+	case IDX_TYPE_STR_SPLITER, IDX_TYPE_GOD:        //分词模式, 上帝模式--按分词处理
+		terms := trimPunctuation(Splitter.DoSplit(content, false))
+		nodes = countTermFreq(docId, terms)
+		docLen = uint32(len(terms))
 	default:
 		err = errors.New(fmt.Sprintf("Inverted-->AddDocument: Type %v can't add invertIndex", rIdx.indexType))
 		//return errors.New("Unsupport indexType")
@@ -130,21 +169,23 @@ func (rIdx *InvertedIndex) AddDocument(docId uint32, content string) error {
 	for term, node := range nodes {
 		if _, exist := rIdx.termMap[term]; !exist {
 			rIdx.termMap[term] = []basic.DocNode{}
+			rIdx.memBytes += uint64(len(term)) + TERM_MEM_OVERHEAD
 		}
 		rIdx.termMap[term] = append(rIdx.termMap[term], node)
+		rIdx.memBytes += DOCNODE_BYTE_CNT
 	}
 
 SUCC:
 	rIdx.nextDocId++ //docId自增
 	log.Debugf("InvertAddDoc--> DocId: %v, Field: %v, Content: %v, NodesNum: %v",
 		docId, rIdx.fieldName, content, len(nodes))
-	return nil
+	return docLen, nil
 
 FAIL:
 	rIdx.nextDocId++ //docId自增
 	log.Warnf("InvertAddDoc Failed!. DocId: %v, Field: %v, Content: %v, Error: %v",
 		docId, rIdx.fieldName, content, err.Error())
-	return err
+	return 0, err
 }
 
 //给定一个查询词query，找出doc的list
@@ -160,23 +201,81 @@ func (rIdx *InvertedIndex) QueryTerm(term string) ([]basic.DocNode, bool) {
 			copy(retNodes, docNodes)
 			return retNodes, true
 		}
+	} else if (rIdx.ivtMmap != nil && rIdx.btdb != nil) {
+		it, ok := rIdx.QueryTermIterator(term)
+		if !ok {
+			return nil, false
+		}
+		//迭代器不拷贝底层数据, 全部解码出来的是新的slice
+		return it.ReadAll(), true
+	}
+
+	return nil, false
+}
+
+//给定一个查询词, 返回倒排链的迭代器, 磁盘态的压缩倒排链按需解码
+func (rIdx *InvertedIndex) QueryTermIterator(term string) (*PostingIterator, bool) {
+	if rIdx.inMemory {
+		docNodes, ok := rIdx.termMap[term]
+		if ok {
+			return NewPostingIterator(docNodes), true
+		}
 	} else if (rIdx.ivtMmap != nil && rIdx.btdb != nil) {
 		offset, ok := rIdx.btdb.GetInt(rIdx.fieldName, term)
 		if !ok {
 			return nil, false
 		}
 
-		count := rIdx.ivtMmap.ReadUInt64(uint64(offset))
-		docNodes := readDocNodes(uint64(offset) + DOCNODE_BYTE_CNT, count, rIdx.ivtMmap)
-		//fmt.Println("Ivt Disk QueryTerm:", term, count, helper.JsonEncode(docNodes))
-		retNodes := make([]basic.DocNode, len(docNodes))
-		copy(retNodes, docNodes)
-		return retNodes, true
+		count, compressed := rIdx.readNodeCnt(uint64(offset))
+		start := uint64(offset) + DOCNODE_BYTE_CNT
+		if !compressed {
+			return NewPostingIterator(readDocNodes(start, count, rIdx.ivtMmap)), true
+		}
+		buf := rIdx.ivtMmap.DataBytes[start:]
+		return newCompressedIterator(buf, count), true
 	}
 
 	return nil, false
 }
 
+//多个查询词的倒排链求交集, 借助迭代器跳跃, 不需要把每个倒排链全部解码出来
+//weight用于计算文档在各个词项中的权重, nil表示直接使用倒排中的权重
+func (rIdx *InvertedIndex) IntersectTerms(terms []string, weight func(term string, node basic.DocNode) uint32) ([]basic.DocNode, bool) {
+	if len(terms) == 0 {
+		return nil, false
+	}
+	its := make([]*PostingIterator, len(terms))
+	for i, term := range terms {
+		it, ok := rIdx.QueryTermIterator(term)
+		if !ok {
+			return nil, false
+		}
+		its[i] = it
+	}
+	var fn func(i int, node basic.DocNode) uint32
+	if weight != nil {
+		fn = func(i int, node basic.DocNode) uint32 { return weight(terms[i], node) }
+	}
+	ret := IntersectPostings(its, fn)
+	return ret, len(ret) > 0
+}
+
+//读取数据块头部的文档数, 以及是否压缩
+func (rIdx *InvertedIndex) readNodeCnt(offset uint64) (uint64, bool) {
+	nodeCnt := rIdx.ivtMmap.ReadUInt64(offset)
+	return nodeCnt &^ POSTING_COMPRESSED_FLAG, nodeCnt & POSTING_COMPRESSED_FLAG != 0
+}
+
+//数据块中位置信息的起始偏移
+func (rIdx *InvertedIndex) positionsStart(offset uint64) uint64 {
+	count, compressed := rIdx.readNodeCnt(offset)
+	start := offset + DOCNODE_BYTE_CNT
+	if !compressed {
+		return start + count * uint64(basic.DOC_NODE_SIZE)
+	}
+	return start + postingsLen(rIdx.ivtMmap.DataBytes[start:], count)
+}
+
 //从mmap中读取出
 func readDocNodes(start, count uint64, mmp *mmap.Mmap) []basic.DocNode {
 	nodeList := *(*[]basic.DocNode)(unsafe.Pointer(&reflect.SliceHeader {
@@ -187,6 +286,119 @@ func readDocNodes(start, count uint64, mmp *mmap.Mmap) []basic.DocNode {
 	return nodeList
 }
 
+//给定一个查询词, 找出doc的list, 以及每个doc中该词出现的位置
+//如果索引没有开启位置信息, 则位置信息返回nil
+func (rIdx *InvertedIndex) QueryTermPositions(term string) ([]basic.DocNode, [][]uint32, bool) {
+	if !rIdx.positional {
+		nodes, ok := rIdx.QueryTerm(term)
+		return nodes, nil, ok
+	}
+
+	if rIdx.inMemory {
+		docNodes, ok := rIdx.termMap[term]
+		if ok {
+			retNodes := make([]basic.DocNode, len(docNodes))
+			copy(retNodes, docNodes)
+			retPos := make([][]uint32, len(docNodes))
+			copy(retPos, rIdx.posMap[term])
+			return retNodes, retPos, true
+		}
+	} else if (rIdx.ivtMmap != nil && rIdx.btdb != nil) {
+		offset, ok := rIdx.btdb.GetInt(rIdx.fieldName, term)
+		if !ok {
+			return nil, nil, false
+		}
+
+		it, _ := rIdx.QueryTermIterator(term)
+		retNodes := it.ReadAll()
+
+		posStart := rIdx.positionsStart(uint64(offset))
+		posLen := rIdx.ivtMmap.ReadUInt64(posStart)
+		retPos := decodePositions(rIdx.ivtMmap.ReadBytes(posStart + DOCNODE_BYTE_CNT, posLen), len(retNodes))
+		return retNodes, retPos, true
+	}
+
+	return nil, nil, false
+}
+
+//位置信息编码, 依次为每个node写入[posCnt(4Byte)|pos1(4Byte)|pos2(4Byte)|....]
+func encodePositions(posList [][]uint32) []byte {
+	size := 0
+	for _, positions := range posList {
+		size += 4 * (len(positions) + 1)
+	}
+	buf := make([]byte, size)
+	idx := 0
+	for _, positions := range posList {
+		binary.LittleEndian.PutUint32(buf[idx:], uint32(len(positions)))
+		idx += 4
+		for _, pos := range positions {
+			binary.LittleEndian.PutUint32(buf[idx:], pos)
+			idx += 4
+		}
+	}
+	return buf
+}
+
+//位置信息解码
+func decodePositions(buf []byte, count int) [][]uint32 {
+	posList := make([][]uint32, count)
+	idx := 0
+	for i := 0; i < count && idx + 4 <= len(buf); i++ {
+		posCnt := int(binary.LittleEndian.Uint32(buf[idx:]))
+		idx += 4
+		positions := make([]uint32, posCnt)
+		for j := 0; j < posCnt; j++ {
+			positions[j] = binary.LittleEndian.Uint32(buf[idx:])
+			idx += 4
+		}
+		posList[i] = positions
+	}
+	return posList
+}
+
+//写入一块倒排数据: [nodeCnt(8Byte)|postings], 开启位置信息的再追加[posLen(8Byte)|posList...]
+//倒排链总是压缩编码, nodeCnt带上压缩标记
+//返回写入的总字节数
+func (rIdx *InvertedIndex) writeBlock(fd *os.File, docNodeList []basic.DocNode, posList [][]uint32) (int, error) {
+	//先写入长度, 占8个字节
+	nodeCnt := len(docNodeList)
+	lenBuffer := make([]byte, DOCNODE_BYTE_CNT)
+	binary.LittleEndian.PutUint64(lenBuffer, uint64(nodeCnt) | POSTING_COMPRESSED_FLAG)
+	n, err := fd.Write(lenBuffer)
+	if err != nil || n != DOCNODE_BYTE_CNT {
+		log.Errf(fmt.Sprintf("Write err:%v, len:%v, len:%v", err, n, DOCNODE_BYTE_CNT))
+		return 0, errors.New("Write Error")
+	}
+
+	//再写入压缩后的倒排链
+	buffer := encodePostings(docNodeList)
+	writeLength, err := fd.Write(buffer)
+	if err != nil || writeLength != len(buffer) {
+		log.Errf("Write err, %v, %v, %v",err, writeLength, len(buffer))
+		return 0, errors.New("Write Error")
+	}
+	total := DOCNODE_BYTE_CNT + writeLength
+	if !rIdx.positional {
+		return total, nil
+	}
+
+	//最后写入位置信息
+	posBuffer := encodePositions(posList)
+	binary.LittleEndian.PutUint64(lenBuffer, uint64(len(posBuffer)))
+	n, err = fd.Write(lenBuffer)
+	if err != nil || n != DOCNODE_BYTE_CNT {
+		log.Errf(fmt.Sprintf("Write err:%v, len:%v, len:%v", err, n, DOCNODE_BYTE_CNT))
+		return 0, errors.New("Write Error")
+	}
+	n, err = fd.Write(posBuffer)
+	if err != nil || n != len(posBuffer) {
+		log.Errf("Write err, %v, %v, %v",err, n, len(posBuffer))
+		return 0, errors.New("Write Error")
+	}
+	return total + DOCNODE_BYTE_CNT + n, nil
+}
+
 //索引销毁
 // Note: 只销毁内存部分，mmap和btdb因为是公用，需要在高层统一销毁
 func (rIdx *InvertedIndex) DoClose() {
@@ -207,6 +419,16 @@ func (rIdx *InvertedIndex) SetBtree(tree btree.Btree) {
 	rIdx.btdb = tree
 }
 
+//设置是否记录位置信息
+//Note: 只能在索引为空的时候设置, 否则新老数据的格式不一致
+func (rIdx *InvertedIndex) SetPositional(positional bool) {
+	rIdx.positional = positional
+}
+
+func (rIdx *InvertedIndex) IsPositional() bool {
+	return rIdx.positional
+}
+
 //设置btree
 func (rIdx *InvertedIndex) SetInMemory(in bool) {
 	rIdx.inMemory = in
@@ -237,6 +459,14 @@ func (rIdx *InvertedIndex) GetNextKV(key string) (string, uint32, bool) {
 }
 
 //btree操作
+//内存容器占用的内存(估算值), 磁盘态的索引为0
+func (rIdx *InvertedIndex) MemBytes() uint64 {
+	if !rIdx.inMemory {
+		return 0
+	}
+	return rIdx.memBytes
+}
+
 func (rIdx *InvertedIndex) GetNextId() uint32 {
 	return rIdx.nextDocId
 }
@@ -274,7 +504,7 @@ func (rIdx *InvertedIndex) Walk() error {
 //持久化倒排索引
 //落地 termMap落地到倒排文件; term进入B+tree
 //倒排文件格式:
-//  顺序的数据块, 每块数据长这个个样子 [{nodeCnt(8Byte)|node1|node2|....}, {}, {}]
+//  顺序的数据块, 每块数据长这个个样子 [{nodeCnt(8Byte)|postings}, {}, {}], postings是压缩编码的倒排链
 //B+树:
 //  key是term, val则是term在倒排文件中的offset
 //
@@ -302,28 +532,11 @@ func (rIdx *InvertedIndex) Persist(partitionPathName string, btdb btree.Btree) e
 	}
 	for term, docNodeList := range rIdx.termMap {
 		//fmt.Println(rIdx.fieldName, "落盘：", term, helper.JsonEncode(docNodeList))
-		//先写入长度, 占8个字节
-		nodeCnt := len(docNodeList)
-		lenBuffer := make([]byte, DOCNODE_BYTE_CNT)
-		binary.LittleEndian.PutUint64(lenBuffer, uint64(nodeCnt))
-		n, err := idxFd.Write(lenBuffer)
-		if err != nil || n != DOCNODE_BYTE_CNT {
-			log.Errf(fmt.Sprintf("Write err:%v, len:%v, len:%v", err, n, DOCNODE_BYTE_CNT))
-			return errors.New("Write Error")
-		}
-
-		//再写入node list
-		buffer := new(bytes.Buffer)
-		err = binary.Write(buffer, binary.LittleEndian, docNodeList)
+		//写入[长度|node list|位置信息]
+		writeLength, err := rIdx.writeBlock(idxFd, docNodeList, rIdx.posMap[term])
 		if err != nil {
-			log.Errf("Persist :: Error %v", err)
 			return err
 		}
-		writeLength, err := idxFd.Write(buffer.Bytes())
-		if err != nil || writeLength != nodeCnt * basic.DOC_NODE_SIZE{
-			log.Errf("Write err, %v, %v, %v",err, writeLength, nodeCnt * basic.DOC_NODE_SIZE)
-			return errors.New("Write Error")
-		}
 
 		//B+树录入
 		err = btdb.Set(rIdx.fieldName, term, fmt.Sprintf("%v", offset))
@@ -332,12 +545,13 @@ func (rIdx *InvertedIndex) Persist(partitionPathName string, btdb btree.Btree) e
 			//造成不一致了哦，或者说写脏了一块数据，但是以后也不会被引用到，因为btree里面没落盘
 			return err
 		}
-		offset = offset + DOCNODE_BYTE_CNT + writeLength
+		offset = offset + writeLength
 	}
 
 	//绑定btdb，内存态 => 磁盘态
 	rIdx.btdb = btdb
 	rIdx.termMap = nil
+	rIdx.posMap = nil
 	rIdx.inMemory = false
 	//rIdx.nextDocId = 0
 
@@ -351,6 +565,7 @@ type tmpMerge struct {
 	rIndex *InvertedIndex
 	term   string
 	nodes []basic.DocNode
+	positions [][]uint32
 }
 
 //多路归并, 将多个反向索引进行合并成为一个大的反向索引， 将这一切作用在接收者上面
@@ -359,7 +574,9 @@ type tmpMerge struct {
 // 所以mmap并不会加载回来，但是btdb和inMemory参数被加载回来了
 //
 // 倒排索引只能合并磁盘态的，因为这里面涉及到term的顺序，要依赖B+树，所以内存态的索引不支持
-func (rIdx *InvertedIndex)MergePersistIvtIndex(rIndexes []*InvertedIndex, partitionPathName string, btdb btree.Btree) error {
+//
+// docIds是需要保留的文档(升序), 用于剔除已删除的文档, 剔除后没有文档的term不再写入; nil表示全部保留
+func (rIdx *InvertedIndex)MergePersistIvtIndex(rIndexes []*InvertedIndex, docIds []uint32, partitionPathName string, btdb btree.Btree) error {
 	//一些校验
 	if rIndexes == nil || len(rIndexes) == 0 {
 		return errors.New("Nil []*InvertedIndex")
@@ -402,12 +619,13 @@ func (rIdx *InvertedIndex)MergePersistIvtIndex(rIndexes []*InvertedIndex, partit
 		if !ok {
 			continue
 		}
-		nodes, _ := ivt.QueryTerm(term)
+		nodes, positions, _ := ivt.QueryTermPositions(term)
 		tmpIvts = append(tmpIvts, tmpMerge{
 			over: false,
 			rIndex: ivt,
 			term:  term,
 			nodes: nodes,
+			positions: positions,
 		})
 	}
 	//补齐树
@@ -439,8 +657,17 @@ func (rIdx *InvertedIndex)MergePersistIvtIndex(rIndexes []*InvertedIndex, partit
 		}
 
 		value := make([]basic.DocNode, 0) //合并这这些个首term, 他们各自的后继者需要顶上来
+		posValue := make([][]uint32, 0)
 		for _, i := range minIds {
 			value = append(value, tmpIvts[i].nodes...)
+			if rIdx.positional {
+				//老的索引可能没有位置信息, 用空位置占位, 短语查询时这些文档退化为各个词项同时出现(见QueryPhrase)
+				if tmpIvts[i].positions == nil {
+					posValue = append(posValue, make([][]uint32, len(tmpIvts[i].nodes))...)
+				} else {
+					posValue = append(posValue, tmpIvts[i].positions...)
+				}
+			}
 
 			//找到后继者，顶上去
 			nextTerm, _, ok := tmpIvts[i].rIndex.GetNextKV(tmpIvts[i].term)
@@ -450,39 +677,32 @@ func (rIdx *InvertedIndex)MergePersistIvtIndex(rIndexes []*InvertedIndex, partit
 				continue
 			}
 			tmpIvts[i].term = nextTerm
-			tmpIvts[i].nodes, ok = tmpIvts[i].rIndex.QueryTerm(nextTerm)
+			tmpIvts[i].nodes, tmpIvts[i].positions, ok = tmpIvts[i].rIndex.QueryTermPositions(nextTerm)
 			if !ok {
 				panic("Index wrong!")
 			}
 		}
 
-		//写倒排文件 & 写B+树
-		nodeCnt := len(value)
-		lenBuffer := make([]byte, DOCNODE_BYTE_CNT)
-		binary.LittleEndian.PutUint64(lenBuffer, uint64(nodeCnt))
-		n, err := fd.Write(lenBuffer)
-		if err != nil || n != DOCNODE_BYTE_CNT {
-			log.Errf(fmt.Sprintf("Write err:%v, len:%v, len:%v", err, n, DOCNODE_BYTE_CNT))
-			return errors.New("Write Error")
-		}
-		buffer := new(bytes.Buffer)
-		err = binary.Write(buffer, binary.LittleEndian, value)
-		if err != nil {
-			log.Err("Invert--> Merge :: Error %v", err)
-			return err
-		}
-		writeLength, err := fd.Write(buffer.Bytes())
-		if err != nil || writeLength != nodeCnt * basic.DOC_NODE_SIZE{
-			log.Errf("Write err, %v, %v, %v",err, writeLength, nodeCnt * basic.DOC_NODE_SIZE)
-			return errors.New("Write Error")
+		//剔除已删除的文档
+		if docIds != nil {
+			value, posValue = keepDocNodes(value, posValue, docIds)
 		}
 
-		err = btdb.Set(fieldName, minTerm, fmt.Sprintf("%v", offset))
-		if err != nil {
-			log.Errf("Invert--> Merge :: Error:%v, fieldName: %v, term: %v, len(term): %v", err, fieldName, minTerm, len(minTerm))
-			return err
+		//写倒排文件 & 写B+树
+		if len(value) > 0 {
+			writeLength, err := rIdx.writeBlock(fd, value, posValue)
+			if err != nil {
+				log.Errf("Invert--> Merge :: Error %v", err)
+				return err
+			}
+
+			err = btdb.Set(fieldName, minTerm, fmt.Sprintf("%v", offset))
+			if err != nil {
+				log.Errf("Invert--> Merge :: Error:%v, fieldName: %v, term: %v, len(term): %v", err, fieldName, minTerm, len(minTerm))
+				return err
+			}
+			offset = offset + writeLength
 		}
-		offset = offset + DOCNODE_BYTE_CNT + writeLength
 
 		//如果所有的索引都合并完毕， 则退出
 		quit := true
@@ -500,8 +720,139 @@ func (rIdx *InvertedIndex)MergePersistIvtIndex(rIndexes []*InvertedIndex, partit
 	//绑定btdb，内存态 => 磁盘态
 	rIdx.btdb = btdb
 	rIdx.termMap = nil
+	rIdx.posMap = nil
 	rIdx.inMemory = false
 	rIdx.nextDocId = rIndexes[len(rIndexes)-1].nextDocId
 
 	return nil
-}
\ No newline at end of file
+}
+//只保留docIds中的文档, 位置信息同步剔除
+func keepDocNodes(nodes []basic.DocNode, posList [][]uint32, docIds []uint32) ([]basic.DocNode, [][]uint32) {
+	keepNodes := make([]basic.DocNode, 0, len(nodes))
+	var keepPos [][]uint32
+	if len(posList) > 0 {
+		keepPos = make([][]uint32, 0, len(nodes))
+	}
+	for i, node := range nodes {
+		j := sort.Search(len(docIds), func(j int) bool { return docIds[j] >= node.DocId })
+		if j == len(docIds) || docIds[j] != node.DocId {
+			continue
+		}
+		keepNodes = append(keepNodes, node)
+		if len(posList) > 0 {
+			keepPos = append(keepPos, posList[i])
+		}
+	}
+	return keepNodes, keepPos
+}
+
+//短语查询, terms和positions是短语分词后的词项及其位置(见SplitPhrase)
+//slop为0时要求词项按照短语中的相对位置紧密相连
+//slop大于0时, 要求词项按顺序出现, 并且总跨度比短语本身多出的距离不超过slop
+//Note:
+// 没有开启位置信息的索引, 退化为各个词项同时出现即可
+// 开启了位置信息的索引中, 从没有位置信息的老分区合并过来的文档, 其位置列表为空, 同样退化为词项同时出现
+func (rIdx *InvertedIndex) QueryPhrase(terms []string, positions []uint32, slop int) ([]basic.DocNode, bool) {
+	if len(terms) == 0 || len(terms) != len(positions) {
+		return nil, false
+	}
+
+	//取出各个词项的倒排链
+	nodeLists := make([][]basic.DocNode, len(terms))
+	posLists := make([][][]uint32, len(terms))
+	for i, term := range terms {
+		nodes, posList, ok := rIdx.QueryTermPositions(term)
+		if !ok {
+			return nil, false
+		}
+		nodeLists[i] = nodes
+		posLists[i] = posList
+	}
+
+	//以第一个词项的倒排链为基准, 逐个文档检查其他词项
+	retNodes := []basic.DocNode{}
+	cursors := make([]int, len(terms))
+	docPos := make([][]uint32, len(terms))
+	for i, node := range nodeLists[0] {
+		weight := node.Weight
+		if posLists[0] != nil {
+			docPos[0] = posLists[0][i]
+		}
+		allMatch := true
+		for k := 1; k < len(terms); k++ {
+			for cursors[k] < len(nodeLists[k]) && nodeLists[k][cursors[k]].DocId < node.DocId {
+				cursors[k]++
+			}
+			if cursors[k] >= len(nodeLists[k]) || nodeLists[k][cursors[k]].DocId != node.DocId {
+				allMatch = false
+				break
+			}
+			weight += nodeLists[k][cursors[k]].Weight
+			if posLists[k] != nil {
+				docPos[k] = posLists[k][cursors[k]]
+			}
+		}
+		if !allMatch {
+			continue
+		}
+		if rIdx.positional && hasPositions(docPos) && !matchPhrase(docPos, positions, slop) {
+			continue
+		}
+		retNodes = append(retNodes, basic.DocNode{DocId: node.DocId, Weight: weight})
+	}
+	return retNodes, len(retNodes) > 0
+}
+
+//文档是否记录了位置信息
+//分词字段中出现的词项至少有一个位置, 所以空的位置列表只能是老分区合并过来的没有位置信息的文档
+func hasPositions(docPos [][]uint32) bool {
+	for _, pos := range docPos {
+		if len(pos) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//检查一篇文档中各个词项的位置是否满足短语要求
+func matchPhrase(docPos [][]uint32, positions []uint32, slop int) bool {
+	last := len(positions) - 1
+	for _, start := range docPos[0] {
+		if slop == 0 {
+			//精确匹配: 每个词项都必须出现在相对位置上
+			match := true
+			for k := 1; k <= last; k++ {
+				if !containsPos(docPos[k], start + positions[k] - positions[0]) {
+					match = false
+					break
+				}
+			}
+			if match {
+				return true
+			}
+			continue
+		}
+
+		//近似匹配: 按顺序贪心地取最近的位置, 使得跨度最小
+		prev := start
+		match := true
+		for k := 1; k <= last; k++ {
+			idx := sort.Search(len(docPos[k]), func(j int) bool { return docPos[k][j] > prev })
+			if idx >= len(docPos[k]) {
+				match = false
+				break
+			}
+			prev = docPos[k][idx]
+		}
+		if match && int(prev - start) - int(positions[last] - positions[0]) <= slop {
+			return true
+		}
+	}
+	return false
+}
+
+//有序的位置列表中是否包含pos
+func containsPos(list []uint32, pos uint32) bool {
+	idx := sort.Search(len(list), func(j int) bool { return list[j] >= pos })
+	return idx < len(list) && list[idx] == pos
+}
@@ -0,0 +1,124 @@
+package index
+
+/*
+ * 数字索引类, 用于数字(包括时间)类型字段的范围查询
+ * 本质上是按值排序之后的(值, 位置)数组, 范围查询时二分查找出上下界, 上下界之间的位置就是命中的文档
+ *
+ * 数字索引只存在于磁盘态, 落地时由正排的值排序后生成, 追加写在分区的正排文件中, 格式如：
+ *     [cnt][value|pos][value|pos][value|pos]...
+ * cnt是有值的文档数, 没有值的文档(MaxInt64)不进入索引
+ *
+ * Note：
+ * 内存态的分区没有数字索引, 范围查询仍然逐个文档过滤(内存分区文档数有限, 并且直接读内存)
+ **/
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/hq-cml/spider-engine/basic"
+	"github.com/hq-cml/spider-engine/utils/log"
+	"github.com/hq-cml/spider-engine/utils/mmap"
+	"os"
+	"sort"
+)
+
+const NUM_ENTRY_BYTE_CNT = DATA_BYTE_CNT * 2
+
+type NumericIndex struct {
+	offset   uint64     //本索引在正排文件中的起始偏移
+	baseMmap *mmap.Mmap //分区的正排mmap
+}
+
+//加载数字索引, mmap从外部传入, 和正排索引共用
+func LoadNumericIndex(baseMmap *mmap.Mmap, offset uint64) *NumericIndex {
+	return &NumericIndex{
+		offset:   offset,
+		baseMmap: baseMmap,
+	}
+}
+
+//根据正排的值生成数字索引, 追加写入正排文件, 返回索引的偏移量
+//values的下标即文档在分区中的位置
+func PersistNumericIndex(values []int64, partitionPathName string) (*NumericIndex, error) {
+	//没有值的文档不进入索引, 和正排的过滤逻辑保持一致
+	poses := make([]uint32, 0, len(values))
+	for pos, value := range values {
+		if MaxInt64 & value != MaxInt64 {
+			poses = append(poses, uint32(pos))
+		}
+	}
+	sort.SliceStable(poses, func(i, j int) bool {
+		return values[poses[i]] < values[poses[j]]
+	})
+
+	//打开正排文件
+	fwdFileName := partitionPathName + basic.IDX_FILENAME_SUFFIX_FWD
+	fwdFd, err := os.OpenFile(fwdFileName, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer fwdFd.Close()
+	fi, err := fwdFd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := fi.Size()
+
+	buffer := make([]byte, DATA_BYTE_CNT + len(poses) * NUM_ENTRY_BYTE_CNT)
+	binary.LittleEndian.PutUint64(buffer, uint64(len(poses)))
+	for i, pos := range poses {
+		start := DATA_BYTE_CNT + i * NUM_ENTRY_BYTE_CNT
+		binary.LittleEndian.PutUint64(buffer[start:], uint64(values[pos]))
+		binary.LittleEndian.PutUint64(buffer[start + DATA_BYTE_CNT:], uint64(pos))
+	}
+	n, err := fwdFd.Write(buffer)
+	if err != nil || n != len(buffer) {
+		log.Errf(fmt.Sprintf("Write err:%v, len:%v, len:%v", err, n, len(buffer)))
+		return nil, errors.New("Write Error")
+	}
+
+	return &NumericIndex{offset: uint64(offset)}, nil
+}
+
+func (numIdx *NumericIndex) SetBaseMmap(mmap *mmap.Mmap) {
+	numIdx.baseMmap = mmap
+}
+
+func (numIdx *NumericIndex) GetOffset() uint64 {
+	return numIdx.offset
+}
+
+//有值的文档数
+func (numIdx *NumericIndex) count() int {
+	if numIdx.baseMmap == nil || int(numIdx.offset + DATA_BYTE_CNT) > numIdx.baseMmap.Boundary() {
+		return 0
+	}
+	return int(numIdx.baseMmap.ReadUInt64(numIdx.offset))
+}
+
+//第i个值
+func (numIdx *NumericIndex) value(i int) int64 {
+	return numIdx.baseMmap.ReadInt64(numIdx.offset + DATA_BYTE_CNT + uint64(i) * NUM_ENTRY_BYTE_CNT)
+}
+
+//取值在[begin, end]之间的文档在索引中的下标范围[lo, hi)
+func (numIdx *NumericIndex) Range(begin, end int64) (int, int) {
+	cnt := numIdx.count()
+	if begin > end {
+		return 0, 0
+	}
+	lo := sort.Search(cnt, func(i int) bool { return numIdx.value(i) >= begin })
+	hi := sort.Search(cnt, func(i int) bool { return numIdx.value(i) > end })
+	return lo, hi
+}
+
+//下标范围[lo, hi)内的文档位置, 按位置升序排列
+func (numIdx *NumericIndex) Positions(lo, hi int) []uint32 {
+	poses := make([]uint32, 0, hi - lo)
+	for i := lo; i < hi; i++ {
+		poses = append(poses, uint32(numIdx.baseMmap.ReadUInt64(numIdx.offset + DATA_BYTE_CNT +
+			uint64(i) * NUM_ENTRY_BYTE_CNT + DATA_BYTE_CNT)))
+	}
+	sort.Slice(poses, func(i, j int) bool { return poses[i] < poses[j] })
+	return poses
+}
@@ -0,0 +1,290 @@
+package index
+
+/*
+ * 倒排链的压缩编码
+ * 倒排链按docId升序, 每POSTING_BLOCK_SIZE个文档一块, 分块压缩:
+ *   docId: 和前一个文档的差值, varint编码
+ *   weight: 按块内最大值的位宽做位压缩(全词、分号、单字模式的权重都是0, 位宽为0, 不占空间)
+ * 压缩后的倒排链格式如：
+ *   [dataLen(8Byte)|skip1|skip2|....|block1|block2|....]
+ *   skip: [块内最大docId(4Byte)|块在数据区的偏移(4Byte)], 和block一一对应, 用于跳过整块
+ *   block: [docId差值(varint)....|位宽(1Byte)|weight位压缩....]
+ *   每块第一个docId的差值相对于前一块的最大docId(即前一个skip), 所以每块都可以独立解码
+ *
+ * 倒排文件中每个词项的数据块头部(nodeCnt)的最高位标记了倒排链是否压缩, 没有标记的是老格式(未压缩的DocNode数组)
+ * 查询时通过迭代器遍历倒排链, 压缩格式只解码遍历到的块, 求交集时借助跳表跳过不可能命中的块
+ */
+import (
+	"encoding/binary"
+	"math/bits"
+	"sort"
+	"github.com/hq-cml/spider-engine/basic"
+)
+
+const (
+	POSTING_BLOCK_SIZE      = 128                //每块的文档数
+	POSTING_SKIP_BYTE_CNT   = 8                  //跳表每一项的字节数
+	POSTING_COMPRESSED_FLAG = uint64(1) << 63    //nodeCnt的最高位, 标记倒排链是压缩格式
+)
+
+//压缩编码倒排链, 返回[dataLen|skip list|block list]
+func encodePostings(nodes []basic.DocNode) []byte {
+	blockCnt := (len(nodes) + POSTING_BLOCK_SIZE - 1) / POSTING_BLOCK_SIZE
+	skip := make([]byte, blockCnt * POSTING_SKIP_BYTE_CNT)
+	data := make([]byte, 0, len(nodes) * 2)
+	varBuf := make([]byte, binary.MaxVarintLen32)
+	prev := uint32(0)
+	for b := 0; b < blockCnt; b++ {
+		start := b * POSTING_BLOCK_SIZE
+		end := start + POSTING_BLOCK_SIZE
+		if end > len(nodes) {
+			end = len(nodes)
+		}
+		block := nodes[start:end]
+		binary.LittleEndian.PutUint32(skip[b * POSTING_SKIP_BYTE_CNT:], block[len(block)-1].DocId)
+		binary.LittleEndian.PutUint32(skip[b * POSTING_SKIP_BYTE_CNT + 4:], uint32(len(data)))
+
+		//docId差值
+		for _, node := range block {
+			n := binary.PutUvarint(varBuf, uint64(node.DocId - prev))
+			data = append(data, varBuf[:n]...)
+			prev = node.DocId
+		}
+		//weight位压缩
+		data = packWeights(data, block)
+	}
+
+	buf := make([]byte, DOCNODE_BYTE_CNT, DOCNODE_BYTE_CNT + len(skip) + len(data))
+	binary.LittleEndian.PutUint64(buf, uint64(len(data)))
+	buf = append(buf, skip...)
+	return append(buf, data...)
+}
+
+//压缩后的倒排链的总长度, buf以dataLen开头
+func postingsLen(buf []byte, count uint64) uint64 {
+	blockCnt := (count + POSTING_BLOCK_SIZE - 1) / POSTING_BLOCK_SIZE
+	return DOCNODE_BYTE_CNT + blockCnt * POSTING_SKIP_BYTE_CNT + binary.LittleEndian.Uint64(buf)
+}
+
+//按块内最大值的位宽, 将weight依次压入, 低位在前
+func packWeights(data []byte, block []basic.DocNode) []byte {
+	width := 0
+	for _, node := range block {
+		if w := bits.Len32(node.Weight); w > width {
+			width = w
+		}
+	}
+	data = append(data, byte(width))
+	if width == 0 {
+		return data
+	}
+	var acc uint64
+	var accBits uint
+	for _, node := range block {
+		acc |= uint64(node.Weight) << accBits
+		accBits += uint(width)
+		for accBits >= 8 {
+			data = append(data, byte(acc))
+			acc >>= 8
+			accBits -= 8
+		}
+	}
+	if accBits > 0 {
+		data = append(data, byte(acc))
+	}
+	return data
+}
+
+//解压weight, 填入nodes
+func unpackWeights(data []byte, nodes []basic.DocNode) {
+	width := uint(data[0])
+	if width == 0 {
+		for i := range nodes {
+			nodes[i].Weight = 0
+		}
+		return
+	}
+	idx := 1
+	mask := uint64(1) << width - 1
+	var acc uint64
+	var accBits uint
+	for i := range nodes {
+		for accBits < width {
+			acc |= uint64(data[idx]) << accBits
+			idx++
+			accBits += 8
+		}
+		nodes[i].Weight = uint32(acc & mask)
+		acc >>= width
+		accBits -= width
+	}
+}
+
+//倒排链的迭代器, 按docId升序遍历
+//压缩格式按块解码, 只解码遍历到的块; 未压缩的倒排链(内存态和老格式)直接遍历
+//Note: 迭代器不拷贝底层数据, 只在一次查询之内使用
+type PostingIterator struct {
+	nodes    []basic.DocNode //未压缩的倒排链, 或者当前块解码后的结果
+	idx      int             //当前文档在nodes中的下标
+	count    int             //文档总数
+	skip     []byte          //跳表, 只有压缩格式才有
+	data     []byte          //数据区, 只有压缩格式才有
+	blockIdx int             //当前块的序号
+	blockCnt int
+	buf      []basic.DocNode //块解码的缓冲区
+}
+
+//未压缩的倒排链的迭代器
+func NewPostingIterator(nodes []basic.DocNode) *PostingIterator {
+	return &PostingIterator{
+		nodes: nodes,
+		count: len(nodes),
+	}
+}
+
+//压缩的倒排链的迭代器, buf是encodePostings的结果
+func newCompressedIterator(buf []byte, count uint64) *PostingIterator {
+	blockCnt := int((count + POSTING_BLOCK_SIZE - 1) / POSTING_BLOCK_SIZE)
+	skipEnd := DOCNODE_BYTE_CNT + blockCnt * POSTING_SKIP_BYTE_CNT
+	it := &PostingIterator{
+		count:    int(count),
+		skip:     buf[DOCNODE_BYTE_CNT:skipEnd],
+		data:     buf[skipEnd:postingsLen(buf, count)],
+		blockCnt: blockCnt,
+	}
+	it.loadBlock(0)
+	return it
+}
+
+//文档总数
+func (it *PostingIterator) Len() int {
+	return it.count
+}
+
+//当前文档, 遍历结束则返回false
+func (it *PostingIterator) Doc() (basic.DocNode, bool) {
+	if it.idx < len(it.nodes) {
+		return it.nodes[it.idx], true
+	}
+	return basic.DocNode{}, false
+}
+
+//移到下一个文档
+func (it *PostingIterator) Next() (basic.DocNode, bool) {
+	it.idx++
+	if it.idx >= len(it.nodes) && it.skip != nil && it.blockIdx < it.blockCnt {
+		it.loadBlock(it.blockIdx + 1)
+	}
+	return it.Doc()
+}
+
+//移到第一个docId不小于target的文档, 只会向后移动
+func (it *PostingIterator) Advance(target uint32) (basic.DocNode, bool) {
+	node, ok := it.Doc()
+	if !ok || node.DocId >= target {
+		return node, ok
+	}
+
+	//压缩格式先借助跳表找到target所在的块, 中间的块不需要解码
+	if it.skip != nil && it.blockLastDocId(it.blockIdx) < target {
+		rest := it.blockCnt - it.blockIdx - 1
+		b := it.blockIdx + 1 + sort.Search(rest, func(i int) bool {
+			return it.blockLastDocId(it.blockIdx + 1 + i) >= target
+		})
+		it.loadBlock(b)
+	}
+
+	//块内二分
+	start := it.idx
+	it.idx = start + sort.Search(len(it.nodes) - start, func(i int) bool {
+		return it.nodes[start + i].DocId >= target
+	})
+	return it.Doc()
+}
+
+//全部解码, 返回新的slice
+func (it *PostingIterator) ReadAll() []basic.DocNode {
+	ret := make([]basic.DocNode, 0, it.count)
+	for node, ok := it.Doc(); ok; node, ok = it.Next() {
+		ret = append(ret, node)
+	}
+	return ret
+}
+
+func (it *PostingIterator) blockLastDocId(b int) uint32 {
+	return binary.LittleEndian.Uint32(it.skip[b * POSTING_SKIP_BYTE_CNT:])
+}
+
+//解码第b块
+func (it *PostingIterator) loadBlock(b int) {
+	it.blockIdx = b
+	it.idx = 0
+	if b >= it.blockCnt {
+		it.nodes = nil
+		return
+	}
+	n := it.count - b * POSTING_BLOCK_SIZE
+	if n > POSTING_BLOCK_SIZE {
+		n = POSTING_BLOCK_SIZE
+	}
+	if it.buf == nil {
+		it.buf = make([]basic.DocNode, POSTING_BLOCK_SIZE)
+	}
+	nodes := it.buf[:n]
+
+	docId := uint32(0)
+	if b > 0 {
+		docId = it.blockLastDocId(b - 1)
+	}
+	pos := int(binary.LittleEndian.Uint32(it.skip[b * POSTING_SKIP_BYTE_CNT + 4:]))
+	for i := range nodes {
+		delta, k := binary.Uvarint(it.data[pos:])
+		pos += k
+		docId += uint32(delta)
+		nodes[i].DocId = docId
+	}
+	unpackWeights(it.data[pos:], nodes)
+	it.nodes = nodes
+}
+
+//多个倒排链求交集, 从最短的链出发, 其他的链按需跳跃, 不需要全部解码
+//weight用于计算每个命中的文档在各个链中的权重, 结果中的权重为各链之和; nil表示直接使用倒排中的权重
+func IntersectPostings(its []*PostingIterator, weight func(i int, node basic.DocNode) uint32) []basic.DocNode {
+	ret := []basic.DocNode{}
+	if len(its) == 0 {
+		return ret
+	}
+	if weight == nil {
+		weight = func(i int, node basic.DocNode) uint32 { return node.Weight }
+	}
+	order := make([]int, len(its))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return its[order[a]].Len() < its[order[b]].Len() })
+
+	lead := its[order[0]]
+	node, ok := lead.Doc()
+	for ok {
+		w := weight(order[0], node)
+		match := true
+		for _, k := range order[1:] {
+			other, found := its[k].Advance(node.DocId)
+			if !found {
+				return ret //有一个链已经遍历完, 不会再有交集
+			}
+			if other.DocId != node.DocId {
+				//其他链中的下一个文档更大, 主链直接跳过去
+				node, ok = lead.Advance(other.DocId)
+				match = false
+				break
+			}
+			w += weight(k, other)
+		}
+		if match {
+			ret = append(ret, basic.DocNode{DocId: node.DocId, Weight: w})
+			node, ok = lead.Next()
+		}
+	}
+	return ret
+}
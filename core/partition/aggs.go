@@ -0,0 +1,150 @@
+package partition
+
+/*
+ * 分区内的聚合
+ * 基于正排索引, 对分区内命中的文档逐个取值, 得到分区的聚合中间状态
+ * 各个分区的中间状态由表汇总合并, 最后再计算出最终结果
+ */
+import (
+	"github.com/hq-cml/spider-engine/basic"
+	"github.com/hq-cml/spider-engine/core/index"
+	"math"
+	"time"
+)
+
+//时间间隔
+const (
+	INTERVAL_HOUR  = "hour"
+	INTERVAL_DAY   = "day"
+	INTERVAL_WEEK  = "week"
+	INTERVAL_MONTH = "month"
+	INTERVAL_YEAR  = "year"
+)
+
+//聚合的中间状态, 可以跨分区合并
+type AggState struct {
+	Count   int              //有值的文档数
+	Sum     float64          //用于min, max, avg, sum
+	Min     float64
+	Max     float64
+	Terms   map[string]int   //用于terms, 值 => 文档数
+	Buckets map[int64]int    //用于date_histogram, 桶的起始时间戳 => 文档数
+}
+
+func NewAggState() *AggState {
+	return &AggState{
+		Min:     math.Inf(1),
+		Max:     math.Inf(-1),
+		Terms:   map[string]int{},
+		Buckets: map[int64]int{},
+	}
+}
+
+//合并其他分区的中间状态
+func (s *AggState) Merge(other *AggState) {
+	s.Count += other.Count
+	s.Sum += other.Sum
+	if other.Min < s.Min {
+		s.Min = other.Min
+	}
+	if other.Max > s.Max {
+		s.Max = other.Max
+	}
+	for k, v := range other.Terms {
+		s.Terms[k] += v
+	}
+	for k, v := range other.Buckets {
+		s.Buckets[k] += v
+	}
+}
+
+//获取字符型字段的值, 用于聚合
+func (part *Partition) GetString(docId uint32, fieldName string) (string, bool) {
+	//校验
+	if docId < part.StartDocId || docId >= part.NextDocId {
+		return "", false
+	}
+	fld, ok := part.Fields[fieldName]
+	if !ok {
+		return "", false
+	}
+
+	//获取
+	return fld.GetString(docId)
+}
+
+//获取浮点值, 整数类型也转成浮点返回, 用于聚合
+func (part *Partition) GetFloat(docId uint32, fieldName string) (float64, bool) {
+	//校验
+	if docId < part.StartDocId || docId >= part.NextDocId {
+		return 0, false
+	}
+	fld, ok := part.Fields[fieldName]
+	if !ok {
+		return 0, false
+	}
+
+	//获取
+	return fld.GetFloat(docId)
+}
+
+//对分区内命中的文档做聚合, docs必须都属于本分区
+//没有值的文档(字符为空, 数字为MaxInt64)不参与聚合
+func (part *Partition) Aggregate(docs []basic.DocNode, agg basic.SearchAgg) *AggState {
+	state := NewAggState()
+	for _, doc := range docs {
+		if agg.AggType == basic.AGG_TERMS {
+			v, ok := part.GetString(doc.DocId, agg.FieldName)
+			if !ok || v == "" {
+				continue
+			}
+			state.Count++
+			state.Terms[v]++
+			continue
+		}
+
+		if agg.AggType == basic.AGG_DATE_HISTOGRAM {
+			v, ok := part.GetInt(doc.DocId, agg.FieldName)
+			if !ok || v == index.MaxInt64 {
+				continue
+			}
+			state.Count++
+			state.Buckets[HistogramKey(v, agg.Interval)]++
+			continue
+		}
+
+		//数值统计统一按浮点计算
+		v, ok := part.GetFloat(doc.DocId, agg.FieldName)
+		if !ok {
+			continue
+		}
+		state.Count++
+		state.Sum += v
+		if v < state.Min {
+			state.Min = v
+		}
+		if v > state.Max {
+			state.Max = v
+		}
+	}
+	return state
+}
+
+//计算时间戳所在的桶的起始时间戳, 按本地时间划分, 周从周一开始
+func HistogramKey(timestamp int64, interval string) int64 {
+	tm := time.Unix(timestamp, 0)
+	y, m, d := tm.Date()
+	switch interval {
+	case INTERVAL_HOUR:
+		return time.Date(y, m, d, tm.Hour(), 0, 0, 0, time.Local).Unix()
+	case INTERVAL_WEEK:
+		offset := (int(tm.Weekday()) + 6) % 7
+		return time.Date(y, m, d-offset, 0, 0, 0, 0, time.Local).Unix()
+	case INTERVAL_MONTH:
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.Local).Unix()
+	case INTERVAL_YEAR:
+		return time.Date(y, 1, 1, 0, 0, 0, 0, time.Local).Unix()
+	default:
+		return time.Date(y, m, d, 0, 0, 0, 0, time.Local).Unix()
+	}
+}
@@ -19,7 +19,10 @@ import (
 	"github.com/hq-cml/spider-engine/basic"
 	"github.com/hq-cml/spider-engine/utils/bitmap"
 	"github.com/hq-cml/spider-engine/core/index"
+	"github.com/hq-cml/spider-engine/core/query"
+	"os"
 	"strings"
+	"time"
 )
 
 const (
@@ -31,10 +34,12 @@ type Partition struct {
 	StartDocId      uint32                     `json:"startDocId"`
 	NextDocId       uint32                     `json:"nextDocId"`      //下次的DocId（所以Max的DocId是NextId-1）
 	DocCnt          uint32                     `json:"docCnt"` 	       //分区文档个数，这个是物理上占位的文档个数，可能多余实际的文档数
+	Compacted       bool                       `json:"compacted,omitempty"`   //合并时是否剔除了删除的文档, 是则docId需要通过映射转换成正排中的位置
+	IdMapOffset     uint64                     `json:"idMapOffset,omitempty"` //文档Id映射在正排文件中的偏移量
 	RealDocNum      uint32                     `json:"realDocNum"`     //分区实际拥有的有效文档数
 	PrtPathName     string                     `json:"prtPathName"`
 	CoreFields      map[string]field.CoreField `json:"fields"`         //分区各个字段的最基础信息，落盘用
-	GodBaseField    field.BasicField           `json:"godField"`       //上帝视角字段, 用于跨字段倒排索引搜索
+	GodBaseField    field.CoreField            `json:"godField"`       //上帝视角字段, 用于跨字段倒排索引搜索
 	Fields          map[string]*field.Field    `json:"-"`
 	GodField        *field.Field               `json:"-"`
 	inMemory        bool                       `json:"-"`
@@ -42,6 +47,7 @@ type Partition struct {
 	ivtMmap         *mmap.Mmap                 `json:"-"`
 	baseMmap        *mmap.Mmap                 `json:"-"`
 	extMmap         *mmap.Mmap                 `json:"-"`
+	idMap           *index.DocIdMap            `json:"-"`              //文档Id映射, 仅Compacted的分区才有
 	//rwMutex         sync.RWMutex               `json:"-"`              //分区的读写锁，仅用于保护内存分区，磁盘分区仅用于查询，不添加
 }
 
@@ -67,24 +73,32 @@ func NewEmptyPartitionWithBasicFields(PrtPathName string, start uint32, basicFie
 		inMemory:    true,
 	}
 
+	positional := false
 	for _, fld := range basicFields {
 		coreField := field.CoreField{
 			BasicField: field.BasicField{
 				FieldName: fld.FieldName,
 				IndexType: fld.IndexType,
+				Positions: fld.Positions,
 			},
 		}
 		part.CoreFields[fld.FieldName] = coreField
 		emptyField := field.NewEmptyField(fld.FieldName, start, fld.IndexType)
+		emptyField.SetPositional(fld.Positions)
 		part.Fields[fld.FieldName] = emptyField
+		positional = positional || fld.Positions
 	}
 
-	//上帝字段
-	part.GodBaseField = field.BasicField{
-		FieldName: GOD_FIELD_NAME,
-		IndexType: index.IDX_TYPE_GOD,
+	//上帝字段, 只要有一个字段记录了位置, 上帝字段也记录位置
+	part.GodBaseField = field.CoreField{
+		BasicField: field.BasicField{
+			FieldName: GOD_FIELD_NAME,
+			IndexType: index.IDX_TYPE_GOD,
+			Positions: positional,
+		},
 	}
 	part.GodField = field.NewEmptyGodField(GOD_FIELD_NAME, start)
+	part.GodField.SetPositional(positional)
 
 	log.Infof("New Partition [%v] Success ", PrtPathName)
 	return part
@@ -101,7 +115,7 @@ func LoadPartition(prtPathName string) (*Partition, error) {
 
 	//从meta文件加载partition信息到part
 	metaFileName := prtPathName + basic.IDX_FILENAME_SUFFIX_META
-	buffer, err := helper.ReadFile(metaFileName)
+	buffer, err := helper.ReadManifest(metaFileName)
 	if err != nil {
 		return nil ,err
 	}
@@ -140,24 +154,33 @@ func LoadPartition(prtPathName string) (*Partition, error) {
 	}
 	log.Debugf("Load Detail File : %v.ext", prtPathName)
 
+	//加载文档Id映射
+	if part.Compacted {
+		part.idMap = index.LoadDocIdMap(part.baseMmap, part.IdMapOffset)
+	}
+
 	//加载各个Field
 	for _, coreField := range part.CoreFields {
-		if part.DocCnt == 0 {
+		if part.DocCnt == 0 && !part.Compacted { //合并时文档可能全部被剔除
 			panic("Unknow error")
 			newField := field.NewEmptyField(coreField.FieldName, part.StartDocId, coreField.IndexType)
 			part.Fields[coreField.FieldName] = newField
 		} else {
 			oldField := field.LoadField(coreField.FieldName, part.StartDocId,
-				part.NextDocId, coreField.IndexType, coreField.FwdOffset, part.DocCnt,
+				part.NextDocId, coreField.IndexType, coreField.FwdOffset, coreField.LenOffset, coreField.NumOffset, part.DocCnt,
 				part.baseMmap, part.extMmap, part.ivtMmap, part.btdb)
+			oldField.SetPositional(coreField.Positions)
+			oldField.SetIdMap(part.idMap)
 			part.Fields[coreField.FieldName] = oldField
 		}
 	}
 
 	//加载上帝字段
 	part.GodField = field.LoadField(GOD_FIELD_NAME, part.StartDocId,
-		part.NextDocId, index.IDX_TYPE_GOD, 0, 0,
-		nil, nil, part.ivtMmap, part.btdb)
+		part.NextDocId, index.IDX_TYPE_GOD, 0, part.GodBaseField.LenOffset, 0, part.DocCnt,
+		part.baseMmap, nil, part.ivtMmap, part.btdb)
+	part.GodField.SetPositional(part.GodBaseField.Positions)
+	part.GodField.SetIdMap(part.idMap)
 
 	return &part, nil
 }
@@ -167,6 +190,45 @@ func (part *Partition) IsEmpty() bool {
 	return part.StartDocId == part.NextDocId
 }
 
+//内存分区占用的内存(估算值), 用于判断是否需要落地; 磁盘分区为0
+func (part *Partition) MemBytes() uint64 {
+	if !part.inMemory {
+		return 0
+	}
+	var bytes uint64
+	for _, fld := range part.Fields {
+		bytes += fld.MemBytes()
+	}
+	if part.GodField != nil {
+		bytes += part.GodField.MemBytes()
+	}
+	return bytes
+}
+
+//分区是否拥有该文档, 合并时被剔除的文档不再拥有
+func (part *Partition) HasDoc(docId uint32) bool {
+	if docId < part.StartDocId || docId >= part.NextDocId {
+		return false
+	}
+	if part.idMap == nil {
+		return true
+	}
+	_, ok := part.idMap.Pos(docId)
+	return ok
+}
+
+//分区拥有的全部docId, 升序排列
+func (part *Partition) DocIds() []uint32 {
+	if part.idMap != nil {
+		return part.idMap.DocIds()
+	}
+	docIds := make([]uint32, 0, part.NextDocId - part.StartDocId)
+	for docId := part.StartDocId; docId < part.NextDocId; docId++ {
+		docIds = append(docIds, docId)
+	}
+	return docIds
+}
+
 //添加字段
 func (part *Partition) AddField(basicField field.BasicField) error {
 	//锁
@@ -190,10 +252,18 @@ func (part *Partition) AddField(basicField field.BasicField) error {
 		BasicField: field.BasicField{
 			FieldName: basicField.FieldName,
 			IndexType: basicField.IndexType,
+			Positions: basicField.Positions,
 		},
 	}
 	newFiled := field.NewEmptyField(basicField.FieldName, part.NextDocId, basicField.IndexType)
+	newFiled.SetPositional(basicField.Positions)
 	part.Fields[basicField.FieldName] = newFiled
+
+	//分区为空, 上帝字段可以直接开启位置记录
+	if basicField.Positions && !part.GodBaseField.Positions {
+		part.GodBaseField.Positions = true
+		part.GodField.SetPositional(true)
+	}
 	return nil
 }
 
@@ -266,7 +336,7 @@ func (part *Partition) AddDocument(docId uint32, content map[string]interface{})
 			iField.IndexType == index.IDX_TYPE_STR_LIST ||
 			iField.IndexType == index.IDX_TYPE_STR_WORD {
 			if val, ok := content[fieldName]; ok {
-				str, _ := val.(string)
+				str, _ := index.ListContent(val).(string)
 				godStrs = append(godStrs, str)
 			}
 		}
@@ -399,7 +469,7 @@ func (part *Partition) Remove() error {
 	}
 
 	//删除文件
-	if err := helper.Remove(part.PrtPathName + basic.IDX_FILENAME_SUFFIX_META); err != nil {return err}
+	if err := helper.RemoveManifest(part.PrtPathName + basic.IDX_FILENAME_SUFFIX_META); err != nil {return err}
 	if err := helper.Remove(part.PrtPathName + basic.IDX_FILENAME_SUFFIX_INVERT); err != nil {return err}
 	if err := helper.Remove(part.PrtPathName + basic.IDX_FILENAME_SUFFIX_FWD); err != nil {return err}
 	if err := helper.Remove(part.PrtPathName + basic.IDX_FILENAME_SUFFIX_FWDEXT); err != nil {return err}
@@ -407,6 +477,84 @@ func (part *Partition) Remove() error {
 	return nil
 }
 
+//清理分区残留的文件
+//分区落地之后, 表的元信息提交之前崩溃, 会留下不属于表的分区文件, 新分区复用这个名字之前需要先清理
+func RemoveLeftover(prtPathName string) error {
+	for _, suffix := range []string{basic.IDX_FILENAME_SUFFIX_INVERT, basic.IDX_FILENAME_SUFFIX_FWD,
+		basic.IDX_FILENAME_SUFFIX_FWDEXT, basic.IDX_FILENAME_SUFFIX_BTREE} {
+		if helper.Exist(prtPathName + suffix) {
+			log.Warnf("Remove leftover file: %v", prtPathName + suffix)
+			if err := helper.Remove(prtPathName + suffix); err != nil {
+				return err
+			}
+		}
+	}
+	return helper.RemoveManifest(prtPathName + basic.IDX_FILENAME_SUFFIX_META)
+}
+
+//复制磁盘分区的文件到新的位置, 并按新的位置重写元信息, 用于快照和恢复
+//Note:
+// 索引文件(.ivt, .fwd, .ext)落地之后不会再变化, 优先硬链接; btdb打开时会加文件锁, 必须复制一份
+// basePathName非空时是之前复制出的同一个分区, 如果分区没有变化, 则直接复用它的文件(硬链接), 不再复制
+func CopyPartition(srcPathName, dstPathName, basePathName string) error {
+	buffer, err := helper.ReadManifest(srcPathName + basic.IDX_FILENAME_SUFFIX_META)
+	if err != nil {
+		return err
+	}
+	part := Partition{}
+	if err := json.Unmarshal(buffer, &part); err != nil {
+		return err
+	}
+	reuse := basePathName != "" && samePartition(&part, basePathName)
+
+	for _, suffix := range []string{basic.IDX_FILENAME_SUFFIX_INVERT, basic.IDX_FILENAME_SUFFIX_FWD,
+		basic.IDX_FILENAME_SUFFIX_FWDEXT, basic.IDX_FILENAME_SUFFIX_BTREE} {
+		src := srcPathName + suffix
+		if !helper.Exist(src) {
+			continue
+		}
+		if reuse && sameSize(src, basePathName + suffix) {
+			err = helper.LinkOrCopy(basePathName + suffix, dstPathName + suffix)
+		} else if suffix == basic.IDX_FILENAME_SUFFIX_BTREE {
+			err = helper.CopyFile(src, dstPathName + suffix)
+		} else {
+			err = helper.LinkOrCopy(src, dstPathName + suffix)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	part.PrtPathName = dstPathName
+	return part.storeMeta()
+}
+
+//basePathName是否和part是同一个分区
+func samePartition(part *Partition, basePathName string) bool {
+	buffer, err := helper.ReadManifest(basePathName + basic.IDX_FILENAME_SUFFIX_META)
+	if err != nil {
+		return false
+	}
+	base := Partition{}
+	if err := json.Unmarshal(buffer, &base); err != nil {
+		return false
+	}
+	base.PrtPathName = part.PrtPathName
+	return helper.JsonEncode(&base) == helper.JsonEncode(part)
+}
+
+func sameSize(path1, path2 string) bool {
+	fi1, err := os.Stat(path1)
+	if err != nil {
+		return false
+	}
+	fi2, err := os.Stat(path2)
+	if err != nil {
+		return false
+	}
+	return fi1.Size() == fi2.Size()
+}
+
 //获取详情，单个字段
 func (part *Partition) getFieldValue(docId uint32, fieldName string) (interface{}, bool) {
 
@@ -422,10 +570,25 @@ func (part *Partition) getFieldValue(docId uint32, fieldName string) (interface{
 	return part.Fields[fieldName].GetValue(docId)
 }
 
+//获取数值型字段的值, 用于排序和聚合
+func (part *Partition) GetInt(docId uint32, fieldName string) (int64, bool) {
+	//校验
+	if docId < part.StartDocId || docId >= part.NextDocId {
+		return index.MaxInt64, false
+	}
+	fld, ok := part.Fields[fieldName]
+	if !ok {
+		return index.MaxInt64, false
+	}
+
+	//获取
+	return fld.GetInt(docId)
+}
+
 //获取整篇文档详情，全部字段
 func (part *Partition) getDocument(docId uint32) (map[string]interface{}, bool) {
 	//校验
-	if docId < part.StartDocId || docId >= part.NextDocId {
+	if !part.HasDoc(docId) {
 		return nil, false
 	}
 
@@ -446,7 +609,7 @@ func (part *Partition) GetValueWithFields(docId uint32, fieldNames []string) (ma
 	//	defer part.rwMutex.RUnlock()
 	//}
 	//校验
-	if docId < part.StartDocId || docId >= part.NextDocId {
+	if !part.HasDoc(docId) {
 		return nil, false
 	}
 	if fieldNames == nil {
@@ -471,7 +634,7 @@ func (part *Partition) storeMeta() error {
 	metaFileName := part.PrtPathName + basic.IDX_FILENAME_SUFFIX_META
 	data := helper.JsonEncodeIndent(part)
 	if data != "" {
-		if err := helper.OverWriteToFile([]byte(data), metaFileName); err != nil {
+		if err := helper.WriteManifest([]byte(data), metaFileName); err != nil {
 			return err
 		}
 	} else {
@@ -507,6 +670,8 @@ func (part *Partition) Persist() error {
 		}
 		//设置coreField的fwdOffset和docCnt
 		coreField.FwdOffset = fwdOffset
+		coreField.LenOffset = part.Fields[name].GetLenOffset()
+		coreField.NumOffset = part.Fields[name].GetNumOffset()
 		part.CoreFields[coreField.FieldName] = coreField
 		log.Debugf("Persist Field:%v, fwdOffset:%v, docCnt:%v", name, coreField.FwdOffset, docCnt)
 		if part.DocCnt != docCnt {
@@ -521,6 +686,7 @@ func (part *Partition) Persist() error {
 		log.Errf("GodField.Persist Error:%v", err.Error())
 		return err
 	}
+	part.GodBaseField.LenOffset = part.GodField.GetLenOffset()
 
 	//存储源信息
 	if err = part.storeMeta(); err != nil {
@@ -548,7 +714,7 @@ func (part *Partition) Persist() error {
 	for name := range part.Fields {
 		part.Fields[name].SetMmap(part.baseMmap, part.extMmap, part.ivtMmap)
 	}
-	part.GodField.SetMmap(nil, nil, part.ivtMmap)
+	part.GodField.SetMmap(part.baseMmap, nil, part.ivtMmap)
 
 	log.Infof("Persist Partition File : [%v] Finish", part.PrtPathName)
 	return nil
@@ -558,7 +724,12 @@ func (part *Partition) Persist() error {
 //Note:
 // 这个和底层的MergePersist有不同, 因为四个文件是按照分区级别公用，所以函数会完整的填充接收者
 // 接受者初始是一个骨架，加载btdb和mmap以及其他控制字段，使之成为一个可用的磁盘态分区
-func (part *Partition) MergePersistPartitions(parts []*Partition) error {
+//Note:
+// docIds是需要保留的文档(升序), 其余的(已删除的)文档不再写入新分区, 新分区通过文档Id映射保持原有的docId不变;
+// docIds为nil则全部保留
+//Note:
+// 合并可以和搜索并发进行(高层不加锁), 所以这里不能读取源分区中会变化的数据(比如RealDocNum)
+func (part *Partition) MergePersistPartitions(parts []*Partition, docIds []uint32) error {
 	//锁
 	//part.rwMutex.Lock()
 	//defer part.rwMutex.Unlock()
@@ -577,7 +748,16 @@ func (part *Partition) MergePersistPartitions(parts []*Partition) error {
 		part.btdb = btree.NewBtree("", btdbname)
 	}
 
-	//逐个字段进行merge
+	//全部保留
+	if docIds == nil {
+		docIds = []uint32{}
+		for _, pt := range parts {
+			docIds = append(docIds, pt.DocIds()...)
+		}
+	}
+
+	//逐个字段进行merge, 每个字段合并完成之后限速
+	start := time.Now()
 	tmp := map[uint32]bool{}
 	var fwdOffset uint64
 	var docCnt uint32
@@ -595,17 +775,20 @@ func (part *Partition) MergePersistPartitions(parts []*Partition) error {
 				fs = append(fs, fakefield)
 			}
 		}
-		fwdOffset, docCnt, err = part.Fields[fieldName].MergePersistField(fs, part.PrtPathName, part.btdb)
+		fwdOffset, docCnt, err = part.Fields[fieldName].MergePersistField(fs, docIds, part.PrtPathName, part.btdb)
 		if err != nil {
 			log.Errln("MergePartitions Error1:", err)
 			return err
 		}
 
 		coreField.FwdOffset = fwdOffset
+		coreField.LenOffset = part.Fields[fieldName].GetLenOffset()
+		coreField.NumOffset = part.Fields[fieldName].GetNumOffset()
 		tmp[docCnt] = true
 		part.CoreFields[fieldName] = coreField
+		part.throttle(start)
 	}
-	if len(tmp) > 1 {
+	if len(tmp) > 1 || (len(tmp) == 1 && docCnt != uint32(len(docIds))) {
 		log.Errf("Doc cnt not consistent!!. %v", tmp)
 		return errors.New("Doc cnt not consistent!!")
 	}
@@ -615,11 +798,21 @@ func (part *Partition) MergePersistPartitions(parts []*Partition) error {
 	for _, pt := range parts {
 		fs = append(fs, pt.GodField)
 	}
-	_, _, err = part.GodField.MergePersistField(fs, part.PrtPathName, part.btdb)
+	_, _, err = part.GodField.MergePersistField(fs, docIds, part.PrtPathName, part.btdb)
 	if err != nil {
 		log.Errln("Merge God Partitions failed:", err)
 		return err
 	}
+	part.GodBaseField.LenOffset = part.GodField.GetLenOffset()
+
+	//文档Id映射同样追加到正排文件
+	part.idMap, err = index.PersistDocIdMap(docIds, part.PrtPathName)
+	if err != nil {
+		log.Errln("Persist doc id map failed:", err)
+		return err
+	}
+	part.Compacted = true
+	part.IdMapOffset = part.idMap.GetOffset()
 
 	//加载回mmap
 	part.ivtMmap, err = mmap.NewMmap(part.PrtPathName+ basic.IDX_FILENAME_SUFFIX_INVERT, true, 0)
@@ -637,10 +830,13 @@ func (part *Partition) MergePersistPartitions(parts []*Partition) error {
 		log.Errln("MergePartitions Error4:", err)
 		return err
 	}
+	part.idMap.SetBaseMmap(part.baseMmap)
 	for name := range part.Fields {
 		part.Fields[name].SetMmap(part.baseMmap, part.extMmap, part.ivtMmap)
+		part.Fields[name].SetIdMap(part.idMap)
 	}
-	part.GodField.SetMmap(nil, nil, part.ivtMmap)
+	part.GodField.SetMmap(part.baseMmap, nil, part.ivtMmap)
+	part.GodField.SetIdMap(part.idMap)
 
 	//内存态 => 磁盘态
 	part.inMemory = false
@@ -648,17 +844,31 @@ func (part *Partition) MergePersistPartitions(parts []*Partition) error {
 	//最后设置startId和nextDocId
 	part.StartDocId = parts[0].StartDocId
 	part.NextDocId = parts[l-1].NextDocId
-	part.DocCnt = docCnt
-	var real uint32
-	for _, pt := range parts {
-		real = real + pt.RealDocNum
-	}
-	part.RealDocNum = real
+	part.DocCnt = uint32(len(docIds))
+	part.RealDocNum = uint32(len(docIds))
 
 	log.Infof("MergePartitions [%v] Finish", part.PrtPathName)
 	return part.storeMeta()
 }
 
+//合并限速, 按已经写入的文件大小计算, 超过basic.MERGE_IO_RATE_LIMIT(MB/s)则休眠
+func (part *Partition) throttle(start time.Time) {
+	if basic.MERGE_IO_RATE_LIMIT <= 0 {
+		return
+	}
+	var written int64
+	for _, suffix := range []string{basic.IDX_FILENAME_SUFFIX_INVERT, basic.IDX_FILENAME_SUFFIX_FWD,
+		basic.IDX_FILENAME_SUFFIX_FWDEXT} {
+		if fi, err := os.Stat(part.PrtPathName + suffix); err == nil {
+			written += fi.Size()
+		}
+	}
+	expect := time.Duration(float64(written) / float64(basic.MERGE_IO_RATE_LIMIT << 20) * float64(time.Second))
+	if elapsed := time.Since(start); elapsed < expect {
+		time.Sleep(expect - elapsed)
+	}
+}
+
 //查询
 func (part *Partition) query(fieldName string, key interface{}) ([]basic.DocNode, bool) {
 	//校验
@@ -676,9 +886,62 @@ func (part *Partition) query(fieldName string, key interface{}) ([]basic.DocNode
 	return nodes, ok
 }
 
+//获取字段, 包括上帝字段
+func (part *Partition) getField(fieldName string) (*field.Field, bool) {
+	fld, exist := part.Fields[fieldName]
+	if !exist {
+		if fieldName != GOD_FIELD_NAME {
+			log.Errf("Field [%v] not found", fieldName)
+			return nil, false
+		}
+		fld = part.GodField
+	}
+	return fld, true
+}
+
+//多词查询, 分词字段先切词再查找
+func (part *Partition) queryWords(fieldName, keyWord, op string, scoring *query.Scoring) ([]basic.DocNode, bool) {
+	fld, exist := part.getField(fieldName)
+	if !exist {
+		return nil, false
+	}
+	return fld.QueryWords(keyWord, op, scoring)
+}
+
+//词项在本分区中的文档频率, 已删除的文档不计入
+func (part *Partition) DocFreq(fieldName, term string, bitmap bitmap.BitSet) uint32 {
+	nodes, ok := part.query(fieldName, term)
+	if !ok {
+		return 0
+	}
+	var cnt uint32
+	for _, node := range nodes {
+		if bitmap == nil || !bitmap.IsSet(uint64(node.DocId)) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+//文档在各个倒排字段(包括上帝字段)的长度, 用于统计平均长度
+func (part *Partition) GetDocLens(docId uint32) map[string]uint32 {
+	lens := map[string]uint32{}
+	if docId < part.StartDocId || docId >= part.NextDocId {
+		return lens
+	}
+	for fieldName, fld := range part.Fields {
+		if fld.LenIdx != nil {
+			lens[fieldName] = fld.GetDocLen(docId)
+		}
+	}
+	lens[GOD_FIELD_NAME] = part.GodField.GetDocLen(docId)
+	return lens
+}
+
 //搜索, 如果keyWord为空, 则取出所有未删除的节点
+//分词字段的keyWord会被切分成多个词项, 按照op(and/or)合并, scoring用于相关性打分
 //根据搜索结果, 再通过bitmap进行过滤
-func (part *Partition) SearchDocs(fieldName, keyWord string, bitmap *bitmap.Bitmap,
+func (part *Partition) SearchDocs(fieldName, keyWord, op string, scoring *query.Scoring, bitmap bitmap.BitSet,
 		filters []basic.SearchFilter) ([]basic.DocNode, bool) {
 
 	//对于读取的操作，用读取锁保护内存分区，磁盘分区随便读取
@@ -697,14 +960,17 @@ func (part *Partition) SearchDocs(fieldName, keyWord string, bitmap *bitmap.Bitm
 
 	//fmt.Println("\n--------------------\nPart SearchDocs:", part.PrtPathName, fieldName, keyWord)
 	retDocs := []basic.DocNode{}
-	//如果keyWord为空, 则取出所有未删除的节点
+	//如果keyWord为空, 则优先通过数字索引取出满足范围过滤的节点, 否则取出所有节点
 	if keyWord == "" {
-		for i := part.StartDocId; i < part.NextDocId; i++ {
-			retDocs = append(retDocs, basic.DocNode{DocId: i})
+		var used int
+		if retDocs, used = part.rangeDocs(filters); used >= 0 {
+			filters = append(append([]basic.SearchFilter{}, filters[:used]...), filters[used+1:]...)
+		} else {
+			retDocs = part.AllDocs()
 		}
 	} else {
 		var match bool
-		retDocs, match = part.query(fieldName, keyWord)
+		retDocs, match = part.queryWords(fieldName, keyWord, op, scoring)
 		if !match {
 			//fmt.Println("Get not docs")
 			return retDocs, false
@@ -712,12 +978,65 @@ func (part *Partition) SearchDocs(fieldName, keyWord string, bitmap *bitmap.Bitm
 	}
 
 	//fmt.Println("Org Docs:", helper.JsonEncode(retDocs))
-	//再用bitmap去掉已删除的数据
-	if bitmap != nil {
+	finalRetDocs := part.filterDocs(retDocs, bitmap, filters)
+	return finalRetDocs, len(finalRetDocs)>0
+}
+
+//按照查询语法树搜索, 未指定字段的词项在defaultField上查找, scoring用于相关性打分
+//根据搜索结果, 再通过bitmap和过滤器进行过滤
+func (part *Partition) SearchQuery(node *query.Node, defaultField string, scoring *query.Scoring,
+		bitmap bitmap.BitSet, filters []basic.SearchFilter) ([]basic.DocNode, bool) {
+
+	retDocs := node.Eval(&searcher{part: part, scoring: scoring}, defaultField)
+	finalRetDocs := part.filterDocs(retDocs, bitmap, filters)
+	return finalRetDocs, len(finalRetDocs)>0
+}
+
+//分区检索器, 实现query.Searcher, 携带本次搜索的打分上下文
+type searcher struct {
+	part    *Partition
+	scoring *query.Scoring
+}
+
+//词项查询
+//分词字段上的词项如果还能再切分, 则要求切分后的词项全部命中
+func (s *searcher) TermDocs(fieldName, term string) []basic.DocNode {
+	nodes, _ := s.part.queryWords(fieldName, term, query.OP_AND, s.scoring)
+	return nodes
+}
+
+//短语查询
+func (s *searcher) PhraseDocs(fieldName, phrase string, slop int) []basic.DocNode {
+	fld, exist := s.part.getField(fieldName)
+	if !exist {
+		return nil
+	}
+	nodes, _ := fld.QueryPhrase(phrase, slop, s.scoring)
+	return nodes
+}
+
+func (s *searcher) AllDocs() []basic.DocNode {
+	return s.part.AllDocs()
+}
+
+//分区内的全部文档
+func (part *Partition) AllDocs() []basic.DocNode {
+	docIds := part.DocIds()
+	retDocs := make([]basic.DocNode, 0, len(docIds))
+	for _, docId := range docIds {
+		retDocs = append(retDocs, basic.DocNode{DocId: docId})
+	}
+	return retDocs
+}
+
+//用bitmap去掉已删除的数据, 再使用过滤器
+func (part *Partition) filterDocs(retDocs []basic.DocNode, delBitmap bitmap.BitSet,
+		filters []basic.SearchFilter) []basic.DocNode {
+	if delBitmap != nil {
 		idx := 0
 		for _, doc := range retDocs{
 			//保留未删除的
-			if !bitmap.IsSet(uint64(doc.DocId)) {
+			if !delBitmap.IsSet(uint64(doc.DocId)) {
 				retDocs[idx] = doc
 				idx++
 			}
@@ -726,6 +1045,42 @@ func (part *Partition) SearchDocs(fieldName, keyWord string, bitmap *bitmap.Bitm
 	}
 
 	//fmt.Println("After bitmap, Final Docs:", helper.JsonEncode(retDocs))
+	//范围过滤优先使用数字索引: 命中的文档比候选文档少的时候, 索引结果放入压缩位图, 多个范围的结果求交集
+	//最后用位图筛选候选文档, 候选文档的顺序和权重不变
+	rest := []basic.SearchFilter{}
+	var hits *bitmap.Roaring
+	for _, filter := range filters {
+		if fld, exist := part.Fields[filter.FieldName]; exist {
+			if begin, end, ok := filterRange(filter, fld.IndexType); ok {
+				if cnt, ok := fld.RangeCount(begin, end); ok && cnt < len(retDocs) {
+					docs, _ := fld.RangeDocs(begin, end)
+					set := bitmap.NewRoaring()
+					for _, doc := range docs {
+						set.Set(uint64(doc.DocId))
+					}
+					if hits == nil {
+						hits = set
+					} else {
+						hits = hits.And(set)
+					}
+					continue
+				}
+			}
+		}
+		rest = append(rest, filter)
+	}
+	filters = rest
+	if hits != nil {
+		idx := 0
+		for _, doc := range retDocs {
+			if hits.IsSet(uint64(doc.DocId)) {
+				retDocs[idx] = doc
+				idx++
+			}
+		}
+		retDocs = retDocs[:idx]
+	}
+
 	//再使用过滤器
 	finalRetDocs := []basic.DocNode{}
 	if filters != nil && len(filters) > 0 {
@@ -746,7 +1101,55 @@ func (part *Partition) SearchDocs(fieldName, keyWord string, bitmap *bitmap.Bitm
 	} else {
 		finalRetDocs = retDocs
 	}
-	return finalRetDocs, len(finalRetDocs)>0
+	return finalRetDocs
+}
+
+//把数字类型的过滤器转换成闭区间[begin, end], 不能转换的返回false
+//浮点字段先转换成等价的整数过滤器
+func filterRange(filter basic.SearchFilter, indexType uint16) (int64, int64, bool) {
+	if !index.IsNumericType(indexType) {
+		return 0, 0, false
+	}
+	if indexType == index.IDX_TYPE_FLOAT {
+		filter = index.FloatFilter(filter)
+	}
+	switch basic.FilterTypeMap[filter.FilterType] {
+	case basic.FILT_EQ:
+		return filter.IntVal, filter.IntVal, true
+	case basic.FILT_MORE_THAN:
+		return filter.IntVal, index.MaxInt64 - 1, true
+	case basic.FILT_LESS_THAN:
+		return -index.MaxInt64 - 1, filter.IntVal, true
+	case basic.FILT_BETWEEN:
+		return filter.Begin, filter.End, true
+	}
+	return 0, 0, false
+}
+
+//通过数字索引找出满足某个范围过滤器的节点, 选择命中最少的过滤器
+//返回使用的过滤器的下标, 没有可用的数字索引则返回-1
+func (part *Partition) rangeDocs(filters []basic.SearchFilter) ([]basic.DocNode, int) {
+	used, minCnt := -1, 0
+	for i, filter := range filters {
+		fld, exist := part.Fields[filter.FieldName]
+		if !exist {
+			continue
+		}
+		begin, end, ok := filterRange(filter, fld.IndexType)
+		if !ok {
+			continue
+		}
+		if cnt, ok := fld.RangeCount(begin, end); ok && (used < 0 || cnt < minCnt) {
+			used, minCnt = i, cnt
+		}
+	}
+	if used < 0 {
+		return nil, -1
+	}
+	fld := part.Fields[filters[used].FieldName]
+	begin, end, _ := filterRange(filters[used], fld.IndexType)
+	docs, _ := fld.RangeDocs(begin, end)
+	return docs, used
 }
 
 func (part *Partition) GetStatus() *PartitionStatus {
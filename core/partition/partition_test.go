@@ -302,7 +302,7 @@ func TestPartitionMerge(t *testing.T) {
 	defer part2.DoClose()
 
 	//合并
-	err = part2.MergePersistPartitions([]*Partition{part0, part1})
+	err = part2.MergePersistPartitions([]*Partition{part0, part1}, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -505,7 +505,7 @@ func TestPartitionMergeAfterFiledChange(t *testing.T) {
 	defer part2.DoClose()
 
 	//合并
-	err = part2.MergePersistPartitions([]*Partition{part0, part1})
+	err = part2.MergePersistPartitions([]*Partition{part0, part1}, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,137 @@
+package partition
+
+/*
+ * 分区的完整性校验
+ * 只读取磁盘上的文件, 不依赖分区的加载, 损坏的分区(加载会失败甚至panic)也可以校验：
+ *   1. 元信息可读, docId范围和文档数自洽
+ *   2. 正排、倒排文件存在
+ *   3. 字段的正排、长度、数字索引偏移量以及文档Id映射的偏移量都在正排文件之内
+ *   4. btdb中各个词项的偏移量都在倒排文件之内
+ * 分区的索引文件是落地时追加写入的, 没有mmap的首部, 偏移量就是文件中的绝对位置, 所以按文件大小校验
+ */
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"github.com/hq-cml/spider-engine/basic"
+	"github.com/hq-cml/spider-engine/core/index"
+	"github.com/hq-cml/spider-engine/utils/btree"
+	"github.com/hq-cml/spider-engine/utils/helper"
+)
+
+const VERIFY_MAX_BAD_TERMS = 3 //每个字段最多列出几个越界的词项
+
+//离线校验一个分区, 返回分区的元信息(元信息不可读时为nil)和发现的问题
+//Note: 分区的btdb不能被其他实例打开, 所以只能校验没有加载的分区
+func VerifyPartition(prtPathName string) (*Partition, []string) {
+	part := &Partition{PrtPathName: prtPathName}
+	buffer, err := helper.ReadManifest(prtPathName + basic.IDX_FILENAME_SUFFIX_META)
+	if err != nil {
+		return nil, []string{"Read meta error: " + err.Error()}
+	}
+	if err := json.Unmarshal(buffer, part); err != nil {
+		return nil, []string{"Decode meta error: " + err.Error()}
+	}
+
+	var btdb btree.Btree
+	btdbPath := prtPathName + basic.IDX_FILENAME_SUFFIX_BTREE
+	if helper.Exist(btdbPath) {
+		btdb, err = btree.OpenBtree("", btdbPath)
+		if err != nil {
+			return part, []string{"Open btdb error: " + err.Error()}
+		}
+		defer btdb.Close()
+	}
+	return part, part.verifyFiles(btdb)
+}
+
+//在线校验已经加载的磁盘分区, 使用分区已经打开的btdb
+func (part *Partition) Verify() []string {
+	if part.inMemory {
+		return nil
+	}
+	return part.verifyFiles(part.btdb)
+}
+
+func (part *Partition) verifyFiles(btdb btree.Btree) []string {
+	problems := []string{}
+
+	//docId范围
+	if part.StartDocId > part.NextDocId {
+		problems = append(problems, fmt.Sprintf("Invalid docId range: [%v, %v)", part.StartDocId, part.NextDocId))
+		return problems
+	}
+	span := part.NextDocId - part.StartDocId
+	if (!part.Compacted && part.DocCnt != span) || part.DocCnt > span {
+		problems = append(problems, fmt.Sprintf("DocCnt %v mismatch docId range [%v, %v)", part.DocCnt, part.StartDocId, part.NextDocId))
+	}
+	if part.RealDocNum > part.DocCnt {
+		problems = append(problems, fmt.Sprintf("RealDocNum %v is larger than DocCnt %v", part.RealDocNum, part.DocCnt))
+	}
+
+	//索引文件, 正排辅助文件可以没有
+	fwdEnd, err := fileSize(part.PrtPathName + basic.IDX_FILENAME_SUFFIX_FWD)
+	if err != nil {
+		problems = append(problems, "Forward file error: " + err.Error())
+	}
+	ivtEnd, ivtErr := fileSize(part.PrtPathName + basic.IDX_FILENAME_SUFFIX_INVERT)
+	if ivtErr != nil {
+		problems = append(problems, "Invert file error: " + ivtErr.Error())
+	}
+
+	//正排文件中的偏移量
+	if err == nil {
+		check := func(name, kind string, offset uint64) {
+			if offset > fwdEnd {
+				problems = append(problems, fmt.Sprintf("Field [%v] %v offset %v out of forward file %v", name, kind, offset, fwdEnd))
+			}
+		}
+		for name, coreField := range part.CoreFields {
+			check(name, "fwd", coreField.FwdOffset)
+			check(name, "len", coreField.LenOffset)
+			check(name, "num", coreField.NumOffset)
+		}
+		check(GOD_FIELD_NAME, "len", part.GodBaseField.LenOffset)
+		if part.Compacted {
+			check("", "idMap", part.IdMapOffset)
+		}
+	}
+
+	//btdb中词项的偏移量
+	if btdb != nil && ivtErr == nil {
+		names := []string{GOD_FIELD_NAME}
+		for name := range part.CoreFields {
+			names = append(names, name)
+		}
+		for _, name := range names {
+			if !btdb.HasTree(name) {
+				continue
+			}
+			bad := []string{}
+			badCnt := 0
+			btdb.ForEach(name, func(term, value string) bool {
+				offset, err := strconv.ParseUint(value, 10, 64)
+				if err != nil || offset + index.DOCNODE_BYTE_CNT > ivtEnd {
+					badCnt++
+					if len(bad) < VERIFY_MAX_BAD_TERMS {
+						bad = append(bad, fmt.Sprintf("%v=%v", term, value))
+					}
+				}
+				return true
+			})
+			if badCnt > 0 {
+				problems = append(problems, fmt.Sprintf("Field [%v] has %v terms out of invert file %v, such as %v", name, badCnt, ivtEnd, bad))
+			}
+		}
+	}
+	return problems
+}
+
+func fileSize(filePath string) (uint64, error) {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(fi.Size()), nil
+}
@@ -0,0 +1,306 @@
+package query
+
+/*
+ * 查询串解析
+ * 语法:
+ *   golang                 默认字段上的词项
+ *   title:golang           指定字段的词项
+ *   "search engine"        短语, 分词字段要求各个词项按顺序紧密相连, 其他字段整体作为查询内容
+ *   "search engine"~3      邻近查询, 词项按顺序出现, 允许额外间隔3个位置
+ *   a AND b, a && b        同时满足
+ *   a OR b, a || b         满足其一
+ *   NOT a, -a, !a          排除
+ *   title:(a OR b)         分组, 组内未指定字段的词项归属title
+ * 相邻子句之间没有运算符时, 使用默认运算符连接
+ * 优先级: NOT > AND > OR, 可用括号改变
+ */
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+//默认运算符
+const (
+	OP_OR  = "or"
+	OP_AND = "and"
+)
+
+//词法单元类型
+const (
+	tokEOF uint8 = iota
+	tokWord
+	tokPhrase
+	tokField
+	tokAnd
+	tokOr
+	tokNot
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	typ  uint8
+	val  string
+	slop int
+}
+
+type parser struct {
+	tokens    []token
+	pos       int
+	defaultOp string
+}
+
+//解析查询串, 相邻子句默认按OR连接
+func Parse(q string) (*Node, error) {
+	return ParseWithOp(q, OP_OR)
+}
+
+//解析查询串, 指定相邻子句之间的默认运算符(and/or)
+func ParseWithOp(q string, defaultOp string) (*Node, error) {
+	defaultOp = strings.ToLower(defaultOp)
+	if defaultOp == "" {
+		defaultOp = OP_OR
+	}
+	if defaultOp != OP_OR && defaultOp != OP_AND {
+		return nil, errors.New("Unsupport default operator: " + defaultOp)
+	}
+	tokens, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, defaultOp: defaultOp}
+	if p.peek().typ == tokEOF {
+		return nil, errors.New("Empty query")
+	}
+	node, err := p.parseOr("")
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().typ != tokEOF {
+		return nil, errors.New(fmt.Sprintf("Unexpected token '%v'", p.peek().val))
+	}
+	return node, nil
+}
+
+//词法分析
+func lex(q string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(q)
+	i := 0
+	for i < len(runes) {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{typ: tokLParen, val: "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{typ: tokRParen, val: ")"})
+			i++
+		case r == '"':
+			//短语, 支持\"转义
+			i++
+			buf := []rune{}
+			closed := false
+			for i < len(runes) {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					buf = append(buf, runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == '"' {
+					closed = true
+					i++
+					break
+				}
+				buf = append(buf, runes[i])
+				i++
+			}
+			if !closed {
+				return nil, errors.New("Unclosed phrase in query")
+			}
+			//邻近查询的间隔, 形如"a b"~3
+			slop := 0
+			if i < len(runes) && runes[i] == '~' {
+				i++
+				start := i
+				for i < len(runes) && runes[i] >= '0' && runes[i] <= '9' {
+					slop = slop*10 + int(runes[i]-'0')
+					i++
+				}
+				if i == start {
+					return nil, errors.New("Missing slop after '~' in query")
+				}
+			}
+			tokens = append(tokens, token{typ: tokPhrase, val: string(buf), slop: slop})
+		case r == '-' || r == '!':
+			if r == '!' && i+1 < len(runes) && runes[i+1] == '=' {
+				return nil, errors.New("Unexpected '!=' in query")
+			}
+			tokens = append(tokens, token{typ: tokNot, val: string(r)})
+			i++
+		case r == '&' && i+1 < len(runes) && runes[i+1] == '&':
+			tokens = append(tokens, token{typ: tokAnd, val: "&&"})
+			i += 2
+		case r == '|' && i+1 < len(runes) && runes[i+1] == '|':
+			tokens = append(tokens, token{typ: tokOr, val: "||"})
+			i += 2
+		default:
+			//普通单词, 遇到空白、括号、引号或冒号结束
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' &&
+				runes[i] != ')' && runes[i] != '"' && runes[i] != ':' {
+				i++
+			}
+			word := string(runes[start:i])
+			if i < len(runes) && runes[i] == ':' {
+				if word == "" {
+					return nil, errors.New("Empty field name in query")
+				}
+				tokens = append(tokens, token{typ: tokField, val: word})
+				i++
+				continue
+			}
+			switch word {
+			case "AND":
+				tokens = append(tokens, token{typ: tokAnd, val: word})
+			case "OR":
+				tokens = append(tokens, token{typ: tokOr, val: word})
+			case "NOT":
+				tokens = append(tokens, token{typ: tokNot, val: word})
+			default:
+				tokens = append(tokens, token{typ: tokWord, val: word})
+			}
+		}
+	}
+	return tokens, nil
+}
+
+func (p *parser) peek() token {
+	if p.pos >= len(p.tokens) {
+		return token{typ: tokEOF}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+//是否可以作为一个子句的开头
+func startsClause(t token) bool {
+	return t.typ == tokWord || t.typ == tokPhrase || t.typ == tokField ||
+		t.typ == tokNot || t.typ == tokLParen
+}
+
+// or := and ( OR and )*
+func (p *parser) parseOr(fieldName string) (*Node, error) {
+	left, err := p.parseAnd(fieldName)
+	if err != nil {
+		return nil, err
+	}
+	children := []*Node{left}
+	for {
+		t := p.peek()
+		if t.typ == tokOr {
+			p.next()
+		} else if !(p.defaultOp == OP_OR && startsClause(t)) {
+			break
+		}
+		right, err := p.parseAnd(fieldName)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+	return combine(NODE_OR, children), nil
+}
+
+// and := unary ( AND unary )*
+func (p *parser) parseAnd(fieldName string) (*Node, error) {
+	left, err := p.parseUnary(fieldName)
+	if err != nil {
+		return nil, err
+	}
+	children := []*Node{left}
+	for {
+		t := p.peek()
+		if t.typ == tokAnd {
+			p.next()
+		} else if !(p.defaultOp == OP_AND && startsClause(t)) {
+			break
+		}
+		right, err := p.parseUnary(fieldName)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+	return combine(NODE_AND, children), nil
+}
+
+// unary := NOT unary | primary
+func (p *parser) parseUnary(fieldName string) (*Node, error) {
+	if p.peek().typ == tokNot {
+		p.next()
+		child, err := p.parseUnary(fieldName)
+		if err != nil {
+			return nil, err
+		}
+		//双重否定抵消
+		if child.Type == NODE_NOT {
+			return child.Children[0], nil
+		}
+		return &Node{Type: NODE_NOT, Children: []*Node{child}}, nil
+	}
+	return p.parsePrimary(fieldName)
+}
+
+// primary := ( or ) | field: primary | word | phrase
+func (p *parser) parsePrimary(fieldName string) (*Node, error) {
+	t := p.next()
+	switch t.typ {
+	case tokLParen:
+		node, err := p.parseOr(fieldName)
+		if err != nil {
+			return nil, err
+		}
+		if p.next().typ != tokRParen {
+			return nil, errors.New("Missing ')' in query")
+		}
+		return node, nil
+	case tokField:
+		if p.peek().typ == tokNot {
+			return nil, errors.New(fmt.Sprintf("Unexpected '%v' after field %v", p.peek().val, t.val))
+		}
+		return p.parsePrimary(t.val)
+	case tokWord:
+		return &Node{Type: NODE_TERM, Field: fieldName, Value: t.val}, nil
+	case tokPhrase:
+		return &Node{Type: NODE_PHRASE, Field: fieldName, Value: t.val, Slop: t.slop}, nil
+	case tokEOF:
+		return nil, errors.New("Unexpected end of query")
+	}
+	return nil, errors.New(fmt.Sprintf("Unexpected token '%v'", t.val))
+}
+
+//只有一个子节点时不必包一层, 同类节点拍平
+func combine(typ uint8, children []*Node) *Node {
+	if len(children) == 1 {
+		return children[0]
+	}
+	flat := []*Node{}
+	for _, child := range children {
+		if child.Type == typ {
+			flat = append(flat, child.Children...)
+		} else {
+			flat = append(flat, child)
+		}
+	}
+	return &Node{Type: typ, Children: flat}
+}
@@ -0,0 +1,211 @@
+package query
+
+/*
+ * 查询语言的语法树, 以及基于倒排链的求值
+ * 语法树的叶子节点是词项/短语, 非叶子节点是AND/OR/NOT
+ * 求值时, 叶子节点从倒排索引取出倒排链, 非叶子节点对倒排链做交、并、差
+ */
+import (
+	"fmt"
+	"strings"
+	"github.com/hq-cml/spider-engine/basic"
+)
+
+//语法树节点类型
+const (
+	NODE_TERM uint8 = iota //词项
+	NODE_PHRASE            //短语
+	NODE_AND               //交集
+	NODE_OR                //并集
+	NODE_NOT               //排除
+)
+
+//语法树节点
+type Node struct {
+	Type     uint8   `json:"type"`
+	Field    string  `json:"field,omitempty"` //叶子节点所属字段, 为空表示默认字段
+	Value    string  `json:"value,omitempty"` //叶子节点的查询内容
+	Slop     int     `json:"slop,omitempty"`  //短语允许的额外间隔, 0表示精确匹配
+	Children []*Node `json:"children,omitempty"`
+}
+
+//倒排检索接口, 由分区实现
+//Note:
+// 返回的倒排链必须按照docId升序排列, 交并差依赖这个有序性
+type Searcher interface {
+	TermDocs(fieldName, term string) []basic.DocNode               //词项查询
+	PhraseDocs(fieldName, phrase string, slop int) []basic.DocNode //短语查询
+	AllDocs() []basic.DocNode                                      //全部文档, 用于纯排除查询
+}
+
+//可读形式, 便于调试和测试
+func (n *Node) String() string {
+	switch n.Type {
+	case NODE_TERM, NODE_PHRASE:
+		val := n.Value
+		if n.Type == NODE_PHRASE {
+			val = fmt.Sprintf("%q", n.Value)
+			if n.Slop > 0 {
+				val = fmt.Sprintf("%v~%v", val, n.Slop)
+			}
+		}
+		if n.Field != "" {
+			return n.Field + ":" + val
+		}
+		return val
+	case NODE_NOT:
+		return "NOT " + n.Children[0].String()
+	case NODE_AND, NODE_OR:
+		op := " AND "
+		if n.Type == NODE_OR {
+			op = " OR "
+		}
+		subs := []string{}
+		for _, child := range n.Children {
+			subs = append(subs, child.String())
+		}
+		return "(" + strings.Join(subs, op) + ")"
+	}
+	return ""
+}
+
+//语法树中引用到的全部字段(去重), 未指定字段的叶子节点归入defaultField
+func (n *Node) FieldNames(defaultField string) []string {
+	names := []string{}
+	exist := map[string]bool{}
+	n.walk(func(leaf *Node) {
+		name := leaf.Field
+		if name == "" {
+			name = defaultField
+		}
+		if !exist[name] {
+			exist[name] = true
+			names = append(names, name)
+		}
+	})
+	return names
+}
+
+//遍历全部叶子节点
+func (n *Node) walk(fn func(leaf *Node)) {
+	if n.Type == NODE_TERM || n.Type == NODE_PHRASE {
+		fn(n)
+		return
+	}
+	for _, child := range n.Children {
+		child.walk(fn)
+	}
+}
+
+//求值, 返回满足条件的文档(docId升序)
+//各个词项命中的权重在交集、并集中累加
+func (n *Node) Eval(s Searcher, defaultField string) []basic.DocNode {
+	switch n.Type {
+	case NODE_TERM, NODE_PHRASE:
+		fieldName := n.Field
+		if fieldName == "" {
+			fieldName = defaultField
+		}
+		if n.Type == NODE_PHRASE {
+			return s.PhraseDocs(fieldName, n.Value, n.Slop)
+		}
+		return s.TermDocs(fieldName, n.Value)
+	case NODE_NOT:
+		return Subtract(s.AllDocs(), n.Children[0].Eval(s, defaultField))
+	case NODE_OR:
+		var ret []basic.DocNode
+		for i, child := range n.Children {
+			if i == 0 {
+				ret = child.Eval(s, defaultField)
+			} else {
+				ret = Union(ret, child.Eval(s, defaultField))
+			}
+		}
+		return ret
+	case NODE_AND:
+		//先对正向条件求交集, 再减去排除条件, 避免对全集求补
+		var ret []basic.DocNode
+		hasPositive := false
+		excludes := []*Node{}
+		for _, child := range n.Children {
+			if child.Type == NODE_NOT {
+				excludes = append(excludes, child.Children[0])
+				continue
+			}
+			docs := child.Eval(s, defaultField)
+			if !hasPositive {
+				ret = docs
+				hasPositive = true
+			} else {
+				ret = Intersect(ret, docs)
+			}
+			if len(ret) == 0 {
+				return ret
+			}
+		}
+		if !hasPositive {
+			ret = s.AllDocs()
+		}
+		for _, child := range excludes {
+			ret = Subtract(ret, child.Eval(s, defaultField))
+		}
+		return ret
+	}
+	return nil
+}
+
+//交集, 权重累加
+func Intersect(a, b []basic.DocNode) []basic.DocNode {
+	ret := []basic.DocNode{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].DocId == b[j].DocId {
+			ret = append(ret, basic.DocNode{DocId: a[i].DocId, Weight: a[i].Weight + b[j].Weight})
+			i++
+			j++
+		} else if a[i].DocId < b[j].DocId {
+			i++
+		} else {
+			j++
+		}
+	}
+	return ret
+}
+
+//并集, 同时命中的权重累加
+func Union(a, b []basic.DocNode) []basic.DocNode {
+	ret := make([]basic.DocNode, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].DocId == b[j].DocId {
+			ret = append(ret, basic.DocNode{DocId: a[i].DocId, Weight: a[i].Weight + b[j].Weight})
+			i++
+			j++
+		} else if a[i].DocId < b[j].DocId {
+			ret = append(ret, a[i])
+			i++
+		} else {
+			ret = append(ret, b[j])
+			j++
+		}
+	}
+	ret = append(ret, a[i:]...)
+	ret = append(ret, b[j:]...)
+	return ret
+}
+
+//差集, 保留a中不在b中的文档
+func Subtract(a, b []basic.DocNode) []basic.DocNode {
+	ret := []basic.DocNode{}
+	j := 0
+	for _, doc := range a {
+		for j < len(b) && b[j].DocId < doc.DocId {
+			j++
+		}
+		if j < len(b) && b[j].DocId == doc.DocId {
+			continue
+		}
+		ret = append(ret, doc)
+	}
+	return ret
+}
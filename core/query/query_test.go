@@ -0,0 +1,158 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"github.com/hq-cml/spider-engine/basic"
+	"github.com/hq-cml/spider-engine/utils/helper"
+)
+
+//测试用的倒排
+type fakeSearcher map[string][]basic.DocNode
+
+func (s fakeSearcher) TermDocs(fieldName, term string) []basic.DocNode {
+	return s[fieldName+":"+term]
+}
+
+func (s fakeSearcher) PhraseDocs(fieldName, phrase string, slop int) []basic.DocNode {
+	return s[fieldName+":"+phrase]
+}
+
+func (s fakeSearcher) AllDocs() []basic.DocNode {
+	ret := []basic.DocNode{}
+	for i := uint32(0); i < 6; i++ {
+		ret = append(ret, basic.DocNode{DocId: i})
+	}
+	return ret
+}
+
+func docIds(docs []basic.DocNode) []uint32 {
+	ret := []uint32{}
+	for _, doc := range docs {
+		ret = append(ret, doc.DocId)
+	}
+	return ret
+}
+
+func TestParse(t *testing.T) {
+	cases := map[string]string{
+		`golang`:                                         `golang`,
+		`title:golang`:                                   `title:golang`,
+		`"search engine"`:                                `"search engine"`,
+		`a AND b OR c`:                                   `((a AND b) OR c)`,
+		`a OR b AND c`:                                   `(a OR (b AND c))`,
+		`a b`:                                            `(a OR b)`,
+		`a && (b || c)`:                                  `(a AND (b OR c))`,
+		`NOT a`:                                          `NOT a`,
+		`- -a`:                                           `a`,
+		`title:(golang AND "search engine") OR -tag:spam`: `((title:golang AND title:"search engine") OR NOT tag:spam)`,
+		`title:(a OR tag:b)`:                             `(title:a OR tag:b)`,
+		`e-mail`:                                         `e-mail`,
+		`desc:"北京 大学"~3 AND x`:                           `(desc:"北京 大学"~3 AND x)`,
+	}
+	for q, expect := range cases {
+		node, err := Parse(q)
+		if err != nil {
+			panic(q + ": " + err.Error())
+		}
+		if node.String() != expect {
+			panic(q + " => " + node.String() + ", expect " + expect)
+		}
+		t.Log(q, " => ", node.String())
+	}
+
+	//默认运算符为AND
+	node, err := ParseWithOp(`a b OR c`, OP_AND)
+	if err != nil {
+		panic(err)
+	}
+	if node.String() != `((a AND b) OR c)` {
+		panic("Wrong default operator: " + node.String())
+	}
+
+	//非法的查询
+	for _, q := range []string{``, `(a OR b`, `"abc`, `a AND`, `title:`, `a )`, `"a b"~`} {
+		if _, err := Parse(q); err == nil {
+			panic("Should error: " + q)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	s := fakeSearcher{
+		"title:golang":        {{DocId: 0, Weight: 1}, {DocId: 1, Weight: 1}, {DocId: 3, Weight: 1}},
+		"title:search engine": {{DocId: 1, Weight: 2}, {DocId: 3, Weight: 2}, {DocId: 4, Weight: 2}},
+		"tag:spam":            {{DocId: 3}, {DocId: 5}},
+		"desc:rust":           {{DocId: 2, Weight: 5}},
+	}
+
+	node, _ := Parse(`title:(golang AND "search engine")`)
+	docs := node.Eval(s, "desc")
+	if helper.JsonEncode(docIds(docs)) != "[1,3]" || docs[0].Weight != 3 {
+		panic("Wrong AND result: " + helper.JsonEncode(docs))
+	}
+
+	node, _ = ParseWithOp(`title:(golang AND "search engine") -tag:spam`, OP_AND)
+	docs = node.Eval(s, "desc")
+	if helper.JsonEncode(docIds(docs)) != "[1]" {
+		panic("Wrong NOT result: " + helper.JsonEncode(docs))
+	}
+
+	node, _ = Parse(`title:golang OR rust`)
+	docs = node.Eval(s, "desc")
+	if helper.JsonEncode(docIds(docs)) != "[0,1,2,3]" {
+		panic("Wrong OR result: " + helper.JsonEncode(docs))
+	}
+
+	node, _ = Parse(`rust OR -tag:spam`)
+	docs = node.Eval(s, "desc")
+	if helper.JsonEncode(docIds(docs)) != "[0,1,2,4]" {
+		panic("Wrong OR NOT result: " + helper.JsonEncode(docs))
+	}
+
+	node, _ = Parse(`NOT title:golang`)
+	docs = node.Eval(s, "desc")
+	if helper.JsonEncode(docIds(docs)) != "[2,4,5]" {
+		panic("Wrong pure NOT result: " + helper.JsonEncode(docs))
+	}
+
+	t.Log(helper.JsonEncode(node.FieldNames("desc")))
+}
+
+func TestBM25(t *testing.T) {
+	s := NewBM25()
+	stats := TermStats{DocCount: 100, DocFreq: 10, AvgLen: 10}
+
+	//词频越高, 得分越高, 但是趋于饱和
+	s1 := s.Score(1, 10, stats)
+	s2 := s.Score(2, 10, stats)
+	s10 := s.Score(10, 10, stats)
+	if !(s1 < s2 && s2 < s10) || s10 > s1*(s.K1+1) {
+		panic(fmt.Sprintf("Wrong tf: %v, %v, %v", s1, s2, s10))
+	}
+
+	//文档越长, 得分越低; 长度未知按平均长度处理
+	if !(s.Score(1, 5, stats) > s1 && s.Score(1, 20, stats) < s1) || s.Score(1, 0, stats) != s1 {
+		panic("Wrong length norm")
+	}
+
+	//词项越稀有, 得分越高
+	rare := TermStats{DocCount: 100, DocFreq: 1, AvgLen: 10}
+	if s.Score(1, 10, rare) <= s1 {
+		panic("Wrong idf")
+	}
+
+	//打分上下文: 统计信息只计算一次, 权重放大后存储
+	calls := 0
+	sc := NewScoring(s, func(fieldName, term string) TermStats {
+		calls++
+		return stats
+	})
+	w := sc.Weight("title", "golang", 1, 10)
+	sc.Weight("title", "golang", 2, 10)
+	if calls != 1 || w != uint32(math.Round(s1*SCORE_MULTIPLE)) {
+		panic(fmt.Sprintf("Wrong scoring: %v, %v", calls, w))
+	}
+	t.Log("BM25: ", s1, s2, s10)
+}
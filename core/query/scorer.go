@@ -0,0 +1,104 @@
+package query
+
+/*
+ * 相关性打分
+ * 打分器是可插拔的, 默认使用BM25, 同时保留TF-IDF
+ * 语料的统计信息(有效文档数、字段平均长度、词项的文档频率)由表统一提供,
+ * 所有分区使用同一套统计口径, 所以各个分区的得分可以直接比较
+ */
+import (
+	"math"
+)
+
+const (
+	SCORE_MULTIPLE = 100000 //得分放大倍数, DocNode的权重是uint32, 得分放大后四舍五入存储
+)
+
+//词项在表中的统计信息
+type TermStats struct {
+	DocCount uint32  //有效文档数
+	DocFreq  uint32  //包含词项的有效文档数
+	AvgLen   float64 //字段的平均长度(词项个数)
+}
+
+//打分器接口
+//tf是词项在文档字段中出现的次数, fieldLen是文档字段的长度, 0表示长度未知
+type Scorer interface {
+	Score(tf float64, fieldLen uint32, stats TermStats) float64
+}
+
+//BM25打分器
+type BM25 struct {
+	K1 float64 //词频饱和度
+	B  float64 //长度归一化的程度, 0表示不做归一化
+}
+
+//默认参数的BM25
+func NewBM25() *BM25 {
+	return &BM25{K1: 1.2, B: 0.75}
+}
+
+func (s *BM25) Score(tf float64, fieldLen uint32, stats TermStats) float64 {
+	n := float64(stats.DocCount)
+	df := float64(stats.DocFreq)
+	if df > n {
+		df = n
+	}
+	idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+
+	//长度未知的时候, 按平均长度处理
+	norm := 1.0
+	if fieldLen > 0 && stats.AvgLen > 0 {
+		norm = 1 - s.B + s.B*float64(fieldLen)/stats.AvgLen
+	}
+	return idf * tf * (s.K1 + 1) / (tf + s.K1*norm)
+}
+
+//TF-IDF打分器
+type TFIDF struct{}
+
+func (s *TFIDF) Score(tf float64, fieldLen uint32, stats TermStats) float64 {
+	if stats.DocFreq == 0 {
+		return 0
+	}
+	freq := tf
+	if fieldLen > 0 {
+		freq = tf / float64(fieldLen)
+	}
+	idf := math.Log10(1 + float64(stats.DocCount)/float64(stats.DocFreq))
+	return freq * idf
+}
+
+//一次搜索的打分上下文
+//统计信息按照字段+词项缓存, 同一次搜索中各个分区只计算一次
+type Scoring struct {
+	scorer  Scorer
+	statsFn func(fieldName, term string) TermStats
+	cache   map[string]TermStats
+}
+
+func NewScoring(scorer Scorer, statsFn func(fieldName, term string) TermStats) *Scoring {
+	return &Scoring{
+		scorer:  scorer,
+		statsFn: statsFn,
+		cache:   map[string]TermStats{},
+	}
+}
+
+//计算得分, 返回放大之后的权重
+func (sc *Scoring) Weight(fieldName, term string, tf float64, fieldLen uint32) uint32 {
+	key := fieldName + "\x00" + term
+	stats, ok := sc.cache[key]
+	if !ok {
+		stats = sc.statsFn(fieldName, term)
+		sc.cache[key] = stats
+	}
+	score := sc.scorer.Score(tf, fieldLen, stats)
+	if score <= 0 {
+		return 0
+	}
+	if score*SCORE_MULTIPLE >= math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(math.Round(score * SCORE_MULTIPLE))
+}
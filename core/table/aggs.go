@@ -0,0 +1,111 @@
+package table
+
+/*
+ * 搜索结果的聚合(分面)
+ * 聚合针对过滤之后的全部命中文档, 不受分页影响
+ * 每个分区基于正排索引算出中间状态, 表汇总各个分区的中间状态之后得出最终结果
+ */
+import (
+	"errors"
+	"fmt"
+	"github.com/hq-cml/spider-engine/basic"
+	"github.com/hq-cml/spider-engine/core/index"
+	"github.com/hq-cml/spider-engine/core/partition"
+	"github.com/hq-cml/spider-engine/utils/helper"
+	"sort"
+)
+
+const (
+	DEFAULT_AGG_TERMS_SIZE = 10
+)
+
+//校验聚合参数, 并补全默认值
+func (tbl *Table) checkAggs(aggs map[string]basic.SearchAgg) (map[string]basic.SearchAgg, error) {
+	ret := map[string]basic.SearchAgg{}
+	for name, agg := range aggs {
+		fld, exist := tbl.BasicFields[agg.FieldName]
+		if !exist {
+			return nil, errors.New(fmt.Sprintf("Field %v not Exist ", agg.FieldName))
+		}
+
+		switch agg.AggType {
+		case basic.AGG_TERMS:
+			if fld.IndexType != index.IDX_TYPE_STR_WHOLE {
+				return nil, errors.New(agg.FieldName + " should be whole")
+			}
+			if agg.Size <= 0 {
+				agg.Size = DEFAULT_AGG_TERMS_SIZE
+			}
+		case basic.AGG_MIN, basic.AGG_MAX, basic.AGG_AVG, basic.AGG_SUM:
+			if fld.IndexType != index.IDX_TYPE_INTEGER && fld.IndexType != index.IDX_TYPE_FLOAT {
+				return nil, errors.New(agg.FieldName + " should be number or float")
+			}
+		case basic.AGG_DATE_HISTOGRAM:
+			if fld.IndexType != index.IDX_TYPE_DATE {
+				return nil, errors.New(agg.FieldName + " should be time")
+			}
+			switch agg.Interval {
+			case "":
+				agg.Interval = partition.INTERVAL_DAY
+			case partition.INTERVAL_HOUR, partition.INTERVAL_DAY, partition.INTERVAL_WEEK,
+				partition.INTERVAL_MONTH, partition.INTERVAL_YEAR:
+			default:
+				return nil, errors.New("Unsupport interval: " + agg.Interval)
+			}
+		default:
+			return nil, errors.New("Unsupport aggregation: " + agg.AggType)
+		}
+		ret[name] = agg
+	}
+	return ret, nil
+}
+
+//由汇总之后的中间状态计算最终结果
+func finishAgg(agg basic.SearchAgg, state *partition.AggState) *basic.AggResult {
+	ret := &basic.AggResult{Count: state.Count}
+	switch agg.AggType {
+	case basic.AGG_TERMS:
+		ret.Buckets = []basic.AggBucket{}
+		for k, v := range state.Terms {
+			ret.Buckets = append(ret.Buckets, basic.AggBucket{Key: k, Count: v})
+		}
+		//文档数多的在前, 相同的按值排序
+		sort.Slice(ret.Buckets, func(i, j int) bool {
+			if ret.Buckets[i].Count != ret.Buckets[j].Count {
+				return ret.Buckets[i].Count > ret.Buckets[j].Count
+			}
+			return ret.Buckets[i].Key < ret.Buckets[j].Key
+		})
+		if len(ret.Buckets) > agg.Size {
+			ret.Buckets = ret.Buckets[:agg.Size]
+		}
+	case basic.AGG_DATE_HISTOGRAM:
+		keys := []int64{}
+		for k := range state.Buckets {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		ret.Buckets = []basic.AggBucket{}
+		for _, k := range keys {
+			ret.Buckets = append(ret.Buckets, basic.AggBucket{Key: helper.Timestamp2String(k), Count: state.Buckets[k]})
+		}
+	default:
+		//没有值的时候, 结果为空
+		if state.Count == 0 {
+			return ret
+		}
+		var v float64
+		switch agg.AggType {
+		case basic.AGG_MIN:
+			v = state.Min
+		case basic.AGG_MAX:
+			v = state.Max
+		case basic.AGG_SUM:
+			v = state.Sum
+		case basic.AGG_AVG:
+			v = state.Sum / float64(state.Count)
+		}
+		ret.Value = &v
+	}
+	return ret
+}
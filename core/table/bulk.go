@@ -0,0 +1,130 @@
+package table
+
+/*
+ * 批量写入
+ * 一批操作在一次写锁之内依次执行, WAL在批量结束时统一刷盘, 每个操作单独返回结果, 某一个失败不影响其他的操作
+ * 指定IfVersion的操作只有文档的当前版本一致才执行
+ *   index:  主键存在则变更, 否则新增
+ *   create: 新增, 主键已经存在则失败
+ *   update: 变更, 主键不存在则失败
+ *   delete: 删除, 主键不存在返回not_found
+ */
+import (
+	"errors"
+	"github.com/hq-cml/spider-engine/utils/log"
+)
+
+const (
+	BULK_OP_INDEX  = "index"
+	BULK_OP_CREATE = "create"
+	BULK_OP_UPDATE = "update"
+	BULK_OP_DELETE = "delete"
+
+	BULK_STATUS_CREATED   = "created"
+	BULK_STATUS_UPDATED   = "updated"
+	BULK_STATUS_DELETED   = "deleted"
+	BULK_STATUS_NOT_FOUND = "not_found"
+)
+
+//批量中的一个操作
+type BulkItem struct {
+	Op         string
+	PrimaryKey string                 //为空时新增的文档自动生成主键
+	Content    map[string]interface{} //删除时不需要
+	IfVersion  uint64                 //非0时校验文档的当前版本
+}
+
+//一个操作的结果
+type BulkResult struct {
+	Op         string `json:"op"`
+	PrimaryKey string `json:"primaryKey"`
+	Status     string `json:"status,omitempty"`
+	Version    uint64 `json:"version,omitempty"` //写入之后文档的版本
+	Error      string `json:"error,omitempty"`
+}
+
+//批量写入, 只加一次写锁
+//返回的error表示WAL刷盘失败, 此时各个操作已经生效, 但是不保证宕机之后不丢失
+func (tbl *Table) BulkDocs(items []*BulkItem) ([]*BulkResult, error) {
+	//写锁
+	tbl.rwMutex.Lock()
+	defer tbl.rwMutex.Unlock()
+
+	wal := tbl.wal
+	if wal != nil {
+		wal.BeginBatch()
+	}
+	results := make([]*BulkResult, len(items))
+	for i, item := range items {
+		results[i] = tbl.bulkOne(item)
+	}
+	if wal != nil {
+		if err := wal.EndBatch(); err != nil {
+			log.Errf("Bulk sync wal error: %v", err)
+			return results, err
+		}
+	}
+	log.Infof("Table %v bulk %v docs", tbl.TableName, len(items))
+	return results, nil
+}
+
+//执行批量中的一个操作
+func (tbl *Table) bulkOne(item *BulkItem) *BulkResult {
+	ret := &BulkResult{Op: item.Op, PrimaryKey: item.PrimaryKey}
+	var err error
+	switch item.Op {
+	case BULK_OP_INDEX, BULK_OP_CREATE, BULK_OP_UPDATE:
+		if err = tbl.fillPrimaryKey(item); err != nil {
+			break
+		}
+		update := item.Op == BULK_OP_UPDATE
+		if item.Op == BULK_OP_INDEX && tbl.PrimaryKey != "" && item.PrimaryKey != "" {
+			_, update = tbl.findDocIdByPrimaryKey(item.PrimaryKey)
+		}
+		var docId uint32
+		if update {
+			docId, err = tbl.updateDoc(item.Content, item.IfVersion)
+			ret.Status = BULK_STATUS_UPDATED
+		} else if err = tbl.checkVersion(item.PrimaryKey, 0, false, item.IfVersion); err == nil {
+			var key string
+			if docId, key, err = tbl.addDoc(item.Content); key != "" {
+				ret.PrimaryKey = key
+			}
+			ret.Status = BULK_STATUS_CREATED
+		}
+		if err == nil {
+			ret.Version = tbl.getVersion(docId)
+		}
+	case BULK_OP_DELETE:
+		var found bool
+		if found, err = tbl.delDoc(item.PrimaryKey, item.IfVersion); err != nil {
+			break
+		} else if found {
+			ret.Status = BULK_STATUS_DELETED
+		} else {
+			ret.Status = BULK_STATUS_NOT_FOUND
+		}
+	default:
+		err = errors.New("Unsupport bulk op: " + item.Op)
+	}
+	if err != nil {
+		ret.Status = ""
+		ret.Error = err.Error()
+	}
+	return ret
+}
+
+//主键值写入文档内容, 文档中已经有主键时必须和指定的一致
+func (tbl *Table) fillPrimaryKey(item *BulkItem) error {
+	if item.Content == nil {
+		return errors.New("Doc content is empty!")
+	}
+	if tbl.PrimaryKey == "" || item.PrimaryKey == "" {
+		return nil
+	}
+	if v, exist := item.Content[tbl.PrimaryKey]; exist && v != item.PrimaryKey {
+		return errors.New("PrimaryKey val is not consitent!")
+	}
+	item.Content[tbl.PrimaryKey] = item.PrimaryKey
+	return nil
+}
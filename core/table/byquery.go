@@ -0,0 +1,161 @@
+package table
+
+/*
+ * 按查询删除/更新
+ * 分两步进行: 先在读锁之内找出命中的全部文档(docId), 再由调用方分批删除或局部更新, 每一批在一次写锁之内执行
+ * docId和文档内容一一对应(变更会生成新的docId), 所以找出之后才被删除或变更过的文档, 其docId已经标记删除,
+ * 计入冲突直接跳过, 不会覆盖掉期间的写入
+ */
+import (
+	"errors"
+	"fmt"
+	"github.com/hq-cml/spider-engine/basic"
+	"github.com/hq-cml/spider-engine/core/query"
+	"github.com/hq-cml/spider-engine/utils/log"
+)
+
+//一批文档的处理结果
+type ByQueryResult struct {
+	Deleted   int      `json:"deleted"`
+	Updated   int      `json:"updated"`
+	Conflicts int      `json:"conflicts"`          //期间已经被删除或变更过的文档
+	Failures  []string `json:"failures,omitempty"` //单个文档的失败原因
+}
+
+//累加一批的结果
+func (ret *ByQueryResult) Add(other *ByQueryResult) {
+	ret.Deleted += other.Deleted
+	ret.Updated += other.Updated
+	ret.Conflicts += other.Conflicts
+	ret.Failures = append(ret.Failures, other.Failures...)
+}
+
+//按词项搜索, 返回命中的全部文档的docId, 不排序不分页
+func (tbl *Table) MatchDocIdsWithOp(fieldName, keyWord, op string, filters []basic.SearchFilter) ([]uint32, error) {
+	searchFn, err := tbl.opSearchFn(fieldName, keyWord, op, filters)
+	if err != nil {
+		return nil, err
+	}
+	return tbl.matchDocIds(filters, searchFn)
+}
+
+//按查询语法树搜索, 返回命中的全部文档的docId, 不排序不分页
+func (tbl *Table) MatchDocIdsQuery(node *query.Node, defaultField string, filters []basic.SearchFilter) ([]uint32, error) {
+	searchFn, err := tbl.querySearchFn(node, defaultField, filters)
+	if err != nil {
+		return nil, err
+	}
+	return tbl.matchDocIds(filters, searchFn)
+}
+
+//各个分区分别检索, 汇总docId
+func (tbl *Table) matchDocIds(filters []basic.SearchFilter, searchFn searchFunc) ([]uint32, error) {
+	if tbl.status != TABLE_STATUS_RUNNING {
+		return nil, errors.New("The Spider Is Not Running!")
+	}
+	if err := tbl.checkFilters(filters); err != nil {
+		return nil, err
+	}
+
+	//读锁
+	tbl.rwMutex.RLock()
+	defer tbl.rwMutex.RUnlock()
+
+	docIds := []uint32{}
+	scoring := tbl.newScoring()
+	prts := tbl.partitions
+	if tbl.memPartition != nil && !tbl.memPartition.IsEmpty() {
+		prts = append(prts[:len(prts):len(prts)], tbl.memPartition)
+	}
+	for _, prt := range prts {
+		nodes, ok := searchFn(prt, scoring)
+		if !ok {
+			continue
+		}
+		for _, node := range nodes {
+			docIds = append(docIds, node.DocId)
+		}
+	}
+	return docIds, nil
+}
+
+//按docId批量删除, 在一次写锁之内执行, WAL在结束时统一刷盘
+func (tbl *Table) DeleteByDocIds(docIds []uint32) (*ByQueryResult, error) {
+	return tbl.applyByDocIds(docIds, func(key string, docId uint32, ret *ByQueryResult) error {
+		found, err := tbl.delDoc(key, 0)
+		if err == nil && found {
+			ret.Deleted++
+		}
+		return err
+	})
+}
+
+//按docId批量局部更新, fields中的字段覆盖原值, incr中的数字字段在原值上增减
+func (tbl *Table) PatchByDocIds(docIds []uint32, fields map[string]interface{}, incr map[string]float64) (*ByQueryResult, error) {
+	if _, exist := fields[tbl.PrimaryKey]; exist {
+		return nil, errors.New("Can not update the primary key!")
+	}
+	if err := tbl.checkIncr(fields, incr); err != nil {
+		return nil, err
+	}
+	return tbl.applyByDocIds(docIds, func(key string, docId uint32, ret *ByQueryResult) error {
+		content, exist := tbl.getDocByDocId(docId)
+		if !exist {
+			return errors.New("Can not find the doc content")
+		}
+		if err := tbl.mergePatch(content, fields, incr); err != nil {
+			return err
+		}
+		content[tbl.PrimaryKey] = key
+		if _, err := tbl.updateDoc(content, 0); err != nil {
+			return err
+		}
+		ret.Updated++
+		return nil
+	})
+}
+
+//在一次写锁之内逐个处理仍然存活的文档
+func (tbl *Table) applyByDocIds(docIds []uint32, fn func(key string, docId uint32, ret *ByQueryResult) error) (*ByQueryResult, error) {
+	//写锁
+	tbl.rwMutex.Lock()
+	defer tbl.rwMutex.Unlock()
+
+	//校验
+	if tbl.status != TABLE_STATUS_RUNNING {
+		return nil, errors.New("Table status must be running!")
+	}
+	if tbl.readOnly() {
+		return nil, errors.New("Table is read only!")
+	}
+	if tbl.PrimaryKey == "" {
+		return nil, errors.New("No Primary Key")
+	}
+
+	wal := tbl.wal
+	if wal != nil {
+		wal.BeginBatch()
+	}
+	ret := &ByQueryResult{}
+	for _, docId := range docIds {
+		if tbl.delFlagBitMap.IsSet(uint64(docId)) {
+			ret.Conflicts++
+			continue
+		}
+		key, ok := tbl.findPrimaryKeyByDocId(docId)
+		if !ok {
+			ret.Conflicts++
+			continue
+		}
+		if err := fn(key, docId, ret); err != nil {
+			ret.Failures = append(ret.Failures, fmt.Sprintf("%v: %v", key, err))
+		}
+	}
+	if wal != nil {
+		if err := wal.EndBatch(); err != nil {
+			log.Errf("ByQuery sync wal error: %v", err)
+			return ret, err
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,121 @@
+package table
+
+/*
+ * 全表导出
+ * 按docId顺序遍历各个分区, 跳过删除标记的文档, 逐个回调; 不打分不排序, 内存占用和表的大小无关
+ * 每次只在读锁之内取出EXPORT_BATCH_SIZE个docId范围内的文档, 回调(如写网络)时不持有锁, 不会长时间阻塞写入; 期间表被关闭则导出失败
+ * 导出不是某一时刻的快照: 导出期间新增的文档可能被导出, 被变更的文档可能出现两次(新的docId在后面)
+ */
+import (
+	"errors"
+	"github.com/hq-cml/spider-engine/basic"
+)
+
+const EXPORT_BATCH_SIZE = 1000 //每次加锁遍历的docId个数
+
+//导出全部存活的文档, fields为空表示全部字段
+//fn返回错误时停止导出, 并返回该错误
+func (tbl *Table) Export(fields []string, fn func(doc *basic.DocInfo) error) error {
+	if tbl.status != TABLE_STATUS_RUNNING {
+		return errors.New("The Spider Is Not Running!")
+	}
+
+	fieldNames, withKey, err := tbl.exportFields(fields)
+	if err != nil {
+		return err
+	}
+
+	docs := make([]*basic.DocInfo, 0, EXPORT_BATCH_SIZE)
+	for docId := uint32(0); ; {
+		var end uint32
+		if docs, end, err = tbl.exportBatch(docId, fieldNames, withKey, docs[:0]); err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if err := fn(doc); err != nil {
+				return err
+			}
+		}
+		if end <= docId {
+			return nil
+		}
+		docId = end
+	}
+}
+
+//在读锁之内解析需要导出的字段(字段可能被并发的增删), 主键单独处理
+func (tbl *Table) exportFields(fields []string) ([]string, bool, error) {
+	//读锁
+	tbl.rwMutex.RLock()
+	defer tbl.rwMutex.RUnlock()
+
+	withKey := tbl.PrimaryKey != DEFAULT_PRIMARY_FIELD_NAME
+	fieldNames := []string{}
+	if len(fields) == 0 {
+		for _, v := range tbl.BasicFields {
+			if v.FieldName != tbl.PrimaryKey {
+				fieldNames = append(fieldNames, v.FieldName)
+			}
+		}
+		return fieldNames, withKey, nil
+	}
+
+	withKey = false
+	for _, fieldName := range fields {
+		if fieldName == tbl.PrimaryKey && tbl.PrimaryKey != DEFAULT_PRIMARY_FIELD_NAME {
+			withKey = true
+			continue
+		}
+		if _, exist := tbl.BasicFields[fieldName]; !exist || fieldName == tbl.PrimaryKey {
+			return nil, false, errors.New("Field not exist: " + fieldName)
+		}
+		fieldNames = append(fieldNames, fieldName)
+	}
+	return fieldNames, withKey, nil
+}
+
+//在读锁之内取出[start, start+EXPORT_BATCH_SIZE)之间的存活文档, 返回下一批的起点, 没有更多的文档时返回start
+func (tbl *Table) exportBatch(start uint32, fieldNames []string, withKey bool, docs []*basic.DocInfo) ([]*basic.DocInfo, uint32, error) {
+	//读锁
+	tbl.rwMutex.RLock()
+	defer tbl.rwMutex.RUnlock()
+
+	if tbl.status != TABLE_STATUS_RUNNING {
+		return nil, 0, errors.New("Table is closed!")
+	}
+
+	if start < tbl.StartDocId {
+		start = tbl.StartDocId
+	}
+	if start >= tbl.NextDocId {
+		return docs, start, nil
+	}
+	end := start + EXPORT_BATCH_SIZE
+	if end > tbl.NextDocId || end < start {
+		end = tbl.NextDocId
+	}
+
+	for docId := start; docId < end; docId++ {
+		if tbl.delFlagBitMap.IsSet(uint64(docId)) {
+			continue
+		}
+		prt, ok := tbl.findPartition(docId)
+		if !ok || !prt.HasDoc(docId) {
+			continue
+		}
+		detail, _ := prt.GetValueWithFields(docId, fieldNames)
+		primaryKey, ok := tbl.findPrimaryKeyByDocId(docId)
+		if !ok {
+			continue
+		}
+		if withKey {
+			detail[tbl.PrimaryKey] = primaryKey
+		}
+		docs = append(docs, &basic.DocInfo{
+			Key:     primaryKey,
+			Detail:  detail,
+			Version: tbl.getVersion(docId),
+		})
+	}
+	return docs, end, nil
+}
@@ -0,0 +1,120 @@
+package table
+
+/*
+ * 内存分区的落地策略
+ * 满足以下任意一个条件, 内存分区就会落地成磁盘分区：
+ *   1. 文档数: 内存分区的文档数达到PART_PERSIST_MIN_DOC_CNT
+ *   2. 内存: 内存分区的索引(termMap、memoryStr等)占用的内存超过FLUSH_MAX_BYTES
+ *   3. 时间: 内存分区中最早的一个文档写入之后超过FLUSH_MAX_AGE_SEC仍未落地
+ * 各个阈值可以按表设置, 详见TableSettings
+ * 前两个条件在写入文档时检查; 写入停止之后时间条件就不会再被写入触发, 所以由后台协程定时检查
+ * 另外可以手动落地(Flush)
+ */
+import (
+	"time"
+	"github.com/hq-cml/spider-engine/utils/log"
+)
+
+const FLUSH_CHECK_INTERVAL = time.Second //后台检查的周期
+
+//启动后台定时落地
+func (tbl *Table) startFlusher() {
+	tbl.flushStop = make(chan struct{})
+	tbl.flushWg.Add(1)
+	go func() {
+		defer tbl.flushWg.Done()
+		ticker := time.NewTicker(FLUSH_CHECK_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-tbl.flushStop:
+				return
+			case <-ticker.C:
+				tbl.flushExpired()
+			}
+		}
+	}()
+}
+
+//停止后台定时落地
+//Note: 调用方不能持有表的锁
+func (tbl *Table) stopFlusher() {
+	if tbl.flushStop == nil {
+		return
+	}
+	select {
+	case <-tbl.flushStop: //已经停止
+		return
+	default:
+	}
+	close(tbl.flushStop)
+	tbl.flushWg.Wait()
+}
+
+//内存分区超时则落地
+func (tbl *Table) flushExpired() {
+	tbl.rwMutex.Lock()
+	defer tbl.rwMutex.Unlock()
+
+	if tbl.status != TABLE_STATUS_RUNNING || tbl.replaying || !tbl.memExpired() {
+		return
+	}
+	if err := tbl.Persist(); err != nil {
+		log.Errf("Flush Error: %v. Table: %v", err.Error(), tbl.TableName)
+		return
+	}
+	log.Infof("Flush expired mem partition. Table: %v", tbl.TableName)
+	tbl.notifyMerge()
+}
+
+//手动落地内存分区, 落地之后通知后台合并
+func (tbl *Table) Flush() error {
+	tbl.rwMutex.Lock()
+	defer tbl.rwMutex.Unlock()
+
+	if err := tbl.Persist(); err != nil {
+		return err
+	}
+	tbl.notifyMerge()
+	return nil
+}
+
+//写入文档之后检查是否满足落地的条件, 满足则落地, 落地之后通知后台合并
+//Note: 调用方需持有写锁
+func (tbl *Table) checkFlush() {
+	if tbl.memSince.IsZero() && tbl.memPartition != nil && !tbl.memPartition.IsEmpty() {
+		tbl.memSince = time.Now()
+	}
+
+	//重放WAL时不触发, 否则会清空还没重放完的WAL
+	if tbl.replaying || !tbl.needFlush() {
+		return
+	}
+	if err := tbl.Persist(); err != nil {
+		log.Fatalf("Persist Error: %v. Table: %v", err.Error(), tbl.TableName)
+	}
+	tbl.notifyMerge()
+}
+
+//是否满足落地的条件
+func (tbl *Table) needFlush() bool {
+	if tbl.memPartition == nil || tbl.memPartition.IsEmpty() {
+		return false
+	}
+	if tbl.NextDocId - tbl.memPartition.StartDocId >= tbl.persistMinDocCnt() {
+		return true
+	}
+	if maxBytes := tbl.flushMaxBytes(); maxBytes > 0 && tbl.memPartition.MemBytes() >= maxBytes {
+		return true
+	}
+	return tbl.memExpired()
+}
+
+//内存分区中的数据是否超时未落地
+func (tbl *Table) memExpired() bool {
+	if tbl.memPartition == nil || tbl.memPartition.IsEmpty() || tbl.memSince.IsZero() {
+		return false
+	}
+	maxAge := tbl.flushMaxAge()
+	return maxAge > 0 && time.Since(tbl.memSince) >= maxAge
+}
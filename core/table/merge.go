@@ -0,0 +1,376 @@
+package table
+
+/*
+ * 分区合并
+ * 合并分三步进行, 只有首尾两步需要加表的写锁, 耗时的中间步骤不加锁, 合并过程中搜索和增删改都可以照常进行：
+ *   1. 加写锁: 选出要合并的分区, 记录下此刻存活的文档(bitmap的快照)
+ *   2. 不加锁: 生成新分区, 只读取源分区(磁盘分区只读)和快照, 期间搜索仍然使用旧的分区
+ *   3. 加写锁: 用新分区原子的替换掉旧分区, 提交元信息, 之后再清理旧分区
+ * 合并期间被删除的文档会留在新分区中, 以bitmap的删除标记为准, 下次合并时再剔除
+ *
+ * 合并策略：
+ *   后台合并: 分层合并, 分区按存活文档数分层, 同一层级相邻的分区个数达到PART_MERGE_FACTOR就合并成上一层级的分区,
+ *            另外删除的文档超过一半的分区单独合并, 以剔除删除的文档
+ *   手动合并(MergePartitions): 文档数不足PART_MERGE_MIN_DOC_CNT的分区依次合并
+ * 各个阈值可以按表设置, 详见TableSettings
+ * 同一时刻只有一个合并在进行
+ */
+import (
+	"errors"
+	"fmt"
+	"github.com/hq-cml/spider-engine/core/field"
+	"github.com/hq-cml/spider-engine/core/partition"
+	"github.com/hq-cml/spider-engine/utils/log"
+)
+
+//一组待合并的分区
+type mergeTask struct {
+	parts       []*partition.Partition
+	prtPathName string
+	docIds      []uint32 //快照时存活的文档
+	purged      []uint32 //快照时已删除的文档, 合并之后清理主键
+	realDocNum  uint32   //快照时源分区的有效文档数之和
+	newPart     *partition.Partition
+}
+
+//启动后台合并
+func (tbl *Table) startMerger() {
+	tbl.mergeCh = make(chan struct{}, 1)
+	tbl.mergeStop = make(chan struct{})
+	tbl.mergeWg.Add(1)
+	go func() {
+		defer tbl.mergeWg.Done()
+		for {
+			select {
+			case <-tbl.mergeStop:
+				return
+			case <-tbl.mergeCh:
+				if err := tbl.mergeTiered(); err != nil {
+					log.Errf("Background merge error: %v. Table: %v", err, tbl.TableName)
+				}
+			}
+		}
+	}()
+}
+
+//停止后台合并, 等待正在进行的合并结束
+//Note: 调用方不能持有表的锁, 否则合并的最后一步会死锁
+func (tbl *Table) stopMerger() {
+	if tbl.mergeStop == nil {
+		return
+	}
+	select {
+	case <-tbl.mergeStop: //已经停止
+		return
+	default:
+	}
+	close(tbl.mergeStop)
+	tbl.mergeWg.Wait()
+}
+
+//通知后台合并, 不阻塞, 已经有待处理的通知则忽略
+func (tbl *Table) notifyMerge() {
+	if tbl.mergeCh == nil || tbl.replaying {
+		return
+	}
+	select {
+	case tbl.mergeCh <- struct{}{}:
+	default:
+	}
+}
+
+//后台的分层合并, 合并之后可能满足更高层级的合并条件, 所以一直合并到没有可合并的分区为止
+func (tbl *Table) mergeTiered() error {
+	for {
+		select {
+		case <-tbl.mergeStop:
+			return nil
+		default:
+		}
+		n, err := tbl.doMerge(false, tbl.pickTiered)
+		if err != nil || n == 0 {
+			return err
+		}
+	}
+}
+
+//合并表内分区
+//内存分区非空则先落地, 然后将文档数不足PART_MERGE_MIN_DOC_CNT的分区依次合并
+func (tbl *Table) MergePartitions() error {
+	_, err := tbl.doMerge(true, tbl.pickLegacy)
+	return err
+}
+
+//分区所在的层级, 存活文档数每增加PART_MERGE_FACTOR倍, 层级加一
+//落地阈值为0(没有加载配置)或者倍数不足2时无法分层, 都视为0层
+func (tbl *Table) mergeLevel(docCnt uint32) int {
+	level := 0
+	factor := uint64(tbl.mergeFactor())
+	size := uint64(tbl.persistMinDocCnt()) * factor
+	if size == 0 || factor < 2 {
+		return level
+	}
+	for uint64(docCnt) >= size {
+		level++
+		size = size * factor
+	}
+	return level
+}
+
+//分层合并策略
+//Note: 调用方需持有写锁
+func (tbl *Table) pickTiered() [][]*partition.Partition {
+	groups := [][]*partition.Partition{}
+	run := []*partition.Partition{}
+	runLevel := -1
+	for _, prt := range tbl.partitions {
+		//删除的文档超过一半, 单独合并
+		if prt.DocCnt > 0 && prt.RealDocNum * 2 < prt.DocCnt {
+			groups = append(groups, []*partition.Partition{prt})
+			run, runLevel = []*partition.Partition{}, -1
+			continue
+		}
+		level := tbl.mergeLevel(prt.DocCnt)
+		if level != runLevel {
+			run, runLevel = []*partition.Partition{}, level
+		}
+		run = append(run, prt)
+		if len(run) == tbl.mergeFactor() {
+			groups = append(groups, run)
+			run, runLevel = []*partition.Partition{}, -1
+		}
+	}
+	return groups
+}
+
+//手动合并的策略: 找到第一个文档数不足PART_MERGE_MIN_DOC_CNT的分区, 从它开始, 一点点尝试出最佳的分区合并方式
+//Note: 调用方需持有写锁
+func (tbl *Table) pickLegacy() [][]*partition.Partition {
+	startIdx := -1
+	for idx := range tbl.partitions {
+		if tbl.partitions[idx].NextDocId - tbl.partitions[idx].StartDocId < tbl.mergeMinDocCnt() {
+			startIdx = idx
+			break
+		}
+	}
+	if startIdx == -1 || len(tbl.partitions[startIdx:]) == 1 {
+		log.Infof("No nessary to merge!")
+		return nil
+	}
+
+	groups := [][]*partition.Partition{}
+	start := tbl.partitions[startIdx].StartDocId
+	tmpPrts := []*partition.Partition{}
+	for i := startIdx; i < len(tbl.partitions); i++ {
+		tmpPrts = append(tmpPrts, tbl.partitions[i])
+		if tbl.partitions[i].NextDocId - start >= tbl.mergeMinDocCnt() {
+			groups = append(groups, tmpPrts)
+			tmpPrts = []*partition.Partition{}
+			start = tbl.partitions[i].NextDocId
+		}
+	}
+	if len(tmpPrts) > 0 {
+		groups = append(groups, tmpPrts)
+	}
+	return groups
+}
+
+//执行一轮合并, 返回合并的组数
+func (tbl *Table) doMerge(persistMem bool, pick func() [][]*partition.Partition) (int, error) {
+	tbl.mergeMutex.Lock()
+	defer tbl.mergeMutex.Unlock()
+
+	//第一步: 选出分区, 做快照
+	tasks, basicFields, err := tbl.prepareMerge(persistMem, pick)
+	if err != nil || len(tasks) == 0 {
+		return 0, err
+	}
+
+	//第二步: 生成新分区, 不加锁
+	for _, task := range tasks {
+		log.Infof("Table[%v] Merge Partition[%v] Begin!", tbl.TableName, task.prtPathName)
+		newPart := partition.NewEmptyPartitionWithBasicFields(task.prtPathName, task.parts[0].StartDocId, basicFields)
+		if err := newPart.MergePersistPartitions(task.parts, task.docIds); err != nil {
+			log.Errf("MergePartitions Error: %s", err)
+			newPart.Destroy()
+			destroyMerged(tasks)
+			return 0, err
+		}
+		task.newPart = newPart
+		log.Infof("Table[%v] Merge Partition[%v] Finish!", tbl.TableName, task.prtPathName)
+	}
+
+	//第三步: 替换
+	if err := tbl.commitMerge(tasks, basicFields); err != nil {
+		destroyMerged(tasks)
+		return 0, err
+	}
+	//旧分区已经不在表中, 搜索不会再用到, 可以放心清理
+	for _, task := range tasks {
+		for _, prt := range task.parts {
+			prt.Destroy()
+		}
+	}
+	return len(tasks), nil
+}
+
+//合并第一步, 加写锁
+func (tbl *Table) prepareMerge(persistMem bool, pick func() [][]*partition.Partition) ([]*mergeTask, []field.BasicField, error) {
+	tbl.rwMutex.Lock()
+	defer tbl.rwMutex.Unlock()
+
+	if tbl.status != TABLE_STATUS_RUNNING {
+		return nil, nil, errors.New("Table status must be running!")
+	}
+
+	//内存分区非空则先落地
+	if persistMem && tbl.memPartition != nil && !tbl.memPartition.IsEmpty() {
+		if err := tbl.persistMemPartition(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	//准备好非主键字段信息备用
+	var basicFields []field.BasicField
+	for _, f := range tbl.BasicFields {
+		basicFields = append(basicFields, f)
+	}
+
+	tasks := []*mergeTask{}
+	for _, parts := range pick() {
+		prtPathName, err := tbl.newPrtPathName()
+		if err != nil {
+			return nil, nil, err
+		}
+		task := &mergeTask{parts: parts, prtPathName: prtPathName, docIds: []uint32{}, purged: []uint32{}}
+		for _, prt := range parts {
+			task.realDocNum += prt.RealDocNum
+			for _, docId := range prt.DocIds() {
+				if tbl.delFlagBitMap.IsSet(uint64(docId)) {
+					task.purged = append(task.purged, docId)
+				} else {
+					task.docIds = append(task.docIds, docId)
+				}
+			}
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, basicFields, nil
+}
+
+//合并第三步, 加写锁, 用新分区替换旧分区并提交元信息
+func (tbl *Table) commitMerge(tasks []*mergeTask, basicFields []field.BasicField) error {
+	tbl.rwMutex.Lock()
+	defer tbl.rwMutex.Unlock()
+
+	if tbl.status != TABLE_STATUS_RUNNING {
+		return errors.New("Table status must be running!")
+	}
+
+	//合并期间字段发生了变更, 新分区的字段已经过时, 放弃本次合并
+	if len(basicFields) != len(tbl.BasicFields) {
+		return errors.New("Fields changed during merge!")
+	}
+	for _, f := range basicFields {
+		if bf, exist := tbl.BasicFields[f.FieldName]; !exist || bf.IndexType != f.IndexType {
+			return errors.New("Fields changed during merge!")
+		}
+	}
+
+	//内存分区先落地, 否则提交的元信息(NextDocId)和主键btdb会包含尚未落地的文档, 而WAL不会重置, 宕机之后重放失败
+	if err := tbl.persistMemPartition(); err != nil {
+		return err
+	}
+
+	oldPartitions, oldPrtPathNames := tbl.partitions, tbl.PrtPathNames
+	partitions := append([]*partition.Partition{}, tbl.partitions...)
+	for _, task := range tasks {
+		idx := -1
+		for i, prt := range partitions {
+			if prt == task.parts[0] {
+				idx = i
+				break
+			}
+		}
+		if idx == -1 || idx + len(task.parts) > len(partitions) {
+			return errors.New(fmt.Sprintf("Merged partitions not found: %v", task.prtPathName))
+		}
+		for i, prt := range task.parts {
+			if partitions[idx + i] != prt {
+				return errors.New(fmt.Sprintf("Merged partitions changed: %v", task.prtPathName))
+			}
+		}
+
+		//合并期间又有文档被删除, 同步到新分区
+		var realDocNum uint32
+		for _, prt := range task.parts {
+			realDocNum += prt.RealDocNum
+		}
+		task.newPart.RealDocNum -= task.realDocNum - realDocNum
+
+		tmp := append([]*partition.Partition{}, partitions[:idx]...)
+		tmp = append(tmp, task.newPart)
+		partitions = append(tmp, partitions[idx + len(task.parts):]...)
+	}
+	tbl.partitions = partitions
+	tbl.PrtPathNames = make([]string, 0, len(partitions))
+	for _, prt := range partitions {
+		tbl.PrtPathNames = append(tbl.PrtPathNames, prt.PrtPathName)
+	}
+
+	//存储meta, 提交之后合并结果才生效
+	if err := tbl.storeMetaAndBtdb(); err != nil {
+		tbl.partitions, tbl.PrtPathNames = oldPartitions, oldPrtPathNames
+		return err
+	}
+
+	//清理被剔除文档的主键, 失败不影响正确性(以bitmap的删除标记为准), 只是残留一些脏数据
+	for _, task := range tasks {
+		if err := tbl.purgePrimaryKeys(task.purged); err != nil {
+			log.Warnf("Purge primary keys error: %v. Table: %v", err, tbl.TableName)
+		}
+	}
+	return nil
+}
+
+//合并失败, 清理已经生成的新分区
+func destroyMerged(tasks []*mergeTask) {
+	for _, task := range tasks {
+		if task.newPart != nil {
+			task.newPart.Destroy()
+			task.newPart = nil
+		}
+	}
+}
+
+//清理已剔除文档在主键btdb中的数据
+//docId => 主键的映射和文档版本直接删除, 主键 => docId的映射仍然指向该文档(即主键已被删除, 而不是变更)的才删除
+//Note: 调用方需持有写锁
+func (tbl *Table) purgePrimaryKeys(docIds []uint32) error {
+	if tbl.PrimaryKey == "" || len(docIds) == 0 {
+		return nil
+	}
+	fwdKeys := make([]string, 0, len(docIds))
+	ivtKeys := []string{}
+	verKeys := make([]string, 0, len(docIds))
+	for _, docId := range docIds {
+		docIdStr := fmt.Sprintf("%v", docId)
+		verKeys = append(verKeys, docIdStr)
+		key, ok := tbl.priBtdb.GetStr(PRI_FWD_BTREE_NAME, docIdStr)
+		if !ok {
+			continue
+		}
+		fwdKeys = append(fwdKeys, docIdStr)
+		if v, ok := tbl.priBtdb.GetInt(PRI_IVT_BTREE_NAME, key); ok && uint32(v) == docId {
+			ivtKeys = append(ivtKeys, key)
+		}
+	}
+	if err := tbl.priBtdb.MutiDel(PRI_IVT_BTREE_NAME, ivtKeys); err != nil {
+		return err
+	}
+	if err := tbl.priBtdb.MutiDel(PRI_VER_BTREE_NAME, verKeys); err != nil {
+		return err
+	}
+	log.Infof("Table[%v] purge %v docs, %v primary keys", tbl.TableName, len(fwdKeys), len(ivtKeys))
+	return tbl.priBtdb.MutiDel(PRI_FWD_BTREE_NAME, fwdKeys)
+}
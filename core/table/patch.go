@@ -0,0 +1,119 @@
+package table
+
+/*
+ * 局部更新
+ * 在写锁之内读出当前的文档, 合并指定的字段和原子增减之后整体变更, 客户端不需要先读后写, 也不会和其他写入互相覆盖
+ * 本质上仍然是UpdateDoc(新增一个docId, 旧的标记删除), WAL中记录的是合并之后的完整文档, 重放结果确定
+ */
+import (
+	"errors"
+	"fmt"
+	"math"
+	"github.com/hq-cml/spider-engine/core/index"
+)
+
+//局部更新
+//fields中的字段覆盖原值, incr中的数字字段在原值上增减; 文档不存在时, upsert为true则新增, 增减的字段从0开始
+//ifVersion非0时, 只有文档的当前版本一致才更新
+//返回新的docId以及是否新增
+func (tbl *Table) PatchDoc(key string, fields map[string]interface{}, incr map[string]float64, upsert bool, ifVersion uint64) (uint32, bool, error) {
+	//写锁
+	tbl.rwMutex.Lock()
+	defer tbl.rwMutex.Unlock()
+
+	//校验
+	if tbl.status != TABLE_STATUS_RUNNING {
+		return 0, false, errors.New("Table status must be running!")
+	}
+	if tbl.readOnly() {
+		return 0, false, errors.New("Table is read only!")
+	}
+	if tbl.PrimaryKey == "" {
+		return 0, false, errors.New("No Primary Key")
+	}
+	if v, exist := fields[tbl.PrimaryKey]; exist && v != key {
+		return 0, false, errors.New("PrimaryKey val is not consitent!")
+	}
+	if err := tbl.checkIncr(fields, incr); err != nil {
+		return 0, false, err
+	}
+
+	//当前的文档
+	var content map[string]interface{}
+	var docId uint32
+	docNode, exist := tbl.findDocIdByPrimaryKey(key)
+	if exist {
+		docId = docNode.DocId
+		content, exist = tbl.getDocByDocId(docId)
+	}
+	if err := tbl.checkVersion(key, docId, exist, ifVersion); err != nil {
+		return 0, false, err
+	}
+	if !exist {
+		if !upsert {
+			return 0, false, errors.New(fmt.Sprintf("Can not find the doc %v. Patch faield!", key))
+		}
+		content = map[string]interface{}{}
+	}
+
+	//合并
+	if err := tbl.mergePatch(content, fields, incr); err != nil {
+		return 0, false, err
+	}
+	content[tbl.PrimaryKey] = key
+
+	if !exist {
+		docId, _, err := tbl.addDoc(content)
+		return docId, true, err
+	}
+	docId, err := tbl.updateDoc(content, 0)
+	return docId, false, err
+}
+
+//校验增减的字段
+func (tbl *Table) checkIncr(fields map[string]interface{}, incr map[string]float64) error {
+	for fieldName := range incr {
+		basicField, exist := tbl.BasicFields[fieldName]
+		if !exist {
+			return errors.New("Field not exist: " + fieldName)
+		}
+		if basicField.IndexType != index.IDX_TYPE_INTEGER && basicField.IndexType != index.IDX_TYPE_FLOAT {
+			return errors.New("Incr only support number field: " + fieldName)
+		}
+		if _, exist := fields[fieldName]; exist {
+			return errors.New("Field both in doc and incr: " + fieldName)
+		}
+	}
+	return nil
+}
+
+//覆盖的字段和增减的字段合并到文档内容中
+func (tbl *Table) mergePatch(content, fields map[string]interface{}, incr map[string]float64) error {
+	for fieldName, value := range fields {
+		content[fieldName] = value
+	}
+	for fieldName, delta := range incr {
+		value, err := incrValue(tbl.BasicFields[fieldName].IndexType, content[fieldName], delta)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Incr field %v error: %v", fieldName, err))
+		}
+		content[fieldName] = value
+	}
+	return nil
+}
+
+//数字字段增减, 原值为空(文档新增)时从0开始
+func incrValue(indexType uint16, current interface{}, delta float64) (interface{}, error) {
+	if indexType == index.IDX_TYPE_FLOAT {
+		cur, _ := current.(float64)
+		return cur + delta, nil
+	}
+	if delta != math.Trunc(delta) {
+		return nil, errors.New(fmt.Sprintf("Integer field can not incr %v", delta))
+	}
+	cur, ok := current.(int64)
+	if !ok || cur == index.MaxInt64 {
+		cur = 0
+	}
+	return cur + int64(delta), nil
+}
@@ -0,0 +1,142 @@
+package table
+
+/*
+ * 表级别的设置
+ * 不同的表规模差异很大, 落地、合并的阈值等可以按表设置, 建表时指定, 之后也可以修改, 随表的元信息一起落地
+ * 数值类型的设置为0表示使用全局配置(spider.conf)
+ */
+import (
+	"encoding/json"
+	"errors"
+	"time"
+	"github.com/hq-cml/spider-engine/basic"
+	"github.com/hq-cml/spider-engine/core/index"
+	"github.com/hq-cml/spider-engine/utils/log"
+)
+
+type TableSettings struct {
+	PersistMinDocCnt uint32 `json:"persistMinDocCnt,omitempty"` //内存分区满多少个文档就落地
+	MergeMinDocCnt   uint32 `json:"mergeMinDocCnt,omitempty"`   //手动合并时, 合并后的分区至少拥有的文档数
+	MergeFactor      int    `json:"mergeFactor,omitempty"`      //分层合并的层级倍数
+	FlushMaxAge      int    `json:"flushMaxAge,omitempty"`      //内存分区中的数据最长多久落地一次(秒)
+	FlushMaxBytes    int    `json:"flushMaxBytes,omitempty"`    //内存分区最多占用多少内存就落地(MB)
+	BitmapSize       uint32 `json:"bitmapSize,omitempty"`       //已废弃: 删除标记改为roaring bitmap, 无需预分配; 仍然接受该项以兼容老的建表参数和元信息, 但不再生效
+	Analyzer         string `json:"analyzer,omitempty"`         //默认分析器, 没有指定类型的字段使用, 默认words
+	ReadOnly         bool   `json:"readOnly,omitempty"`         //只读, 禁止文档的增删改和字段的增删
+}
+
+//可以作为默认分析器的字段类型
+var analyzerMap = map[string]uint16 {
+	index.IDX_TYPE_NAME_WHOLE: index.IDX_TYPE_STR_WHOLE,
+	index.IDX_TYPE_NAME_WORDS: index.IDX_TYPE_STR_SPLITER,
+	index.IDX_TYPE_NAME_LIST:  index.IDX_TYPE_STR_LIST,
+	index.IDX_TYPE_NAME_CHARS: index.IDX_TYPE_STR_WORD,
+}
+
+//校验设置
+func (s *TableSettings) Check() error {
+	if s.PersistMinDocCnt == 0 && basic.PART_PERSIST_MIN_DOC_CNT == 0 {
+		return errors.New("persistMinDocCnt must be positive!")
+	}
+	if s.MergeFactor != 0 && s.MergeFactor < 2 {
+		return errors.New("mergeFactor must be at least 2!")
+	}
+	if s.FlushMaxAge < 0 || s.FlushMaxBytes < 0 {
+		return errors.New("flushMaxAge and flushMaxBytes can not be negative!")
+	}
+	if _, ok := analyzerMap[s.Analyzer]; s.Analyzer != "" && !ok {
+		return errors.New("Unsupport analyzer: " + s.Analyzer)
+	}
+	return nil
+}
+
+//获取表的设置
+func (tbl *Table) GetSettings() TableSettings {
+	tbl.rwMutex.RLock()
+	defer tbl.rwMutex.RUnlock()
+	return tbl.Settings
+}
+
+//修改表的设置, patch是json格式的设置, 只修改其中出现的项
+//Note:
+// 内存分区非空则先落地, 保证元信息和WAL的一致
+func (tbl *Table) UpdateSettings(patch []byte) (TableSettings, error) {
+	tbl.rwMutex.Lock()
+	defer tbl.rwMutex.Unlock()
+
+	if tbl.status != TABLE_STATUS_RUNNING {
+		return tbl.Settings, errors.New("Table status must be running!")
+	}
+	settings := tbl.Settings
+	if err := json.Unmarshal(patch, &settings); err != nil {
+		return tbl.Settings, err
+	}
+	settings.BitmapSize = tbl.Settings.BitmapSize //已废弃的设置, 接受但忽略
+	if err := settings.Check(); err != nil {
+		return tbl.Settings, err
+	}
+
+	old := tbl.Settings
+	tbl.Settings = settings
+	if err := tbl.persistMemPartition(); err != nil {
+		tbl.Settings = old
+		return tbl.Settings, err
+	}
+	if err := tbl.storeMetaAndBtdb(); err != nil {
+		tbl.Settings = old
+		return tbl.Settings, err
+	}
+	log.Infof("Update Table [%v] settings: %v", tbl.TableName, string(patch))
+
+	//合并的阈值可能变化了
+	tbl.notifyMerge()
+	return tbl.Settings, nil
+}
+
+//是否禁止写入, 建表和重放WAL不受限制
+func (tbl *Table) readOnly() bool {
+	return tbl.Settings.ReadOnly && tbl.status == TABLE_STATUS_RUNNING && !tbl.replaying
+}
+
+func (tbl *Table) persistMinDocCnt() uint32 {
+	if tbl.Settings.PersistMinDocCnt > 0 {
+		return tbl.Settings.PersistMinDocCnt
+	}
+	return basic.PART_PERSIST_MIN_DOC_CNT
+}
+
+func (tbl *Table) mergeMinDocCnt() uint32 {
+	if tbl.Settings.MergeMinDocCnt > 0 {
+		return tbl.Settings.MergeMinDocCnt
+	}
+	return basic.PART_MERGE_MIN_DOC_CNT
+}
+
+func (tbl *Table) mergeFactor() int {
+	if tbl.Settings.MergeFactor > 0 {
+		return tbl.Settings.MergeFactor
+	}
+	return basic.PART_MERGE_FACTOR
+}
+
+func (tbl *Table) flushMaxAge() time.Duration {
+	if tbl.Settings.FlushMaxAge > 0 {
+		return time.Duration(tbl.Settings.FlushMaxAge) * time.Second
+	}
+	return time.Duration(basic.FLUSH_MAX_AGE_SEC) * time.Second
+}
+
+func (tbl *Table) flushMaxBytes() uint64 {
+	if tbl.Settings.FlushMaxBytes > 0 {
+		return uint64(tbl.Settings.FlushMaxBytes) * 1024 * 1024
+	}
+	return uint64(basic.FLUSH_MAX_BYTES) * 1024 * 1024
+}
+
+//默认分析器对应的字段类型
+func (tbl *Table) analyzerType() uint16 {
+	if t, ok := analyzerMap[tbl.Settings.Analyzer]; ok {
+		return t
+	}
+	return index.IDX_TYPE_STR_SPLITER
+}
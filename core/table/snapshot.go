@@ -0,0 +1,142 @@
+package table
+
+/*
+ * 表的快照与恢复
+ * 快照目录中的文件和表目录中的同名：表的元信息、主键btdb、bitmap以及各个磁盘分区的文件
+ * 生成快照时先将内存分区落地, 并落地bitmap、主键btdb和元信息, 之后表的全部数据都在磁盘上(WAL为空, 不需要备份)：
+ *   分区的索引文件不会再变化, 直接硬链接, 不占用额外的空间
+ *   主键btdb、bitmap、元信息仍然会变化, 复制一份
+ * 整个过程持有表的写锁, 只是短暂的阻塞写入, 保证快照的一致性
+ */
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"github.com/hq-cml/spider-engine/core/partition"
+	"github.com/hq-cml/spider-engine/utils/helper"
+	"github.com/hq-cml/spider-engine/utils/log"
+)
+
+//生成表的快照, 写入dir目录(需已存在)
+//baseDir非空时是同一张表之前的快照, 没有变化的分区直接复用其中的文件
+func (tbl *Table) Snapshot(dir, baseDir string) error {
+	dir = fixDir(dir)
+	if baseDir != "" {
+		baseDir = fixDir(baseDir)
+	}
+
+	//写锁
+	tbl.rwMutex.Lock()
+	defer tbl.rwMutex.Unlock()
+
+	if tbl.status != TABLE_STATUS_RUNNING {
+		return errors.New("Table status must be running!")
+	}
+
+	//内存分区落地, 主键也一并落地到btdb
+	if err := tbl.persistMemPartition(); err != nil {
+		return err
+	}
+	//内存分区为空时不会落地, 而bitmap只在落地元信息时写入文件, 其中的删除标记可能只记录在WAL中, 这里统一落地一次
+	if err := tbl.storeMetaAndBtdb(); err != nil {
+		return err
+	}
+
+	//逐个复制磁盘分区
+	for _, prtPathName := range tbl.PrtPathNames {
+		name := filepath.Base(prtPathName)
+		base := ""
+		if baseDir != "" {
+			base = baseDir + name
+		}
+		if err := partition.CopyPartition(prtPathName, dir + name, base); err != nil {
+			log.Errf("Snapshot partition %v error: %v", prtPathName, err)
+			return err
+		}
+	}
+
+	//主键btdb和bitmap
+	snap := &Table{Path: dir, TableName: tbl.TableName}
+	if tbl.PrimaryKey != "" && helper.Exist(tbl.getPrimaryBtName()) {
+		if err := helper.CopyFile(tbl.getPrimaryBtName(), snap.getPrimaryBtName()); err != nil {
+			return err
+		}
+	}
+	if err := helper.CopyFile(tbl.getBitMapName(), snap.getBitMapName()); err != nil {
+		return err
+	}
+
+	//最后写元信息, 有元信息的快照才是完整的
+	data := helper.JsonEncodeIndent(tbl)
+	if data == "" {
+		return errors.New("Json error")
+	}
+	if err := helper.WriteManifest([]byte(data), snap.getMetaName()); err != nil {
+		return err
+	}
+
+	log.Infof("Snapshot Table [%v] to %v", tbl.TableName, dir)
+	return nil
+}
+
+//从快照恢复一张表
+//快照在srcDir目录中, 表名为srcName; 恢复到path目录(需已存在), 表名为name
+//Note:
+// 表的元信息中记录的是绝对路径, 所以按新的位置重写表和分区的元信息
+func RestoreTable(srcDir, srcName, path, name string) (*Table, error) {
+	srcDir, path = fixDir(srcDir), fixDir(path)
+	src := &Table{Path: srcDir, TableName: srcName}
+	buffer, err := helper.ReadManifest(src.getMetaName())
+	if err != nil {
+		return nil, err
+	}
+	tbl := &Table{}
+	if err := json.Unmarshal(buffer, tbl); err != nil {
+		return nil, err
+	}
+	tbl.Path, tbl.TableName = path, name
+
+	//分区文件: 表名_序号.xxx
+	prtPathNames := make([]string, 0, len(tbl.PrtPathNames))
+	for _, prtPathName := range tbl.PrtPathNames {
+		srcPrt := filepath.Base(prtPathName)
+		if !strings.HasPrefix(srcPrt, srcName + "_") {
+			return nil, errors.New("Invalid partition in snapshot: " + srcPrt)
+		}
+		dstPathName := path + name + strings.TrimPrefix(srcPrt, srcName)
+		if err := partition.CopyPartition(srcDir + srcPrt, dstPathName, ""); err != nil {
+			return nil, err
+		}
+		prtPathNames = append(prtPathNames, dstPathName)
+	}
+	tbl.PrtPathNames = prtPathNames
+
+	if tbl.PrimaryKey != "" && helper.Exist(src.getPrimaryBtName()) {
+		if err := helper.CopyFile(src.getPrimaryBtName(), tbl.getPrimaryBtName()); err != nil {
+			return nil, err
+		}
+	}
+	if err := helper.CopyFile(src.getBitMapName(), tbl.getBitMapName()); err != nil {
+		return nil, err
+	}
+
+	data := helper.JsonEncodeIndent(tbl)
+	if data == "" {
+		return nil, errors.New("Json error")
+	}
+	if err := helper.WriteManifest([]byte(data), tbl.getMetaName()); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Restore Table [%v] from %v", name, srcDir + srcName)
+	return LoadTable(path, name)
+}
+
+//目录补齐结尾的/
+func fixDir(dir string) string {
+	if string(dir[len(dir)-1]) != "/" {
+		dir = dir + "/"
+	}
+	return dir
+}
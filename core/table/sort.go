@@ -0,0 +1,193 @@
+package table
+
+/*
+ * 搜索结果排序
+ * 支持多个排序字段, 每个字段可以指定asc/desc, 相关性得分(_score)也是其中一种排序字段
+ * 排序值取自各个分区的正排索引, 缺失值(MaxInt64)无论升序降序都排在最后, 浮点字段的正排是保序的整数, 可以直接比较
+ * 分页只需要前offset+size个结果, 所以用一个大小为K的堆做TopK, 避免对全部命中结果排序
+ * 深度分页使用search_after游标: 游标由排序值和文档的主键编码而成, 下一页只保留排在游标之后的文档, 不需要offset
+ * 排序值全部相同的按主键排序, 而不是docId: 文档更新之后docId会变大, 但是主键不变, 排序值没变的文档在分页中的位置也不变
+ * 分页过程中新增或删除的文档不会导致其他文档重复或遗漏, 但是排序值被修改的文档可能会在后面的页中重复出现或者被遗漏
+ */
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hq-cml/spider-engine/basic"
+	"github.com/hq-cml/spider-engine/core/index"
+	"sort"
+	"strings"
+)
+
+const (
+	SORT_ORDER_ASC  = "asc"
+	SORT_ORDER_DESC = "desc"
+)
+
+//解析后的排序字段
+type sortKey struct {
+	fieldName string
+	desc      bool
+}
+
+//待排序的文档, values和排序字段一一对应
+//key是文档的主键, 只在排序值全部相同时才需要, 所以按需获取
+type sortDoc struct {
+	node   basic.DocNode
+	values []int64
+	key    string
+	hasKey bool
+}
+
+//校验并解析排序字段, 为空则默认按相关性得分降序
+func (tbl *Table) checkSorts(sorts []basic.SearchSort) ([]sortKey, error) {
+	if len(sorts) == 0 {
+		return []sortKey{{fieldName: basic.SORT_BY_SCORE, desc: true}}, nil
+	}
+
+	keys := []sortKey{}
+	for _, s := range sorts {
+		order := strings.ToLower(s.Order)
+		if order != "" && order != SORT_ORDER_ASC && order != SORT_ORDER_DESC {
+			return nil, errors.New("Unsupport sort order: " + s.Order)
+		}
+		if s.FieldName != basic.SORT_BY_SCORE {
+			fld, exist := tbl.BasicFields[s.FieldName]
+			if !exist {
+				return nil, errors.New(fmt.Sprintf("Field %v not Exist ", s.FieldName))
+			}
+			if !index.IsNumericType(fld.IndexType) {
+				return nil, errors.New(s.FieldName + " should be number, float or time")
+			}
+		}
+		keys = append(keys, sortKey{fieldName: s.FieldName, desc: order != SORT_ORDER_ASC})
+	}
+	return keys, nil
+}
+
+//取出文档的排序值
+//Note: 调用方需持有读锁
+func (tbl *Table) sortValues(node basic.DocNode, keys []sortKey) []int64 {
+	values := make([]int64, len(keys))
+	prt, ok := tbl.findPartition(node.DocId)
+	for i, key := range keys {
+		if key.fieldName == basic.SORT_BY_SCORE {
+			values[i] = int64(node.Weight)
+			continue
+		}
+		values[i] = index.MaxInt64
+		if ok {
+			if v, exist := prt.GetInt(node.DocId, key.fieldName); exist {
+				values[i] = v
+			}
+		}
+	}
+	return values
+}
+
+//文档的主键
+//Note: 调用方需持有读锁
+func (tbl *Table) sortDocKey(doc *sortDoc) string {
+	if !doc.hasKey {
+		doc.key, _ = tbl.findPrimaryKeyByDocId(doc.node.DocId)
+		doc.hasKey = true
+	}
+	return doc.key
+}
+
+//a是否排在b的前面, 全部排序值都相同的按主键排序, 保证分页结果稳定
+//Note: 调用方需持有读锁
+func (tbl *Table) sortBefore(a, b *sortDoc, keys []sortKey) bool {
+	for i, key := range keys {
+		va, vb := a.values[i], b.values[i]
+		if va == vb {
+			continue
+		}
+		//缺失值排在最后
+		if va == index.MaxInt64 {
+			return false
+		}
+		if vb == index.MaxInt64 {
+			return true
+		}
+		if key.desc {
+			return va > vb
+		}
+		return va < vb
+	}
+	return tbl.sortDocKey(a) < tbl.sortDocKey(b)
+}
+
+//TopK堆, 堆顶是当前排在最后的文档
+type sortHeap struct {
+	tbl  *Table
+	docs []*sortDoc
+	keys []sortKey
+}
+
+func (h *sortHeap) Len() int           { return len(h.docs) }
+func (h *sortHeap) Swap(i, j int)      { h.docs[i], h.docs[j] = h.docs[j], h.docs[i] }
+func (h *sortHeap) Less(i, j int) bool { return h.tbl.sortBefore(h.docs[j], h.docs[i], h.keys) }
+func (h *sortHeap) Push(x interface{}) { h.docs = append(h.docs, x.(*sortDoc)) }
+func (h *sortHeap) Pop() interface{} {
+	n := len(h.docs)
+	x := h.docs[n-1]
+	h.docs = h.docs[:n-1]
+	return x
+}
+
+//对命中结果排序, 只返回排在前k个的文档
+//after非空时, 只保留排在after之后的文档
+//Note: 调用方需持有读锁
+func (tbl *Table) sortTopK(docs []basic.DocNode, keys []sortKey, k int, after *sortDoc) []*sortDoc {
+	if k <= 0 {
+		return []*sortDoc{}
+	}
+
+	h := &sortHeap{tbl: tbl, keys: keys}
+	for _, node := range docs {
+		doc := &sortDoc{node: node, values: tbl.sortValues(node, keys)}
+		if after != nil && !tbl.sortBefore(after, doc, keys) {
+			continue
+		}
+		if h.Len() < k {
+			heap.Push(h, doc)
+		} else if tbl.sortBefore(doc, h.docs[0], keys) {
+			h.docs[0] = doc
+			heap.Fix(h, 0)
+		}
+	}
+
+	sort.Slice(h.docs, func(i, j int) bool {
+		return tbl.sortBefore(h.docs[i], h.docs[j], keys)
+	})
+	return h.docs
+}
+
+//游标的内容
+type cursor struct {
+	Values []int64 `json:"v"`
+	Key    string  `json:"k"`
+}
+
+//生成文档的search_after游标
+//Note: 调用方需持有读锁
+func (tbl *Table) encodeCursor(doc *sortDoc) string {
+	b, _ := json.Marshal(cursor{Values: doc.values, Key: tbl.sortDocKey(doc)})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+//解析search_after游标, 排序值的个数必须和排序字段一致
+func decodeCursor(str string, keys []sortKey) (*sortDoc, error) {
+	b, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, errors.New("Invalid search after: " + str)
+	}
+	c := cursor{}
+	if err := json.Unmarshal(b, &c); err != nil || len(c.Values) != len(keys) {
+		return nil, errors.New("Invalid search after: " + str)
+	}
+	return &sortDoc{values: c.Values, key: c.Key, hasKey: true}, nil
+}
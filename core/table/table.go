@@ -14,10 +14,12 @@ package table
  */
 import (
 	"sync"
+	"time"
 	"fmt"
 	"encoding/json"
 	"errors"
 	"strconv"
+	"strings"
 	"github.com/hq-cml/spider-engine/core/partition"
 	"github.com/hq-cml/spider-engine/utils/btree"
 	"github.com/hq-cml/spider-engine/utils/bitmap"
@@ -26,8 +28,7 @@ import (
 	"github.com/hq-cml/spider-engine/utils/helper"
 	"github.com/hq-cml/spider-engine/core/index"
 	"github.com/hq-cml/spider-engine/core/field"
-	"math"
-	"sort"
+	"github.com/hq-cml/spider-engine/core/query"
 )
 
 //表的原则：
@@ -45,9 +46,11 @@ type Table struct {
 	StartDocId   uint32                      `json:"startDocId"`
 	NextDocId    uint32                      `json:"nextDocId"`
 	RealDocNum   uint32                      `json:"realDocNum"`  //表总文档数，和底层的docCnt不同，这个docNum表示实际有多少有效文档
-	MaxDocNum    uint32                      `json:"maxDocNum"`
 	PartSuffix   uint64                      `json:"prefix"`
 	PrtPathNames []string                    `json:"prtPathNames"` //磁盘态的分区列表名--这些分区均不包括主键！！！
+	FieldLenSum  map[string]uint64           `json:"fieldLenSum"`  //各个倒排字段(包括上帝字段)有效文档的长度之和, 用于计算平均长度
+	WalSeq       uint64                      `json:"walSeq"`       //WAL的序号, 每次清空WAL都会自增
+	Settings     TableSettings               `json:"settings"`     //表级别的设置
 
 	status         uint8
 	memPartition   *partition.Partition   //内存态的分区,分区不包括逐渐
@@ -55,8 +58,19 @@ type Table struct {
 	priBtdb        btree.Btree            //主键专用正排 & 倒排索引（磁盘态）
 	priIvtMap      map[string]string      //主键专用倒排索引（内存态），primaryKey => docId
 	priFwdMap      map[string]string      //主键专正排排索引（内存态），docId => primaryKey
-	delFlagBitMap  *bitmap.Bitmap         //用于文档删除标记
+	priVerMap      map[string]string      //文档版本（内存态），docId => version
+	delFlagBitMap  bitmap.BitSet          //用于文档删除标记
+	scorer         query.Scorer           //相关性打分器, 默认BM25
+	wal            *Wal                   //预写日志, 保证内存分区崩溃后可恢复
+	replaying      bool                   //是否正在重放WAL
 	rwMutex        sync.RWMutex           //读写锁
+	mergeMutex     sync.Mutex             //合并锁, 保证同一时刻只有一个合并在进行
+	mergeCh        chan struct{}          //后台合并的通知
+	mergeStop      chan struct{}          //后台合并的退出信号
+	mergeWg        sync.WaitGroup
+	memSince       time.Time              //内存分区中最早的未落地文档的写入时间
+	flushStop      chan struct{}          //后台定时落地的退出信号
+	flushWg        sync.WaitGroup
 }
 
 type TableStatus struct {
@@ -69,27 +83,31 @@ type TableStatus struct {
 	NextDocId  uint32                       `json:"nextDocId"`
 	DiskParts  []*partition.PartitionStatus `json:"partitions"`  //磁盘态的分区列表名--这些分区均不包括主键！！！
 	MemPart    *partition.PartitionStatus   `json:"memPartition"`
+	Settings   TableSettings                `json:"settings"`
 }
 
 const (
 	DEFAULT_PRIMARY_FIELD_NAME = "#Def%Pri$Key@" //系统默认主键名称
 	PRI_FWD_BTREE_NAME 		   = "pri_fwd_tree"
 	PRI_IVT_BTREE_NAME         = "pri_ivt_tree"
-	BitmapOrgNum               = 0x01 << 27      //16M 文件, 表示最大1.3亿的文档
-	//BitmapOrgNum             = 8 			     //test
+	PRI_VER_BTREE_NAME         = "pri_ver_tree"
+	DEFAULT_PAGE_SIZE          = 100             //搜索默认的分页大小
 )
 
 const (
 	TABLE_STATUS_INIT uint8 = iota
 	TABLE_STATUS_LOADING
 	TABLE_STATUS_RUNNING
-	TABLE_STATUS_MERGEING
 	TABLE_STATUS_CLOSING
 	TABLE_STATUS_CLOSED
 )
 
 //新建空表
 func newEmptyTable(path, name string) *Table {
+	return newEmptyTableWithSettings(path, name, TableSettings{})
+}
+
+func newEmptyTableWithSettings(path, name string, settings TableSettings) *Table {
 	if string(path[len(path)-1]) != "/" {
 		path = path + "/"
 	}
@@ -101,13 +119,15 @@ func newEmptyTable(path, name string) *Table {
 		BasicFields:  make(map[string]field.BasicField),
 		priIvtMap:    make(map[string]string),
 		priFwdMap:    make(map[string]string),
+		priVerMap:    make(map[string]string),
+		FieldLenSum:  make(map[string]uint64),
+		scorer:       query.NewBM25(),
 		status:       TABLE_STATUS_INIT,
+		Settings:     settings,
 	}
 
-	//bitmap文件新建
-	btmpName := tab.getBitMapName()
-	tab.delFlagBitMap = bitmap.NewBitmap(btmpName, BitmapOrgNum)
-	tab.MaxDocNum = BitmapOrgNum
+	//bitmap新建, 元信息落地时写入文件
+	tab.delFlagBitMap = bitmap.NewRoaringFile(tab.getBitMapName())
 
 	return &tab
 }
@@ -118,14 +138,17 @@ func (tbl *Table) generateMemPartition() error {
 		tbl.status != TABLE_STATUS_LOADING {
 		return errors.New("Table status must be running/init/loading")
 	}
-	prtPathName := tbl.getPrtPathName()
+	prtPathName, err := tbl.newPrtPathName()
+	if err != nil {
+		return err
+	}
 	var basicFields []field.BasicField
 	for _, f := range tbl.BasicFields {
 		basicFields = append(basicFields, f)
 	}
 
 	tbl.memPartition = partition.NewEmptyPartitionWithBasicFields(prtPathName, tbl.NextDocId, basicFields)
-	tbl.PartSuffix++ //自增
+	tbl.memSince = time.Time{}
 
 	return nil
 }
@@ -133,7 +156,15 @@ func (tbl *Table) generateMemPartition() error {
 //创建表
 //如果用户没有传主键，则系统自动补充一个主键
 func CreateTable(path, tableName string, fields []field.BasicField) (*Table, error) {
-	tab := newEmptyTable(path, tableName)
+	return CreateTableWithSettings(path, tableName, fields, TableSettings{})
+}
+
+//创建表, 同时指定表的设置
+func CreateTableWithSettings(path, tableName string, fields []field.BasicField, settings TableSettings) (*Table, error) {
+	if err := settings.Check(); err != nil {
+		return nil, err
+	}
+	tab := newEmptyTableWithSettings(path, tableName, settings)
 
 	hasKey := false
 	for _, bf := range fields {
@@ -154,7 +185,16 @@ func CreateTable(path, tableName string, fields []field.BasicField) (*Table, err
 			FieldName: DEFAULT_PRIMARY_FIELD_NAME,
 		})
 	}
+
+	//新建WAL
+	wal, err := NewWal(tab.getWalName(), tab.WalSeq)
+	if err != nil {
+		return nil, err
+	}
+	tab.wal = wal
 	tab.status = TABLE_STATUS_RUNNING
+	tab.startMerger()
+	tab.startFlusher()
 
 	return tab, nil
 }
@@ -164,9 +204,9 @@ func LoadTable(path, name string) (*Table, error) {
 	if string(path[len(path)-1]) != "/" {
 		path = path + "/"
 	}
-	tbl := Table{Path:path, TableName:name, status: TABLE_STATUS_LOADING}
+	tbl := Table{Path:path, TableName:name, status: TABLE_STATUS_LOADING, scorer: query.NewBM25()}
 	metaFileName := tbl.getMetaName()
-	buffer, err := helper.ReadFile(metaFileName)
+	buffer, err := helper.ReadManifest(metaFileName)
 	if err != nil {
 		return nil, err
 	}
@@ -175,6 +215,9 @@ func LoadTable(path, name string) (*Table, error) {
 	if err != nil {
 		return nil, err
 	}
+	if tbl.FieldLenSum == nil {
+		tbl.FieldLenSum = make(map[string]uint64)
+	}
 
 	//分别加载各个分区
 	for _, prtPathName := range tbl.PrtPathNames {
@@ -194,7 +237,11 @@ func LoadTable(path, name string) (*Table, error) {
 
 	//加载bitmap
 	btmpPath := path + name + basic.IDX_FILENAME_SUFFIX_BITMAP
-	tbl.delFlagBitMap = bitmap.LoadBitmap(btmpPath)
+	tbl.delFlagBitMap, err = bitmap.LoadRoaring(btmpPath)
+	if err != nil {
+		log.Errf("bitmap.LoadRoaring Error:%v", err)
+		return nil, err
+	}
 
 	//如果存在主键，则加载主键专用btree并初始化内存map
 	if tbl.PrimaryKey != "" {
@@ -202,39 +249,87 @@ func LoadTable(path, name string) (*Table, error) {
 		tbl.priBtdb = btree.NewBtree("", primaryName)
 		tbl.priIvtMap = make(map[string]string)
 		tbl.priFwdMap = make(map[string]string)
+		tbl.priVerMap = make(map[string]string)
+		//老版本的表没有版本树
+		if !tbl.priBtdb.HasTree(PRI_VER_BTREE_NAME) {
+			tbl.priBtdb.AddTree(PRI_VER_BTREE_NAME)
+		}
 	}
 
-	log.Infof("Load Table %v success", tbl.TableName)
+	//重放WAL, 恢复崩溃前的内存分区
 	tbl.status = TABLE_STATUS_RUNNING
+	err = tbl.recoverWal()
+	if err != nil {
+		return nil, err
+	}
+	tbl.startMerger()
+	tbl.startFlusher()
+
+	log.Infof("Load Table %v success", tbl.TableName)
 	return &tbl, nil
 }
 
 //落地表的元信息
+//如果内存分区为空, 说明全部数据都已经在磁盘上, 同时清空WAL
+//Note:
+// 主键必须先于元信息落地: 元信息中的WalSeq一旦更新, 老的WAL就会被丢弃, 此时内存map中的主键必须已经在btdb中
+// 反过来在两者之间崩溃, btdb中多出的docId超出了元信息中的NextDocId, 会被忽略, 重放WAL时重新生成
 func (tbl *Table) storeMetaAndBtdb() error {
+	//bitmap先于元信息落地, 其中多出来的删除标记会在重放WAL时撤销
+	if err := tbl.delFlagBitMap.Sync(); err != nil {
+		log.Errf("delFlagBitMap.Sync Error:%v", err.Error())
+		return err
+	}
+	if err := tbl.storePrimaryKeys(); err != nil {
+		return err
+	}
+
+	walReset := tbl.memPartition == nil || tbl.memPartition.IsEmpty()
+	if walReset {
+		tbl.WalSeq++
+	}
 	metaFileName := tbl.getMetaName()
 	data := helper.JsonEncodeIndent(tbl)
-	if data != "" {
-		if err := helper.OverWriteToFile([]byte(data), metaFileName); err != nil {
-			log.Errf("OverWriteToFile Error:%v", err.Error())
-			return err
+	if data == "" {
+		if walReset {
+			tbl.WalSeq--
 		}
-	} else {
 		return errors.New("Json error")
 	}
-
-	//将内存态的主键，全部落盘到btree
-	if tbl.PrimaryKey != "" {
-		err := tbl.priBtdb.MutiSet(PRI_IVT_BTREE_NAME, tbl.priIvtMap); if err != nil {
-			log.Errf("tbl.priBtdb.MutiSet Error:%v", err.Error())
-			return err
-		}
-		err = tbl.priBtdb.MutiSet(PRI_FWD_BTREE_NAME, tbl.priFwdMap); if err != nil {
-			log.Errf("tbl.priBtdb.MutiSet Error:%v", err.Error())
-			return err
+	if err := helper.WriteManifest([]byte(data), metaFileName); err != nil {
+		log.Errf("WriteManifest Error:%v", err.Error())
+		if walReset {
+			tbl.WalSeq--
 		}
-		tbl.priIvtMap = make(map[string]string)
-		tbl.priFwdMap = make(map[string]string)
+		return err
+	}
+
+	if walReset {
+		return tbl.resetWal()
+	}
+	return nil
+}
+
+//将内存态的主键和版本，全部落盘到btree
+func (tbl *Table) storePrimaryKeys() error {
+	if tbl.PrimaryKey == "" {
+		return nil
+	}
+	err := tbl.priBtdb.MutiSet(PRI_IVT_BTREE_NAME, tbl.priIvtMap); if err != nil {
+		log.Errf("tbl.priBtdb.MutiSet Error:%v", err.Error())
+		return err
+	}
+	err = tbl.priBtdb.MutiSet(PRI_FWD_BTREE_NAME, tbl.priFwdMap); if err != nil {
+		log.Errf("tbl.priBtdb.MutiSet Error:%v", err.Error())
+		return err
+	}
+	err = tbl.priBtdb.MutiSet(PRI_VER_BTREE_NAME, tbl.priVerMap); if err != nil {
+		log.Errf("tbl.priBtdb.MutiSet Error:%v", err.Error())
+		return err
 	}
+	tbl.priIvtMap = make(map[string]string)
+	tbl.priFwdMap = make(map[string]string)
+	tbl.priVerMap = make(map[string]string)
 	return nil
 }
 
@@ -251,6 +346,13 @@ func (tbl *Table) AddField(basicField field.BasicField) error {
 	if tbl.status != TABLE_STATUS_RUNNING && tbl.status != TABLE_STATUS_INIT {
 		return errors.New("Table status must be running or init")
 	}
+	if tbl.readOnly() {
+		return errors.New("Table is read only!")
+	}
+	//没有指定类型, 则使用表的默认分析器
+	if basicField.IndexType == 0 {
+		basicField.IndexType = tbl.analyzerType()
+	}
 	if basicField.IndexType == index.IDX_TYPE_PK && tbl.PrimaryKey != "" {
 		return errors.New("Primary key has exist!")
 	}
@@ -258,6 +360,9 @@ func (tbl *Table) AddField(basicField field.BasicField) error {
 		log.Warnf("Field %v have Exist ", basicField.FieldName)
 		return errors.New(fmt.Sprintf("Field %v have Exist ", basicField.FieldName))
 	}
+	if basicField.Positions && basicField.IndexType != index.IDX_TYPE_STR_SPLITER {
+		return errors.New(fmt.Sprintf("Field %v: only words field can record positions", basicField.FieldName))
+	}
 
 	//实施新增
 	if basicField.IndexType == index.IDX_TYPE_PK {
@@ -267,6 +372,7 @@ func (tbl *Table) AddField(basicField field.BasicField) error {
 		tbl.priBtdb = btree.NewBtree("", primaryName)
 		tbl.priBtdb.AddTree(PRI_IVT_BTREE_NAME)
 		tbl.priBtdb.AddTree(PRI_FWD_BTREE_NAME)
+		tbl.priBtdb.AddTree(PRI_VER_BTREE_NAME)
 	} else {
 
 		//基础信息注册
@@ -325,6 +431,9 @@ func (tbl *Table) DeleteField(fieldname string) error {
 	if tbl.status != TABLE_STATUS_RUNNING && tbl.status != TABLE_STATUS_INIT {
 		return errors.New("Table status must be running or init")
 	}
+	if tbl.readOnly() {
+		return errors.New("Table is read only!")
+	}
 	if fieldname == tbl.PrimaryKey {
 		return errors.New("Can not del primary key!")
 	}
@@ -334,6 +443,7 @@ func (tbl *Table) DeleteField(fieldname string) error {
 
 	//假删除
 	delete(tbl.BasicFields, fieldname)
+	delete(tbl.FieldLenSum, fieldname)
 
 	if tbl.memPartition == nil {
 		//啥也不需要干
@@ -367,25 +477,9 @@ func (tbl *Table) DeleteField(fieldname string) error {
 	return nil
 }
 
-//BitMap扩大
-func (tbl *Table) doExpandBitMap() error{
-
-	err := tbl.delFlagBitMap.DoExpand()
-	if err != nil {
-		log.Errf("Expand error: %v", err)
-		return err
-	}
-	tbl.MaxDocNum = uint32(tbl.delFlagBitMap.MaxNum + 1)
-
-	return nil
-}
-
 //获取文档
 func (tbl *Table) GetDoc(primaryKey string) (*basic.DocInfo, uint32, bool, error) {
 	if tbl.status != TABLE_STATUS_RUNNING {
-		if tbl.status == TABLE_STATUS_MERGEING {
-			return nil, 0, false, errors.New("The Spider Is Merging. Please Try Again Later!")
-		}
 		return nil, 0, false, errors.New("The Spider Is Not Running!")
 	}
 
@@ -411,6 +505,7 @@ func (tbl *Table) GetDoc(primaryKey string) (*basic.DocInfo, uint32, bool, error
 	detail := basic.DocInfo{
 		Key: primaryKey,
 		Detail:tmp,
+		Version: tbl.getVersion(docNode.DocId),
 	}
 
 	return &detail, docNode.DocId, true, nil
@@ -424,13 +519,24 @@ func (tbl *Table) AddDoc(content map[string]interface{}) (uint32, string, error)
 	tbl.rwMutex.Lock()
 	defer tbl.rwMutex.Unlock()
 
+	return tbl.addDoc(content)
+}
+
+//新增文档的实际流程, 调用方需持有写锁
+func (tbl *Table) addDoc(content map[string]interface{}) (uint32, string, error) {
 	//校验
 	if tbl.status != TABLE_STATUS_RUNNING {
 		return 0, "", errors.New("Table status must be running!")
 	}
+	if tbl.readOnly() {
+		return 0, "", errors.New("Table is read only!")
+	}
 	if len(tbl.BasicFields) == 0 {
 		return 0, "", errors.New("field is nil")
 	}
+	if err := tbl.checkListFields(content); err != nil {
+		return 0, "", err
+	}
 
 	//获取主键
 	var key string
@@ -461,16 +567,21 @@ func (tbl *Table) AddDoc(content map[string]interface{}) (uint32, string, error)
 		}
 	}
 
-	//bitmap判断是否需要自动扩容
-	if tbl.NextDocId == tbl.MaxDocNum {
-		err := tbl.doExpandBitMap()
-		if err != nil {
-			log.Errf("doExpandBitMap Error: %v", err.Error())
-			return 0, "", err
+	newDocId := tbl.NextDocId
+
+	//先写WAL, 主键也要记录下来, 保证重放时主键不变
+	rec := &walRecord{Op: WAL_OP_ADD, Key: key, DocId: newDocId, Content: content}
+	if tbl.PrimaryKey != "" {
+		rec.Content = make(map[string]interface{}, len(content) + 1)
+		for k, v := range content {
+			rec.Content[k] = v
 		}
+		rec.Content[tbl.PrimaryKey] = key
+	}
+	if err := tbl.writeWal(rec); err != nil {
+		log.Errf("Write Wal Error:%v. PrimaryKey:%v", err, key)
+		return 0, "", err
 	}
-
-	newDocId := tbl.NextDocId
 
 	//实质新增流程开始：一致性考虑，此刻开始必须执行到底
 	// 处理主键新增
@@ -496,24 +607,13 @@ func (tbl *Table) AddDoc(content map[string]interface{}) (uint32, string, error)
 		//成功，NextDocId自增
 		tbl.NextDocId++
 		tbl.RealDocNum++
+		tbl.updateFieldLenSum(newDocId, true)
+		tbl.setVersion(newDocId, 1)
 		log.Infof("Table AddDoc Success. PrimaryKey: %v", key)
 	}
 
-	//最后，如果满足了落地的阈值, 需要先落地分区
-	if tbl.NextDocId % basic.PART_PERSIST_MIN_DOC_CNT == 0 {
-		err := tbl.Persist()
-		if err != nil {
-			log.Fatalf("MergePartitions Error: %v. Table: %v", err.Error(), tbl.TableName)
-		}
-	}
-
-	//最后，如果满足了合并归档的阈值, 需要合并归档
-	if tbl.NextDocId % basic.PART_MERGE_MIN_DOC_CNT == 0 {
-		err := tbl.MergePartitions()
-		if err != nil {
-			log.Fatalf("MergePartitions Error: %v. Table: %v", err.Error(), tbl.TableName)
-		}
-	}
+	//最后，如果满足了落地的条件, 需要先落地分区
+	tbl.checkFlush()
 
 	return newDocId, key, err
 }
@@ -525,14 +625,46 @@ func (tbl *Table) DelDoc(primaryKey string) bool {
 	tbl.rwMutex.Lock()
 	defer tbl.rwMutex.Unlock()
 
+	_, err := tbl.delDoc(primaryKey, 0)
+	return err == nil
+}
+
+//删除, 指定版本时只有文档的当前版本一致才删除, 返回文档是否存在
+func (tbl *Table) DelDocWithVersion(primaryKey string, ifVersion uint64) (bool, error) {
+	//写锁
+	tbl.rwMutex.Lock()
+	defer tbl.rwMutex.Unlock()
+
+	return tbl.delDoc(primaryKey, ifVersion)
+}
+
+//删除的实际流程, 返回文档是否存在, 调用方需持有写锁
+func (tbl *Table) delDoc(primaryKey string, ifVersion uint64) (bool, error) {
 	//校验
 	if tbl.status != TABLE_STATUS_RUNNING {
-		return false
+		return false, errors.New("Table status must be running!")
+	}
+	if tbl.readOnly() {
+		return false, errors.New("Table is read only!")
 	}
 	docId, found := tbl.findDocIdByPrimaryKey(primaryKey)
+	var docIdVal uint32
+	if found {
+		docIdVal = docId.DocId
+	}
+	if err := tbl.checkVersion(primaryKey, docIdVal, found, ifVersion); err != nil {
+		return found, err
+	}
 	if found {
+		//先写WAL
+		if err := tbl.writeWal(&walRecord{Op: WAL_OP_DEL, Key: primaryKey, OldDocId: docId.DocId}); err != nil {
+			log.Errf("Write Wal Error:%v. PrimaryKey:%v", err, primaryKey)
+			return true, err
+		}
+
 		//Table的realDocNum--
 		tbl.RealDocNum--
+		tbl.updateFieldLenSum(docId.DocId, false)
 
 		//文档所属分区的realDocNum--
 		if tbl.memPartition != nil &&
@@ -552,11 +684,14 @@ func (tbl *Table) DelDoc(primaryKey string) bool {
 			}
 		}
 		//核心标记删除
-		return tbl.delFlagBitMap.Set(uint64(docId.DocId))
+		if !tbl.delFlagBitMap.Set(uint64(docId.DocId)) {
+			return true, errors.New(fmt.Sprintf("Set bitmap failed: %v", docId.DocId))
+		}
+		return true, nil
 	} else {
 		log.Infof("No found %v!, Do nothing", primaryKey)
 	}
-	return true
+	return false, nil
 }
 
 //变更文档
@@ -570,13 +705,33 @@ func (tbl *Table) UpdateDoc(content map[string]interface{}) (uint32, error) {
 	tbl.rwMutex.Lock()
 	defer tbl.rwMutex.Unlock()
 
+	return tbl.updateDoc(content, 0)
+}
+
+//变更文档, 指定版本时只有文档的当前版本一致才变更
+func (tbl *Table) UpdateDocWithVersion(content map[string]interface{}, ifVersion uint64) (uint32, error) {
+	//写锁
+	tbl.rwMutex.Lock()
+	defer tbl.rwMutex.Unlock()
+
+	return tbl.updateDoc(content, ifVersion)
+}
+
+//变更文档的实际流程, 调用方需持有写锁
+func (tbl *Table) updateDoc(content map[string]interface{}, ifVersion uint64) (uint32, error) {
 	//校验
 	if tbl.status != TABLE_STATUS_RUNNING {
 		return 0, errors.New("Table status must be running!")
 	}
+	if tbl.readOnly() {
+		return 0, errors.New("Table is read only!")
+	}
 	if len(tbl.BasicFields) == 0 {
 		return 0, errors.New("field is nil")
 	}
+	if err := tbl.checkListFields(content); err != nil {
+		return 0, err
+	}
 	//如果表没有主键，则不支持变更
 	if tbl.PrimaryKey == "" {
 		return 0, errors.New("No Primary Key")
@@ -592,20 +747,8 @@ func (tbl *Table) UpdateDoc(content map[string]interface{}) (uint32, error) {
 
 	//如果内存分区为空，则新建
 	if tbl.memPartition == nil {
-		tbl.rwMutex.Lock()
 		err := tbl.generateMemPartition()
 		if err != nil {
-			tbl.rwMutex.Unlock()
-			return 0, err
-		}
-		tbl.rwMutex.Unlock()
-	}
-
-	//bitmap自动扩容
-	if tbl.NextDocId == tbl.MaxDocNum {
-		err := tbl.doExpandBitMap()
-		if err != nil {
-			log.Errf("doExpandBitMap Error: %v", err.Error())
 			return 0, err
 		}
 	}
@@ -613,15 +756,28 @@ func (tbl *Table) UpdateDoc(content map[string]interface{}) (uint32, error) {
 	//找到原来的docId
 	oldDocid, found := tbl.findDocIdByPrimaryKey(key)
 	if !found {
+		if ifVersion > 0 {
+			return 0, &VersionConflictError{Key: key, Expect: ifVersion}
+		}
 		return 0, errors.New(fmt.Sprintf("Can not find the doc %v. Update faield!", key))
 	}
+	if err := tbl.checkVersion(key, oldDocid.DocId, true, ifVersion); err != nil {
+		return 0, err
+	}
 
 	//本质上仍然是新增文档
-	//实质流程开始：一致性考虑，此刻开始必须执行到底
 	newDocId := tbl.NextDocId
 
+	//先写WAL
+	err := tbl.writeWal(&walRecord{Op: WAL_OP_UPDATE, Key: key, DocId: newDocId, OldDocId: oldDocid.DocId, Content: content})
+	if err != nil {
+		log.Errf("Write Wal Error:%v. PrimaryKey:%v", err, key)
+		return 0, err
+	}
+
+	//实质流程开始：一致性考虑，此刻开始必须执行到底
+
 	//实质内容本质上还是新增，主键不变，但是docId变了
-	var err error
 	err = tbl.memPartition.AddDocument(newDocId, content)
 	if err != nil {
 		//在顶层将新的docId标记删除
@@ -631,6 +787,9 @@ func (tbl *Table) UpdateDoc(content map[string]interface{}) (uint32, error) {
 		//成功增加了主体文档，则开始底层篡改
 		//先标记删除oldDocId
 		tbl.delFlagBitMap.Set(uint64(oldDocid.DocId))
+		tbl.updateFieldLenSum(oldDocid.DocId, false)
+		tbl.updateFieldLenSum(newDocId, true)
+		tbl.setVersion(newDocId, tbl.getVersion(oldDocid.DocId) + 1)
 
 		//变更指向 key=>docId
 		if _, exist := tbl.priIvtMap[key]; exist {
@@ -670,21 +829,8 @@ func (tbl *Table) UpdateDoc(content map[string]interface{}) (uint32, error) {
 	//无论成功与否，兼容一致性，均nextDocId均自增
 	tbl.NextDocId++
 
-	//最后，如果满足了落地的阈值, 需要先落地分区
-	if tbl.NextDocId % basic.PART_PERSIST_MIN_DOC_CNT == 0 {
-		err := tbl.Persist()
-		if err != nil {
-			log.Fatalf("MergePartitions Error: %v. Table: %v", err.Error(), tbl.TableName)
-		}
-	}
-
-	//最后，如果满足了合并归档的阈值, 需要合并归档
-	if tbl.NextDocId % basic.PART_MERGE_MIN_DOC_CNT == 0 {
-		err := tbl.MergePartitions()
-		if err != nil {
-			log.Fatalf("MergePartitions Error: %v. Table: %v", err.Error(), tbl.TableName)
-		}
-	}
+	//最后，如果满足了落地的条件, 需要先落地分区
+	tbl.checkFlush()
 
 	return newDocId, err
 }
@@ -737,8 +883,8 @@ func (tbl *Table) findDocIdByPrimaryKey(key string) (*basic.DocNode, bool) {
 		docId = int(vv)
 	}
 
-	//校验是否已经删除
-	if tbl.delFlagBitMap.IsSet(uint64(docId)) {
+	//校验是否已经删除, 超出范围的是元信息回退之后主键btdb中残留的数据
+	if tbl.delFlagBitMap.IsSet(uint64(docId)) || uint32(docId) >= tbl.NextDocId {
 		return nil, false
 	}
 
@@ -791,12 +937,17 @@ func (tbl *Table) persistMemPartition() error {
 	tbl.partitions = append(tbl.partitions, tmpPartition)
 	tbl.PrtPathNames = append(tbl.PrtPathNames, tmpPartition.PrtPathName)
 	tbl.memPartition = nil
+	tbl.memSince = time.Time{}
 
 	return tbl.storeMetaAndBtdb()
 }
 
 //关闭一张表
 func (tbl *Table) DoClose() error {
+	//先停掉后台合并和定时落地
+	tbl.stopMerger()
+	tbl.stopFlusher()
+
 	//写锁
 	tbl.rwMutex.Lock()
 	defer tbl.rwMutex.Unlock()
@@ -827,6 +978,12 @@ func (tbl *Table) DoClose() error {
 	if tbl.delFlagBitMap != nil {
 		tbl.delFlagBitMap.Close()
 	}
+
+	//关闭WAL
+	if tbl.wal != nil {
+		tbl.wal.Close()
+		tbl.wal = nil
+	}
 	log.Infof("DoClose Table [%v] Finish", tbl.TableName)
 	tbl.status = TABLE_STATUS_CLOSED
 	return nil
@@ -861,127 +1018,114 @@ func (tbl *Table) Destroy() error {
 	primaryFile := tbl.getPrimaryBtName()
 	bitmapFile := tbl.getBitMapName()
 
-	if err := helper.Remove(metaFile); err != nil {	log.Err(err.Error()); return err }
+	if err := helper.RemoveManifest(metaFile); err != nil {	log.Err(err.Error()); return err }
 	if err := helper.Remove(primaryFile); err != nil { log.Err(err.Error()); return err }
 	if err := helper.Remove(bitmapFile); err != nil { log.Err(err.Error()); return err }
+	if err := helper.Remove(tbl.getWalName()); err != nil { log.Err(err.Error()); return err }
 	if err := helper.Remove(tbl.Path); err != nil {	log.Err(err.Error()); return err }
 
 	log.Infof("Destroy Table [%v] Finish", tbl.TableName)
 	return nil
 }
 
-//合并表内分区
-func (tbl *Table) MergePartitions() error {
-
-	//锁整表，取消锁，否则会在AddDoc和UpdateDoc中把自己锁死
-	//tbl.rwMutex.Lock()
-	//defer tbl.rwMutex.Unlock()
+//表内搜索, 多个词项之间默认按OR合并
+func (tbl *Table) SearchDocs(fieldName, keyWord string, filters []basic.SearchFilter, offset, size int32) ([]basic.DocInfo, int, bool, error) {
+	docs, total, _, exist, err := tbl.SearchDocsWithOp(fieldName, keyWord, query.OP_OR, filters, nil, nil, "", offset, size)
+	return docs, total, exist, err
+}
 
-	if tbl.status != TABLE_STATUS_RUNNING {
-		return errors.New("Table status must be running!")
+//表内搜索, 指定分词后多个词项之间的合并方式(and/or)、排序方式和聚合
+//searchAfter非空时, 从游标之后开始取size个结果, 忽略offset
+func (tbl *Table) SearchDocsWithOp(fieldName, keyWord, op string, filters []basic.SearchFilter, sorts []basic.SearchSort,
+		aggs map[string]basic.SearchAgg, searchAfter string, offset, size int32) ([]basic.DocInfo, int, map[string]*basic.AggResult, bool, error) {
+	searchFn, err := tbl.opSearchFn(fieldName, keyWord, op, filters)
+	if err != nil {
+		return nil, 0, nil, false, err
 	}
+	return tbl.doSearch(filters, sorts, aggs, searchAfter, offset, size, searchFn)
+}
 
-	//表状态变更
-	tbl.status = TABLE_STATUS_MERGEING
-	defer func() {
-		tbl.status = TABLE_STATUS_RUNNING
-	}()
-
-	var startIdx int = -1
+//按查询语法树搜索, 未指定字段的词项在defaultField上查找
+func (tbl *Table) SearchQuery(node *query.Node, defaultField string, filters []basic.SearchFilter, sorts []basic.SearchSort,
+		aggs map[string]basic.SearchAgg, searchAfter string, offset, size int32) ([]basic.DocInfo, int, map[string]*basic.AggResult, bool, error) {
+	searchFn, err := tbl.querySearchFn(node, defaultField, filters)
+	if err != nil {
+		return nil, 0, nil, false, err
+	}
+	return tbl.doSearch(filters, sorts, aggs, searchAfter, offset, size, searchFn)
+}
 
+//单个分区的检索
+type searchFunc func(prt *partition.Partition, scoring *query.Scoring) ([]basic.DocNode, bool)
 
-	//内存分区非空则先落地
-	if tbl.memPartition != nil && !tbl.memPartition.IsEmpty(){
-		tbl.persistMemPartition()
+//按词项搜索的分区检索
+func (tbl *Table) opSearchFn(fieldName, keyWord, op string, filters []basic.SearchFilter) (searchFunc, error) {
+	//如果字段为空，那么会使用上帝视角进行跨字段搜索
+	if fieldName == "" {
+		fieldName = partition.GOD_FIELD_NAME
 	}
-
-	//找到第一个个数不符合规范，即要合并的partition
-	for idx := range tbl.partitions {
-		if tbl.partitions[idx].NextDocId - tbl.partitions[idx].StartDocId < basic.PART_MERGE_MIN_DOC_CNT {
-			startIdx = idx
-			break
-		}
+	op = strings.ToLower(op)
+	if op == "" {
+		op = query.OP_OR
 	}
-	if startIdx == -1 {
-		log.Infof("No nessary to merge!")
-		return nil
-	}
-	if len(tbl.partitions[startIdx:]) == 1 {
-		log.Infof("No nessary to merge!")
-		return nil
+	if op != query.OP_OR && op != query.OP_AND {
+		return nil, errors.New("Unsupport default operator: " + op)
 	}
 
-	//准备好非主键字段信息备用
-	var basicFields []field.BasicField
-	for _, f := range tbl.BasicFields {
-		basicFields = append(basicFields, f)
-	}
+	return func(prt *partition.Partition, scoring *query.Scoring) ([]basic.DocNode, bool) {
+		return prt.SearchDocs(fieldName, keyWord, op, scoring, tbl.delFlagBitMap, filters)
+	}, nil
+}
 
-	//从startIdx开始, 一点点尝试出最佳的分区合并方式
-	todoPartitions := [][]*partition.Partition{}
-	start := tbl.partitions[startIdx].StartDocId
-	tmpPrts := []*partition.Partition{}
-	for i := startIdx; i < len(tbl.partitions); i++ {
-		tmpPrts = append(tmpPrts, tbl.partitions[i])
-		if tbl.partitions[i].NextDocId - start >= basic.PART_MERGE_MIN_DOC_CNT {
-			todoPartitions = append(todoPartitions, tmpPrts)
-			tmpPrts = []*partition.Partition{}
-			start = tbl.partitions[i].NextDocId
-		}
-	}
-	if len(tmpPrts) > 0{
-		todoPartitions = append(todoPartitions, tmpPrts)
+//按查询语法树搜索的分区检索
+func (tbl *Table) querySearchFn(node *query.Node, defaultField string, filters []basic.SearchFilter) (searchFunc, error) {
+	//如果默认字段为空，那么会使用上帝视角进行跨字段搜索
+	if defaultField == "" {
+		defaultField = partition.GOD_FIELD_NAME
 	}
 
-	//截断后面的没用的分区
-	tbl.partitions = tbl.partitions[:startIdx]
-	tbl.PrtPathNames = tbl.PrtPathNames[:startIdx]
-	//开始合并
-	for _, todoParts := range todoPartitions {
-		//生成内存分区骨架，开始合并
-		prtPathName := tbl.getPrtPathName()
-		log.Infof("Table[%v] Merge Partition[%v] Begin!", tbl.TableName, prtPathName)
-		tbl.PartSuffix++
-		tmpPartition := partition.NewEmptyPartitionWithBasicFields(prtPathName, todoParts[0].StartDocId, basicFields)
-
-		err := tmpPartition.MergePersistPartitions(todoParts)
-		if err != nil {
-			log.Errf("MergePartitions Error: %s", err)
-			return err
-		}
+	//查询校验
+	if err := tbl.checkQuery(node, defaultField); err != nil {
+		return nil, err
+	}
 
-		//追加上有用的分区
-		tbl.partitions = append(tbl.partitions, tmpPartition)
-		tbl.PrtPathNames = append(tbl.PrtPathNames, prtPathName)
+	return func(prt *partition.Partition, scoring *query.Scoring) ([]basic.DocNode, bool) {
+		return prt.SearchQuery(node, defaultField, scoring, tbl.delFlagBitMap, filters)
+	}, nil
+}
 
-		//清理旧的分区
-		for _, prt := range todoParts {
-			prt.Destroy()
-		}
+//搜索的公共流程: 各个分区分别检索、聚合, 然后汇总、排序、分页、组装结果
+//各个分区共用同一个打分上下文, 得分基于整张表的统计信息, 可以直接比较
+func (tbl *Table) doSearch(filters []basic.SearchFilter, sorts []basic.SearchSort, aggs map[string]basic.SearchAgg,
+		searchAfter string, offset, size int32, searchFn searchFunc) ([]basic.DocInfo, int, map[string]*basic.AggResult, bool, error) {
+	if tbl.status != TABLE_STATUS_RUNNING {
+		return nil, 0, nil, false, errors.New("The Spider Is Not Running!")
+	}
 
-		log.Infof("Table[%v] Merge Partition[%v] Finish!", tbl.TableName, prtPathName)
+	//过滤器校验
+	if err := tbl.checkFilters(filters); err != nil {
+		return nil, 0, nil, false, err
 	}
 
-	//存储meta
-	err := tbl.storeMetaAndBtdb()
+	//排序字段校验
+	keys, err := tbl.checkSorts(sorts)
 	if err != nil {
-		return err
+		return nil, 0, nil, false, err
 	}
-	return nil
-}
 
-//表内搜索
-func (tbl *Table) SearchDocs(fieldName, keyWord string, filters []basic.SearchFilter, offset, size int32) ([]basic.DocInfo, int, bool, error) {
-	if tbl.status != TABLE_STATUS_RUNNING {
-		if tbl.status == TABLE_STATUS_MERGEING {
-			return nil, 0, false, errors.New("The Spider Is Merging. Please Try Again Later!")
-		}
-		return nil, 0, false, errors.New("The Spider Is Not Running!")
+	//聚合校验
+	aggs, err = tbl.checkAggs(aggs)
+	if err != nil {
+		return nil, 0, nil, false, err
 	}
 
-	//过滤器校验
-	if err := tbl.checkFilters(filters); err != nil {
-		return nil, 0, false, err
+	//游标解析
+	var after *sortDoc
+	if searchAfter != "" {
+		if after, err = decodeCursor(searchAfter, keys); err != nil {
+			return nil, 0, nil, false, err
+		}
+		offset = 0
 	}
 
 	//读锁
@@ -990,57 +1134,73 @@ func (tbl *Table) SearchDocs(fieldName, keyWord string, filters []basic.SearchFi
 
 	docIds := []basic.DocNode{}
 	exist := false
+	scoring := tbl.newScoring()
+	states := map[string]*partition.AggState{}
+	for name := range aggs {
+		states[name] = partition.NewAggState()
+	}
 
 	//fmt.Println("-----------Table search -------------")
 	//fmt.Println("BitMap: ", tbl.delFlagBitMap.String())
 
-	//如果字段为空，那么会使用上帝视角进行跨字段搜索
-	if fieldName == "" {
-		fieldName = partition.GOD_FIELD_NAME
-	}
-
 	//各个磁盘分区执行搜索
 	for _, prt := range tbl.partitions {
-		ids, ok := prt.SearchDocs(fieldName, keyWord, tbl.delFlagBitMap, filters)
+		ids, ok := searchFn(prt, scoring)
 		if ok {
 			exist = true
 			docIds = append(docIds, ids...)
+			for name, agg := range aggs {
+				states[name].Merge(prt.Aggregate(ids, agg))
+			}
 		}
 	}
 
 	//内存分区执行搜索
 	if tbl.memPartition != nil && !tbl.memPartition.IsEmpty(){
-		ids, ok := tbl.memPartition.SearchDocs(fieldName, keyWord, tbl.delFlagBitMap, filters)
+		ids, ok := searchFn(tbl.memPartition, scoring)
 		if ok {
 			exist = true
 			docIds = append(docIds, ids...)
+			for name, agg := range aggs {
+				states[name].Merge(tbl.memPartition.Aggregate(ids, agg))
+			}
 		}
 	}
 
 	//总数
 	total := len(docIds)
 
-	//将词频转化为TF-IDF
-	convertWeight(docIds, tbl.NextDocId)
+	//汇总聚合结果
+	var aggRets map[string]*basic.AggResult
+	if len(aggs) > 0 {
+		aggRets = map[string]*basic.AggResult{}
+		for name, agg := range aggs {
+			aggRets[name] = finishAgg(agg, states[name])
+		}
+	}
 
-	//TF-IDF排序
-	sort.Sort(DocWeightSort(docIds))
+	//分页, size默认100, offset超出范围返回空页
+	if offset < 0 {
+		offset = 0
+	}
+	if size <= 0 {
+		size = DEFAULT_PAGE_SIZE
+	}
+	if int(offset) >= total {
+		return []basic.DocInfo{}, total, aggRets, exist, nil
+	}
 
-	//分页, 默认取0-99
-	if offset < 0 || size <= 0 || (offset + size) > int32(len(docIds)) {
-		if len(docIds) > 100 {
-			offset = 0
-			size = 100
-		} else {
-			offset = 0
-			size = int32(len(docIds))
-		}
+	//排序, 只需要排出前offset+size个
+	sortDocs := tbl.sortTopK(docIds, keys, int(offset + size), after)
+	if int(offset) >= len(sortDocs) {
+		return []basic.DocInfo{}, total, aggRets, exist, nil
 	}
-	docIds = docIds[offset: offset + size]
+	sortDocs = sortDocs[offset:]
 
 	//结果组装
 	retDocs := []basic.DocInfo{}
-	for _, doc := range docIds {
+	for _, sdoc := range sortDocs {
+		doc := sdoc.node
 		tmp, ok := tbl.getDocByDocId(doc.DocId)
 		if !ok {
 			log.Errf("Can't find doc[%v] !!!!", doc.DocId)
@@ -1064,11 +1224,30 @@ func (tbl *Table) SearchDocs(fieldName, keyWord string, filters []basic.SearchFi
 		detail := basic.DocInfo{
 			Key: primaryKey,
 			Detail:tmp,
+			Version: tbl.getVersion(doc.DocId),
+			Cursor: tbl.encodeCursor(sdoc),
 		}
 
 		retDocs = append(retDocs, detail)
 	}
-	return retDocs, total, exist, nil
+	return retDocs, total, aggRets, exist, nil
+}
+
+//校验列表类型的字段, json数组的元素中不能含有分隔符
+//重放WAL时不校验, 之前已经写入的文档照常重放, 保证docId和WAL一致
+func (tbl *Table) checkListFields(content map[string]interface{}) error {
+	if tbl.replaying {
+		return nil
+	}
+	for fieldName, fld := range tbl.BasicFields {
+		if fld.IndexType != index.IDX_TYPE_STR_LIST {
+			continue
+		}
+		if err := index.CheckListContent(content[fieldName]); err != nil {
+			return errors.New(fieldName + ": " + err.Error())
+		}
+	}
+	return nil
 }
 
 //校验过滤器
@@ -1082,12 +1261,15 @@ func (tbl *Table) checkFilters(filters []basic.SearchFilter) error {
 
 			switch filter.FilterType {
 			case ">", "<", "between":
-			if fld.IndexType != index.IDX_TYPE_INTEGER &&
-				 fld.IndexType != index.IDX_TYPE_DATE {
-				return errors.New(filter.FieldName + "should be number or time")
+			if !index.IsNumericType(fld.IndexType) {
+				return errors.New(filter.FieldName + "should be number, float or time")
 			}
 			case "in", "not in":
-				if fld.IndexType == index.IDX_TYPE_INTEGER ||
+				if fld.IndexType == index.IDX_TYPE_FLOAT {
+					if filter.RangeFloats == nil {
+						return errors.New(filter.FieldName + " RangeFloats shoud not be nil")
+					}
+				} else if fld.IndexType == index.IDX_TYPE_INTEGER ||
 					fld.IndexType == index.IDX_TYPE_DATE {
 					if filter.RangeNums == nil {
 						return errors.New(filter.FieldName + " RangeNums shoud not be nil")
@@ -1098,9 +1280,15 @@ func (tbl *Table) checkFilters(filters []basic.SearchFilter) error {
 					}
 				}
 
+			case "contain any", "contain all":
+				if fld.IndexType != index.IDX_TYPE_STR_LIST {
+					return errors.New(filter.FieldName + " should be list")
+				}
+				if filter.RangeStrs == nil {
+					return errors.New(filter.FieldName + " RangeStrs shoud not be nil")
+				}
 			case "prefix", "suffix", "contain":
-				if fld.IndexType == index.IDX_TYPE_INTEGER ||
-					fld.IndexType == index.IDX_TYPE_DATE {
+				if index.IsNumericType(fld.IndexType) {
 					return errors.New(filter.FieldName + "should be string")
 				}
 			default:
@@ -1113,21 +1301,81 @@ func (tbl *Table) checkFilters(filters []basic.SearchFilter) error {
 	return nil
 }
 
-//将词频转化为TF-IDF
-func convertWeight(res []basic.DocNode, maxdoc uint32) {
-	df := len(res)
-	idf := math.Log10(float64(maxdoc) / float64(df))
-	for idx := 0; idx < len(res); idx++ {
-		res[idx].Weight = uint32(float64(res[idx].Weight) / index.BIGGER_MULTIPLE * idf * 1000)
+//校验查询语法树, 涉及的字段必须存在且拥有倒排索引
+func (tbl *Table) checkQuery(node *query.Node, defaultField string) error {
+	for _, fieldName := range node.FieldNames(defaultField) {
+		if fieldName == partition.GOD_FIELD_NAME {
+			continue
+		}
+		fld, exist := tbl.BasicFields[fieldName]
+		if !exist {
+			return errors.New(fmt.Sprintf("Field %v not Exist ", fieldName))
+		}
+		if fld.IndexType != index.IDX_TYPE_STR_WHOLE &&
+			fld.IndexType != index.IDX_TYPE_STR_SPLITER &&
+			fld.IndexType != index.IDX_TYPE_STR_LIST &&
+			fld.IndexType != index.IDX_TYPE_STR_WORD {
+			return errors.New(fmt.Sprintf("Field %v can not be searched", fieldName))
+		}
 	}
+	return nil
+}
+
+//设置相关性打分器
+func (tbl *Table) SetScorer(scorer query.Scorer) {
+	tbl.rwMutex.Lock()
+	defer tbl.rwMutex.Unlock()
+	tbl.scorer = scorer
 }
 
-//按TF-IDF排序
-type DocWeightSort []basic.DocNode
-func (a DocWeightSort) Len() int      { return len(a) }
-func (a DocWeightSort) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a DocWeightSort) Less(i, j int) bool {
-	return a[i].Weight > a[j].Weight
+//生成一次搜索的打分上下文
+//有效文档数和平均长度取自表的统计, 文档频率汇总自全部分区(已删除的文档不计入)
+//Note: 调用方需持有读锁
+func (tbl *Table) newScoring() *query.Scoring {
+	return query.NewScoring(tbl.scorer, func(fieldName, term string) query.TermStats {
+		stats := query.TermStats{DocCount: tbl.RealDocNum}
+		if tbl.RealDocNum > 0 {
+			stats.AvgLen = float64(tbl.FieldLenSum[fieldName]) / float64(tbl.RealDocNum)
+		}
+		for _, prt := range tbl.partitions {
+			stats.DocFreq += prt.DocFreq(fieldName, term, tbl.delFlagBitMap)
+		}
+		if tbl.memPartition != nil && !tbl.memPartition.IsEmpty() {
+			stats.DocFreq += tbl.memPartition.DocFreq(fieldName, term, tbl.delFlagBitMap)
+		}
+		return stats
+	})
+}
+
+//找到docId所在的分区
+func (tbl *Table) findPartition(docId uint32) (*partition.Partition, bool) {
+	if tbl.memPartition != nil &&
+		(docId >= tbl.memPartition.StartDocId && docId < tbl.memPartition.NextDocId) {
+		return tbl.memPartition, true
+	}
+	for _, prt := range tbl.partitions {
+		if docId >= prt.StartDocId && docId < prt.NextDocId {
+			return prt, true
+		}
+	}
+	return nil, false
+}
+
+//文档新增或删除时, 更新各个字段的长度之和
+func (tbl *Table) updateFieldLenSum(docId uint32, add bool) {
+	prt, ok := tbl.findPartition(docId)
+	if !ok {
+		return
+	}
+	for fieldName, docLen := range prt.GetDocLens(docId) {
+		if add {
+			tbl.FieldLenSum[fieldName] += uint64(docLen)
+		} else if tbl.FieldLenSum[fieldName] >= uint64(docLen) {
+			tbl.FieldLenSum[fieldName] -= uint64(docLen)
+		} else {
+			tbl.FieldLenSum[fieldName] = 0
+		}
+	}
 }
 
 func (tbl *Table) displayInner() string {
@@ -1158,6 +1406,16 @@ func (tbl *Table) getPrimaryBtName() string {
 	return primaryName
 }
 
+//生成新分区的名字, 并清理同名的残留文件
+func (tbl *Table) newPrtPathName() (string, error) {
+	prtPathName := tbl.getPrtPathName()
+	tbl.PartSuffix++ //自增
+	if err := partition.RemoveLeftover(prtPathName); err != nil {
+		return "", err
+	}
+	return prtPathName, nil
+}
+
 func (tbl *Table) getPrtPathName() string {
 	prtPathName := fmt.Sprintf("%v%v_%010v", tbl.Path, tbl.TableName, tbl.PartSuffix) //10位补零
 	return prtPathName
@@ -1207,5 +1465,6 @@ func (tbl *Table) GetStatus() *TableStatus {
 		NextDocId      : tbl.NextDocId,
 		DiskParts      : p,
 		MemPart        : memPart,
+		Settings       : tbl.Settings,
 	}
 }
\ No newline at end of file
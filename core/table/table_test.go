@@ -11,6 +11,12 @@ import (
 	"github.com/hq-cml/spider-engine/utils/helper"
 	"github.com/hq-cml/spider-engine/basic"
 	"github.com/hq-cml/spider-engine/core/partition"
+	"github.com/hq-cml/spider-engine/core/query"
+	"sort"
+	"time"
+	"path/filepath"
+	"errors"
+	"strconv"
 )
 
 const TEST_TABLE = "user"         //用户
@@ -623,95 +629,54 @@ func TestConsistentAfterError(t *testing.T) {
 	t.Log("\n\n")
 }
 
-//测试bitmap自动增长
-//这个用例需要将BitmapOrgNum改成8，方可测试
-func TestExpandBitmap(t *testing.T) {
-	t.Skip() //这个用例需要将BitmapOrgNum改成8，方可测试
+//测试删除标记的落地与加载
+func TestDelBitmap(t *testing.T) {
 	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
 	_, err := cmd.Output()
 	if err != nil {
 		os.Exit(1)
 	}
 
-	table := newEmptyTable("/tmp/spider", TEST_TABLE)
-
-	if err := table.AddField(field.BasicField{
-		FieldName: TEST_FIELD0,
-		IndexType: index.IDX_TYPE_PK,
-	}); err != nil {
-		panic(err)
-	}
-
-	if err := table.AddField(field.BasicField{
-		FieldName: TEST_FIELD1,
-		IndexType: index.IDX_TYPE_STR_WHOLE,
-	}); err != nil {
-		panic(err)
-	}
-
-	docId, _, err := table.AddDoc(map[string]interface{}{TEST_FIELD0: "10001", TEST_FIELD1: "张三"})
+	table, err := CreateTable("/tmp/spider", TEST_TABLE, []field.BasicField{
+		{FieldName: TEST_FIELD0, IndexType: index.IDX_TYPE_PK},
+		{FieldName: TEST_FIELD1, IndexType: index.IDX_TYPE_STR_WHOLE},
+	})
 	if err != nil {
-		panic(fmt.Sprintf("AddDoc Error:%s", err))
-	}
-	t.Log("Add DocId:", docId)
-
-	docId, _, err = table.AddDoc(map[string]interface{}{TEST_FIELD0: "10002", TEST_FIELD1: "李四"})
-	if err != nil {
-		panic(fmt.Sprintf("AddDoc Error:%s", err))
-	}
-	t.Log("Add DocId:", docId)
-
-	docId, _, err = table.AddDoc(map[string]interface{}{TEST_FIELD0: "10003",TEST_FIELD1: "王二麻"})
-	if err != nil {
-		panic(fmt.Sprintf("AddDoc Error:%s", err))
-	}
-	t.Log("Add DocId:", docId)
-
-	docId, _, err = table.AddDoc(map[string]interface{}{TEST_FIELD0: "10004", TEST_FIELD1: "张三"})
-	if err != nil {
-		panic(fmt.Sprintf("AddDoc Error:%s", err))
+		panic(err)
 	}
-	t.Log("Add DocId:", docId)
-
-	docId, _, err = table.AddDoc(map[string]interface{}{TEST_FIELD0: "10005", TEST_FIELD1: "李四"})
-	if err != nil {
-		panic(fmt.Sprintf("AddDoc Error:%s", err))
+	for i := 0; i < 100; i++ {
+		_, _, err := table.AddDoc(map[string]interface{}{TEST_FIELD0: fmt.Sprintf("%v", 10000 + i), TEST_FIELD1: "张三"})
+		if err != nil {
+			panic(fmt.Sprintf("AddDoc Error:%s", err))
+		}
 	}
-	t.Log("Add DocId:", docId)
-
-	docId, _, err = table.AddDoc(map[string]interface{}{TEST_FIELD0: "10006",TEST_FIELD1: "王二麻"})
-	if err != nil {
-		panic(fmt.Sprintf("AddDoc Error:%s", err))
+	for i := 0; i < 100; i += 10 {
+		if !table.DelDoc(fmt.Sprintf("%v", 10000 + i)) {
+			panic("DelDoc failed")
+		}
 	}
-	t.Log("Add DocId:", docId)
+	table.DoClose()
 
-	docId, _, err = table.AddDoc(map[string]interface{}{TEST_FIELD0: "10007", TEST_FIELD1: "张三"})
-	if err != nil {
-		panic(fmt.Sprintf("AddDoc Error:%s", err))
+	//bitmap文件只有几十个字节, 不再预先分配
+	info, err := os.Stat("/tmp/spider/" + TEST_TABLE + basic.IDX_FILENAME_SUFFIX_BITMAP)
+	if err != nil || info.Size() > 1024 {
+		panic(fmt.Sprintf("Wrong bitmap file: %v", err))
 	}
-	t.Log("Add DocId:", docId)
 
-	docId, _, err = table.AddDoc(map[string]interface{}{TEST_FIELD0: "10008", TEST_FIELD1: "李四"})
+	table, err = LoadTable("/tmp/spider", TEST_TABLE)
 	if err != nil {
-		panic(fmt.Sprintf("AddDoc Error:%s", err))
-	}
-	t.Log("Add DocId:", docId)
-
-	if table.MaxDocNum != 8 || table.delFlagBitMap.MaxNum != 7 { //此时观察bitmap文件是9Byte
-		panic("MaxDocNum shoud be 8")
+		panic(err)
 	}
-
-	docId, _, err = table.AddDoc(map[string]interface{}{TEST_FIELD0: "10003",TEST_FIELD1: "王二麻"})
-	if err != nil {
-		panic(fmt.Sprintf("AddDoc Error:%s", err))
+	defer table.DoClose()
+	if table.RealDocNum != 90 {
+		panic(fmt.Sprintf("Wrong doc num: %v", table.RealDocNum))
 	}
-	t.Log("Add DocId:", docId)
-
-	if table.MaxDocNum != 16 || table.delFlagBitMap.MaxNum != 15 { //此时观察bitmap文件是10Byte
-		panic("MaxDocNum shoud be 16")
+	for i := 0; i < 100; i++ {
+		_, _, exist, _ := table.GetDoc(fmt.Sprintf("%v", 10000 + i))
+		if exist != (i % 10 != 0) {
+			panic(fmt.Sprintf("Wrong doc: %v, %v", 10000 + i, exist))
+		}
 	}
-
-	table.DoClose()
 	t.Log("\n\n")
 }
 
@@ -1065,7 +1030,7 @@ func TestLoadAgainAgain(t *testing.T) {
 		panic(fmt.Sprintf("Load table Error:%s", err))
 	}
 
-	docs, ok, _ := table.SearchDocs(TEST_FIELD1, "刘七", nil, 0, 0)
+	docs, _, ok, _ := table.SearchDocs(TEST_FIELD1, "刘七", nil, 0, 0)
 	if !ok {
 		panic("shuoud exist")
 	}
@@ -1083,3 +1048,2306 @@ func TestLoadAgainAgain(t *testing.T) {
 
 	t.Log("\n\n")
 }
+
+//测试查询语法: AND/OR/NOT/分组, 同时覆盖磁盘分区和内存分区
+func TestSearchQuery(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "article", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "title", IndexType: index.IDX_TYPE_STR_SPLITER},
+		{FieldName: "tag", IndexType: index.IDX_TYPE_STR_WHOLE},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "1", "title": "golang搜索引擎实战", "tag": "tech"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "2", "title": "golang入门", "tag": "spam"}); if err != nil {panic(err) }
+	table.Persist()
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "3", "title": "搜索引擎原理", "tag": "tech"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "4", "title": "golang搜索引擎", "tag": "spam"}); if err != nil {panic(err) }
+
+	cases := map[string]string{
+		`title:(golang AND 搜索引擎)`:              `["1","4"]`,
+		`title:(golang AND 搜索引擎) AND -tag:spam`: `["1"]`,
+		`title:golang OR tag:tech`:               `["1","2","3","4"]`,
+		`title:搜索引擎 AND NOT title:golang`:       `["3"]`,
+		`NOT tag:spam`:                           `["1","3"]`,
+		`golang AND spam`:                        `["2","4"]`, //未指定字段, 跨字段搜索
+	}
+	for q, expect := range cases {
+		node, err := query.Parse(q)
+		if err != nil {
+			panic(err)
+		}
+		docs, total, _, _, err := table.SearchQuery(node, "", nil, nil, nil, "", 0, 10)
+		if err != nil {
+			panic(err)
+		}
+		keys := []string{}
+		for _, doc := range docs {
+			keys = append(keys, doc.Key)
+		}
+		sort.Strings(keys)
+		if helper.JsonEncode(keys) != expect || total != len(keys) {
+			panic(fmt.Sprintf("%v => %v, expect %v", q, helper.JsonEncode(keys), expect))
+		}
+		t.Log(q, " => ", helper.JsonEncode(keys))
+	}
+
+	//删除的文档不再出现
+	table.DelDoc("4")
+	node, _ := query.Parse(`title:(golang AND 搜索引擎)`)
+	docs, _, _, _, _ := table.SearchQuery(node, "", nil, nil, nil, "", 0, 10)
+	if len(docs) != 1 || docs[0].Key != "1" {
+		panic("Deleted doc should not be found")
+	}
+
+	//非法字段
+	node, _ = query.Parse(`nothing:golang`)
+	if _, _, _, _, err := table.SearchQuery(node, "", nil, nil, nil, "", 0, 10); err == nil {
+		panic("Should error")
+	}
+
+	table.DoClose()
+	t.Log("\n\n")
+}
+
+func TestPhraseQuery(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "article", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "title", IndexType: index.IDX_TYPE_STR_SPLITER, Positions: true},
+		{FieldName: "tag", IndexType: index.IDX_TYPE_STR_WHOLE},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "1", "title": "我爱北京天安门", "tag": "a"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "2", "title": "我爱北京的天安门", "tag": "b"}); if err != nil {panic(err) }
+	table.Persist()
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "3", "title": "天安门在北京", "tag": "a"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "4", "title": "去北京天安门", "tag": "b"}); if err != nil {panic(err) }
+
+	cases := map[string]string{
+		`title:"北京 天安门"`:          `["1","4"]`,
+		`title:"北京 天安门"~1`:        `["1","2","4"]`,
+		`title:(北京 AND 天安门)`:      `["1","2","3","4"]`,
+		`"北京 天安门" AND tag:b`:      `["4"]`, //未指定字段, 跨字段短语
+		`title:"北京 天安门" -tag:a`:   `["4"]`,
+	}
+	check := func(stage string) {
+		for q, expect := range cases {
+			node, err := query.ParseWithOp(q, query.OP_AND)
+			if err != nil {
+				panic(err)
+			}
+			docs, _, _, _, err := table.SearchQuery(node, "", nil, nil, nil, "", 0, 10)
+			if err != nil {
+				panic(err)
+			}
+			keys := []string{}
+			for _, doc := range docs {
+				keys = append(keys, doc.Key)
+			}
+			sort.Strings(keys)
+			if helper.JsonEncode(keys) != expect {
+				panic(fmt.Sprintf("%v: %v => %v, expect %v", stage, q, helper.JsonEncode(keys), expect))
+			}
+			t.Log(stage, ": ", q, " => ", helper.JsonEncode(keys))
+		}
+	}
+	check("内存")
+	table.Persist()
+	check("落地")
+	if err := table.MergePartitions(); err != nil {
+		panic(err)
+	}
+	check("合并")
+	table.DoClose()
+	table, err = LoadTable("/tmp/spider", "article")
+	if err != nil {
+		panic(err)
+	}
+	check("加载")
+
+	//非分词字段不支持位置信息
+	if err := table.AddField(field.BasicField{FieldName: "x", IndexType: index.IDX_TYPE_STR_WHOLE, Positions: true}); err == nil {
+		panic("Should error")
+	}
+
+	table.DoClose()
+	t.Log("\n\n")
+}
+
+func TestSearchMultiWords(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "person", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_WHOLE},
+		{FieldName: "desc", IndexType: index.IDX_TYPE_STR_SPLITER},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "1", "name": "唐伯虎", "desc": "我是一个喜欢秋香的人"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "2", "name": "祝枝山", "desc": "我喜欢石榴姐"}); if err != nil {panic(err) }
+	table.Persist()
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "3", "name": "华夫人", "desc": "秋香是我的丫鬟"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "4", "name": "文征明", "desc": "我是北京大学的学生"}); if err != nil {panic(err) }
+
+	type searchCase struct {
+		field, keyWord, op, expect string
+	}
+	cases := []searchCase{
+		{"desc", "喜欢秋香的人", query.OP_OR, `["1","2","3"]`},
+		{"desc", "喜欢秋香的人", query.OP_AND, `["1"]`},
+		{"desc", "喜欢, 秋香!", query.OP_AND, `["1"]`},
+		{"desc", "北京大学", query.OP_AND, `["4"]`},
+		{"desc", "秋香", "", `["1","3"]`},
+		{"name", "唐伯虎", query.OP_AND, `["1"]`}, //非分词字段整体匹配
+		{"", "唐伯虎 秋香", query.OP_AND, `["1"]`}, //跨字段
+	}
+	for _, c := range cases {
+		docs, total, _, _, err := table.SearchDocsWithOp(c.field, c.keyWord, c.op, nil, nil, nil, "", 0, 10)
+		if err != nil {
+			panic(err)
+		}
+		keys := []string{}
+		for _, doc := range docs {
+			keys = append(keys, doc.Key)
+		}
+		sort.Strings(keys)
+		if helper.JsonEncode(keys) != c.expect || total != len(keys) {
+			panic(fmt.Sprintf("%v %v => %v, expect %v", c.keyWord, c.op, helper.JsonEncode(keys), c.expect))
+		}
+		t.Log(c.keyWord, " ", c.op, " => ", helper.JsonEncode(keys))
+	}
+
+	//OR语义下, 命中词项越多, 得分越高
+	docs, _, _, _, _ := table.SearchDocsWithOp("desc", "喜欢秋香", query.OP_OR, nil, nil, nil, "", 0, 10)
+	if docs[0].Key != "1" {
+		panic("Wrong score: " + helper.JsonEncode(docs))
+	}
+
+	if _, _, _, _, err := table.SearchDocsWithOp("desc", "秋香", "xor", nil, nil, nil, "", 0, 10); err == nil {
+		panic("Should error")
+	}
+
+	table.DoClose()
+	t.Log("\n\n")
+}
+
+func TestBM25Rank(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "article", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "title", IndexType: index.IDX_TYPE_STR_SPLITER},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "long", "title": "今天天气很好，我们一起去公园散步，然后去图书馆看书，晚上回家吃饭"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "x1", "title": "我们一起吃饭"}); if err != nil {panic(err) }
+	table.Persist()
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "short", "title": "去图书馆看书"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "twice", "title": "看书看书，然后回家"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "x2", "title": "我们回家"}); if err != nil {panic(err) }
+
+	rank := func(keyWord string) []string {
+		docs, _, _, err := table.SearchDocs("title", keyWord, nil, 0, 10)
+		if err != nil {
+			panic(err)
+		}
+		keys := []string{}
+		for _, doc := range docs {
+			keys = append(keys, doc.Key)
+		}
+		return keys
+	}
+	check := func(stage string) {
+		//短文档得分高于长文档, 词频高的得分更高
+		keys := rank("看书")
+		if helper.JsonEncode(keys) != `["twice","short","long"]` {
+			panic(stage + ": Wrong rank " + helper.JsonEncode(keys))
+		}
+		//稀有的词项(图书馆)比常见的词项(回家)贡献更大的得分
+		keys = rank("图书馆 回家")
+		if keys[0] != "short" {
+			panic(stage + ": Wrong idf rank " + helper.JsonEncode(keys))
+		}
+		t.Log(stage, ": ", helper.JsonEncode(keys))
+	}
+	check("内存")
+	table.Persist()
+	check("落地")
+	if err := table.MergePartitions(); err != nil {
+		panic(err)
+	}
+	check("合并")
+
+	//删除的文档不再计入平均长度
+	sum := table.FieldLenSum["title"]
+	table.DelDoc("long")
+	if table.FieldLenSum["title"] >= sum || table.RealDocNum != 4 {
+		panic("Wrong field length sum")
+	}
+	table.DoClose()
+
+	//统计信息随元数据落地
+	table, err = LoadTable("/tmp/spider", "article")
+	if err != nil {
+		panic(err)
+	}
+	if table.FieldLenSum["title"] == 0 || table.FieldLenSum[partition.GOD_FIELD_NAME] == 0 {
+		panic("Field length sum lost")
+	}
+	keys := rank("看书")
+	if helper.JsonEncode(keys) != `["twice","short"]` {
+		panic("Wrong rank after load " + helper.JsonEncode(keys))
+	}
+	table.DoClose()
+	t.Log("\n\n")
+}
+
+func TestSortDocs(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "article", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "title", IndexType: index.IDX_TYPE_STR_SPLITER},
+		{FieldName: "read_cnt", IndexType: index.IDX_TYPE_INTEGER},
+		{FieldName: "date", IndexType: index.IDX_TYPE_DATE},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "a", "title": "学习golang", "read_cnt": 10, "date": "2020-01-01"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "b", "title": "学习搜索引擎", "read_cnt": 30, "date": "2020-01-02"}); if err != nil {panic(err) }
+	table.Persist()
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "c", "title": "学习倒排索引", "read_cnt": 10, "date": "2020-01-03"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "d", "title": "学习正排索引", "read_cnt": 20, "date": "2020-01-01"}); if err != nil {panic(err) }
+
+	search := func(sorts []basic.SearchSort, offset, size int32) []string {
+		docs, total, _, err := table.SearchDocs("title", "学习", nil, 0, 0)
+		if err != nil || total != 4 || len(docs) != 4 {
+			panic(fmt.Sprintf("Wrong search: %v, %v", total, err))
+		}
+		docs, _, _, _, err = table.SearchDocsWithOp("title", "学习", query.OP_OR, nil, sorts, nil, "", offset, size)
+		if err != nil {
+			panic(err)
+		}
+		keys := []string{}
+		for _, doc := range docs {
+			keys = append(keys, doc.Key)
+		}
+		return keys
+	}
+	check := func(stage string) {
+		cases := []struct {
+			sorts  []basic.SearchSort
+			offset int32
+			size   int32
+			expect string
+		}{
+			{[]basic.SearchSort{{FieldName: "read_cnt", Order: "desc"}, {FieldName: "date", Order: "desc"}}, 0, 10, `["b","d","c","a"]`},
+			{[]basic.SearchSort{{FieldName: "read_cnt", Order: "asc"}, {FieldName: "date"}}, 0, 10, `["c","a","d","b"]`},
+			{[]basic.SearchSort{{FieldName: "read_cnt", Order: "desc"}, {FieldName: "date", Order: "desc"}}, 1, 2, `["d","c"]`},
+			{[]basic.SearchSort{{FieldName: "date", Order: "ASC"}, {FieldName: basic.SORT_BY_SCORE}}, 0, 1, `["a"]`},
+		}
+		for _, c := range cases {
+			keys := search(c.sorts, c.offset, c.size)
+			if helper.JsonEncode(keys) != c.expect {
+				panic(stage + ": Wrong sort " + helper.JsonEncode(c.sorts) + " => " + helper.JsonEncode(keys))
+			}
+		}
+		t.Log(stage, ": ", helper.JsonEncode(search([]basic.SearchSort{{FieldName: "read_cnt"}}, 0, 10)))
+	}
+	check("内存")
+	table.Persist()
+	check("落地")
+	if err := table.MergePartitions(); err != nil {
+		panic(err)
+	}
+	check("合并")
+
+	//非法的排序字段和排序方向
+	for _, sorts := range [][]basic.SearchSort{
+		{{FieldName: "title"}},
+		{{FieldName: "not_exist"}},
+		{{FieldName: "read_cnt", Order: "up"}},
+	} {
+		if _, _, _, _, err := table.SearchDocsWithOp("title", "学习", query.OP_OR, nil, sorts, nil, "", 0, 10); err == nil {
+			panic("Should error: " + helper.JsonEncode(sorts))
+		}
+	}
+
+	//新增的字段, 之前的文档没有值, 无论升序降序都排在最后
+	if err := table.AddField(field.BasicField{FieldName: "likes", IndexType: index.IDX_TYPE_INTEGER}); err != nil {
+		panic(err)
+	}
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "e", "title": "学习排序", "read_cnt": 1, "date": "2020-01-05", "likes": 5}); if err != nil {panic(err) }
+	for _, order := range []string{"asc", "desc"} {
+		docs, _, _, _, err := table.SearchDocsWithOp("title", "学习", query.OP_OR, nil,
+			[]basic.SearchSort{{FieldName: "likes", Order: order}}, nil, "", 0, 10)
+		if err != nil {
+			panic(err)
+		}
+		if len(docs) != 5 || docs[0].Key != "e" || docs[1].Key != "a" {
+			panic("Wrong missing value sort: " + helper.JsonEncode(docs))
+		}
+	}
+	table.DoClose()
+	t.Log("\n\n")
+}
+
+func TestSearchAfter(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "article", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "title", IndexType: index.IDX_TYPE_STR_SPLITER},
+		{FieldName: "read_cnt", IndexType: index.IDX_TYPE_INTEGER},
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 25; i++ {
+		_, _, err = table.AddDoc(map[string]interface{}{"id": fmt.Sprintf("doc%02d", i), "title": "学习golang", "read_cnt": i % 5})
+		if err != nil {
+			panic(err)
+		}
+		if i % 10 == 9 {
+			table.Persist()
+		}
+	}
+	sorts := []basic.SearchSort{{FieldName: "read_cnt", Order: "desc"}}
+
+	//一次性取出全部结果作为参照
+	all, total, _, _, err := table.SearchDocsWithOp("title", "学习", query.OP_OR, nil, sorts, nil, "", 0, 100)
+	if err != nil || total != 25 || len(all) != 25 {
+		panic(fmt.Sprintf("Wrong search: %v, %v", total, err))
+	}
+
+	//按游标逐页获取, 结果和一次性获取的一致
+	crawl := func() []string {
+		keys := []string{}
+		after := ""
+		for {
+			docs, total, _, _, err := table.SearchDocsWithOp("title", "学习", query.OP_OR, nil, sorts, nil, after, 0, 4)
+			if err != nil {
+				panic(err)
+			}
+			if total != int(table.RealDocNum) {
+				panic(fmt.Sprintf("Wrong total: %v", total))
+			}
+			if len(docs) == 0 {
+				break
+			}
+			for _, doc := range docs {
+				keys = append(keys, doc.Key)
+			}
+			after = docs[len(docs)-1].Cursor
+		}
+		return keys
+	}
+	keys := crawl()
+	expect := []string{}
+	for _, doc := range all {
+		expect = append(expect, doc.Key)
+	}
+	if helper.JsonEncode(keys) != helper.JsonEncode(expect) {
+		panic("Wrong search after: " + helper.JsonEncode(keys))
+	}
+	t.Log(helper.JsonEncode(keys))
+
+	//翻页过程中删除已经返回的文档, 不影响后面的页
+	docs, _, _, _, _ := table.SearchDocsWithOp("title", "学习", query.OP_OR, nil, sorts, nil, "", 0, 3)
+	table.DelDoc(docs[0].Key)
+	docs, _, _, _, _ = table.SearchDocsWithOp("title", "学习", query.OP_OR, nil, sorts, nil, docs[2].Cursor, 0, 3)
+	if helper.JsonEncode([]string{docs[0].Key, docs[1].Key, docs[2].Key}) != helper.JsonEncode(expect[3:6]) {
+		panic("Wrong search after delete: " + helper.JsonEncode(docs))
+	}
+
+	//翻页过程中更新文档(排序值不变), docId变了但主键不变, 已经返回的不会重复, 没有返回的不会遗漏
+	docs, _, _, _, _ = table.SearchDocsWithOp("title", "学习", query.OP_OR, nil, sorts, nil, "", 0, 2)
+	for _, key := range []string{expect[1], expect[4]} {
+		if _, err := table.UpdateDoc(map[string]interface{}{"id": key, "title": "学习golang", "read_cnt": 4}); err != nil {
+			panic(err)
+		}
+	}
+	docs, _, _, _, _ = table.SearchDocsWithOp("title", "学习", query.OP_OR, nil, sorts, nil, docs[1].Cursor, 0, 3)
+	if helper.JsonEncode([]string{docs[0].Key, docs[1].Key, docs[2].Key}) != helper.JsonEncode(expect[3:6]) {
+		panic("Wrong search after update: " + helper.JsonEncode(docs))
+	}
+
+	//游标之后使用offset, offset被忽略
+	docs2, _, _, _, _ := table.SearchDocsWithOp("title", "学习", query.OP_OR, nil, sorts, nil, docs[0].Cursor, 100, 2)
+	if len(docs2) != 2 || docs2[0].Key != expect[4] {
+		panic("Offset should be ignored: " + helper.JsonEncode(docs2))
+	}
+
+	//超出范围的offset返回空页
+	docs, total, _, _, err = table.SearchDocsWithOp("title", "学习", query.OP_OR, nil, sorts, nil, "", 30, 10)
+	if err != nil || len(docs) != 0 || total != 24 {
+		panic("Should be empty page: " + helper.JsonEncode(docs))
+	}
+	docs, _, _, _, _ = table.SearchDocsWithOp("title", "学习", query.OP_OR, nil, sorts, nil, "", 20, 10)
+	if len(docs) != 4 {
+		panic("Wrong last page: " + helper.JsonEncode(docs))
+	}
+
+	//非法游标, 以及和排序字段不匹配的游标
+	for _, after := range []string{"abc!", all[0].Cursor} {
+		_, _, _, _, err := table.SearchDocsWithOp("title", "学习", query.OP_OR, nil,
+			[]basic.SearchSort{{FieldName: "read_cnt"}, {FieldName: basic.SORT_BY_SCORE}}, nil, after, 0, 10)
+		if err == nil {
+			panic("Should error: " + after)
+		}
+	}
+	table.DoClose()
+	t.Log("\n\n")
+}
+
+func TestAggregations(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_SPLITER},
+		{FieldName: "brand", IndexType: index.IDX_TYPE_STR_WHOLE},
+		{FieldName: "price", IndexType: index.IDX_TYPE_INTEGER},
+		{FieldName: "date", IndexType: index.IDX_TYPE_DATE},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "1", "name": "华为手机", "brand": "华为", "price": 3000, "date": "2020-01-01 10:00:00"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "2", "name": "小米手机", "brand": "小米", "price": 2000, "date": "2020-01-01 20:00:00"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "3", "name": "华为平板", "brand": "华为", "price": 4000, "date": "2020-01-02 10:00:00"}); if err != nil {panic(err) }
+	table.Persist()
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "4", "name": "华为手机", "brand": "华为", "price": 5000, "date": "2020-02-01 10:00:00"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "5", "name": "苹果手机", "brand": "苹果", "price": 6000, "date": "2020-02-03 10:00:00"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "6", "name": "小米手机", "brand": "小米", "price": 1000, "date": "2020-02-05 10:00:00"}); if err != nil {panic(err) }
+
+	aggs := map[string]basic.SearchAgg{
+		"brands":  {FieldName: "brand", AggType: basic.AGG_TERMS, Size: 2},
+		"min":     {FieldName: "price", AggType: basic.AGG_MIN},
+		"max":     {FieldName: "price", AggType: basic.AGG_MAX},
+		"avg":     {FieldName: "price", AggType: basic.AGG_AVG},
+		"sum":     {FieldName: "price", AggType: basic.AGG_SUM},
+		"daily":   {FieldName: "date", AggType: basic.AGG_DATE_HISTOGRAM},
+		"monthly": {FieldName: "date", AggType: basic.AGG_DATE_HISTOGRAM, Interval: "month"},
+	}
+	check := func(stage string) {
+		//手机, 并且价格不低于1500, 聚合针对全部命中文档, 不受分页影响
+		docs, total, rets, _, err := table.SearchDocsWithOp("name", "手机", query.OP_OR, []basic.SearchFilter{
+			{FieldName: "price", FilterType: ">", IntVal: 1500},
+		}, nil, aggs, "", 0, 1)
+		if err != nil {
+			panic(err)
+		}
+		if len(docs) != 1 || total != 4 {
+			panic(fmt.Sprintf("%v: Wrong search: %v, %v", stage, len(docs), total))
+		}
+		expect := map[string]string{
+			"brands":  `{"count":4,"buckets":[{"key":"华为","count":2},{"key":"小米","count":1}]}`,
+			"min":     `{"count":4,"value":2000}`,
+			"max":     `{"count":4,"value":6000}`,
+			"avg":     `{"count":4,"value":4000}`,
+			"sum":     `{"count":4,"value":16000}`,
+			"daily":   `{"count":4,"buckets":[{"key":"2020-01-01 00:00:00","count":2},{"key":"2020-02-01 00:00:00","count":1},{"key":"2020-02-03 00:00:00","count":1}]}`,
+			"monthly": `{"count":4,"buckets":[{"key":"2020-01-01 00:00:00","count":2},{"key":"2020-02-01 00:00:00","count":2}]}`,
+		}
+		for name, e := range expect {
+			if helper.JsonEncode(rets[name]) != e {
+				panic(stage + ": Wrong aggregation " + name + ": " + helper.JsonEncode(rets[name]))
+			}
+		}
+		t.Log(stage, ": ", helper.JsonEncode(rets))
+	}
+	check("内存")
+	table.Persist()
+	check("落地")
+	if err := table.MergePartitions(); err != nil {
+		panic(err)
+	}
+	check("合并")
+
+	//已删除的文档不参与聚合; 没有命中时数值聚合为空
+	table.DelDoc("5")
+	_, _, rets, _, err := table.SearchDocsWithOp("name", "手机", query.OP_OR, nil, nil, aggs, "", 0, 10)
+	if err != nil || rets["max"].Count != 4 || *rets["max"].Value != 5000 {
+		panic("Wrong aggregation after delete: " + helper.JsonEncode(rets))
+	}
+	_, _, rets, _, err = table.SearchDocsWithOp("name", "手机", query.OP_OR, []basic.SearchFilter{
+		{FieldName: "price", FilterType: ">", IntVal: 100000},
+	}, nil, aggs, "", 0, 10)
+	if err != nil || rets["avg"].Count != 0 || rets["avg"].Value != nil || len(rets["brands"].Buckets) != 0 {
+		panic("Wrong empty aggregation: " + helper.JsonEncode(rets))
+	}
+
+	//-1是正常的数值, 不是没有值
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "7", "name": "二手手机", "brand": "二手", "price": -1, "date": "2020-03-01 10:00:00"}); if err != nil {panic(err) }
+	_, _, rets, _, err = table.SearchDocsWithOp("brand", "二手", query.OP_OR, nil, nil, aggs, "", 0, 10)
+	if err != nil || rets["min"].Count != 1 || *rets["min"].Value != -1 || *rets["max"].Value != -1 || *rets["sum"].Value != -1 {
+		panic("Wrong aggregation with -1: " + helper.JsonEncode(rets))
+	}
+
+	//非法的聚合
+	for _, agg := range []basic.SearchAgg{
+		{FieldName: "name", AggType: basic.AGG_TERMS},
+		{FieldName: "brand", AggType: basic.AGG_SUM},
+		{FieldName: "price", AggType: basic.AGG_DATE_HISTOGRAM},
+		{FieldName: "date", AggType: basic.AGG_DATE_HISTOGRAM, Interval: "minute"},
+		{FieldName: "price", AggType: "median"},
+		{FieldName: "not_exist", AggType: basic.AGG_MAX},
+	} {
+		_, _, _, _, err := table.SearchDocsWithOp("name", "手机", query.OP_OR, nil, nil,
+			map[string]basic.SearchAgg{"x": agg}, "", 0, 10)
+		if err == nil {
+			panic("Should error: " + helper.JsonEncode(agg))
+		}
+	}
+	table.DoClose()
+	t.Log("\n\n")
+}
+
+func TestRangeQuery(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_SPLITER},
+		{FieldName: "price", IndexType: index.IDX_TYPE_INTEGER},
+		{FieldName: "date", IndexType: index.IDX_TYPE_DATE},
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 30; i++ {
+		name := "手机"
+		if i % 2 == 1 {
+			name = "平板"
+		}
+		_, _, err = table.AddDoc(map[string]interface{}{"id": fmt.Sprintf("%02d", i), "name": name,
+			"price": (i * 7) % 30 * 10, "date": fmt.Sprintf("2020-01-%02d", i + 1)})
+		if err != nil {
+			panic(err)
+		}
+		if i == 9 || i == 19 {
+			table.Persist()
+		}
+	}
+
+	//逐个文档计算期望的结果
+	expect := func(keyWord string, match func(i int, price, date int64) bool) string {
+		keys := []string{}
+		for i := 0; i < 30; i++ {
+			if (keyWord == "手机" && i % 2 == 1) || (keyWord == "平板" && i % 2 == 0) {
+				continue
+			}
+			if _, _, exist, _ := table.GetDoc(fmt.Sprintf("%02d", i)); !exist {
+				continue
+			}
+			date, _ := helper.String2Timestamp(fmt.Sprintf("2020-01-%02d", i + 1))
+			if match(i, int64((i * 7) % 30 * 10), date) {
+				keys = append(keys, fmt.Sprintf("%02d", i))
+			}
+		}
+		return helper.JsonEncode(keys)
+	}
+	search := func(keyWord string, filters []basic.SearchFilter) string {
+		docs, _, _, _, err := table.SearchDocsWithOp("name", keyWord, query.OP_OR, filters,
+			[]basic.SearchSort{{FieldName: "date", Order: "asc"}}, nil, "", 0, 100)
+		if err != nil {
+			panic(err)
+		}
+		keys := []string{}
+		for _, doc := range docs {
+			keys = append(keys, doc.Key)
+		}
+		return helper.JsonEncode(keys)
+	}
+	day10, _ := helper.String2Timestamp("2020-01-10")
+	check := func(stage string) {
+		cases := []struct {
+			keyWord string
+			filters []basic.SearchFilter
+			match   func(i int, price, date int64) bool
+		}{
+			{"", []basic.SearchFilter{{FieldName: "price", FilterType: "between", Begin: 50, End: 120}},
+				func(i int, price, date int64) bool { return price >= 50 && price <= 120 }},
+			{"", []basic.SearchFilter{{FieldName: "price", FilterType: ">", IntVal: 250}},
+				func(i int, price, date int64) bool { return price >= 250 }},
+			{"", []basic.SearchFilter{{FieldName: "price", FilterType: "=", IntVal: 70}},
+				func(i int, price, date int64) bool { return price == 70 }},
+			{"", []basic.SearchFilter{
+				{FieldName: "price", FilterType: "<", IntVal: 150},
+				{FieldName: "date", FilterType: ">", IntVal: day10},
+				{FieldName: "name", FilterType: "=", StrVal: "平板"},
+			}, func(i int, price, date int64) bool { return price <= 150 && date >= day10 && i % 2 == 1 }},
+			{"手机", []basic.SearchFilter{{FieldName: "price", FilterType: "between", Begin: 0, End: 100}},
+				func(i int, price, date int64) bool { return price <= 100 }},
+			{"", []basic.SearchFilter{{FieldName: "price", FilterType: "between", Begin: 120, End: 50}},
+				func(i int, price, date int64) bool { return false }},
+		}
+		for _, c := range cases {
+			ret, exp := search(c.keyWord, c.filters), expect(c.keyWord, c.match)
+			if ret != exp {
+				panic(stage + ": Wrong range query " + helper.JsonEncode(c.filters) + " => " + ret + ", expect " + exp)
+			}
+		}
+		t.Log(stage, ": ", search("", []basic.SearchFilter{{FieldName: "price", FilterType: "between", Begin: 50, End: 120}}))
+	}
+	check("内存")
+	table.Persist()
+	for _, prt := range table.partitions {
+		if prt.Fields["price"].NumIdx == nil || prt.Fields["date"].NumIdx == nil {
+			panic("Numeric index not built")
+		}
+	}
+	check("落地")
+	table.DelDoc("05")
+	table.DelDoc("22")
+	check("删除")
+	if err := table.MergePartitions(); err != nil {
+		panic(err)
+	}
+	check("合并")
+	table.DoClose()
+
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	if table.partitions[0].Fields["price"].NumIdx == nil {
+		panic("Numeric index not loaded")
+	}
+	check("加载")
+
+	//新增字段之后合并, 老文档没有值, 不会命中范围过滤
+	if err := table.AddField(field.BasicField{FieldName: "stock", IndexType: index.IDX_TYPE_INTEGER}); err != nil {
+		panic(err)
+	}
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "new", "name": "手机", "price": 10, "date": "2020-02-01", "stock": 5}); if err != nil {panic(err) }
+	table.Persist()
+	if err := table.MergePartitions(); err != nil {
+		panic(err)
+	}
+	docs, _, _, _, err := table.SearchDocsWithOp("", "", query.OP_OR, []basic.SearchFilter{
+		{FieldName: "stock", FilterType: "<", IntVal: 100},
+	}, nil, nil, "", 0, 100)
+	if err != nil || len(docs) != 1 || docs[0].Key != "new" {
+		panic("Wrong range query on new field: " + helper.JsonEncode(docs))
+	}
+	table.DoClose()
+	t.Log("\n\n")
+}
+
+func TestFloatField(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_SPLITER},
+		{FieldName: "score", IndexType: index.IDX_TYPE_FLOAT},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	//json解析出来的是float64, 也支持字符形式
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "1", "name": "华为手机", "score": 4.5}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "2", "name": "小米手机", "score": "3.25"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "3", "name": "苹果手机", "score": -1.5}); if err != nil {panic(err) }
+	table.Persist()
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "4", "name": "华为平板", "score": 0}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "5", "name": "小米平板", "score": 4.75}); if err != nil {panic(err) }
+
+	search := func(filters []basic.SearchFilter, sorts []basic.SearchSort) string {
+		docs, _, _, _, err := table.SearchDocsWithOp("", "", query.OP_OR, filters, sorts, nil, "", 0, 100)
+		if err != nil {
+			panic(err)
+		}
+		keys := []string{}
+		for _, doc := range docs {
+			keys = append(keys, doc.Key)
+		}
+		return helper.JsonEncode(keys)
+	}
+	check := func(stage string) {
+		asc := []basic.SearchSort{{FieldName: "score", Order: "asc"}}
+		cases := []struct {
+			filters []basic.SearchFilter
+			sorts   []basic.SearchSort
+			expect  string
+		}{
+			{nil, asc, `["3","4","2","1","5"]`},
+			{nil, []basic.SearchSort{{FieldName: "score", Order: "desc"}}, `["5","1","2","4","3"]`},
+			{[]basic.SearchFilter{{FieldName: "score", FilterType: "between", FloatBegin: -2, FloatEnd: 3.25}}, asc, `["3","4","2"]`},
+			{[]basic.SearchFilter{{FieldName: "score", FilterType: ">", FloatVal: 4.5}}, asc, `["1","5"]`},
+			{[]basic.SearchFilter{{FieldName: "score", FilterType: "<", FloatVal: 0}}, asc, `["3","4"]`},
+			{[]basic.SearchFilter{{FieldName: "score", FilterType: "=", FloatVal: 3.25}}, asc, `["2"]`},
+			{[]basic.SearchFilter{{FieldName: "score", FilterType: "in", RangeFloats: []float64{0, 4.75}}}, asc, `["4","5"]`},
+		}
+		for _, c := range cases {
+			if ret := search(c.filters, c.sorts); ret != c.expect {
+				panic(stage + ": Wrong float search " + helper.JsonEncode(c.filters) + " => " + ret)
+			}
+		}
+
+		_, _, rets, _, err := table.SearchDocsWithOp("", "", query.OP_OR, nil, nil, map[string]basic.SearchAgg{
+			"min": {FieldName: "score", AggType: basic.AGG_MIN},
+			"max": {FieldName: "score", AggType: basic.AGG_MAX},
+			"avg": {FieldName: "score", AggType: basic.AGG_AVG},
+		}, "", 0, 1)
+		if err != nil {
+			panic(err)
+		}
+		if helper.JsonEncode(rets["min"]) != `{"count":5,"value":-1.5}` ||
+			helper.JsonEncode(rets["max"]) != `{"count":5,"value":4.75}` ||
+			helper.JsonEncode(rets["avg"]) != `{"count":5,"value":2.2}` {
+			panic(stage + ": Wrong float aggregation " + helper.JsonEncode(rets))
+		}
+
+		doc, _, exist, err := table.GetDoc("2")
+		if err != nil || !exist || doc.Detail["score"] != 3.25 {
+			panic(stage + ": Wrong float doc " + helper.JsonEncode(doc))
+		}
+		t.Log(stage, ": ", search(nil, asc))
+	}
+	check("内存")
+	table.Persist()
+	check("落地")
+	if err := table.MergePartitions(); err != nil {
+		panic(err)
+	}
+	check("合并")
+	table.DoClose()
+
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	check("加载")
+
+	//字符串类型的过滤和非法的浮点
+	if _, _, _, _, err := table.SearchDocsWithOp("", "", query.OP_OR, []basic.SearchFilter{
+		{FieldName: "score", FilterType: "prefix", StrVal: "3"},
+	}, nil, nil, "", 0, 10); err == nil {
+		panic("Prefix filter on float should fail")
+	}
+	if _, _, err := table.AddDoc(map[string]interface{}{"id": "7", "name": "手机", "score": "abc"}); err == nil {
+		panic("Wrong float should fail")
+	}
+
+	//新增的浮点字段, 之前的文档没有值: 和整数一样返回MaxInt64, 局部更新之后仍然没有值, 也不参与聚合
+	if err := table.AddField(field.BasicField{FieldName: "rate", IndexType: index.IDX_TYPE_FLOAT}); err != nil {
+		panic(err)
+	}
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "6", "name": "华为手表", "score": 1, "rate": 0.5}); if err != nil {panic(err) }
+	table.Persist()
+	if err := table.MergePartitions(); err != nil {
+		panic(err)
+	}
+	if _, _, err := table.PatchDoc("1", map[string]interface{}{"name": "华为新手机"}, nil, false, 0); err != nil {
+		panic(err)
+	}
+	for _, key := range []string{"1", "2"} {
+		doc, _, exist, err := table.GetDoc(key)
+		if err != nil || !exist || doc.Detail["rate"] != int64(index.MaxInt64) {
+			panic("Float without value: " + helper.JsonEncode(doc))
+		}
+	}
+	_, _, rets, _, err := table.SearchDocsWithOp("", "", query.OP_OR, nil, nil, map[string]basic.SearchAgg{
+		"avg": {FieldName: "rate", AggType: basic.AGG_AVG},
+	}, "", 0, 1)
+	if err != nil || helper.JsonEncode(rets["avg"]) != `{"count":1,"value":0.5}` {
+		panic("Wrong aggregation on float without value: " + helper.JsonEncode(rets))
+	}
+
+	//WAL重放之后仍然没有值
+	table.DoClose()
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	doc, _, _, _ := table.GetDoc("1")
+	if doc.Detail["rate"] != int64(index.MaxInt64) || doc.Detail["name"] != "华为新手机" {
+		panic("Float without value after reload: " + helper.JsonEncode(doc))
+	}
+	table.DoClose()
+	t.Log("\n\n")
+}
+
+func TestListAndCharsField(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "tags", IndexType: index.IDX_TYPE_STR_LIST},
+		{FieldName: "code", IndexType: index.IDX_TYPE_STR_WORD},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	//列表支持json数组和分号分隔的字符串
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "1", "tags": []interface{}{"红色", "大屏"}, "code": "ab1"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "2", "tags": "蓝色;大屏;5G", "code": "bc2"}); if err != nil {panic(err) }
+	table.Persist()
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "3", "tags": []interface{}{"红色", "5G"}, "code": "cd3"}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "4", "tags": "白色", "code": "de4"}); if err != nil {panic(err) }
+
+	//数组的元素中含有分号, 会被切分成多个元素, 新增和变更都拒绝
+	docNum := table.RealDocNum
+	if _, _, err = table.AddDoc(map[string]interface{}{"id": "5", "tags": []interface{}{"红色;5G"}}); err == nil {
+		panic("Should error")
+	}
+	if _, err = table.UpdateDoc(map[string]interface{}{"id": "1", "tags": []string{"红色", "大屏;5G"}}); err == nil {
+		panic("Should error")
+	}
+	if table.RealDocNum != docNum {
+		panic(fmt.Sprintf("Wrong doc num: %v", table.RealDocNum))
+	}
+
+	search := func(fieldName, keyWord, op string, filters []basic.SearchFilter) string {
+		docs, _, _, _, err := table.SearchDocsWithOp(fieldName, keyWord, op, filters, nil, nil, "", 0, 100)
+		if err != nil {
+			panic(err)
+		}
+		keys := []string{}
+		for _, doc := range docs {
+			keys = append(keys, doc.Key)
+		}
+		sort.Strings(keys)
+		return helper.JsonEncode(keys)
+	}
+	check := func(stage string) {
+		cases := []struct {
+			fieldName, keyWord, op string
+			filters                []basic.SearchFilter
+			expect                 string
+		}{
+			{"tags", "红色", query.OP_OR, nil, `["1","3"]`},
+			{"tags", "红色;5G", query.OP_OR, nil, `["1","2","3"]`},
+			{"tags", "红色;5G", query.OP_AND, nil, `["3"]`},
+			{"code", "c", query.OP_OR, nil, `["2","3"]`},
+			{"code", "b2", query.OP_AND, nil, `["2"]`},
+			{"", "", query.OP_OR, []basic.SearchFilter{{FieldName: "tags", FilterType: "contain any", RangeStrs: []string{"蓝色", "白色"}}}, `["2","4"]`},
+			{"", "", query.OP_OR, []basic.SearchFilter{{FieldName: "tags", FilterType: "contain all", RangeStrs: []string{"大屏", "5G"}}}, `["2"]`},
+			{"tags", "大屏", query.OP_OR, []basic.SearchFilter{{FieldName: "tags", FilterType: "contain any", RangeStrs: []string{"红色"}}}, `["1"]`},
+		}
+		for _, c := range cases {
+			if ret := search(c.fieldName, c.keyWord, c.op, c.filters); ret != c.expect {
+				panic(stage + ": Wrong list search " + c.keyWord + helper.JsonEncode(c.filters) + " => " + ret)
+			}
+		}
+
+		//列表以数组形式返回
+		doc, _, exist, err := table.GetDoc("2")
+		if err != nil || !exist || helper.JsonEncode(doc.Detail["tags"]) != `["蓝色","大屏","5G"]` {
+			panic(stage + ": Wrong list doc " + helper.JsonEncode(doc))
+		}
+		t.Log(stage, ": ", helper.JsonEncode(doc))
+	}
+	check("内存")
+	table.Persist()
+	check("落地")
+	if err := table.MergePartitions(); err != nil {
+		panic(err)
+	}
+	check("合并")
+	table.DoClose()
+
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	check("加载")
+
+	if _, _, _, _, err := table.SearchDocsWithOp("", "", query.OP_OR, []basic.SearchFilter{
+		{FieldName: "code", FilterType: "contain any", RangeStrs: []string{"a"}},
+	}, nil, nil, "", 0, 10); err == nil {
+		panic("Contain any on chars should fail")
+	}
+	table.DoClose()
+	t.Log("\n\n")
+}
+
+//模拟崩溃: 内存分区不落地, 直接关闭文件
+//后台的合并和定时落地也要停掉, 否则会在之后的测试中落地到同一个目录
+func crashTable(tbl *Table) {
+	tbl.stopMerger()
+	tbl.stopFlusher()
+	for _, prt := range tbl.partitions {
+		prt.DoClose()
+	}
+	tbl.priBtdb.Close()
+	tbl.delFlagBitMap.Close()
+	tbl.wal.Close()
+}
+
+func TestWalRecover(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+	basic.WAL_SYNC_POLICY = basic.WAL_SYNC_ALWAYS
+	defer func() {
+		basic.WAL_SYNC_POLICY = basic.WAL_SYNC_INTERVAL
+	}()
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_SPLITER},
+		{FieldName: "price", IndexType: index.IDX_TYPE_INTEGER},
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 10; i++ {
+		_, _, err = table.AddDoc(map[string]interface{}{"id": fmt.Sprintf("%02d", i), "name": "华为手机", "price": i * 100})
+		if err != nil {
+			panic(err)
+		}
+		if i == 4 {
+			table.Persist()
+		}
+	}
+
+	//落地分区和内存分区的文档都有删除和变更, 02变更两次
+	table.DelDoc("01")
+	table.DelDoc("06")
+	_, err = table.UpdateDoc(map[string]interface{}{"id": "02", "name": "小米手机", "price": 2001}); if err != nil {panic(err) }
+	_, err = table.UpdateDoc(map[string]interface{}{"id": "07", "name": "小米平板", "price": 7001}); if err != nil {panic(err) }
+	_, err = table.UpdateDoc(map[string]interface{}{"id": "02", "name": "苹果手机", "price": 2002}); if err != nil {panic(err) }
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "10", "name": "华为平板", "price": "abc"}) //失败的文档
+	if err == nil {
+		panic("Should fail")
+	}
+	_, autoKey, err := table.AddDoc(map[string]interface{}{"name": "苹果平板", "price": 1100}); if err != nil {panic(err) }
+
+	//记录崩溃前的状态
+	keys := []string{"00", "01", "02", "03", "05", "06", "07", "08", "09", "10", autoKey}
+	snapshot := func(tbl *Table) string {
+		ret := fmt.Sprintf("%v,%v|", tbl.NextDocId, tbl.RealDocNum)
+		for _, key := range keys {
+			doc, docId, _, _ := tbl.GetDoc(key)
+			ret += fmt.Sprintf("%v:%v:%v|", key, docId, helper.JsonEncode(doc))
+		}
+		docs, total, _, _, err := tbl.SearchDocsWithOp("name", "手机", query.OP_OR, nil,
+			[]basic.SearchSort{{FieldName: "price", Order: "asc"}}, nil, "", 0, 100)
+		if err != nil {
+			panic(err)
+		}
+		return ret + fmt.Sprintf("%v:%v", total, helper.JsonEncode(docs))
+	}
+	expect := snapshot(table)
+	t.Log(expect)
+
+	//崩溃, 并且WAL尾部有一条写了一半的记录
+	crashTable(table)
+	fd, err := os.OpenFile("/tmp/spider/goods" + basic.IDX_FILENAME_SUFFIX_WAL, os.O_WRONLY | os.O_APPEND, 0644)
+	if err != nil {
+		panic(err)
+	}
+	fd.Write([]byte{100, 0, 0, 0, 1, 2, 3})
+	fd.Close()
+
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	if ret := snapshot(table); ret != expect {
+		panic("Wrong recover: " + ret)
+	}
+
+	//恢复之后继续写入, 再次崩溃
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "11", "name": "华为手机", "price": 1200}); if err != nil {panic(err) }
+	keys = append(keys, "11")
+	expect = snapshot(table)
+	crashTable(table)
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	if ret := snapshot(table); ret != expect {
+		panic("Wrong recover again: " + ret)
+	}
+
+	//落地之后清空WAL, 过期的WAL不会被重放
+	cmd = exec.Command("/bin/sh", "-c", `/bin/cp /tmp/spider/goods.wal /tmp/spider/goods.wal.bak`)
+	if _, err := cmd.Output(); err != nil {
+		panic(err)
+	}
+	if err := table.Persist(); err != nil {
+		panic(err)
+	}
+	if fi, _ := os.Stat("/tmp/spider/goods" + basic.IDX_FILENAME_SUFFIX_WAL); fi.Size() != WAL_HEAD_BYTE_CNT {
+		panic(fmt.Sprintf("Wal should be empty: %v", fi.Size()))
+	}
+	crashTable(table)
+	cmd = exec.Command("/bin/sh", "-c", `/bin/mv /tmp/spider/goods.wal.bak /tmp/spider/goods.wal`)
+	if _, err := cmd.Output(); err != nil {
+		panic(err)
+	}
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	if ret := snapshot(table); ret != expect {
+		panic("Wrong recover with expired wal: " + ret)
+	}
+	table.DoClose()
+	t.Log("\n\n")
+}
+
+func TestManifestFallback(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_SPLITER},
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 10; i++ {
+		_, _, err = table.AddDoc(map[string]interface{}{"id": fmt.Sprintf("%02d", i), "name": "华为手机"})
+		if err != nil {
+			panic(err)
+		}
+		if i == 4 || i == 9 {
+			table.Persist()
+		}
+	}
+	table.DoClose()
+
+	//模拟最后一次提交元信息时, 改名过程中崩溃, 只剩下上一个版本
+	if err := os.Remove("/tmp/spider/goods" + basic.IDX_FILENAME_SUFFIX_META); err != nil {
+		panic(err)
+	}
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	if table.NextDocId != 5 || table.RealDocNum != 5 || len(table.partitions) != 1 {
+		panic(fmt.Sprintf("Wrong fallback: %v, %v, %v", table.NextDocId, table.RealDocNum, len(table.partitions)))
+	}
+	if _, _, exist, _ := table.GetDoc("04"); !exist {
+		panic("04 should exist")
+	}
+	if _, _, exist, _ := table.GetDoc("05"); exist {
+		panic("05 should not exist")
+	}
+
+	//未提交的分区残留的文件会被清理, 主键可以重新写入
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "05", "name": "小米手机"}); if err != nil {panic(err) }
+	table.Persist()
+	table.DoClose()
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	docs, total, _, err := table.SearchDocs("name", "手机", nil, 0, 100)
+	if err != nil || total != 6 {
+		panic(fmt.Sprintf("Wrong search: %v, %v", total, err))
+	}
+	doc, _, exist, _ := table.GetDoc("05")
+	if !exist || doc.Detail["name"] != "小米手机" {
+		panic("Wrong doc: " + helper.JsonEncode(doc))
+	}
+	t.Log(helper.JsonEncode(docs))
+	table.DoClose()
+	t.Log("\n\n")
+}
+
+func TestMergePurge(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_SPLITER},
+		{FieldName: "price", IndexType: index.IDX_TYPE_INTEGER},
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 10; i++ {
+		_, _, err = table.AddDoc(map[string]interface{}{"id": fmt.Sprintf("%02d", i), "name": "华为手机", "price": 100 + i})
+		if err != nil {
+			panic(err)
+		}
+	}
+	table.Persist()
+	//0~4变更, 5~6删除
+	for i := 0; i < 5; i++ {
+		_, err = table.UpdateDoc(map[string]interface{}{"id": fmt.Sprintf("%02d", i), "name": "小米手机", "price": 200 + i})
+		if err != nil {
+			panic(err)
+		}
+	}
+	table.DelDoc("05")
+	table.DelDoc("06")
+	table.Persist()
+
+	check := func(stage string, live int) {
+		docs, total, _, err := table.SearchDocs("name", "手机", nil, 0, 100)
+		if err != nil || total != live {
+			panic(fmt.Sprintf("%v: Wrong search: %v, %v", stage, total, err))
+		}
+		_, total, _, err = table.SearchDocs("name", "华为", nil, 0, 100)
+		if err != nil || total != 3 {
+			panic(fmt.Sprintf("%v: Wrong search: %v, %v", stage, total, err))
+		}
+		_, total, _, err = table.SearchDocs("name", "小米", []basic.SearchFilter{
+			{FieldName: "price", FilterType: "between", Begin: 202, End: 300}}, 0, 100)
+		if err != nil || total != 3 {
+			panic(fmt.Sprintf("%v: Wrong filter: %v, %v", stage, total, err))
+		}
+		docs, _, _, _, err = table.SearchDocsWithOp("name", "手机", query.OP_OR, nil,
+			[]basic.SearchSort{{FieldName: "price", Order: "desc"}}, nil, "", 0, 2)
+		if err != nil || len(docs) != 2 || docs[0].Key != "04" || docs[1].Key != "03" {
+			panic(stage + ": Wrong sort " + helper.JsonEncode(docs))
+		}
+		doc, _, exist, _ := table.GetDoc("01")
+		if !exist || doc.Detail["name"] != "小米手机" {
+			panic(stage + ": Wrong doc: " + helper.JsonEncode(doc))
+		}
+		if _, _, exist, _ := table.GetDoc("05"); exist {
+			panic(stage + ": 05 should not exist")
+		}
+	}
+	check("合并前", 8)
+	if err := table.MergePartitions(); err != nil {
+		panic(err)
+	}
+	check("合并后", 8)
+
+	//合并之后只保留存活的文档, docId不变
+	prt := table.partitions[0]
+	if len(table.partitions) != 1 || prt.DocCnt != 8 || prt.StartDocId != 0 || prt.NextDocId != 15 {
+		panic(fmt.Sprintf("Wrong partition: %v, %v, %v", len(table.partitions), prt.DocCnt, prt.NextDocId))
+	}
+	if helper.JsonEncode(prt.DocIds()) != "[7,8,9,10,11,12,13,14]" {
+		panic("Wrong doc ids: " + helper.JsonEncode(prt.DocIds()))
+	}
+	//被剔除文档的主键也被清理
+	if _, ok := table.priBtdb.GetStr(PRI_FWD_BTREE_NAME, "0"); ok {
+		panic("docId 0 should be purged")
+	}
+	if _, ok := table.priBtdb.GetStr(PRI_IVT_BTREE_NAME, "05"); ok {
+		panic("05 should be purged")
+	}
+	if v, ok := table.priBtdb.GetInt(PRI_IVT_BTREE_NAME, "00"); !ok || v != 10 {
+		panic(fmt.Sprintf("Wrong primary key: %v, %v", v, ok))
+	}
+	table.DoClose()
+
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	check("加载", 8)
+
+	//已合并的分区再次参与合并
+	table.DelDoc("07")
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "10", "name": "华为手机", "price": 50})
+	if err != nil {
+		panic(err)
+	}
+	if err := table.MergePartitions(); err != nil {
+		panic(err)
+	}
+	check("再次合并", 8)
+	if len(table.partitions) != 1 || table.partitions[0].DocCnt != 8 {
+		panic(fmt.Sprintf("Wrong partition: %v, %v", len(table.partitions), table.partitions[0].DocCnt))
+	}
+	t.Log(helper.JsonEncode(table.GetStatus()))
+	table.DoClose()
+	t.Log("\n\n")
+}
+
+//等待后台合并, 直到cond满足
+func waitMerge(table *Table, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		table.rwMutex.RLock()
+		ok := cond()
+		table.rwMutex.RUnlock()
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	panic("Wait merge timeout")
+}
+
+func TestBackgroundMerge(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+	basic.PART_MERGE_FACTOR = 3
+	defer func() {
+		basic.PART_MERGE_FACTOR = 10
+	}()
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_SPLITER},
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 12; i++ {
+		_, _, err = table.AddDoc(map[string]interface{}{"id": fmt.Sprintf("%02d", i), "name": "华为手机"})
+		if err != nil {
+			panic(err)
+		}
+		if i % 4 == 3 {
+			table.Persist()
+		}
+	}
+	table.DelDoc("00")
+
+	//合并期间搜索照常进行
+	done := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(errCh)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_, total, _, err := table.SearchDocs("name", "手机", nil, 0, 100)
+			if err == nil && total != 11 {
+				err = fmt.Errorf("Wrong total: %v", total)
+			}
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	//同一层级的3个分区合并成一个, 删除的文档被剔除
+	table.notifyMerge()
+	waitMerge(table, func() bool { return len(table.partitions) == 1 })
+	close(done)
+	if err := <-errCh; err != nil {
+		panic(err)
+	}
+	if table.partitions[0].DocCnt != 11 || table.partitions[0].RealDocNum != 11 {
+		panic(fmt.Sprintf("Wrong partition: %v, %v", table.partitions[0].DocCnt, table.partitions[0].RealDocNum))
+	}
+
+	//删除超过一半的分区单独合并
+	for i := 1; i < 7; i++ {
+		table.DelDoc(fmt.Sprintf("%02d", i))
+	}
+	table.rwMutex.RLock()
+	groups := table.pickTiered()
+	table.rwMutex.RUnlock()
+	if len(groups) != 1 || len(groups[0]) != 1 {
+		panic(fmt.Sprintf("Wrong groups: %v", len(groups)))
+	}
+	table.notifyMerge()
+	waitMerge(table, func() bool { return table.partitions[0].DocCnt == 5 })
+	table.DoClose()
+
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	docs, total, _, err := table.SearchDocs("name", "手机", nil, 0, 100)
+	if err != nil || total != 5 || docs[0].Key != "07" {
+		panic(fmt.Sprintf("Wrong search: %v, %v", total, err))
+	}
+	t.Log(helper.JsonEncode(docs))
+	table.DoClose()
+	t.Log("\n\n")
+}
+
+func TestSnapshotAndRestore(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_SPLITER},
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 6; i++ {
+		_, _, err = table.AddDoc(map[string]interface{}{"id": fmt.Sprintf("%02d", i), "name": "华为手机"})
+		if err != nil {
+			panic(err)
+		}
+		if i == 2 {
+			table.Persist()
+		}
+	}
+	table.DelDoc("00")
+
+	//内存分区中的文档也在快照中
+	helper.Mkdir("/tmp/spider/snap1")
+	if err := table.Snapshot("/tmp/spider/snap1", ""); err != nil {
+		panic(err)
+	}
+	if len(table.partitions) != 2 {
+		panic(fmt.Sprintf("Wrong partitions: %v", len(table.partitions)))
+	}
+
+	//快照之后的变更不影响快照
+	table.DelDoc("01")
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "06", "name": "华为手机"})
+	if err != nil {
+		panic(err)
+	}
+
+	//增量快照复用没有变化的分区
+	helper.Mkdir("/tmp/spider/snap2")
+	if err := table.Snapshot("/tmp/spider/snap2", "/tmp/spider/snap1"); err != nil {
+		panic(err)
+	}
+	fi1, _ := os.Stat(table.PrtPathNames[0] + basic.IDX_FILENAME_SUFFIX_BTREE)
+	fi2, _ := os.Stat("/tmp/spider/snap1/goods_0000000000" + basic.IDX_FILENAME_SUFFIX_BTREE)
+	fi3, _ := os.Stat("/tmp/spider/snap2/goods_0000000000" + basic.IDX_FILENAME_SUFFIX_BTREE)
+	if os.SameFile(fi1, fi2) || !os.SameFile(fi2, fi3) {
+		panic("Btdb should be copied once and reused")
+	}
+
+	//恢复到新的位置和名字, 原表不受影响
+	helper.Mkdir("/tmp/spider/restore")
+	restored, err := RestoreTable("/tmp/spider/snap1", "goods", "/tmp/spider/restore", "goods_bak")
+	if err != nil {
+		panic(err)
+	}
+	check := func(tbl *Table, live int, gone string) {
+		docs, total, _, err := tbl.SearchDocs("name", "手机", nil, 0, 100)
+		if err != nil || total != live {
+			panic(fmt.Sprintf("Wrong search: %v, %v", total, err))
+		}
+		if _, _, exist, _ := tbl.GetDoc(gone); exist {
+			panic(gone + " should not exist")
+		}
+		t.Log(helper.JsonEncode(docs))
+	}
+	check(restored, 5, "00")
+	check(table, 5, "01")
+	for _, prtPathName := range restored.PrtPathNames {
+		if prtPathName[:len("/tmp/spider/restore/goods_bak_")] != "/tmp/spider/restore/goods_bak_" {
+			panic("Wrong partition path: " + prtPathName)
+		}
+	}
+
+	//恢复出来的表可以正常写入和重新加载
+	_, _, err = restored.AddDoc(map[string]interface{}{"id": "07", "name": "华为手机"})
+	if err != nil {
+		panic(err)
+	}
+	restored.DoClose()
+	restored, err = LoadTable("/tmp/spider/restore", "goods_bak")
+	if err != nil {
+		panic(err)
+	}
+	check(restored, 6, "00")
+	restored.DoClose()
+	table.DoClose()
+	t.Log("\n\n")
+}
+
+func TestFlushPolicy(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+	basic.FLUSH_MAX_AGE_SEC = 1
+	basic.FLUSH_MAX_BYTES = 1
+	defer func() {
+		basic.FLUSH_MAX_AGE_SEC = 300
+		basic.FLUSH_MAX_BYTES = 256
+	}()
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_SPLITER},
+		{FieldName: "detail", IndexType: index.IDX_TYPE_PURE_TEXT},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	//超时落地
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "00", "name": "华为手机", "detail": "x"})
+	if err != nil {
+		panic(err)
+	}
+	if table.memPartition.MemBytes() == 0 {
+		panic("MemBytes should not be 0")
+	}
+	time.Sleep(2500 * time.Millisecond)
+	table.rwMutex.RLock()
+	if len(table.partitions) != 1 || table.memPartition != nil {
+		panic(fmt.Sprintf("Should flush by age: %v", len(table.partitions)))
+	}
+	table.rwMutex.RUnlock()
+
+	//超过内存上限落地
+	basic.FLUSH_MAX_AGE_SEC = 0
+	big := make([]byte, 1024 * 1024)
+	for i := range big {
+		big[i] = 'x'
+	}
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "01", "name": "华为手机", "detail": string(big)})
+	if err != nil {
+		panic(err)
+	}
+	if len(table.partitions) != 2 || table.memPartition != nil {
+		panic(fmt.Sprintf("Should flush by bytes: %v", len(table.partitions)))
+	}
+
+	//手动落地
+	_, _, err = table.AddDoc(map[string]interface{}{"id": "02", "name": "华为手机", "detail": "x"})
+	if err != nil {
+		panic(err)
+	}
+	if len(table.partitions) != 2 {
+		panic(fmt.Sprintf("Should not flush: %v", len(table.partitions)))
+	}
+	if err := table.Flush(); err != nil {
+		panic(err)
+	}
+	if len(table.partitions) != 3 || table.memPartition != nil {
+		panic(fmt.Sprintf("Should flush manually: %v", len(table.partitions)))
+	}
+	_, total, _, err := table.SearchDocs("name", "手机", nil, 0, 100)
+	if err != nil || total != 3 {
+		panic(fmt.Sprintf("Wrong search: %v, %v", total, err))
+	}
+	table.DoClose()
+}
+
+func TestTableSettings(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	if _, err := CreateTableWithSettings("/tmp/spider", "bad", nil, TableSettings{Analyzer: "pure"}); err == nil {
+		panic("Should be invalid analyzer")
+	}
+	table, err := CreateTableWithSettings("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name"},
+	}, TableSettings{PersistMinDocCnt: 3, BitmapSize: 64, Analyzer: index.IDX_TYPE_NAME_WHOLE})
+	if err != nil {
+		panic(err)
+	}
+	if table.BasicFields["name"].IndexType != index.IDX_TYPE_STR_WHOLE {
+		panic(fmt.Sprintf("Settings not honoured: %v", table.BasicFields["name"].IndexType))
+	}
+
+	//按表的阈值落地
+	for i := 0; i < 4; i++ {
+		_, _, err = table.AddDoc(map[string]interface{}{"id": fmt.Sprintf("%02d", i), "name": "华为手机"})
+		if err != nil {
+			panic(err)
+		}
+	}
+	if len(table.partitions) != 1 || table.memPartition.IsEmpty() {
+		panic(fmt.Sprintf("Should persist by table settings: %v", len(table.partitions)))
+	}
+
+	//修改设置, 只修改出现的项
+	settings, err := table.UpdateSettings([]byte(`{"readOnly": true}`))
+	if err != nil {
+		panic(err)
+	}
+	if !settings.ReadOnly || settings.PersistMinDocCnt != 3 {
+		panic(fmt.Sprintf("Wrong settings: %v", helper.JsonEncode(settings)))
+	}
+	if _, _, err = table.AddDoc(map[string]interface{}{"id": "04", "name": "华为手机"}); err == nil {
+		panic("Read only table should reject AddDoc")
+	}
+	if table.DelDoc("00") {
+		panic("Read only table should reject DelDoc")
+	}
+	if err := table.AddField(field.BasicField{FieldName: "price", IndexType: index.IDX_TYPE_INTEGER}); err == nil {
+		panic("Read only table should reject AddField")
+	}
+	_, total, _, err := table.SearchDocs("name", "华为手机", nil, 0, 100)
+	if err != nil || total != 4 {
+		panic(fmt.Sprintf("Wrong search: %v, %v", total, err))
+	}
+
+	//设置随元信息落地
+	table.DoClose()
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	if !table.Settings.ReadOnly || table.Settings.Analyzer != index.IDX_TYPE_NAME_WHOLE {
+		panic(fmt.Sprintf("Settings lost: %v", helper.JsonEncode(table.Settings)))
+	}
+	if _, err := table.UpdateSettings([]byte(`{"readOnly": false}`)); err != nil {
+		panic(err)
+	}
+
+	//已废弃的bitmapSize仍然接受, 但被忽略
+	if settings, err = table.UpdateSettings([]byte(`{"bitmapSize": 128}`)); err != nil || settings.BitmapSize != 64 {
+		panic(fmt.Sprintf("Deprecated bitmapSize should be ignored: %v, %v", helper.JsonEncode(settings), err))
+	}
+	if _, _, err = table.AddDoc(map[string]interface{}{"id": "04", "name": "华为手机"}); err != nil {
+		panic(err)
+	}
+	table.DoClose()
+}
+
+func TestVerifyTable(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTableWithSettings("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_WHOLE},
+	}, TableSettings{PersistMinDocCnt: 3})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 9; i++ {
+		_, _, err = table.AddDoc(map[string]interface{}{"id": fmt.Sprintf("%02d", i), "name": "华为手机"})
+		if err != nil {
+			panic(err)
+		}
+	}
+	table.DelDoc("01")
+	if report, err := table.Verify(); err != nil || len(report.Issues) != 0 {
+		panic(fmt.Sprintf("Online verify: %v, %v", helper.JsonEncode(report), err))
+	}
+	prtPathNames := table.PrtPathNames
+	table.DoClose()
+
+	report, err := VerifyTable("/tmp/spider", "goods", false)
+	if err != nil || len(report.Issues) != 0 || report.Partitions != 3 {
+		panic(fmt.Sprintf("Should be healthy: %v, %v", helper.JsonEncode(report), err))
+	}
+
+	//磁盘满, 倒排文件只写了一部分
+	if err := os.Truncate(prtPathNames[1] + basic.IDX_FILENAME_SUFFIX_INVERT, 4); err != nil {
+		panic(err)
+	}
+	report, err = VerifyTable("/tmp/spider", "goods", false)
+	if err != nil || len(report.Issues) == 0 || report.Issues[0].Repair != "" {
+		panic(fmt.Sprintf("Should find broken partition: %v, %v", helper.JsonEncode(report), err))
+	}
+	t.Log(helper.JsonEncode(report))
+
+	//修复: 隔离损坏的分区, 重建主键
+	report, err = VerifyTable("/tmp/spider", "goods", true)
+	if err != nil {
+		panic(err)
+	}
+	for _, issue := range report.Issues {
+		if issue.Repair == "" {
+			panic(fmt.Sprintf("Not repaired: %v", helper.JsonEncode(issue)))
+		}
+	}
+	if !helper.Exist("/tmp/spider/" + QUARANTINE_DIR + "/" + filepath.Base(prtPathNames[1]) + basic.IDX_FILENAME_SUFFIX_INVERT) {
+		panic("Partition should be quarantined")
+	}
+	report, err = VerifyTable("/tmp/spider", "goods", false)
+	if err != nil || len(report.Issues) != 0 || report.Partitions != 2 {
+		panic(fmt.Sprintf("Should be repaired: %v, %v", helper.JsonEncode(report), err))
+	}
+
+	//修复之后可以加载, 损坏分区中的文档不再存在
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	defer table.DoClose()
+	if table.RealDocNum != 5 {
+		panic(fmt.Sprintf("Wrong doc num: %v", table.RealDocNum))
+	}
+	for i := 0; i < 9; i++ {
+		_, _, exist, _ := table.GetDoc(fmt.Sprintf("%02d", i))
+		if exist != (i != 1 && (i < 3 || i >= 6)) {
+			panic(fmt.Sprintf("Wrong doc: %v, %v", i, exist))
+		}
+	}
+	_, total, _, err := table.SearchDocs("name", "华为手机", nil, 0, 100)
+	if err != nil || total != 5 {
+		panic(fmt.Sprintf("Wrong search: %v, %v", total, err))
+	}
+}
+
+func TestBulkDocs(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_WHOLE},
+	})
+	if err != nil {
+		panic(err)
+	}
+	results, err := table.BulkDocs([]*BulkItem{
+		{Op: BULK_OP_CREATE, PrimaryKey: "01", Content: map[string]interface{}{"name": "华为"}},
+		{Op: BULK_OP_CREATE, PrimaryKey: "02", Content: map[string]interface{}{"name": "小米"}},
+		{Op: BULK_OP_CREATE, Content: map[string]interface{}{"id": "03", "name": "苹果"}},
+		{Op: BULK_OP_INDEX, PrimaryKey: "02", Content: map[string]interface{}{"name": "红米"}},
+		{Op: BULK_OP_INDEX, PrimaryKey: "04", Content: map[string]interface{}{"name": "三星"}},
+		{Op: BULK_OP_CREATE, PrimaryKey: "01", Content: map[string]interface{}{"name": "华为"}},
+		{Op: BULK_OP_UPDATE, PrimaryKey: "05", Content: map[string]interface{}{"name": "oppo"}},
+		{Op: BULK_OP_CREATE, PrimaryKey: "06", Content: map[string]interface{}{"id": "07", "name": "vivo"}},
+		{Op: BULK_OP_DELETE, PrimaryKey: "03"},
+		{Op: BULK_OP_DELETE, PrimaryKey: "09"},
+		{Op: "merge", PrimaryKey: "01"},
+	})
+	if err != nil {
+		panic(err)
+	}
+	expect := []string{BULK_STATUS_CREATED, BULK_STATUS_CREATED, BULK_STATUS_CREATED, BULK_STATUS_UPDATED, BULK_STATUS_CREATED,
+		"", "", "", BULK_STATUS_DELETED, BULK_STATUS_NOT_FOUND, ""}
+	for i, ret := range results {
+		if ret.Status != expect[i] || (ret.Status == "") != (ret.Error != "") {
+			panic(fmt.Sprintf("Wrong result %v: %v", i, helper.JsonEncode(ret)))
+		}
+	}
+	if results[2].PrimaryKey != "03" {
+		panic("Wrong primary key: " + results[2].PrimaryKey)
+	}
+	t.Log(helper.JsonEncode(results))
+
+	check := func() {
+		if table.RealDocNum != 3 {
+			panic(fmt.Sprintf("Wrong doc num: %v", table.RealDocNum))
+		}
+		expectNames := map[string]string{"01": "华为", "02": "红米", "03": "", "04": "三星", "05": ""}
+		for key, name := range expectNames {
+			doc, _, exist, _ := table.GetDoc(key)
+			if exist != (name != "") || (exist && doc.Detail["name"] != name) {
+				panic(fmt.Sprintf("Wrong doc: %v, %v", key, helper.JsonEncode(doc)))
+			}
+		}
+	}
+	check()
+
+	//重新加载, 通过WAL恢复
+	table.DoClose()
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	defer table.DoClose()
+	check()
+}
+
+func TestPatchDoc(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_WHOLE},
+		{FieldName: "views", IndexType: index.IDX_TYPE_INTEGER},
+		{FieldName: "price", IndexType: index.IDX_TYPE_FLOAT},
+	})
+	if err != nil {
+		panic(err)
+	}
+	if _, _, err = table.AddDoc(map[string]interface{}{"id": "01", "name": "华为", "views": 10, "price": 99.5}); err != nil {
+		panic(err)
+	}
+
+	//只改一个字段, 其他字段保持不变
+	if _, created, err := table.PatchDoc("01", map[string]interface{}{"name": "小米"}, nil, false, 0); err != nil || created {
+		panic(fmt.Sprintf("Patch error: %v, %v", created, err))
+	}
+	//原子增减
+	if _, _, err := table.PatchDoc("01", nil, map[string]float64{"views": 2, "price": -0.5}, false, 0); err != nil {
+		panic(err)
+	}
+	//upsert
+	if _, _, err := table.PatchDoc("02", map[string]interface{}{"name": "苹果", "price": 1.5}, nil, false, 0); err == nil {
+		panic("Should not exist")
+	}
+	if _, created, err := table.PatchDoc("02", map[string]interface{}{"name": "苹果", "price": 1.5}, map[string]float64{"views": 1}, true, 0); err != nil || !created {
+		panic(fmt.Sprintf("Upsert error: %v, %v", created, err))
+	}
+	//非法的增减
+	if _, _, err := table.PatchDoc("01", nil, map[string]float64{"name": 1}, false, 0); err == nil {
+		panic("Should not incr string field")
+	}
+	if _, _, err := table.PatchDoc("01", nil, map[string]float64{"views": 0.5}, false, 0); err == nil {
+		panic("Should not incr integer field with float")
+	}
+	if _, _, err := table.PatchDoc("01", map[string]interface{}{"id": "03"}, nil, false, 0); err == nil {
+		panic("Should not change primary key")
+	}
+
+	check := func() {
+		if table.RealDocNum != 2 {
+			panic(fmt.Sprintf("Wrong doc num: %v", table.RealDocNum))
+		}
+		doc, _, exist, _ := table.GetDoc("01")
+		if !exist || doc.Detail["name"] != "小米" || doc.Detail["views"] != int64(12) || doc.Detail["price"] != float64(99) {
+			panic(fmt.Sprintf("Wrong doc: %v", helper.JsonEncode(doc)))
+		}
+		doc, _, exist, _ = table.GetDoc("02")
+		if !exist || doc.Detail["name"] != "苹果" || doc.Detail["views"] != int64(1) || doc.Detail["price"] != float64(1.5) {
+			panic(fmt.Sprintf("Wrong doc: %v", helper.JsonEncode(doc)))
+		}
+	}
+	check()
+
+	//重新加载, 通过WAL恢复
+	table.DoClose()
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	defer table.DoClose()
+	check()
+}
+
+func TestDocVersion(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_WHOLE},
+	})
+	if err != nil {
+		panic(err)
+	}
+	version := func(key string) uint64 {
+		doc, _, exist, _ := table.GetDoc(key)
+		if !exist {
+			return 0
+		}
+		return doc.Version
+	}
+	table.AddDoc(map[string]interface{}{"id": "01", "name": "华为"})
+	table.AddDoc(map[string]interface{}{"id": "02", "name": "小米"})
+	if version("01") != 1 {
+		panic(fmt.Sprintf("Wrong version: %v", version("01")))
+	}
+
+	//版本不一致则冲突
+	if _, err := table.UpdateDocWithVersion(map[string]interface{}{"id": "01", "name": "荣耀"}, 2); !IsVersionConflict(err) {
+		panic(fmt.Sprintf("Should conflict: %v", err))
+	}
+	if _, err := table.UpdateDocWithVersion(map[string]interface{}{"id": "01", "name": "荣耀"}, 1); err != nil {
+		panic(err)
+	}
+	if _, _, err := table.PatchDoc("01", map[string]interface{}{"name": "华为"}, nil, false, 2); err != nil {
+		panic(err)
+	}
+	if _, err := table.UpdateDocWithVersion(map[string]interface{}{"id": "09", "name": "荣耀"}, 1); !IsVersionConflict(err) {
+		panic(fmt.Sprintf("Should conflict: %v", err))
+	}
+	if version("01") != 3 {
+		panic(fmt.Sprintf("Wrong version: %v", version("01")))
+	}
+
+	//落地之后版本在btdb中
+	if err := table.Flush(); err != nil {
+		panic(err)
+	}
+	table.UpdateDoc(map[string]interface{}{"id": "01", "name": "荣耀"})
+	if version("01") != 4 {
+		panic(fmt.Sprintf("Wrong version: %v", version("01")))
+	}
+	docs, _, _, _ := table.SearchDocs("name", "小米", nil, 0, 10)
+	if len(docs) != 1 || docs[0].Version != 1 {
+		panic(fmt.Sprintf("Wrong search: %v", helper.JsonEncode(docs)))
+	}
+
+	//批量
+	results, _ := table.BulkDocs([]*BulkItem{
+		{Op: BULK_OP_INDEX, PrimaryKey: "02", Content: map[string]interface{}{"name": "红米"}, IfVersion: 2},
+		{Op: BULK_OP_INDEX, PrimaryKey: "02", Content: map[string]interface{}{"name": "红米"}, IfVersion: 1},
+		{Op: BULK_OP_CREATE, PrimaryKey: "03", Content: map[string]interface{}{"name": "苹果"}},
+	})
+	if results[0].Error == "" || results[1].Version != 2 || results[2].Version != 1 {
+		panic(fmt.Sprintf("Wrong bulk: %v", helper.JsonEncode(results)))
+	}
+
+	//删除
+	if _, err := table.DelDocWithVersion("01", 3); !IsVersionConflict(err) {
+		panic(fmt.Sprintf("Should conflict: %v", err))
+	}
+	if found, err := table.DelDocWithVersion("01", 4); err != nil || !found {
+		panic(fmt.Sprintf("Delete error: %v, %v", found, err))
+	}
+
+	//重放WAL之后版本不变
+	table.DoClose()
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	defer table.DoClose()
+	if version("01") != 0 || version("02") != 2 || version("03") != 1 {
+		panic(fmt.Sprintf("Wrong version: %v, %v, %v", version("01"), version("02"), version("03")))
+	}
+}
+
+func TestByQuery(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_WHOLE},
+		{FieldName: "views", IndexType: index.IDX_TYPE_INTEGER},
+	})
+	if err != nil {
+		panic(err)
+	}
+	//一部分在磁盘分区, 一部分在内存分区
+	for i := 0; i < 10; i++ {
+		name := "正常"
+		if i % 2 == 0 {
+			name = "垃圾"
+		}
+		table.AddDoc(map[string]interface{}{"id": fmt.Sprintf("%02d", i), "name": name, "views": i})
+		if i == 5 {
+			if err := table.Persist(); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	//找出之后变更过的文档计入冲突
+	docIds, err := table.MatchDocIdsWithOp("name", "垃圾", "", nil)
+	if err != nil || len(docIds) != 5 {
+		panic(fmt.Sprintf("Wrong match: %v, %v", docIds, err))
+	}
+	table.UpdateDoc(map[string]interface{}{"id": "04", "name": "垃圾", "views": 40})
+	ret, err := table.DeleteByDocIds(docIds)
+	if err != nil || ret.Deleted != 4 || ret.Conflicts != 1 {
+		panic(fmt.Sprintf("Wrong delete: %v, %v", helper.JsonEncode(ret), err))
+	}
+	if _, _, exist, _ := table.GetDoc("04"); !exist {
+		panic("Should exist")
+	}
+
+	//局部更新
+	docIds, err = table.MatchDocIdsWithOp("", "", "", []basic.SearchFilter{{FieldName: "views", FilterType: ">", IntVal: 6}})
+	if err != nil || len(docIds) != 3 {
+		panic(fmt.Sprintf("Wrong match: %v, %v", docIds, err))
+	}
+	if _, err := table.PatchByDocIds(docIds, map[string]interface{}{"id": "99"}, nil); err == nil {
+		panic("Should not update primary key")
+	}
+	ret, err = table.PatchByDocIds(docIds, map[string]interface{}{"name": "热门"}, map[string]float64{"views": 100})
+	if err != nil || ret.Updated != 3 || ret.Conflicts != 0 {
+		panic(fmt.Sprintf("Wrong patch: %v, %v", helper.JsonEncode(ret), err))
+	}
+
+	check := func() {
+		if table.RealDocNum != 6 {
+			panic(fmt.Sprintf("Wrong doc num: %v", table.RealDocNum))
+		}
+		for key, views := range map[string]int64{"01": 1, "03": 3, "04": 140, "05": 5, "07": 107, "09": 109} {
+			doc, _, exist, _ := table.GetDoc(key)
+			if !exist || doc.Detail["views"] != views {
+				panic(fmt.Sprintf("Wrong doc %v: %v", key, helper.JsonEncode(doc)))
+			}
+		}
+		docs, _, _, _ := table.SearchDocs("name", "热门", nil, 0, 10)
+		if len(docs) != 3 {
+			panic(fmt.Sprintf("Wrong search: %v", helper.JsonEncode(docs)))
+		}
+	}
+	check()
+
+	//重新加载, 通过WAL恢复
+	table.DoClose()
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	defer table.DoClose()
+	check()
+}
+
+func TestExport(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_WHOLE},
+		{FieldName: "views", IndexType: index.IDX_TYPE_INTEGER},
+	})
+	if err != nil {
+		panic(err)
+	}
+	//跨越多个批次和多个分区, 其中一部分被删除或者变更
+	docCnt := EXPORT_BATCH_SIZE * 2 + 500
+	for i := 0; i < docCnt; i++ {
+		if _, _, err := table.AddDoc(map[string]interface{}{"id": fmt.Sprintf("%05d", i), "name": "商品", "views": i}); err != nil {
+			panic(err)
+		}
+		if i % 1000 == 999 {
+			if err := table.Persist(); err != nil {
+				panic(err)
+			}
+		}
+	}
+	for i := 0; i < docCnt; i += 10 {
+		table.DelDoc(fmt.Sprintf("%05d", i))
+	}
+	table.UpdateDoc(map[string]interface{}{"id": "00001", "name": "商品", "views": 100000})
+	if err := table.MergePartitions(); err != nil {
+		panic(err)
+	}
+
+	//按docId顺序导出存活的文档
+	keys := []string{}
+	err = table.Export(nil, func(doc *basic.DocInfo) error {
+		views, _ := doc.Detail["views"].(int64)
+		if doc.Detail["id"] != doc.Key || doc.Detail["name"] != "商品" || (doc.Key != "00001" && views != mustAtoi(doc.Key)) {
+			panic(fmt.Sprintf("Wrong doc: %v", helper.JsonEncode(doc)))
+		}
+		keys = append(keys, doc.Key)
+		return nil
+	})
+	if err != nil || len(keys) != int(table.RealDocNum) || len(keys) != docCnt - docCnt / 10 {
+		panic(fmt.Sprintf("Wrong export: %v, %v, %v", len(keys), table.RealDocNum, err))
+	}
+	if keys[0] != "00002" || keys[len(keys) - 1] != "00001" {
+		panic(fmt.Sprintf("Wrong order: %v, %v", keys[0], keys[len(keys) - 1]))
+	}
+
+	//指定字段
+	err = table.Export([]string{"views"}, func(doc *basic.DocInfo) error {
+		if len(doc.Detail) != 1 || doc.Version == 0 {
+			panic(fmt.Sprintf("Wrong doc: %v", helper.JsonEncode(doc)))
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if err := table.Export([]string{"nothing"}, func(doc *basic.DocInfo) error { return nil }); err == nil {
+		panic("Should not exist")
+	}
+
+	//回调出错则停止
+	cnt := 0
+	err = table.Export(nil, func(doc *basic.DocInfo) error {
+		cnt++
+		if cnt == 10 {
+			return errors.New("stop")
+		}
+		return nil
+	})
+	if err == nil || cnt != 10 {
+		panic(fmt.Sprintf("Should stop: %v, %v", cnt, err))
+	}
+
+	//导出和字段的增删并发进行
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			table.AddField(field.BasicField{FieldName: "tmp", IndexType: index.IDX_TYPE_INTEGER})
+			table.DeleteField("tmp")
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err := table.Export(nil, func(doc *basic.DocInfo) error { return nil }); err != nil {
+			panic(err)
+		}
+	}
+	<-done
+	table.DoClose()
+}
+
+func mustAtoi(s string) int64 {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		panic(err)
+	}
+	return int64(n)
+}
+
+func TestMergeWithMemThenCrash(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+	basic.WAL_SYNC_POLICY = basic.WAL_SYNC_ALWAYS
+	defer func() {
+		basic.WAL_SYNC_POLICY = basic.WAL_SYNC_INTERVAL
+	}()
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_WHOLE},
+	})
+	if err != nil {
+		panic(err)
+	}
+	//两个磁盘分区, 内存分区中还有未落地的文档
+	for i := 0; i < 9; i++ {
+		if _, _, err := table.AddDoc(map[string]interface{}{"id": fmt.Sprintf("%02d", i), "name": "华为"}); err != nil {
+			panic(err)
+		}
+		if i == 2 || i == 5 {
+			table.Persist()
+		}
+	}
+	table.DelDoc("07")
+
+	//后台合并不落地内存分区, 提交时也不能让元信息越过内存分区中的文档
+	if n, err := table.doMerge(false, table.pickLegacy); err != nil || n == 0 {
+		panic(fmt.Sprintf("Merge error: %v, %v", n, err))
+	}
+	crashTable(table)
+
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	defer table.DoClose()
+	if table.RealDocNum != 8 {
+		panic(fmt.Sprintf("Wrong doc num: %v", table.RealDocNum))
+	}
+	for i := 0; i < 9; i++ {
+		_, _, exist, _ := table.GetDoc(fmt.Sprintf("%02d", i))
+		if exist != (i != 7) {
+			panic(fmt.Sprintf("Wrong doc %v: %v", i, exist))
+		}
+	}
+}
+
+func TestPersistCrashBeforeMeta(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+	basic.WAL_SYNC_POLICY = basic.WAL_SYNC_ALWAYS
+	defer func() {
+		basic.WAL_SYNC_POLICY = basic.WAL_SYNC_INTERVAL
+	}()
+
+	table, err := CreateTable("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_WHOLE},
+	})
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := table.AddDoc(map[string]interface{}{"id": fmt.Sprintf("%02d", i), "name": "华为"}); err != nil {
+			panic(err)
+		}
+	}
+	table.Persist()
+	for i := 3; i < 6; i++ {
+		if _, _, err := table.AddDoc(map[string]interface{}{"id": fmt.Sprintf("%02d", i), "name": "华为"}); err != nil {
+			panic(err)
+		}
+	}
+	if _, err := table.UpdateDoc(map[string]interface{}{"id": "01", "name": "小米"}); err != nil {
+		panic(err)
+	}
+
+	//内存分区和主键已经落地, 元信息落地之前崩溃
+	prt := table.memPartition
+	if err := prt.Persist(); err != nil {
+		panic(err)
+	}
+	table.partitions = append(table.partitions, prt)
+	if err := table.delFlagBitMap.Sync(); err != nil {
+		panic(err)
+	}
+	if err := table.storePrimaryKeys(); err != nil {
+		panic(err)
+	}
+	crashTable(table)
+
+	//元信息和WAL仍然一致, 重放WAL恢复出内存分区和主键
+	table, err = LoadTable("/tmp/spider", "goods")
+	if err != nil {
+		panic(err)
+	}
+	defer table.DoClose()
+	if table.RealDocNum != 6 {
+		panic(fmt.Sprintf("Wrong doc num: %v", table.RealDocNum))
+	}
+	for i := 0; i < 6; i++ {
+		content, _, exist, _ := table.GetDoc(fmt.Sprintf("%02d", i))
+		if !exist {
+			panic(fmt.Sprintf("Lost doc %v", i))
+		}
+		if name := content.Detail["name"]; (i == 1) != (name == "小米") {
+			panic(fmt.Sprintf("Wrong doc %v: %v", i, name))
+		}
+	}
+	if _, _, err := table.AddDoc(map[string]interface{}{"id": "04", "name": "华为"}); err == nil {
+		panic("Should be duplicate primary key")
+	}
+	if _, err := table.UpdateDoc(map[string]interface{}{"id": "04", "name": "小米"}); err != nil {
+		panic(err)
+	}
+}
+
+func TestMergeLevelWithoutConf(t *testing.T) {
+	//没有加载配置时落地阈值为0, 不能死循环
+	old := basic.PART_PERSIST_MIN_DOC_CNT
+	basic.PART_PERSIST_MIN_DOC_CNT = 0
+	defer func() {
+		basic.PART_PERSIST_MIN_DOC_CNT = old
+	}()
+
+	tbl := &Table{}
+	if level := tbl.mergeLevel(100); level != 0 {
+		panic(fmt.Sprintf("Wrong level: %v", level))
+	}
+	if err := tbl.Settings.Check(); err == nil {
+		panic("Should reject persistMinDocCnt 0")
+	}
+	tbl.Settings = TableSettings{PersistMinDocCnt: 10, MergeFactor: 10}
+	if err := tbl.Settings.Check(); err != nil {
+		panic(err)
+	}
+	if level := tbl.mergeLevel(100); level != 1 {
+		panic(fmt.Sprintf("Wrong level: %v", level))
+	}
+}
+
+func TestSnapshotAfterDelete(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
+	_, err := cmd.Output()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	table, err := CreateTableWithSettings("/tmp/spider", "goods", []field.BasicField{
+		{FieldName: "id", IndexType: index.IDX_TYPE_PK},
+		{FieldName: "name", IndexType: index.IDX_TYPE_STR_WHOLE},
+	}, TableSettings{PersistMinDocCnt: 3})
+	if err != nil {
+		panic(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if _, _, err := table.AddDoc(map[string]interface{}{"id": key, "name": "华为"}); err != nil {
+			panic(err)
+		}
+	}
+	//内存分区为空, 删除标记只在内存的bitmap和WAL中
+	table.DelDoc("a")
+	helper.Mkdir("/tmp/spider/snap")
+	if err := table.Snapshot("/tmp/spider/snap", ""); err != nil {
+		panic(err)
+	}
+	table.DoClose()
+
+	restored, err := RestoreTable("/tmp/spider/snap", "goods", "/tmp/spider", "restored")
+	if err != nil {
+		panic(err)
+	}
+	defer restored.DoClose()
+	_, total, _, _ := restored.SearchDocs("name", "华为", nil, 0, 10)
+	if _, _, exist, _ := restored.GetDoc("a"); exist || total != 2 || restored.RealDocNum != 2 {
+		panic(fmt.Sprintf("Wrong restore: %v, %v, %v", exist, total, restored.RealDocNum))
+	}
+}
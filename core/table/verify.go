@@ -0,0 +1,477 @@
+package table
+
+/*
+ * 表的完整性校验与修复
+ * 磁盘满等异常之后表可能无法加载, 校验以下内容：
+ *   1. 各个磁盘分区的文件(详见partition.VerifyPartition)
+ *   2. 分区的docId范围首尾相接, 不重叠也没有空洞
+ *   3. bitmap可以加载
+ *   4. 主键btdb中的每个主键都指向存在的docId, 并且没有两个存活的文档拥有同一个主键
+ * 离线校验(VerifyTable)可以修复：
+ *   损坏的分区移动到表目录下的quarantine目录中隔离, 其中的文档标记删除
+ *   根据主键正排(docId=>主键)和bitmap重建主键倒排(主键=>docId), 同一个主键只保留最新的文档
+ *   bitmap损坏时, 以主键倒排为准重建bitmap: 没有被主键指向的文档全部标记删除
+ *   (删除文档时主键倒排不一定被清理, 这部分已删除的文档会被恢复)
+ * 在线校验(Table.Verify)只报告问题, 不修复
+ */
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"github.com/hq-cml/spider-engine/core/partition"
+	"github.com/hq-cml/spider-engine/utils/bitmap"
+	"github.com/hq-cml/spider-engine/utils/btree"
+	"github.com/hq-cml/spider-engine/utils/helper"
+	"github.com/hq-cml/spider-engine/utils/log"
+)
+
+const (
+	QUARANTINE_DIR       = "quarantine" //隔离损坏分区的目录
+	VERIFY_MAX_EXAMPLES  = 3            //每类问题最多列出几个例子
+)
+
+//校验发现的一个问题
+type VerifyIssue struct {
+	Target string `json:"target"`           //出问题的对象: 分区、bitmap、主键等
+	Msg    string `json:"msg"`
+	Repair string `json:"repair,omitempty"` //已经执行的修复
+}
+
+type VerifyReport struct {
+	TableName  string         `json:"tableName"`
+	Partitions int            `json:"partitions"`
+	Issues     []*VerifyIssue `json:"issues"`
+}
+
+func (report *VerifyReport) add(target, msg string) *VerifyIssue {
+	issue := &VerifyIssue{Target: target, Msg: msg}
+	report.Issues = append(report.Issues, issue)
+	return issue
+}
+
+//一次校验的上下文
+type verifier struct {
+	tbl      *Table
+	report   *VerifyReport
+	deleted  bitmap.BitSet //删除标记, 损坏时为nil
+	broken   [][2]uint32   //损坏的分区的docId范围
+	partEnd  uint32        //最后一个磁盘分区的NextDocId, 之后的文档在内存分区(WAL)中
+}
+
+//离线校验表, repair为true时修复发现的问题
+//Note: 表不能处于加载状态(btdb被占用会打开失败)
+func VerifyTable(path, name string, repair bool) (*VerifyReport, error) {
+	path = fixDir(path)
+	tbl := &Table{Path: path, TableName: name}
+	buffer, err := helper.ReadManifest(tbl.getMetaName())
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buffer, tbl); err != nil {
+		return nil, err
+	}
+	v := &verifier{
+		tbl:    tbl,
+		report: &VerifyReport{TableName: name, Partitions: len(tbl.PrtPathNames), Issues: []*VerifyIssue{}},
+	}
+
+	//逐个校验分区
+	parts := []*partition.Partition{}
+	brokenNames := []string{}
+	for _, prtPathName := range tbl.PrtPathNames {
+		part, problems := partition.VerifyPartition(prtPathName)
+		for _, problem := range problems {
+			v.report.add(filepath.Base(prtPathName), problem)
+		}
+		if len(problems) > 0 {
+			brokenNames = append(brokenNames, prtPathName)
+		}
+		parts = append(parts, part)
+	}
+
+	//bitmap, 分区之间的空洞需要借助bitmap判断
+	delBitmap, err := bitmap.LoadRoaring(tbl.getBitMapName())
+	if err != nil {
+		issue := v.report.add("bitmap", "Load bitmap error: " + err.Error())
+		if repair && tbl.PrimaryKey == "" {
+			issue.Repair = "Can not rebuild bitmap without primary key"
+		}
+	} else {
+		v.deleted = delBitmap
+	}
+	v.verifyRanges(parts)
+	v.markBroken(parts, brokenNames)
+
+	//主键
+	var priBtdb btree.Btree
+	if tbl.PrimaryKey != "" {
+		priBtdb, err = btree.OpenBtree("", tbl.getPrimaryBtName())
+		if err != nil {
+			v.report.add("primary", "Open primary btdb error: " + err.Error())
+		} else {
+			defer priBtdb.Close()
+			v.verifyPrimary(priBtdb, nil)
+		}
+	}
+
+	if !repair || len(v.report.Issues) == 0 {
+		return v.report, nil
+	}
+
+	//修复: 先隔离损坏的分区, 再重建主键和bitmap, 最后提交元信息
+	if err := v.quarantine(parts, brokenNames); err != nil {
+		return v.report, err
+	}
+	if priBtdb != nil {
+		if err := v.rebuildPrimary(priBtdb); err != nil {
+			return v.report, err
+		}
+	}
+	if v.deleted != nil {
+		if err := v.deleted.Sync(); err != nil {
+			return v.report, err
+		}
+	}
+	data := helper.JsonEncodeIndent(tbl)
+	if data == "" {
+		return v.report, errors.New("Json error")
+	}
+	if err := helper.WriteManifest([]byte(data), tbl.getMetaName()); err != nil {
+		return v.report, err
+	}
+	log.Infof("Repair Table [%v] finish", name)
+	return v.report, nil
+}
+
+//在线校验, 只报告问题
+func (tbl *Table) Verify() (*VerifyReport, error) {
+	tbl.rwMutex.RLock()
+	defer tbl.rwMutex.RUnlock()
+
+	if tbl.status != TABLE_STATUS_RUNNING {
+		return nil, errors.New("Table status must be running!")
+	}
+	v := &verifier{
+		tbl:     tbl,
+		report:  &VerifyReport{TableName: tbl.TableName, Partitions: len(tbl.partitions), Issues: []*VerifyIssue{}},
+		deleted: tbl.delFlagBitMap,
+	}
+	for _, prt := range tbl.partitions {
+		for _, problem := range prt.Verify() {
+			v.report.add(filepath.Base(prt.PrtPathName), problem)
+		}
+	}
+	v.verifyRanges(tbl.partitions)
+	if tbl.PrimaryKey != "" {
+		v.verifyPrimary(tbl.priBtdb, tbl.priIvtMap)
+	}
+	return v.report, nil
+}
+
+//分区的docId范围必须首尾相接, 隔离损坏分区留下的空洞除外(空洞中的文档都已经标记删除)
+func (v *verifier) verifyRanges(parts []*partition.Partition) {
+	next := v.tbl.StartDocId
+	for _, part := range parts {
+		if part == nil {
+			continue
+		}
+		if part.StartDocId < next || (part.StartDocId > next && !v.allDeleted(next, part.StartDocId)) {
+			v.report.add(filepath.Base(part.PrtPathName),
+				fmt.Sprintf("DocId range [%v, %v) is not contiguous, expect start %v", part.StartDocId, part.NextDocId, next))
+		}
+		next = part.NextDocId
+	}
+	if next > v.tbl.NextDocId {
+		v.report.add("table", fmt.Sprintf("Partitions end at %v, beyond table nextDocId %v", next, v.tbl.NextDocId))
+	}
+	v.partEnd = next
+}
+
+//[start, end)中的文档是否都已经标记删除
+func (v *verifier) allDeleted(start, end uint32) bool {
+	if v.deleted == nil {
+		return false
+	}
+	for docId := start; docId < end; docId++ {
+		if !v.deleted.IsSet(uint64(docId)) {
+			return false
+		}
+	}
+	return true
+}
+
+//记录损坏分区的docId范围, 元信息不可读的分区取前后分区之间的空洞
+func (v *verifier) markBroken(parts []*partition.Partition, brokenNames []string) {
+	isBroken := map[string]bool{}
+	for _, name := range brokenNames {
+		isBroken[name] = true
+	}
+	for i, prtPathName := range v.tbl.PrtPathNames {
+		if !isBroken[prtPathName] {
+			continue
+		}
+		if parts[i] != nil {
+			v.broken = append(v.broken, [2]uint32{parts[i].StartDocId, parts[i].NextDocId})
+			continue
+		}
+		start, end := v.tbl.StartDocId, v.partEnd
+		for j := i - 1; j >= 0; j-- {
+			if parts[j] != nil {
+				start = parts[j].NextDocId
+				break
+			}
+		}
+		for j := i + 1; j < len(parts); j++ {
+			if parts[j] != nil {
+				end = parts[j].StartDocId
+				break
+			}
+		}
+		v.broken = append(v.broken, [2]uint32{start, end})
+	}
+}
+
+//文档是否存在: 在表的范围内, 不属于损坏的分区
+func (v *verifier) exists(docId uint32) bool {
+	if docId < v.tbl.StartDocId || docId >= v.tbl.NextDocId {
+		return false
+	}
+	for _, r := range v.broken {
+		if docId >= r[0] && docId < r[1] {
+			return false
+		}
+	}
+	return true
+}
+
+//文档是否存活: 存在并且没有被删除
+func (v *verifier) live(docId uint32) bool {
+	if v.deleted != nil && v.deleted.IsSet(uint64(docId)) {
+		return false
+	}
+	return v.exists(docId)
+}
+
+//主键倒排中的docId都必须存在(删除文档时不一定会清理主键, 以bitmap为准, 所以可以指向已删除的文档),
+//主键正排中存活的docId都必须被主键倒排指向
+//memIvt是内存中还没有落地的主键倒排, 优先于btdb
+func (v *verifier) verifyPrimary(priBtdb btree.Btree, memIvt map[string]string) {
+	dangling, danglingCnt := []string{}, 0
+	check := func(key, value string) {
+		docId, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || !v.exists(uint32(docId)) {
+			danglingCnt++
+			if len(dangling) < VERIFY_MAX_EXAMPLES {
+				dangling = append(dangling, fmt.Sprintf("%v=>%v", key, value))
+			}
+		}
+	}
+	if priBtdb.HasTree(PRI_IVT_BTREE_NAME) {
+		priBtdb.ForEach(PRI_IVT_BTREE_NAME, func(key, value string) bool {
+			if _, exist := memIvt[key]; !exist {
+				check(key, value)
+			}
+			return true
+		})
+	}
+	for key, value := range memIvt {
+		check(key, value)
+	}
+	if danglingCnt > 0 {
+		v.report.add("primary", fmt.Sprintf("%v primary keys point to missing docIds, such as %v", danglingCnt, dangling))
+	}
+
+	//只有bitmap完好的时候才能判断正排中的文档是否存活
+	if v.deleted == nil || !priBtdb.HasTree(PRI_FWD_BTREE_NAME) {
+		return
+	}
+	orphan, orphanCnt := []string{}, 0
+	priBtdb.ForEach(PRI_FWD_BTREE_NAME, func(value, key string) bool {
+		docId, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || !v.live(uint32(docId)) {
+			return true
+		}
+		cur, exist := memIvt[key]
+		if !exist {
+			cur, exist = priBtdb.GetStr(PRI_IVT_BTREE_NAME, key)
+		}
+		if !exist || cur != value {
+			orphanCnt++
+			if len(orphan) < VERIFY_MAX_EXAMPLES {
+				orphan = append(orphan, fmt.Sprintf("%v=>%v", value, key))
+			}
+		}
+		return true
+	})
+	if orphanCnt > 0 {
+		v.report.add("primary", fmt.Sprintf("%v live docIds are not pointed by their primary keys, such as %v", orphanCnt, orphan))
+	}
+}
+
+//隔离损坏的分区: 移动到quarantine目录, 从表中去掉
+func (v *verifier) quarantine(parts []*partition.Partition, brokenNames []string) error {
+	if len(brokenNames) == 0 {
+		return nil
+	}
+	dir := v.tbl.Path + QUARANTINE_DIR + "/"
+	if !helper.Exist(dir) && !helper.Mkdir(dir) {
+		return errors.New("Failed create dir: " + dir)
+	}
+	isBroken := map[string]bool{}
+	for _, name := range brokenNames {
+		isBroken[name] = true
+		files, err := filepath.Glob(name + ".*")
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := os.Rename(file, dir + filepath.Base(file)); err != nil {
+				return err
+			}
+		}
+	}
+
+	prtPathNames := []string{}
+	for i, prtPathName := range v.tbl.PrtPathNames {
+		if !isBroken[prtPathName] {
+			prtPathNames = append(prtPathNames, prtPathName)
+			continue
+		}
+		if parts[i] != nil && v.tbl.RealDocNum >= parts[i].RealDocNum {
+			v.tbl.RealDocNum -= parts[i].RealDocNum
+		}
+		for _, issue := range v.report.Issues {
+			if issue.Target == filepath.Base(prtPathName) {
+				issue.Repair = "Moved to " + dir
+			}
+		}
+	}
+	v.tbl.PrtPathNames = prtPathNames
+
+	//损坏分区中的文档标记删除
+	if v.deleted != nil {
+		for _, r := range v.broken {
+			for docId := r[0]; docId < r[1]; docId++ {
+				v.deleted.Set(uint64(docId))
+			}
+		}
+	}
+	return nil
+}
+
+//重建主键倒排, 同一个主键只保留最新的存活文档, 其他的标记删除
+//bitmap完好时以主键正排为准, 否则以主键倒排为准, 并据此重建bitmap
+func (v *verifier) rebuildPrimary(priBtdb btree.Btree) error {
+	ivt := map[string]uint32{}
+	realDocNum := 0
+	if v.deleted != nil {
+		dup := []uint32{}
+		if priBtdb.HasTree(PRI_FWD_BTREE_NAME) {
+			priBtdb.ForEach(PRI_FWD_BTREE_NAME, func(value, key string) bool {
+				docId, err := strconv.ParseUint(value, 10, 32)
+				if err != nil || !v.live(uint32(docId)) {
+					return true
+				}
+				if cur, exist := ivt[key]; exist {
+					if cur > uint32(docId) {
+						dup = append(dup, uint32(docId))
+						return true
+					}
+					dup = append(dup, cur)
+				}
+				ivt[key] = uint32(docId)
+				return true
+			})
+		}
+		for _, docId := range dup {
+			v.deleted.Set(uint64(docId))
+		}
+		realDocNum = len(ivt)
+		//已删除文档的主键和DelDoc一样保留, 重放WAL中的删除记录时还需要通过主键找到它们
+		if priBtdb.HasTree(PRI_IVT_BTREE_NAME) {
+			priBtdb.ForEach(PRI_IVT_BTREE_NAME, func(key, value string) bool {
+				docId, err := strconv.ParseUint(value, 10, 32)
+				if _, exist := ivt[key]; !exist && err == nil && v.exists(uint32(docId)) {
+					ivt[key] = uint32(docId)
+				}
+				return true
+			})
+		}
+	} else {
+		if priBtdb.HasTree(PRI_IVT_BTREE_NAME) {
+			priBtdb.ForEach(PRI_IVT_BTREE_NAME, func(key, value string) bool {
+				docId, err := strconv.ParseUint(value, 10, 32)
+				if err == nil && v.exists(uint32(docId)) {
+					ivt[key] = uint32(docId)
+				}
+				return true
+			})
+		}
+		alive := bitmap.NewRoaring()
+		for _, docId := range ivt {
+			alive.Set(uint64(docId))
+		}
+		rebuilt := bitmap.NewRoaringFile(v.tbl.getBitMapName())
+		for docId := v.tbl.StartDocId; docId < v.tbl.NextDocId; docId++ {
+			if !alive.IsSet(uint64(docId)) {
+				rebuilt.Set(uint64(docId))
+			}
+		}
+		v.deleted = rebuilt
+		realDocNum = len(ivt)
+		for _, issue := range v.report.Issues {
+			if issue.Target == "bitmap" {
+				issue.Repair = "Rebuilt from primary keys, deleted docs may come back"
+			}
+		}
+	}
+
+	kv := make(map[string]string, len(ivt))
+	for key, docId := range ivt {
+		kv[key] = strconv.Itoa(int(docId))
+	}
+	if priBtdb.HasTree(PRI_IVT_BTREE_NAME) {
+		if err := priBtdb.DelTree(PRI_IVT_BTREE_NAME); err != nil {
+			return err
+		}
+	}
+	if err := priBtdb.AddTree(PRI_IVT_BTREE_NAME); err != nil {
+		return err
+	}
+	if err := priBtdb.MutiSet(PRI_IVT_BTREE_NAME, kv); err != nil {
+		return err
+	}
+	v.tbl.RealDocNum = uint32(realDocNum + v.walUndone())
+	for _, issue := range v.report.Issues {
+		if issue.Target == "primary" {
+			issue.Repair = "Rebuilt primary keys"
+		}
+	}
+	return nil
+}
+
+//WAL中落地分区文档的删除和变更, 重放时会先撤销删除标记再重新执行, 所以这部分文档按存活计数
+func (v *verifier) walUndone() int {
+	walName := v.tbl.getWalName()
+	if v.deleted == nil || !helper.Exist(walName) {
+		return 0
+	}
+	wal, seq, records, err := LoadWal(walName)
+	if err != nil {
+		return 0
+	}
+	wal.Close()
+	if seq != v.tbl.WalSeq {
+		return 0
+	}
+	undone := map[uint32]bool{}
+	for _, rec := range records {
+		if rec.Op != WAL_OP_ADD && v.exists(rec.OldDocId) && v.deleted.IsSet(uint64(rec.OldDocId)) {
+			undone[rec.OldDocId] = true
+		}
+	}
+	return len(undone)
+}
@@ -0,0 +1,68 @@
+package table
+
+/*
+ * 文档版本, 用于乐观并发控制
+ * 每次变更都会生成新的docId, 所以版本按docId记录: 新增的文档版本为1, 变更之后的文档版本为旧文档的版本+1
+ * 和主键的正排一样, 内存分区的文档记录在priVerMap中, 落地时写入主键btdb的PRI_VER_BTREE_NAME, 分区合并剔除文档时一并清理
+ * 重放WAL时, 变更会基于旧文档的版本重新计算, 结果和崩溃前一致, 所以WAL中不需要记录版本
+ * 老版本的表没有版本数据, 视为1
+ */
+import (
+	"fmt"
+	"strconv"
+)
+
+//版本冲突
+type VersionConflictError struct {
+	Key     string
+	Current uint64 //当前版本, 0表示文档不存在
+	Expect  uint64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("Version conflict! Key: %v, current version: %v, expect: %v", e.Key, e.Current, e.Expect)
+}
+
+//是否是版本冲突
+func IsVersionConflict(err error) bool {
+	_, ok := err.(*VersionConflictError)
+	return ok
+}
+
+//获取文档的版本
+func (tbl *Table) getVersion(docId uint32) uint64 {
+	docIdStr := strconv.Itoa(int(docId))
+	if v, exist := tbl.priVerMap[docIdStr]; exist {
+		version, _ := strconv.ParseUint(v, 10, 64)
+		return version
+	}
+	if tbl.priBtdb != nil {
+		if v, ok := tbl.priBtdb.GetInt(PRI_VER_BTREE_NAME, docIdStr); ok {
+			return uint64(v)
+		}
+	}
+	return 1
+}
+
+//记录新文档的版本, 新文档一定在内存分区中
+func (tbl *Table) setVersion(docId uint32, version uint64) {
+	if tbl.PrimaryKey == "" {
+		return
+	}
+	tbl.priVerMap[strconv.Itoa(int(docId))] = strconv.FormatUint(version, 10)
+}
+
+//校验版本, ifVersion为0表示不校验
+func (tbl *Table) checkVersion(key string, docId uint32, exist bool, ifVersion uint64) error {
+	if ifVersion == 0 {
+		return nil
+	}
+	var current uint64
+	if exist {
+		current = tbl.getVersion(docId)
+	}
+	if current != ifVersion {
+		return &VersionConflictError{Key: key, Current: current, Expect: ifVersion}
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package table
+
+/*
+ * 预写日志(WAL), 用于保证内存分区在进程崩溃之后不丢数据
+ * 内存分区和主键的内存map只有在落地时才会写到磁盘, 所以增删改在生效之前先追加写入WAL,
+ * 表加载时重放WAL, 恢复出内存分区; 每次表的元信息落地之后, 内存分区的数据都已经在磁盘上, WAL随之清空
+ *
+ * 文件格式：
+ *     [seq][len|crc|record][len|crc|record]...
+ * seq和表元信息中的WalSeq对应, 不一致说明WAL已经过期(元信息落地之后, 清空WAL之前崩溃), 直接丢弃
+ * record是json格式, crc用于识别崩溃时写了一半的记录, 重放到第一条损坏的记录为止
+ */
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hq-cml/spider-engine/basic"
+	"github.com/hq-cml/spider-engine/utils/helper"
+	"github.com/hq-cml/spider-engine/utils/log"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	WAL_OP_ADD    = "add"
+	WAL_OP_UPDATE = "update"
+	WAL_OP_DEL    = "del"
+
+	WAL_HEAD_BYTE_CNT   = 8 //seq
+	WAL_RECORD_HEAD_CNT = 8 //len + crc
+)
+
+//一条WAL记录
+type walRecord struct {
+	Op       string                 `json:"op"`
+	Key      string                 `json:"key"`
+	DocId    uint32                 `json:"docId"`            //新增和变更时新文档的docId
+	OldDocId uint32                 `json:"oldDocId"`         //变更和删除时旧文档的docId
+	Content  map[string]interface{} `json:"content,omitempty"`
+}
+
+type Wal struct {
+	fileName string
+	fd       *os.File
+	policy   string
+	dirty    bool          //是否有未刷盘的数据
+	batch    bool          //批量写入中, 每次写入都刷盘的策略推迟到批量结束时统一刷盘
+	stop     chan struct{} //定时刷盘的退出信号
+	mutex    sync.Mutex
+}
+
+//新建(或清空)WAL文件, 写入seq
+func NewWal(fileName string, seq uint64) (*Wal, error) {
+	fd, err := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	wal := newWal(fileName, fd)
+	if err := wal.writeHead(seq); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	wal.startSync()
+	return wal, nil
+}
+
+//加载WAL文件, 返回seq和全部完好的记录, 损坏的尾部会被截掉, 后续继续追加写
+func LoadWal(fileName string) (*Wal, uint64, []*walRecord, error) {
+	fd, err := os.OpenFile(fileName, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	head := make([]byte, WAL_HEAD_BYTE_CNT)
+	if _, err := io.ReadFull(fd, head); err != nil {
+		fd.Close()
+		return nil, 0, nil, errors.New("Wal head error: " + err.Error())
+	}
+	seq := binary.LittleEndian.Uint64(head)
+
+	//逐条读取, 直到文件结束或者遇到损坏的记录
+	records := []*walRecord{}
+	offset := int64(WAL_HEAD_BYTE_CNT)
+	recHead := make([]byte, WAL_RECORD_HEAD_CNT)
+	for {
+		if _, err := io.ReadFull(fd, recHead); err != nil {
+			break
+		}
+		data := make([]byte, binary.LittleEndian.Uint32(recHead))
+		if _, err := io.ReadFull(fd, data); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(recHead[4:]) {
+			break
+		}
+		rec := walRecord{}
+		if err := json.Unmarshal(data, &rec); err != nil {
+			break
+		}
+		records = append(records, &rec)
+		offset += int64(WAL_RECORD_HEAD_CNT + len(data))
+	}
+
+	//截掉损坏的尾部
+	if err := fd.Truncate(offset); err != nil {
+		fd.Close()
+		return nil, 0, nil, err
+	}
+	if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+		fd.Close()
+		return nil, 0, nil, err
+	}
+	wal := newWal(fileName, fd)
+	wal.startSync()
+	return wal, seq, records, nil
+}
+
+func newWal(fileName string, fd *os.File) *Wal {
+	return &Wal{
+		fileName: fileName,
+		fd:       fd,
+		policy:   basic.WAL_SYNC_POLICY,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (wal *Wal) writeHead(seq uint64) error {
+	head := make([]byte, WAL_HEAD_BYTE_CNT)
+	binary.LittleEndian.PutUint64(head, seq)
+	if _, err := wal.fd.Write(head); err != nil {
+		return err
+	}
+	return wal.fd.Sync()
+}
+
+//定时刷盘
+func (wal *Wal) startSync() {
+	if wal.policy != basic.WAL_SYNC_INTERVAL {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(basic.WAL_SYNC_INTERVAL_SEC) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				wal.Sync()
+			case <-wal.stop:
+				return
+			}
+		}
+	}()
+}
+
+//追加一条记录
+func (wal *Wal) Append(rec *walRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, WAL_RECORD_HEAD_CNT + len(data))
+	binary.LittleEndian.PutUint32(buffer, uint32(len(data)))
+	binary.LittleEndian.PutUint32(buffer[4:], crc32.ChecksumIEEE(data))
+	copy(buffer[WAL_RECORD_HEAD_CNT:], data)
+
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	n, err := wal.fd.Write(buffer)
+	if err != nil || n != len(buffer) {
+		log.Errf(fmt.Sprintf("Write wal err:%v, len:%v, len:%v", err, n, len(buffer)))
+		return errors.New("Write Wal Error")
+	}
+	if wal.policy == basic.WAL_SYNC_ALWAYS && !wal.batch {
+		return wal.fd.Sync()
+	}
+	wal.dirty = true
+	return nil
+}
+
+//开始批量写入
+func (wal *Wal) BeginBatch() {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	wal.batch = true
+}
+
+//结束批量写入, 每次写入都刷盘的策略在此时统一刷盘
+func (wal *Wal) EndBatch() error {
+	wal.mutex.Lock()
+	wal.batch = false
+	wal.mutex.Unlock()
+	if wal.policy == basic.WAL_SYNC_ALWAYS {
+		return wal.Sync()
+	}
+	return nil
+}
+
+//刷盘
+func (wal *Wal) Sync() error {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	if !wal.dirty {
+		return nil
+	}
+	wal.dirty = false
+	return wal.fd.Sync()
+}
+
+//清空WAL, 写入新的seq
+func (wal *Wal) Reset(seq uint64) error {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	if err := wal.fd.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := wal.fd.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	wal.dirty = false
+	return wal.writeHead(seq)
+}
+
+func (wal *Wal) Close() error {
+	close(wal.stop)
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	if wal.dirty {
+		wal.fd.Sync()
+	}
+	return wal.fd.Close()
+}
+
+//表加载时打开WAL, seq和元信息一致则重放其中的记录, 否则丢弃
+//Note: 调用时表已经是running状态
+func (tbl *Table) recoverWal() error {
+	walName := tbl.getWalName()
+	if !helper.Exist(walName) {
+		wal, err := NewWal(walName, tbl.WalSeq)
+		if err != nil {
+			return err
+		}
+		tbl.wal = wal
+		return nil
+	}
+
+	wal, seq, records, err := LoadWal(walName)
+	if err != nil {
+		log.Warnf("Load wal %v error: %v. Discard it", walName, err)
+		wal, err = NewWal(walName, tbl.WalSeq)
+		if err != nil {
+			return err
+		}
+		tbl.wal = wal
+		return nil
+	}
+	if seq != tbl.WalSeq {
+		log.Warnf("Wal %v is expired: %v, %v. Discard it", walName, seq, tbl.WalSeq)
+		wal.Close()
+		wal, err = NewWal(walName, tbl.WalSeq)
+		if err != nil {
+			return err
+		}
+		tbl.wal = wal
+		return nil
+	}
+
+	//先重放再设置wal, 重放的记录已经在WAL中, 不用再写一遍
+	tbl.replayWal(records)
+	tbl.wal = wal
+	return nil
+}
+
+//重放WAL
+//WAL中的操作可能已经有一部分生效在磁盘上(主键btdb是直接写文件的, bitmap可能随元信息一起落地了), 所以先撤销这部分,
+//回到上次元信息落地时的状态, 然后按原有的流程逐条重新执行, 得到的docId和原来一致
+func (tbl *Table) replayWal(records []*walRecord) {
+	maxDocId := tbl.NextDocId
+	for i := len(records) - 1; i >= 0; i-- {
+		rec := records[i]
+		if rec.DocId >= maxDocId {
+			maxDocId = rec.DocId + 1
+		}
+		if rec.Op == WAL_OP_ADD || rec.OldDocId >= tbl.NextDocId {
+			continue
+		}
+		//落地分区的文档, 撤销删除标记; 倒序执行, 主键最终指向最早的docId
+		tbl.delFlagBitMap.Clear(uint64(rec.OldDocId))
+		if rec.Op == WAL_OP_UPDATE {
+			tbl.priBtdb.Set(PRI_IVT_BTREE_NAME, rec.Key, fmt.Sprintf("%v", rec.OldDocId))
+		}
+	}
+	//内存分区的文档全部重新生成, 清掉它们的删除标记
+	for docId := tbl.NextDocId; docId < maxDocId; docId++ {
+		tbl.delFlagBitMap.Clear(uint64(docId))
+	}
+
+	tbl.replaying = true
+	defer func() {
+		tbl.replaying = false
+	}()
+	for _, rec := range records {
+		var docId uint32
+		var err error
+		switch rec.Op {
+		case WAL_OP_ADD:
+			docId, _, err = tbl.AddDoc(rec.Content)
+		case WAL_OP_UPDATE:
+			docId, err = tbl.UpdateDoc(rec.Content)
+		case WAL_OP_DEL:
+			tbl.DelDoc(rec.Key)
+			continue
+		}
+		if docId != rec.DocId {
+			log.Errf("Replay wal error. Op: %v, Key: %v, DocId: %v, %v, Err: %v", rec.Op, rec.Key, docId, rec.DocId, err)
+		}
+	}
+	log.Infof("Table %v replay %v wal records", tbl.TableName, len(records))
+}
+
+//写WAL, 重放过程中不写
+//Note: 调用方需持有写锁
+func (tbl *Table) writeWal(rec *walRecord) error {
+	if tbl.wal == nil || tbl.replaying {
+		return nil
+	}
+	return tbl.wal.Append(rec)
+}
+
+//元信息落地之后, 如果内存分区已经为空, 清空WAL
+//Note: 调用方需持有写锁
+func (tbl *Table) resetWal() error {
+	if tbl.wal == nil {
+		return nil
+	}
+	return tbl.wal.Reset(tbl.WalSeq)
+}
+
+func (tbl *Table) getWalName() string {
+	return fmt.Sprintf("%v%v%v", tbl.Path, tbl.TableName, basic.IDX_FILENAME_SUFFIX_WAL)
+}
@@ -0,0 +1,129 @@
+package engine
+
+/*
+ * 按查询删除/更新
+ * 先按和搜索一致的查询条件找出命中的全部文档, 然后分批交给表的调度器执行, 每一批在表的一次写锁之内完成,
+ * 批次之间搜索和其他写入照常进行. 整个过程作为后台任务运行, 可以查看进度或者取消, 详见task.go
+ * 找出之后才被删除或变更过的文档计入冲突, 不做处理
+ */
+import (
+	"errors"
+	"github.com/hq-cml/spider-engine/basic"
+	"github.com/hq-cml/spider-engine/core/query"
+	"github.com/hq-cml/spider-engine/core/table"
+	"github.com/hq-cml/spider-engine/utils/log"
+)
+
+const DEFAULT_BY_QUERY_BATCH_SIZE = 1000
+
+//按查询删除, 返回后台任务
+func (se *SpiderEngine) DeleteByQuery(p *ByQueryParam) (*Task, error) {
+	return se.startByQuery(TASK_TYPE_DELETE_BY_QUERY, p)
+}
+
+//按查询局部更新, 返回后台任务
+func (se *SpiderEngine) UpdateByQuery(p *ByQueryParam) (*Task, error) {
+	if len(p.Doc) == 0 && len(p.Incr) == 0 {
+		return nil, errors.New("Nothing to update!")
+	}
+	return se.startByQuery(TASK_TYPE_UPDATE_BY_QUERY, p)
+}
+
+//找出命中的文档, 生成后台任务
+func (se *SpiderEngine) startByQuery(typ string, p *ByQueryParam) (*Task, error) {
+	if se.Closed {
+		return nil, errors.New("Spider Engine is closed!")
+	}
+	if p.BatchSize <= 0 {
+		p.BatchSize = DEFAULT_BY_QUERY_BATCH_SIZE
+	}
+	var node *query.Node
+	if p.Query != "" {
+		var err error
+		if node, err = query.ParseWithOp(p.Query, p.Operator); err != nil {
+			log.Errf("Parse Query Error: %v", err.Error())
+			return nil, err
+		}
+	}
+
+	se.RwMutex.RLock()          //读锁
+	db, exist := se.DbMap[p.Database]
+	if !exist {
+		se.RwMutex.RUnlock()
+		log.Errf("The db not exist!")
+		return nil, errors.New("The db not exist!")
+	}
+	docIds, err := db.MatchDocIds(p.Table, node, p.FieldName, p.Value, p.Operator, p.Filters)
+	tab := db.TableMap[p.Table]
+	se.RwMutex.RUnlock()
+	if err != nil {
+		log.Errf("%v Error: %v", typ, err.Error())
+		return nil, err
+	}
+
+	task := se.newTask(typ, p.Database, p.Table, len(docIds))
+	log.Infof("Start %v task: %v, %v, %v, %v docs", typ, task.info.Id, p.Database, p.Table, len(docIds))
+	go se.runByQuery(task, p, tab, docIds)
+	return task, nil
+}
+
+//分批执行, 每一批之前检查是否取消
+func (se *SpiderEngine) runByQuery(task *Task, p *ByQueryParam, tab *table.Table, docIds []uint32) {
+	for start := 0; start < len(docIds); start += p.BatchSize {
+		if task.canceled() {
+			log.Infof("Task %v canceled", task.info.Id)
+			task.finish(TASK_STATUS_CANCELED, nil)
+			return
+		}
+		end := start + p.BatchSize
+		if end > len(docIds) {
+			end = len(docIds)
+		}
+		ret, err := se.doByQueryBatch(tab, &ByQueryBatch{
+			Database: p.Database,
+			Table:    p.Table,
+			Op:       task.info.Type,
+			DocIds:   docIds[start:end],
+			Doc:      p.Doc,
+			Incr:     p.Incr,
+		})
+		if ret != nil {
+			task.progress(end - start, ret)
+		}
+		if err != nil {
+			log.Errf("Task %v failed: %v", task.info.Id, err)
+			task.finish(TASK_STATUS_FAILED, err)
+			return
+		}
+	}
+	log.Infof("Task %v done", task.info.Id)
+	task.finish(TASK_STATUS_DONE, nil)
+}
+
+//一批文档交给表的调度器, 和其他写入串行执行
+//期间表被删除或者重建(如恢复快照)时, docId已经失效, 任务失败
+func (se *SpiderEngine) doByQueryBatch(tab *table.Table, b *ByQueryBatch) (*table.ByQueryResult, error) {
+	if se.Closed {
+		return nil, errors.New("Spider Engine is closed!")
+	}
+	se.RwMutex.RLock()          //读锁, 只在一批之内持有, 不影响期间删表
+	defer se.RwMutex.RUnlock()
+
+	cache, exist := se.CacheMap[b.Database + "." + b.Table]
+	if !exist {
+		return nil, errors.New("The table not exist!")
+	}
+	if db := se.DbMap[b.Database]; db == nil || db.TableMap[b.Table] != tab {
+		return nil, errors.New("The table has been changed!")
+	}
+
+	//生成请求放入cache
+	req := basic.NewRequest(basic.REQ_TYPE_DML_BY_QUERY, b)
+	cache.Put(req)
+	log.Debug("Put ByQuery request: ", b.Database + "." + b.Table)
+
+	//等待结果
+	resp := <- req.Resp
+	ret, _ := resp.Data.(*table.ByQueryResult)
+	return ret, resp.Err
+}
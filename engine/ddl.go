@@ -4,7 +4,7 @@ package engine
  * Note：
  *  其中
  *    建库、删库、建表、删表等操作，相对低频，且需要建立调度等附加工作，故采用直接执行的方式
- *    增减字段等操作采用串行化的方式
+ *    增减字段、修改表的设置等操作采用串行化的方式
  */
 import (
 	"github.com/hq-cml/spider-engine/utils/log"
@@ -13,7 +13,10 @@ import (
 	"errors"
 	"github.com/hq-cml/spider-engine/core/field"
 	"github.com/hq-cml/spider-engine/core/index"
+	"github.com/hq-cml/spider-engine/core/table"
 	"github.com/hq-cml/spider-engine/basic"
+	"github.com/hq-cml/spider-engine/utils/helper"
+	"strings"
 )
 
 //建库
@@ -21,6 +24,9 @@ func (se *SpiderEngine) CreateDatabase(p *DatabaseParam) error {
 	if se.Closed {
 		return errors.New("Spider Engine is closed!")
 	}
+	if err := checkDatabaseName(p.Database); err != nil {
+		return err
+	}
 	se.RwMutex.Lock()
 	defer se.RwMutex.Unlock()
 
@@ -61,8 +67,14 @@ func (se *SpiderEngine) DropDatabase(p *DatabaseParam) error {
 	}
 	se.RwMutex.Lock()
 	defer se.RwMutex.Unlock()
+
+	return se.dropDatabase(p.Database)
+}
+
+//删库, 调用方需持有写锁
+func (se *SpiderEngine) dropDatabase(dbName string) error {
 	//校验
-	db, exist := se.DbMap[p.Database]
+	db, exist := se.DbMap[dbName]
 	if !exist {
 		log.Errf("The db not exist!")
 		return errors.New("The db not exist!")
@@ -70,7 +82,7 @@ func (se *SpiderEngine) DropDatabase(p *DatabaseParam) error {
 
 	//删除对应的请求cache和调度scheduler
 	for tbName, _ := range db.TableMap {
-		dbTable := p.Database + "." + tbName
+		dbTable := dbName + "." + tbName
 		tbCache, ok := se.CacheMap[dbTable]
 		if ok {
 			tbCache.Close()
@@ -86,9 +98,9 @@ func (se *SpiderEngine) DropDatabase(p *DatabaseParam) error {
 	}
 
 	//删slice
-	delete(se.DbMap, p.Database)
+	delete(se.DbMap, dbName)
 	for i := 0; i < len(se.DbList); i++ {
-		if se.DbList[i] == p.Database {
+		if se.DbList[i] == dbName {
 			se.DbList = append(se.DbList[:i], se.DbList[i+1:]...)
 		}
 	}
@@ -100,7 +112,7 @@ func (se *SpiderEngine) DropDatabase(p *DatabaseParam) error {
 		return err
 	}
 
-	log.Infof("DropDatabase database: %v", p.Database)
+	log.Infof("DropDatabase database: %v", dbName)
 	return nil
 }
 
@@ -119,17 +131,22 @@ func (se *SpiderEngine) CreateTable(p *CreateTableParam) error {
 		return errors.New("The db not exist!")
 	}
 
-	//参数拼装
+	if err := p.Settings.Check(); err != nil {
+		return err
+	}
+
+	//参数拼装, 没有指定类型的字段使用表的默认分析器
 	fields := []field.BasicField{}
 	for _, f := range p.Fileds {
 		t, ok := index.IDX_MAP[f.Type]
-		if !ok {
+		if !ok && f.Type != "" {
 			log.Errf("Unsuport index type: %v", f.Type)
 			return errors.New("Unsuport index type: " + f.Type)
 		}
 		fields = append(fields, field.BasicField{
 			FieldName:  f.Name,
 			IndexType:  t,
+			Positions:  f.Positions,
 		})
 	}
 
@@ -137,7 +154,7 @@ func (se *SpiderEngine) CreateTable(p *CreateTableParam) error {
 	dbTable := p.Database + "." + p.Table
 	se.CacheMap[dbTable] = se.doSchedule(dbTable)
 
-	_, err := db.CreateTable(p.Table, fields)
+	_, err := db.CreateTableWithSettings(p.Table, fields, p.Settings)
 	if err != nil {
 		log.Errf("CreateTable Error: %v", err)
 		return err
@@ -155,22 +172,27 @@ func (se *SpiderEngine) DropTable(p *CreateTableParam) error {
 	se.RwMutex.Lock()
 	defer se.RwMutex.Unlock()
 
+	return se.dropTable(p.Database, p.Table)
+}
+
+//删表, 调用方需持有写锁
+func (se *SpiderEngine) dropTable(dbName, tableName string) error {
 	//校验
-	db, exist := se.DbMap[p.Database]
+	db, exist := se.DbMap[dbName]
 	if !exist {
 		log.Errf("The db not exist!")
 		return errors.New("The db not exist!")
 	}
 
 	//删表
-	err := db.DropTable(p.Table)
+	err := db.DropTable(tableName)
 	if err != nil {
 		log.Errf("Drop Table Error: %v", err)
 		return err
 	}
 
 	//删除对应的请求cache和调度scheduler
-	dbTable := p.Database + "." + p.Table
+	dbTable := dbName + "." + tableName
 	tbCache, ok := se.CacheMap[dbTable]
 	if ok {
 		tbCache.Close()
@@ -178,7 +200,15 @@ func (se *SpiderEngine) DropTable(p *CreateTableParam) error {
 	delete(se.CacheMap, dbTable)
 
 
-	log.Infof("Drop Table: %v", p.Database + "." + p.Table)
+	log.Infof("Drop Table: %v", dbTable)
+	return nil
+}
+
+//库名校验, 下划线开头的名字保留给系统使用(比如快照目录_snapshot)
+func checkDatabaseName(name string) error {
+	if name == "" || strings.HasPrefix(name, "_") || strings.Contains(name, "/") {
+		return errors.New("Invalid database name: " + name)
+	}
 	return nil
 }
 
@@ -193,6 +223,7 @@ func (se *SpiderEngine) ProcessDDLRequest(req *basic.SpiderRequest) {
 		fld := field.BasicField{
 			FieldName: p.Filed.Name,
 			IndexType: t,
+			Positions: p.Filed.Positions,
 		}
 		err := db.AddField(p.Table, fld)
 		if err != nil {
@@ -216,6 +247,18 @@ func (se *SpiderEngine) ProcessDDLRequest(req *basic.SpiderRequest) {
 
 		log.Infof("Delete Field: %v", p.Database + "." + p.Table + "." + p.Filed.Name)
 		req.Resp <- basic.NewResponse(nil, nil)
+	} else if req.Type == basic.REQ_TYPE_DDL_SETTINGS {
+		p := req.Req.(*TableSettingsParam)
+		db, _ := se.DbMap[p.Database]
+		settings, err := db.UpdateSettings(p.Table, p.Settings)
+		if err != nil {
+			log.Errf("UpdateSettings Error: %v", err)
+			req.Resp <- basic.NewResponse(err, nil)
+			return
+		}
+
+		log.Infof("Update Settings: %v", p.Database + "." + p.Table)
+		req.Resp <- basic.NewResponse(nil, settings)
 	} else {
 		log.Fatal("Unsupport req.Type:%v", req.Type)
 		req.Resp <- basic.NewResponse(errors.New(fmt.Sprintf("Unsupport req.Type:%v", req.Type)), nil)
@@ -239,7 +282,7 @@ func (se *SpiderEngine) AddField(p *AlterFieldParam) error {
 		return errors.New("The db not exist!")
 	}
 	_, ok := index.IDX_MAP[p.Filed.Type]
-	if !ok {
+	if !ok && p.Filed.Type != "" {
 		log.Errf("Unsuport index type: %v", p.Filed.Type)
 		return errors.New(fmt.Sprintf("Unsuport index type: %v", p.Filed.Type))
 	}
@@ -287,15 +330,102 @@ func (se *SpiderEngine) DeleteField(p *AlterFieldParam) error {
 	return nil
 }
 
+//修改表的设置（串行化）
+func (se *SpiderEngine) UpdateSettings(p *TableSettingsParam) (table.TableSettings, error) {
+	if se.Closed {
+		return table.TableSettings{}, errors.New("Spider Engine is closed!")
+	}
+	se.RwMutex.RLock()          //读锁
+	defer se.RwMutex.RUnlock()
 
+	//校验
+	db, exist := se.DbMap[p.Database]
+	if !exist {
+		log.Errf("The db not exist!")
+		return table.TableSettings{}, errors.New("The db not exist!")
+	}
+	if _, exist := db.TableMap[p.Table]; !exist {
+		return table.TableSettings{}, errors.New("The table not exist!")
+	}
+	if len(p.Settings) == 0 {
+		return table.TableSettings{}, errors.New("Settings is empty!")
+	}
 
+	//生成请求放入cache
+	req := basic.NewRequest(basic.REQ_TYPE_DDL_SETTINGS, p)
+	se.CacheMap[p.Database + "." + p.Table].Put(req)
+	log.Debug("Put UpdateSettings request: ", p.Database + "." +p.Table)
 
+	//等待结果
+	resp := <- req.Resp
+	if resp.Err != nil {
+		return table.TableSettings{}, resp.Err
+	}
+
+	return resp.Data.(table.TableSettings), nil
+}
 
+//手动落地表的内存分区
+func (se *SpiderEngine) FlushTable(p *CreateTableParam) error {
+	if se.Closed {
+		return errors.New("Spider Engine is closed!")
+	}
+	se.RwMutex.RLock()          //读锁
+	defer se.RwMutex.RUnlock()
 
+	//校验
+	db, exist := se.DbMap[p.Database]
+	if !exist {
+		log.Errf("The db not exist!")
+		return errors.New("The db not exist!")
+	}
 
+	if err := db.FlushTable(p.Table); err != nil {
+		log.Errf("FlushTable Error: %v, %v", err, p.Database + "." + p.Table)
+		return err
+	}
 
+	log.Infof("Flush Table: %v", p.Database + "." + p.Table)
+	return nil
+}
 
+//在线校验表, 只报告问题
+func (se *SpiderEngine) VerifyTable(p *CreateTableParam) (*table.VerifyReport, error) {
+	if se.Closed {
+		return nil, errors.New("Spider Engine is closed!")
+	}
+	se.RwMutex.RLock()          //读锁
+	defer se.RwMutex.RUnlock()
 
+	//校验
+	db, exist := se.DbMap[p.Database]
+	if !exist {
+		log.Errf("The db not exist!")
+		return nil, errors.New("The db not exist!")
+	}
 
+	report, err := db.VerifyTable(p.Table)
+	if err != nil {
+		log.Errf("VerifyTable Error: %v, %v", err, p.Database + "." + p.Table)
+		return nil, err
+	}
 
+	log.Infof("Verify Table: %v, issues: %v", p.Database + "." + p.Table, len(report.Issues))
+	return report, nil
+}
 
+//离线校验, 引擎不能处于运行状态
+//target是库名或者"库名.表名", repair为true时修复发现的问题
+func CheckData(path, target string, repair bool) ([]*table.VerifyReport, error) {
+	if string(path[len(path)-1]) != "/" {
+		path = path + "/"
+	}
+	dbName, tableName := target, ""
+	if idx := strings.Index(target, "."); idx >= 0 {
+		dbName, tableName = target[:idx], target[idx+1:]
+	}
+	if !helper.Exist(path + dbName) {
+		return nil, errors.New("The db not exist!")
+	}
+	return database.VerifyDatabase(path + dbName, dbName, tableName, repair)
+}
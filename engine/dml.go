@@ -10,6 +10,8 @@ import (
 	"github.com/hq-cml/spider-engine/utils/log"
 	"github.com/hq-cml/spider-engine/basic"
 	"github.com/hq-cml/spider-engine/utils/helper"
+	"github.com/hq-cml/spider-engine/core/query"
+	"github.com/hq-cml/spider-engine/core/table"
 )
 
 func (se *SpiderEngine) ProcessDMLRequest(req *basic.SpiderRequest) {
@@ -31,11 +33,10 @@ func (se *SpiderEngine) ProcessDMLRequest(req *basic.SpiderRequest) {
 		p := req.Req.(*DelDocParam)
 		//删除文档
 		db, _ := se.DbMap[p.Database]
-		ok := db.DeleteDoc(p.Table, p.PrimaryKey)
-		if !ok {
-			log.Errf("DeleteDoc get null: %v", p.PrimaryKey)
-			req.Resp <- basic.NewResponse(
-				errors.New(fmt.Sprintf("DeleteDoc get null: %v", p.PrimaryKey)), nil)
+		_, err := db.DeleteDocWithVersion(p.Table, p.PrimaryKey, p.IfVersion)
+		if err != nil {
+			log.Errf("DeleteDoc Error: %v, %v", p.PrimaryKey, err)
+			req.Resp <- basic.NewResponse(err, nil)
 			return
 		}
 
@@ -46,7 +47,7 @@ func (se *SpiderEngine) ProcessDMLRequest(req *basic.SpiderRequest) {
 		p := req.Req.(*DocParam)
 		//编辑文档
 		db, _ := se.DbMap[p.Database]
-		docId, err :=  db.UpdateDoc(p.Table, p.Content, p.Primary)
+		docId, err :=  db.UpdateDocWithVersion(p.Table, p.Content, p.Primary, p.IfVersion)
 		if err != nil {
 			log.Errf("UpdateDoc Error: %v", err)
 			req.Resp <- basic.NewResponse(err, nil)
@@ -56,6 +57,50 @@ func (se *SpiderEngine) ProcessDMLRequest(req *basic.SpiderRequest) {
 		log.Infof("UpdateDoc Doc Success: %v, %v, %v", p.Database, p.Table, docId)
 		req.Resp <- basic.NewResponse(nil, nil)
 		return
+	} else if req.Type == basic.REQ_TYPE_DML_PATCH_DOC {
+		p := req.Req.(*PatchDocParam)
+		//局部更新文档
+		db, _ := se.DbMap[p.Database]
+		docId, created, err := db.PatchDoc(p.Table, p.PrimaryKey, p.Doc, p.Incr, p.Upsert, p.IfVersion)
+		if err != nil {
+			log.Errf("PatchDoc Error: %v", err)
+			req.Resp <- basic.NewResponse(err, nil)
+			return
+		}
+
+		log.Infof("PatchDoc Success: %v, %v, %v, %v, %v", p.Database, p.Table, p.PrimaryKey, docId, created)
+		req.Resp <- basic.NewResponse(nil, created)
+		return
+	} else if req.Type == basic.REQ_TYPE_DML_BULK {
+		p := req.Req.(*BulkParam)
+		//批量写入
+		db, _ := se.DbMap[p.Database]
+		results, err := db.BulkDocs(p.Table, p.Items)
+		if err != nil {
+			log.Errf("BulkDocs Error: %v", err)
+		}
+
+		log.Infof("BulkDocs: %v, %v, %v items", p.Database, p.Table, len(p.Items))
+		req.Resp <- basic.NewResponse(err, results)
+		return
+	} else if req.Type == basic.REQ_TYPE_DML_BY_QUERY {
+		p := req.Req.(*ByQueryBatch)
+		//按查询删除/更新的一批
+		db, _ := se.DbMap[p.Database]
+		var ret *table.ByQueryResult
+		var err error
+		if p.Op == TASK_TYPE_DELETE_BY_QUERY {
+			ret, err = db.DeleteByDocIds(p.Table, p.DocIds)
+		} else {
+			ret, err = db.PatchByDocIds(p.Table, p.DocIds, p.Doc, p.Incr)
+		}
+		if err != nil {
+			log.Errf("%v Error: %v", p.Op, err)
+		}
+
+		log.Infof("%v: %v, %v, %v docs", p.Op, p.Database, p.Table, len(p.DocIds))
+		req.Resp <- basic.NewResponse(err, ret)
+		return
 	} else {
 		log.Fatal("Unsupport req.Type:%v", req.Type)
 		req.Resp <- basic.NewResponse(errors.New(fmt.Sprintf("Unsupport req.Type:%v", req.Type)), nil)
@@ -148,6 +193,95 @@ func (se *SpiderEngine) UpdateDoc(p *DocParam) error {
 	return nil
 }
 
+//局部更新文档, 返回是否新增
+func (se *SpiderEngine) PatchDoc(p *PatchDocParam) (bool, error) {
+	if se.Closed {
+		return false, errors.New("Spider Engine is closed!")
+	}
+	se.RwMutex.RLock()          //读锁
+	defer se.RwMutex.RUnlock()
+
+	//校验
+	cache, exist := se.CacheMap[p.Database + "." + p.Table]
+	if !exist {
+		log.Errf("The table not exist!")
+		return false, errors.New("The table not exist!")
+	}
+
+	//生成请求放入cache
+	req := basic.NewRequest(basic.REQ_TYPE_DML_PATCH_DOC, p)
+	cache.Put(req)
+	log.Debug("Put PatchDoc request: ", p.Database + "." + p.Table)
+
+	//等待结果
+	resp := <- req.Resp
+	if resp.Err != nil {
+		return false, resp.Err
+	}
+	return resp.Data.(bool), nil
+}
+
+//批量写入
+//按表分组, 每张表的操作作为一个请求交给该表的调度器, 在一次写锁之内执行, 不同的表并行处理
+//返回的结果和actions一一对应
+func (se *SpiderEngine) Bulk(actions []*BulkAction) ([]*BulkItemResult, error) {
+	if se.Closed {
+		return nil, errors.New("Spider Engine is closed!")
+	}
+	se.RwMutex.RLock()          //读锁
+	defer se.RwMutex.RUnlock()
+
+	//分组
+	results := make([]*BulkItemResult, len(actions))
+	params := map[string]*BulkParam{}
+	positions := map[string][]int{}
+	dbTables := []string{}
+	for i, act := range actions {
+		results[i] = &BulkItemResult{
+			Database:   act.Database,
+			Table:      act.Table,
+			BulkResult: &table.BulkResult{Op: act.Op, PrimaryKey: act.PrimaryKey},
+		}
+		dbTable := act.Database + "." + act.Table
+		if _, exist := se.CacheMap[dbTable]; !exist {
+			results[i].Error = "Table not exist!"
+			continue
+		}
+		p, exist := params[dbTable]
+		if !exist {
+			p = &BulkParam{Database: act.Database, Table: act.Table}
+			params[dbTable] = p
+			dbTables = append(dbTables, dbTable)
+		}
+		p.Items = append(p.Items, &table.BulkItem{Op: act.Op, PrimaryKey: act.PrimaryKey, Content: act.Content, IfVersion: act.IfVersion})
+		positions[dbTable] = append(positions[dbTable], i)
+	}
+
+	//生成请求放入cache
+	reqs := make([]*basic.SpiderRequest, len(dbTables))
+	for i, dbTable := range dbTables {
+		reqs[i] = basic.NewRequest(basic.REQ_TYPE_DML_BULK, params[dbTable])
+		se.CacheMap[dbTable].Put(reqs[i])
+		log.Debug("Put Bulk request: ", dbTable)
+	}
+
+	//等待结果
+	for i, dbTable := range dbTables {
+		resp := <- reqs[i].Resp
+		tableResults, _ := resp.Data.([]*table.BulkResult)
+		for j, pos := range positions[dbTable] {
+			if tableResults != nil {
+				results[pos].BulkResult = tableResults[j]
+			}
+			//WAL刷盘失败时, 已经成功的操作也报错, 由调用方重试
+			if resp.Err != nil && results[pos].Error == "" {
+				results[pos].Error = resp.Err.Error()
+			}
+		}
+	}
+	return results, nil
+}
+
 //获取文档
 func (se *SpiderEngine) GetDoc(dbName, tableName, key string) (*basic.DocInfo, error) {
 	if se.Closed {
@@ -179,9 +313,9 @@ func (se *SpiderEngine) GetDoc(dbName, tableName, key string) (*basic.DocInfo, e
 }
 
 //搜索文档
-func (se *SpiderEngine) SearchDocs(p *SearchParam) ([]basic.DocInfo, int, error) {
+func (se *SpiderEngine) SearchDocs(p *SearchParam) ([]basic.DocInfo, int, map[string]*basic.AggResult, error) {
 	if se.Closed {
-		return nil, 0, errors.New("Spider Engine is closed!")
+		return nil, 0, nil, errors.New("Spider Engine is closed!")
 	}
 	se.RwMutex.RLock()          //读锁
 	defer se.RwMutex.RUnlock()
@@ -189,18 +323,54 @@ func (se *SpiderEngine) SearchDocs(p *SearchParam) ([]basic.DocInfo, int, error)
 	db, exist := se.DbMap[p.Database]
 	if !exist {
 		log.Errf("The db not exist!")
-		return nil, 0, errors.New("The db already exist!")
+		return nil, 0, nil, errors.New("The db already exist!")
+	}
+	var docs []basic.DocInfo
+	var total int
+	var aggs map[string]*basic.AggResult
+	var ok bool
+	var err error
+	if p.Query != "" {
+		//查询语句解析成语法树
+		node, parseErr := query.ParseWithOp(p.Query, p.Operator)
+		if parseErr != nil {
+			log.Errf("Parse Query Error: %v", parseErr.Error())
+			return nil, 0, nil, parseErr
+		}
+		docs, total, aggs, ok, err = db.SearchQuery(p.Table, node, p.FieldName, p.Filters, p.Sorts, p.Aggs, p.SearchAfter, p.Offset, p.Size)
+	} else {
+		docs, total, aggs, ok, err = db.SearchDocsWithOp(p.Table, p.FieldName, p.Value, p.Operator, p.Filters, p.Sorts, p.Aggs, p.SearchAfter, p.Offset, p.Size)
 	}
-	docs, total, ok, err := db.SearchDocs(p.Table, p.FieldName, p.Value, p.Filters, p.Offset, p.Size)
 	if err != nil {
 		log.Errf("SearchDocs Error: %v", err.Error())
-		return nil, 0, err
+		return nil, 0, nil, err
 	}
 	if !ok {
 		log.Warnf("SearchDocs get null:%v", helper.JsonEncode(p))
-		return nil, 0, nil
+		return nil, 0, nil, nil
+	}
+
+	log.Infof("SearchDocs: %v, %v, %v, %v, %v, %v", p.Database ,p.Table ,p.FieldName ,p.Value, p.Query, len(docs))
+	return docs, total, aggs, nil
+}
+//导出全表, 只在找出表的时候加读锁, 导出期间不阻塞建表、删表等操作
+func (se *SpiderEngine) ExportDocs(dbName, tableName string, fields []string, fn func(doc *basic.DocInfo) error) error {
+	if se.Closed {
+		return errors.New("Spider Engine is closed!")
+	}
+	se.RwMutex.RLock()          //读锁
+	db, exist := se.DbMap[dbName]
+	if !exist {
+		se.RwMutex.RUnlock()
+		log.Errf("The db not exist!")
+		return errors.New("The db not exist!")
+	}
+	tab, exist := db.TableMap[tableName]
+	se.RwMutex.RUnlock()
+	if !exist {
+		return errors.New("The table not exist!")
 	}
 
-	log.Infof("SearchDocs: %v, %v, %v, %v, %v", p.Database ,p.Table ,p.FieldName ,p.Value, len(docs))
-	return docs, total, nil
-}
\ No newline at end of file
+	log.Infof("ExportDocs: %v, %v, %v", dbName, tableName, fields)
+	return tab.Export(fields, fn)
+}
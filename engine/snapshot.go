@@ -0,0 +1,367 @@
+package engine
+
+/*
+ * 快照与恢复, 不停服的备份库或者表
+ * 快照存放在数据目录的_snapshot目录下, 每个快照一个目录：
+ *   _snapshot/快照名/snapshot.meta    快照的清单
+ *   _snapshot/快照名/库名/表名/        表的快照, 详见table.Snapshot
+ * 分区的索引文件都是硬链接, 快照之间天然共享没有变化的分区, 所以每个快照都是增量的：
+ * 生成快照时会以同一张表最新的一个快照为基础, 复用其中没有变化的分区文件; 删除任意一个快照不影响其他快照
+ */
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"github.com/hq-cml/spider-engine/core/database"
+	"github.com/hq-cml/spider-engine/core/table"
+	"github.com/hq-cml/spider-engine/utils/helper"
+	"github.com/hq-cml/spider-engine/utils/log"
+)
+
+const (
+	SNAPSHOT_DIR       = "_snapshot"
+	SNAPSHOT_META_NAME = "snapshot.meta"
+	SNAPSHOT_TMP_PREFIX = "."          //生成中的快照目录, 完成之后改名
+	SNAPSHOT_RESTORE_PREFIX = SNAPSHOT_TMP_PREFIX + "restore_" //恢复时的暂存目录, 恢复完成之后删除
+)
+
+//快照的清单
+type SnapshotInfo struct {
+	Name       string   `json:"name"`
+	Database   string   `json:"database"`
+	Table      string   `json:"table,omitempty"` //为空表示整库的快照
+	Tables     []string `json:"tables"`
+	Timestamp  int64    `json:"timestamp"`       //生成时间(纳秒), 用于找出最新的快照
+	CreateTime string   `json:"createTime"`
+}
+
+//生成快照
+func (se *SpiderEngine) CreateSnapshot(p *SnapshotParam) (*SnapshotInfo, error) {
+	if se.Closed {
+		return nil, errors.New("Spider Engine is closed!")
+	}
+	if err := checkSnapshotName(p.Name); err != nil {
+		return nil, err
+	}
+	se.RwMutex.RLock()         //读锁, 防止期间删库删表
+	defer se.RwMutex.RUnlock()
+	se.SnapMutex.Lock()        //快照之间串行
+	defer se.SnapMutex.Unlock()
+
+	//校验
+	db, exist := se.DbMap[p.Database]
+	if !exist {
+		log.Errf("The db not exist!")
+		return nil, errors.New("The db not exist!")
+	}
+	tables := db.TableList
+	if p.Table != "" {
+		if _, exist := db.TableMap[p.Table]; !exist {
+			return nil, errors.New("The table not exist!")
+		}
+		tables = []string{p.Table}
+	}
+	if helper.Exist(se.snapshotPath(p.Name)) {
+		return nil, errors.New("The snapshot already exist!")
+	}
+	snapshots, err := se.listSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	//先在临时目录中生成, 完成之后再改名, 半成品的快照不可见
+	tmpPath := se.snapshotPath(SNAPSHOT_TMP_PREFIX + p.Name)
+	os.RemoveAll(tmpPath)
+	now := time.Now()
+	info := &SnapshotInfo{
+		Name:       p.Name,
+		Database:   p.Database,
+		Table:      p.Table,
+		Tables:     append([]string{}, tables...),
+		Timestamp:  now.UnixNano(),
+		CreateTime: helper.Timestamp2String(now.Unix()),
+	}
+	for _, tbName := range tables {
+		dir := fmt.Sprintf("%s/%s/%s/", tmpPath, p.Database, tbName)
+		if ok := helper.Mkdir(dir); !ok {
+			os.RemoveAll(tmpPath)
+			return nil, errors.New("Failed create dir!")
+		}
+		baseDir := ""
+		if base := latestSnapshot(snapshots, p.Database, tbName); base != nil {
+			baseDir = fmt.Sprintf("%s/%s/%s/", se.snapshotPath(base.Name), p.Database, tbName)
+		}
+		if err := db.TableMap[tbName].Snapshot(dir, baseDir); err != nil {
+			log.Errf("Snapshot Table Error: %v, %v", err, p.Database + "." + tbName)
+			os.RemoveAll(tmpPath)
+			return nil, err
+		}
+	}
+	if err := helper.WriteManifest([]byte(helper.JsonEncodeIndent(info)), tmpPath + "/" + SNAPSHOT_META_NAME); err != nil {
+		os.RemoveAll(tmpPath)
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, se.snapshotPath(p.Name)); err != nil {
+		os.RemoveAll(tmpPath)
+		return nil, err
+	}
+
+	log.Infof("Create Snapshot: %v", p.Name)
+	return info, nil
+}
+
+//快照列表, 按生成时间排序
+func (se *SpiderEngine) ListSnapshots() ([]*SnapshotInfo, error) {
+	se.SnapMutex.Lock()
+	defer se.SnapMutex.Unlock()
+	return se.listSnapshots()
+}
+
+//获取快照
+func (se *SpiderEngine) GetSnapshot(name string) (*SnapshotInfo, error) {
+	if err := checkSnapshotName(name); err != nil {
+		return nil, err
+	}
+	se.SnapMutex.Lock()
+	defer se.SnapMutex.Unlock()
+	return se.loadSnapshot(name)
+}
+
+//删除快照
+func (se *SpiderEngine) DeleteSnapshot(name string) error {
+	if err := checkSnapshotName(name); err != nil {
+		return err
+	}
+	se.SnapMutex.Lock()
+	defer se.SnapMutex.Unlock()
+
+	if !helper.Exist(se.snapshotPath(name)) {
+		return errors.New("The snapshot not exist!")
+	}
+	if err := os.RemoveAll(se.snapshotPath(name)); err != nil {
+		return err
+	}
+
+	log.Infof("Delete Snapshot: %v", name)
+	return nil
+}
+
+//从快照恢复, 库名和表名为空则使用快照中原有的名字
+//Note:
+// 整库的快照恢复成一个库, 表的快照恢复到一个已存在的库中
+// 恢复的目标已经存在则会先删除, 即用快照覆盖掉现有的库或表
+// 快照先完整的恢复到暂存目录并加载校验, 成功之后才删除现有的库或表, 快照有问题时现有的数据不受影响
+func (se *SpiderEngine) RestoreSnapshot(p *RestoreParam) error {
+	if se.Closed {
+		return errors.New("Spider Engine is closed!")
+	}
+	if err := checkSnapshotName(p.Name); err != nil {
+		return err
+	}
+	se.RwMutex.Lock()
+	defer se.RwMutex.Unlock()
+	se.SnapMutex.Lock()
+	defer se.SnapMutex.Unlock()
+
+	info, err := se.loadSnapshot(p.Name)
+	if err != nil {
+		return err
+	}
+	dbName := p.Database
+	if dbName == "" {
+		dbName = info.Database
+	}
+	if err := checkDatabaseName(dbName); err != nil {
+		return err
+	}
+
+	if info.Table == "" {
+		if p.Table != "" {
+			return errors.New("Can not restore a table from a database snapshot!")
+		}
+		return se.restoreDatabase(info, dbName)
+	}
+
+	tbName := p.Table
+	if tbName == "" {
+		tbName = info.Table
+	}
+	return se.restoreTable(info, dbName, tbName)
+}
+
+//整库恢复, 调用方需持有写锁
+func (se *SpiderEngine) restoreDatabase(info *SnapshotInfo, dbName string) error {
+	stagePath, err := se.stageRestore(info, info.Tables)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagePath)
+
+	if _, exist := se.DbMap[dbName]; exist {
+		if err := se.dropDatabase(dbName); err != nil {
+			return err
+		}
+	}
+
+	path := fmt.Sprintf("%s%s", se.Path, dbName)
+	db, err := database.NewDatabase(path, dbName)
+	if err != nil {
+		log.Errf("CreateDatabase Error: %v, %v", err, path)
+		return err
+	}
+	for _, tbName := range info.Tables {
+		srcDir := fmt.Sprintf("%s/%s/", stagePath, tbName)
+		if _, err := db.RestoreTable(srcDir, tbName, tbName); err != nil {
+			log.Errf("Restore Table Error: %v, %v", err, dbName + "." + tbName)
+			db.Destory()
+			return err
+		}
+	}
+
+	//关联进入engine, 每一张表启动独立的调度
+	se.DbMap[dbName] = db
+	se.DbList = append(se.DbList, dbName)
+	for _, tbName := range info.Tables {
+		dbTable := dbName + "." + tbName
+		se.CacheMap[dbTable] = se.doSchedule(dbTable)
+	}
+	if err := se.storeMeta(); err != nil {
+		log.Errf("storeMeta Error: %v", err)
+		return err
+	}
+
+	log.Infof("Restore Database %v from snapshot %v", dbName, info.Name)
+	return nil
+}
+
+//单表恢复, 调用方需持有写锁
+func (se *SpiderEngine) restoreTable(info *SnapshotInfo, dbName, tbName string) error {
+	db, exist := se.DbMap[dbName]
+	if !exist {
+		log.Errf("The db not exist!")
+		return errors.New("The db not exist!")
+	}
+	stagePath, err := se.stageRestore(info, []string{info.Table})
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagePath)
+
+	if _, exist := db.TableMap[tbName]; exist {
+		if err := se.dropTable(dbName, tbName); err != nil {
+			return err
+		}
+	}
+
+	srcDir := fmt.Sprintf("%s/%s/", stagePath, info.Table)
+	if _, err := db.RestoreTable(srcDir, info.Table, tbName); err != nil {
+		log.Errf("Restore Table Error: %v, %v", err, dbName + "." + tbName)
+		return err
+	}
+	dbTable := dbName + "." + tbName
+	se.CacheMap[dbTable] = se.doSchedule(dbTable)
+
+	log.Infof("Restore Table %v from snapshot %v", dbTable, info.Name)
+	return nil
+}
+
+//把快照中的表恢复到暂存目录, 并加载一遍校验快照是否完好, 返回暂存目录
+//暂存目录和数据目录在同一个文件系统中, 之后从暂存目录恢复时分区文件仍然是硬链接
+func (se *SpiderEngine) stageRestore(info *SnapshotInfo, tables []string) (string, error) {
+	stagePath := se.snapshotPath(SNAPSHOT_RESTORE_PREFIX + info.Name)
+	os.RemoveAll(stagePath)
+	for _, tbName := range tables {
+		srcDir := fmt.Sprintf("%s/%s/%s/", se.snapshotPath(info.Name), info.Database, tbName)
+		dir := fmt.Sprintf("%s/%s/", stagePath, tbName)
+		if ok := helper.Mkdir(dir); !ok {
+			os.RemoveAll(stagePath)
+			return "", errors.New("Failed create dir!")
+		}
+		tbl, err := table.RestoreTable(srcDir, tbName, dir, tbName)
+		if err != nil {
+			log.Errf("Restore Table Error: %v, %v", err, info.Database + "." + tbName)
+			os.RemoveAll(stagePath)
+			return "", err
+		}
+		if err := tbl.DoClose(); err != nil {
+			os.RemoveAll(stagePath)
+			return "", err
+		}
+	}
+	return stagePath, nil
+}
+
+func (se *SpiderEngine) snapshotPath(name string) string {
+	return fmt.Sprintf("%s%s/%s", se.Path, SNAPSHOT_DIR, name)
+}
+
+//读取全部快照, 调用方需持有快照锁
+func (se *SpiderEngine) listSnapshots() ([]*SnapshotInfo, error) {
+	snapshots := []*SnapshotInfo{}
+	dir := se.Path + SNAPSHOT_DIR
+	if !helper.Exist(dir) {
+		return snapshots, nil
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() || strings.HasPrefix(fi.Name(), SNAPSHOT_TMP_PREFIX) {
+			continue
+		}
+		info, err := se.loadSnapshot(fi.Name())
+		if err != nil {
+			log.Warnf("Load snapshot %v error: %v", fi.Name(), err)
+			continue
+		}
+		snapshots = append(snapshots, info)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Timestamp < snapshots[j].Timestamp
+	})
+	return snapshots, nil
+}
+
+func (se *SpiderEngine) loadSnapshot(name string) (*SnapshotInfo, error) {
+	metaPath := se.snapshotPath(name) + "/" + SNAPSHOT_META_NAME
+	if !helper.ManifestExist(metaPath) {
+		return nil, errors.New("The snapshot not exist!")
+	}
+	buffer, err := helper.ReadManifest(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	info := &SnapshotInfo{}
+	if err := json.Unmarshal(buffer, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+//包含某张表的最新的快照
+func latestSnapshot(snapshots []*SnapshotInfo, dbName, tbName string) *SnapshotInfo {
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if snapshots[i].Database != dbName {
+			continue
+		}
+		for _, name := range snapshots[i].Tables {
+			if name == tbName {
+				return snapshots[i]
+			}
+		}
+	}
+	return nil
+}
+
+func checkSnapshotName(name string) error {
+	if name == "" || strings.HasPrefix(name, SNAPSHOT_TMP_PREFIX) || strings.Contains(name, "/") {
+		return errors.New("Invalid snapshot name: " + name)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"os"
+	"testing"
+	"github.com/hq-cml/spider-engine/core/index"
+	"github.com/hq-cml/spider-engine/utils/helper"
+)
+
+//测试从快照恢复失败时, 现有的库表不受影响
+func TestRestoreSnapshotFailed(t *testing.T) {
+	path := "/tmp/spider/engine_snapshot/"
+	os.RemoveAll(path)
+	helper.Mkdir(path)
+	se, err := InitSpider(path, "0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer se.Stop()
+
+	if err := se.CreateDatabase(&DatabaseParam{Database: TEST_DATABASE}); err != nil {
+		t.Fatal(err)
+	}
+	err = se.CreateTable(&CreateTableParam{Database: TEST_DATABASE, Table: TEST_TABLE, Fileds: FieldsParam{
+		{Name: TEST_FIELD0, Type: index.IDX_TYPE_NAME_PRIME},
+		{Name: TEST_FIELD1, Type: index.IDX_TYPE_NAME_WHOLE},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDoc := func(id, name string) {
+		_, err := se.AddDoc(&DocParam{Database: TEST_DATABASE, Table: TEST_TABLE, Primary: id,
+			Content: DocContent{TEST_FIELD0: id, TEST_FIELD1: name}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	addDoc("10001", "张三")
+	addDoc("10002", "李四")
+
+	//表快照和整库快照, 各自损坏其中表的文件
+	for _, p := range []*SnapshotParam{
+		{Name: "tb_snap", Database: TEST_DATABASE, Table: TEST_TABLE},
+		{Name: "db_snap", Database: TEST_DATABASE},
+	} {
+		if _, err := se.CreateSnapshot(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.RemoveAll(se.snapshotPath(p.Name) + "/" + TEST_DATABASE + "/" + TEST_TABLE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addDoc("10003", "王五")
+
+	if err := se.RestoreSnapshot(&RestoreParam{Name: "tb_snap"}); err == nil {
+		t.Fatal("Should fail")
+	}
+	if err := se.RestoreSnapshot(&RestoreParam{Name: "db_snap"}); err == nil {
+		t.Fatal("Should fail")
+	}
+	for _, key := range []string{"10001", "10002", "10003"} {
+		if doc, err := se.GetDoc(TEST_DATABASE, TEST_TABLE, key); err != nil || doc == nil {
+			t.Fatalf("Doc %v lost: %v", key, err)
+		}
+	}
+	for _, name := range []string{"tb_snap", "db_snap"} {
+		if helper.Exist(se.snapshotPath(SNAPSHOT_RESTORE_PREFIX + name)) {
+			t.Fatal("Stage dir should be removed")
+		}
+	}
+
+	//完好的快照正常覆盖现有的表
+	if _, err := se.CreateSnapshot(&SnapshotParam{Name: "good_snap", Database: TEST_DATABASE, Table: TEST_TABLE}); err != nil {
+		t.Fatal(err)
+	}
+	addDoc("10004", "赵六")
+	if err := se.RestoreSnapshot(&RestoreParam{Name: "good_snap"}); err != nil {
+		t.Fatal(err)
+	}
+	if doc, err := se.GetDoc(TEST_DATABASE, TEST_TABLE, "10003"); err != nil || doc == nil {
+		t.Fatalf("Doc 10003 lost: %v", err)
+	}
+	if doc, _ := se.GetDoc(TEST_DATABASE, TEST_TABLE, "10004"); doc != nil {
+		t.Fatal("Should not exist")
+	}
+	if helper.Exist(se.snapshotPath(SNAPSHOT_RESTORE_PREFIX + "good_snap")) {
+		t.Fatal("Stage dir should be removed")
+	}
+}
@@ -28,6 +28,10 @@ type SpiderEngine struct {
 	Closed      bool								 `json:"-"`
 	CloseChan   chan bool       					 `json:"-"`
 	RwMutex     sync.RWMutex                         `json:"-"`
+	SnapMutex   sync.Mutex                           `json:"-"`   //快照锁, 快照的生成、删除、恢复串行进行
+	TaskMap     map[string]*Task                     `json:"-"`   //后台任务, 详见task.go
+	TaskList    []string                             `json:"-"`   //后台任务id, 按创建顺序
+	TaskMutex   sync.Mutex                           `json:"-"`
 }
 
 type SpiderStatus struct {
@@ -60,12 +64,13 @@ func InitSpider(path string, ver string) (*SpiderEngine, error) {
 	se := SpiderEngine{
 		Path: path,
 		CloseChan: make(chan bool),
+		TaskMap: map[string]*Task{},
 	}
 	metaPath := se.genMetaName()
 
-	if helper.Exist(metaPath) {
+	if helper.ManifestExist(metaPath) {
 		//加载现有的引擎数据
-		buffer, err := helper.ReadFile(metaPath)
+		buffer, err := helper.ReadManifest(metaPath)
 		if err != nil {
 			return nil, err
 		}
@@ -110,7 +115,7 @@ func (se *SpiderEngine) storeMeta() error {
 	metaFileName := se.genMetaName()
 	data := helper.JsonEncodeIndent(se)
 	if data != "" {
-		if err := helper.OverWriteToFile([]byte(data), metaFileName); err != nil {
+		if err := helper.WriteManifest([]byte(data), metaFileName); err != nil {
 			return err
 		}
 	} else {
@@ -247,9 +252,10 @@ func (se *SpiderEngine)doSchedule(dbTable string) *middleware.RequestCache {
 			log.Debug("Got request. Type: ", req.Type)
 			//处理请求
 			switch req.Type {
-			case basic.REQ_TYPE_DDL_ADD_FIELD, basic.REQ_TYPE_DDL_DEL_FIELD:
+			case basic.REQ_TYPE_DDL_ADD_FIELD, basic.REQ_TYPE_DDL_DEL_FIELD, basic.REQ_TYPE_DDL_SETTINGS:
 				se.ProcessDDLRequest(req)
-			case basic.REQ_TYPE_DML_ADD_DOC, basic.REQ_TYPE_DML_DEL_DOC, basic.REQ_TYPE_DML_EDIT_DOC:
+			case basic.REQ_TYPE_DML_ADD_DOC, basic.REQ_TYPE_DML_DEL_DOC, basic.REQ_TYPE_DML_EDIT_DOC, basic.REQ_TYPE_DML_BULK,
+				basic.REQ_TYPE_DML_PATCH_DOC, basic.REQ_TYPE_DML_BY_QUERY:
 				se.ProcessDMLRequest(req)
 			default:
 				log.Fatal("Unsupport Type: ", req.Type)
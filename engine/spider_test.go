@@ -3,6 +3,7 @@ package engine
 import (
 	"os/exec"
 	"os"
+	"github.com/hq-cml/spider-engine/basic"
 	//"testing"
 	//"github.com/hq-cml/spider-engine/core/field"
 	//"github.com/hq-cml/spider-engine/core/index"
@@ -17,6 +18,8 @@ const TEST_FIELD2 = "user_age"
 const TEST_FIELD3 = "user_desc"
 
 func init() {
+	basic.PART_PERSIST_MIN_DOC_CNT = 10000
+	basic.PART_MERGE_MIN_DOC_CNT = 100000
 	cmd := exec.Command("/bin/sh", "-c", `/bin/rm -rf /tmp/spider/*`)
 	_, err := cmd.Output()
 	if err != nil {
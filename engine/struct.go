@@ -1,7 +1,9 @@
 package engine
 
 import (
+	"encoding/json"
 	"github.com/hq-cml/spider-engine/basic"
+	"github.com/hq-cml/spider-engine/core/table"
 )
 
 //增/删库参数
@@ -11,22 +13,25 @@ type DatabaseParam struct {
 
 //字段参数
 type FieldParam struct {
-	Name string `json:"name"`
-	Type string `json:"type"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Positions bool   `json:"positions"` //是否记录词项位置(仅words类型), 开启后支持短语和邻近查询
 }
 
 //建/删表参数
 type FieldsParam []FieldParam
 type CreateTableParam struct {
-	Database string 	   `json:"database"`
-	Table 	 string        `json:"table"`
-	Fileds   FieldsParam   `json:"fields"`
+	Database string 	         `json:"database"`
+	Table 	 string              `json:"table"`
+	Fileds   FieldsParam         `json:"fields"`
+	Settings table.TableSettings `json:"settings"` //表级别的设置, 可选
 }
 
 //增/删段参数
 type AlterTableParam struct {
-	Type     string       `json:"type"`
-	Filed    FieldParam   `json:"field"`
+	Type     string          `json:"type"`
+	Filed    FieldParam      `json:"field"`
+	Settings json.RawMessage `json:"settings"` //type为settings时, 需要修改的设置项
 }
 type AlterFieldParam struct {
 	Database string 	  `json:"database"`
@@ -34,6 +39,13 @@ type AlterFieldParam struct {
 	Filed    FieldParam   `json:"field"`
 }
 
+//修改表设置参数
+type TableSettingsParam struct {
+	Database string 	     `json:"database"`
+	Table    string          `json:"table"`
+	Settings json.RawMessage `json:"settings"`
+}
+
 //增/改文档参数
 type DocContent map[string]interface{}
 type DocParam struct {
@@ -41,6 +53,18 @@ type DocParam struct {
 	Table    string 	  `json:"table"`
 	Primary  string       `json:"parimary"`
 	Content  DocContent   `json:"content"`
+	IfVersion uint64      `json:"ifVersion"` //非0时只有文档的当前版本一致才变更
+}
+
+//局部更新文档参数
+type PatchDocParam struct {
+	Database   string             `json:"database"`
+	Table      string             `json:"table"`
+	PrimaryKey string             `json:"primaryKey"`
+	Doc        DocContent         `json:"doc"`    //覆盖的字段
+	Incr       map[string]float64 `json:"incr"`   //数字字段的增减
+	Upsert     bool               `json:"upsert"` //文档不存在时新增
+	IfVersion  uint64             `json:"ifVersion"` //非0时只有文档的当前版本一致才更新
 }
 
 //获取/删除文档参数
@@ -48,6 +72,31 @@ type DelDocParam struct {
 	Database   string 	 `json:"database"`
 	Table	   string 	 `json:"table"`
 	PrimaryKey string	 `json:"primaryKey"`
+	IfVersion  uint64    `json:"ifVersion"`  //非0时只有文档的当前版本一致才删除
+}
+
+//批量写入的一个操作
+type BulkAction struct {
+	Op         string
+	Database   string
+	Table      string
+	PrimaryKey string
+	Content    DocContent
+	IfVersion  uint64
+}
+
+//批量写入中一张表的全部操作
+type BulkParam struct {
+	Database string
+	Table    string
+	Items    []*table.BulkItem
+}
+
+//批量写入中一个操作的结果
+type BulkItemResult struct {
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	*table.BulkResult
 }
 
 type SearchParam struct {
@@ -55,8 +104,50 @@ type SearchParam struct {
 	Table	   string 			    `json:"table"`
 	FieldName  string				`json:"fieldName"`
 	Value      string				`json:"value"`
+	Query      string				`json:"query"`      //查询语句, 非空时忽略Value, FieldName作为默认字段
+	Operator   string				`json:"operator"`   //多个词项之间的默认运算符, and或or, 默认or
 	Filters    []basic.SearchFilter `json:"filters"`
+	Sorts      []basic.SearchSort   `json:"sorts"`      //排序方式, 可以指定多个字段, 默认按相关性得分降序
+	SearchAfter string              `json:"searchAfter"` //上一页最后一个文档的游标, 非空时忽略Offset
+	Aggs       map[string]basic.SearchAgg `json:"aggs"` //聚合, 名称 => 聚合参数, 针对过滤后的全部命中文档
 	Offset     int32                `json:"offset"`
 	Size       int32                `json:"size"`
 }
 
+//按查询删除/更新参数, 查询条件和搜索一致
+type ByQueryParam struct {
+	Database   string 	 			`json:"database"`
+	Table	   string 			    `json:"table"`
+	FieldName  string				`json:"fieldName"`
+	Value      string				`json:"value"`
+	Query      string				`json:"query"`
+	Operator   string				`json:"operator"`
+	Filters    []basic.SearchFilter `json:"filters"`
+	Doc        DocContent           `json:"doc"`       //仅更新: 覆盖的字段
+	Incr       map[string]float64   `json:"incr"`      //仅更新: 数字字段的增减
+	BatchSize  int                  `json:"batchSize"` //每一批处理的文档数, 默认1000
+}
+
+//按查询删除/更新的一批文档, 交给表的调度器执行
+type ByQueryBatch struct {
+	Database   string
+	Table      string
+	Op         string
+	DocIds     []uint32
+	Doc        DocContent
+	Incr       map[string]float64
+}
+
+//快照参数
+type SnapshotParam struct {
+	Name       string    `json:"name"`
+	Database   string    `json:"database"`
+	Table      string    `json:"table"`    //为空表示整库的快照
+}
+
+//恢复参数, 库名和表名为空则使用快照中原有的名字
+type RestoreParam struct {
+	Name       string    `json:"name"`
+	Database   string    `json:"database"`
+	Table      string    `json:"table"`
+}
@@ -0,0 +1,187 @@
+package engine
+
+/*
+ * 后台任务, 耗时较长的操作(如按查询删除/更新)在后台goroutine中执行, 可以查看进度或者取消
+ * 任务只保存在内存中, 重启之后不再可见; 已经结束的任务最多保留TASK_HISTORY_SIZE个
+ */
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"github.com/hq-cml/spider-engine/core/table"
+	"github.com/hq-cml/spider-engine/utils/idgen"
+)
+
+const (
+	TASK_TYPE_DELETE_BY_QUERY = "delete_by_query"
+	TASK_TYPE_UPDATE_BY_QUERY = "update_by_query"
+
+	TASK_STATUS_RUNNING  = "running"
+	TASK_STATUS_DONE     = "done"
+	TASK_STATUS_CANCELED = "canceled"
+	TASK_STATUS_FAILED   = "failed"
+
+	TASK_HISTORY_SIZE  = 100
+	TASK_MAX_FAILURES  = 100  //最多记录的失败原因
+)
+
+var taskIdGen = idgen.NewIdGenerator()
+
+//任务的状态
+type TaskInfo struct {
+	Id         string `json:"id"`
+	Type       string `json:"type"`
+	Database   string `json:"database"`
+	Table      string `json:"table"`
+	Status     string `json:"status"`
+	Total      int    `json:"total"`      //需要处理的文档数
+	Processed  int    `json:"processed"`  //已经处理的文档数
+	table.ByQueryResult
+	Error      string `json:"error,omitempty"`
+	StartTime  string `json:"startTime"`
+	EndTime    string `json:"endTime,omitempty"`
+}
+
+//后台任务
+type Task struct {
+	info   TaskInfo
+	mutex  sync.Mutex
+	cancel chan struct{}
+	done   chan struct{}
+}
+
+//生成并登记一个任务
+func (se *SpiderEngine) newTask(typ, dbName, tableName string, total int) *Task {
+	now := time.Now()
+	task := &Task{
+		info: TaskInfo{
+			Id:        fmt.Sprintf("%x-%v", now.Unix(), taskIdGen.GetId()), //带上时间, 重启之后不会和之前的任务重复
+			Type:      typ,
+			Database:  dbName,
+			Table:     tableName,
+			Status:    TASK_STATUS_RUNNING,
+			Total:     total,
+			StartTime: now.Format("2006-01-02 15:04:05"),
+		},
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	se.TaskMutex.Lock()
+	defer se.TaskMutex.Unlock()
+	se.TaskMap[task.info.Id] = task
+	se.TaskList = append(se.TaskList, task.info.Id)
+
+	//清理过多的已结束任务
+	finished := 0
+	for i := len(se.TaskList) - 1; i >= 0; i-- {
+		if se.TaskMap[se.TaskList[i]].Info().Status == TASK_STATUS_RUNNING {
+			continue
+		}
+		finished++
+		if finished > TASK_HISTORY_SIZE {
+			delete(se.TaskMap, se.TaskList[i])
+			se.TaskList = append(se.TaskList[:i], se.TaskList[i+1:]...)
+		}
+	}
+	return task
+}
+
+//获取任务状态
+func (se *SpiderEngine) GetTask(id string) (*TaskInfo, error) {
+	se.TaskMutex.Lock()
+	task, exist := se.TaskMap[id]
+	se.TaskMutex.Unlock()
+	if !exist {
+		return nil, errors.New("The task not exist!")
+	}
+	info := task.Info()
+	return &info, nil
+}
+
+//任务列表, 按创建时间排序
+func (se *SpiderEngine) ListTasks() []TaskInfo {
+	se.TaskMutex.Lock()
+	defer se.TaskMutex.Unlock()
+	infos := []TaskInfo{}
+	for _, id := range se.TaskList {
+		infos = append(infos, se.TaskMap[id].Info())
+	}
+	return infos
+}
+
+//取消任务, 正在执行的一批完成之后停止, 已经完成的部分不会回滚
+func (se *SpiderEngine) CancelTask(id string) (*TaskInfo, error) {
+	se.TaskMutex.Lock()
+	task, exist := se.TaskMap[id]
+	se.TaskMutex.Unlock()
+	if !exist {
+		return nil, errors.New("The task not exist!")
+	}
+	task.Cancel()
+	task.Wait()
+	info := task.Info()
+	return &info, nil
+}
+
+//任务状态的拷贝
+func (task *Task) Info() TaskInfo {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+	info := task.info
+	info.Failures = append([]string{}, task.info.Failures...)
+	return info
+}
+
+//通知任务取消
+func (task *Task) Cancel() {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+	if task.info.Status != TASK_STATUS_RUNNING {
+		return
+	}
+	select {
+	case <-task.cancel:
+	default:
+		close(task.cancel)
+	}
+}
+
+//等待任务结束
+func (task *Task) Wait() {
+	<-task.done
+}
+
+//是否已经被取消
+func (task *Task) canceled() bool {
+	select {
+	case <-task.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+//记录一批的进度
+func (task *Task) progress(processed int, ret *table.ByQueryResult) {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+	task.info.Processed += processed
+	task.info.Add(ret)
+	if len(task.info.Failures) > TASK_MAX_FAILURES {
+		task.info.Failures = task.info.Failures[:TASK_MAX_FAILURES]
+	}
+}
+
+//任务结束
+func (task *Task) finish(status string, err error) {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+	task.info.Status = status
+	if err != nil {
+		task.info.Error = err.Error()
+	}
+	task.info.EndTime = time.Now().Format("2006-01-02 15:04:05")
+	close(task.done)
+}
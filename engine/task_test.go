@@ -0,0 +1,47 @@
+package engine
+
+import (
+	"testing"
+	"github.com/hq-cml/spider-engine/core/table"
+)
+
+//测试后台任务的进度、取消和历史清理
+func TestTask(t *testing.T) {
+	se := &SpiderEngine{TaskMap: map[string]*Task{}}
+
+	task := se.newTask(TASK_TYPE_DELETE_BY_QUERY, "db", "user", 10)
+	task.progress(5, &table.ByQueryResult{Deleted: 4, Conflicts: 1, Failures: []string{"01: error"}})
+	info, err := se.GetTask(task.info.Id)
+	if err != nil || info.Status != TASK_STATUS_RUNNING || info.Processed != 5 || info.Deleted != 4 ||
+			info.Conflicts != 1 || len(info.Failures) != 1 {
+		t.Fatalf("Wrong task: %+v, %v", info, err)
+	}
+
+	//取消之后任务自己结束
+	go func() {
+		<-task.cancel
+		task.finish(TASK_STATUS_CANCELED, nil)
+	}()
+	info, err = se.CancelTask(task.info.Id)
+	if err != nil || info.Status != TASK_STATUS_CANCELED || info.EndTime == "" {
+		t.Fatalf("Wrong task: %+v, %v", info, err)
+	}
+	task.Cancel() //已经结束的任务重复取消没有影响
+	if _, err := se.GetTask("nothing"); err == nil {
+		t.Fatal("Should not exist")
+	}
+
+	//已经结束的任务最多保留TASK_HISTORY_SIZE个, 运行中的任务不清理
+	running := se.newTask(TASK_TYPE_UPDATE_BY_QUERY, "db", "user", 0)
+	for i := 0; i < TASK_HISTORY_SIZE + 10; i++ {
+		se.newTask(TASK_TYPE_UPDATE_BY_QUERY, "db", "user", 0).finish(TASK_STATUS_DONE, nil)
+	}
+	se.newTask(TASK_TYPE_UPDATE_BY_QUERY, "db", "user", 0)
+	tasks := se.ListTasks()
+	if len(tasks) != TASK_HISTORY_SIZE + 2 || tasks[0].Id != running.info.Id {
+		t.Fatalf("Wrong tasks: %v", len(tasks))
+	}
+	if _, err := se.GetTask(task.info.Id); err == nil {
+		t.Fatal("Should be cleaned")
+	}
+}
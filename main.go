@@ -13,10 +13,13 @@ import (
 	"github.com/hq-cml/spider-engine/utils/log"
 	"fmt"
 	"github.com/hq-cml/spider-engine/controller"
+	"github.com/hq-cml/spider-engine/utils/helper"
 )
 
 //全局配置
 var confPath *string = flag.String("c", "conf/spider.conf", "config file")
+var checkTarget *string = flag.String("check", "", "offline check a db or db.table, then exit")
+var repair *bool = flag.Bool("repair", false, "repair the problems found by -check")
 
 func main() {
 	//TODO recover兜底panic
@@ -33,11 +36,22 @@ func main() {
 	basic.GlobalConf = conf
 	basic.PART_PERSIST_MIN_DOC_CNT = uint32(conf.PartPersistMinCnt)
 	basic.PART_MERGE_MIN_DOC_CNT = uint32(conf.PartMergeMinCnt)
+	basic.WAL_SYNC_POLICY = conf.WalSyncPolicy
+	basic.WAL_SYNC_INTERVAL_SEC = conf.WalSyncInterval
+	basic.PART_MERGE_FACTOR = conf.PartMergeFactor
+	basic.MERGE_IO_RATE_LIMIT = conf.MergeIoRateLimit
+	basic.FLUSH_MAX_AGE_SEC = conf.FlushMaxAge
+	basic.FLUSH_MAX_BYTES = conf.FlushMaxBytes
 
 	//创建日志文件并初始化日志句柄
 	log.InitLog(conf.LogPath, conf.LogLevel)
 	log.Infof("Begin to start")
 
+	//离线校验, 完成后退出
+	if *checkTarget != "" {
+		os.Exit(check(conf.DataDir, *checkTarget, *repair))
+	}
+
 	//初始化并启动引擎主体
 	se, err := engine.InitSpider(conf.DataDir, basic.SPIDER_VERSION)
 	if err != nil {
@@ -57,6 +71,22 @@ func main() {
 }
 
 
+//离线校验数据, 输出校验报告, 发现问题则返回1
+func check(dataDir, target string, repair bool) int {
+	reports, err := engine.CheckData(dataDir, target, repair)
+	if err != nil {
+		fmt.Println("Check Error:", err)
+		return 1
+	}
+	fmt.Println(helper.JsonEncodeIndent(reports))
+	for _, report := range reports {
+		if len(report.Issues) > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
 //检查状态，并在满足条件时采取必要退出措施。
 //1. 达到了持续空闲时间
 //2. 接收到了结束的信号
@@ -0,0 +1,496 @@
+package bitmap
+
+/*
+ * 压缩位图(roaring bitmap)
+ * 32位的数按高16位分桶, 每个桶(container)存放低16位:
+ *   桶内的数不超过ARRAY_MAX_CNT个时, 用有序数组存放, 每个数2Byte
+ *   超过之后转换成定长的位图(8KB), 数量回落之后再转换回数组
+ * 稀疏的时候只占用很少的空间, 稠密的时候和普通的位图相当, 也不需要预先分配和扩容
+ *
+ * 既可以关联文件(删除标记), 也可以只在内存中使用(搜索时的结果集合)
+ * 关联文件时数据常驻内存, 调用Sync才写回磁盘, 文件格式：
+ *   [magic(8Byte)|version(4Byte)|crc(4Byte)|dataLen(8Byte)|data]
+ *   data: [桶数(4Byte)|[key(2Byte)|个数(4Byte)|数组或者位图]....]
+ * 写入时先写临时文件再改名替换, 不会出现写了一半的文件
+ */
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"sort"
+	"sync"
+	"github.com/hq-cml/spider-engine/utils/mmap"
+)
+
+const (
+	ROARING_MAGIC    = "SPDROARB" //文件头, 和老的mmap位图(头部是一个很小的uint64)区分开
+	ROARING_VERSION  = 1          //文件格式版本
+	ROARING_HEAD_LEN = 24         //magic + version + crc + dataLen
+	ROARING_MAX_NUM  = 0x01 << 32 //能够表示 0 - 2^32-1 的数字范围
+	ARRAY_MAX_CNT    = 4096       //桶内超过这个数量, 数组转换成位图
+	BITMAP_WORD_CNT  = 1024       //位图容器的uint64个数, 1024*64 = 2^16
+)
+
+//位图的接口, 文档删除标记使用
+type BitSet interface {
+	Set(idx uint64) bool
+	Clear(idx uint64) bool
+	IsSet(idx uint64) bool
+	Sync() error
+	Close() error
+}
+
+//一个桶, array和words二选一
+type container struct {
+	array []uint16 //有序数组
+	words []uint64 //位图
+	card  int      //数的个数
+}
+
+type Roaring struct {
+	keys       []uint16     //各个桶的高16位, 有序
+	containers []*container
+	fileName   string       //关联的文件, 空表示只在内存中使用
+	dirty      bool         //是否有未写回的修改
+	rwMutex    sync.RWMutex
+}
+
+//新建一个只在内存中使用的位图
+func NewRoaring() *Roaring {
+	return &Roaring{}
+}
+
+//新建一个关联文件的空位图, 调用Sync之后才会写入(覆盖)文件
+func NewRoaringFile(fileName string) *Roaring {
+	return &Roaring{fileName: fileName, dirty: true}
+}
+
+//加载位图文件
+//老版本的mmap位图文件会被转换成压缩格式, 并写回原文件
+func LoadRoaring(fileName string) (*Roaring, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	rb := &Roaring{fileName: fileName}
+	if !bytes.HasPrefix(data, []byte(ROARING_MAGIC)) {
+		if err := rb.loadLegacy(fileName); err != nil {
+			return nil, err
+		}
+		rb.dirty = true
+		return rb, rb.Sync()
+	}
+
+	if len(data) < ROARING_HEAD_LEN {
+		return nil, errors.New("Roaring file too short")
+	}
+	if version := binary.LittleEndian.Uint32(data[8:]); version != ROARING_VERSION {
+		return nil, errors.New("Unsupport roaring version")
+	}
+	crc := binary.LittleEndian.Uint32(data[12:])
+	dataLen := binary.LittleEndian.Uint64(data[16:])
+	body := data[ROARING_HEAD_LEN:]
+	if uint64(len(body)) != dataLen || crc32.ChecksumIEEE(body) != crc {
+		return nil, errors.New("Roaring file corrupted")
+	}
+	if err := rb.decode(body); err != nil {
+		return nil, err
+	}
+	return rb, nil
+}
+
+//从老的mmap位图转换, 逐个字节扫描, 跳过全0的字节
+//老的位图文件带有mmap的首部, 先校验首部的innerIdx, 损坏的文件不转换
+func (rb *Roaring) loadLegacy(fileName string) error {
+	if _, err := mmap.CheckFile(fileName); err != nil {
+		return err
+	}
+	bm := LoadBitmap(fileName)
+	if bm == nil {
+		return errors.New("Load legacy bitmap failed")
+	}
+	defer bm.Close()
+	size := bm.DataMap.RealCapcity()
+	for i := uint64(0); i < size; i++ {
+		v := bm.DataMap.GetByte(i)
+		for v != 0 {
+			j := uint64(bits.TrailingZeros8(v))
+			rb.add(uint32(i * BYTE_SIZE + j))
+			v &= v - 1
+		}
+	}
+	return nil
+}
+
+func (rb *Roaring) Set(idx uint64) bool {
+	if idx >= ROARING_MAX_NUM {
+		return false
+	}
+	rb.rwMutex.Lock()
+	defer rb.rwMutex.Unlock()
+	rb.add(uint32(idx))
+	rb.dirty = true
+	return true
+}
+
+func (rb *Roaring) Clear(idx uint64) bool {
+	if idx >= ROARING_MAX_NUM {
+		return false
+	}
+	rb.rwMutex.Lock()
+	defer rb.rwMutex.Unlock()
+	i, found := rb.find(uint16(idx >> 16))
+	if !found {
+		return true
+	}
+	c := rb.containers[i]
+	c.remove(uint16(idx))
+	if c.card == 0 {
+		rb.keys = append(rb.keys[:i], rb.keys[i+1:]...)
+		rb.containers = append(rb.containers[:i], rb.containers[i+1:]...)
+	}
+	rb.dirty = true
+	return true
+}
+
+func (rb *Roaring) IsSet(idx uint64) bool {
+	if idx >= ROARING_MAX_NUM {
+		return false
+	}
+	rb.rwMutex.RLock()
+	defer rb.rwMutex.RUnlock()
+	i, found := rb.find(uint16(idx >> 16))
+	return found && rb.containers[i].contains(uint16(idx))
+}
+
+//数的个数
+func (rb *Roaring) Count() uint64 {
+	rb.rwMutex.RLock()
+	defer rb.rwMutex.RUnlock()
+	var cnt uint64
+	for _, c := range rb.containers {
+		cnt += uint64(c.card)
+	}
+	return cnt
+}
+
+//按升序遍历, f返回false则停止
+func (rb *Roaring) ForEach(f func(idx uint32) bool) {
+	rb.rwMutex.RLock()
+	defer rb.rwMutex.RUnlock()
+	for i, c := range rb.containers {
+		high := uint32(rb.keys[i]) << 16
+		if c.words == nil {
+			for _, low := range c.array {
+				if !f(high | uint32(low)) {
+					return
+				}
+			}
+			continue
+		}
+		for w, word := range c.words {
+			for word != 0 {
+				low := uint32(w * 64 + bits.TrailingZeros64(word))
+				if !f(high | low) {
+					return
+				}
+				word &= word - 1
+			}
+		}
+	}
+}
+
+//交集, 返回一个新的内存位图
+func (rb *Roaring) And(other *Roaring) *Roaring {
+	rb.rwMutex.RLock()
+	defer rb.rwMutex.RUnlock()
+	other.rwMutex.RLock()
+	defer other.rwMutex.RUnlock()
+
+	ret := NewRoaring()
+	i, j := 0, 0
+	for i < len(rb.keys) && j < len(other.keys) {
+		if rb.keys[i] == other.keys[j] {
+			if c := rb.containers[i].and(other.containers[j]); c.card > 0 {
+				ret.keys = append(ret.keys, rb.keys[i])
+				ret.containers = append(ret.containers, c)
+			}
+			i++
+			j++
+		} else if rb.keys[i] < other.keys[j] {
+			i++
+		} else {
+			j++
+		}
+	}
+	return ret
+}
+
+//并集, 返回一个新的内存位图
+func (rb *Roaring) Or(other *Roaring) *Roaring {
+	rb.rwMutex.RLock()
+	defer rb.rwMutex.RUnlock()
+	other.rwMutex.RLock()
+	defer other.rwMutex.RUnlock()
+
+	ret := NewRoaring()
+	i, j := 0, 0
+	for i < len(rb.keys) || j < len(other.keys) {
+		if j >= len(other.keys) || (i < len(rb.keys) && rb.keys[i] < other.keys[j]) {
+			ret.keys = append(ret.keys, rb.keys[i])
+			ret.containers = append(ret.containers, rb.containers[i].clone())
+			i++
+		} else if i >= len(rb.keys) || other.keys[j] < rb.keys[i] {
+			ret.keys = append(ret.keys, other.keys[j])
+			ret.containers = append(ret.containers, other.containers[j].clone())
+			j++
+		} else {
+			ret.keys = append(ret.keys, rb.keys[i])
+			ret.containers = append(ret.containers, rb.containers[i].or(other.containers[j]))
+			i++
+			j++
+		}
+	}
+	return ret
+}
+
+//写回关联的文件, 没有修改则跳过
+func (rb *Roaring) Sync() error {
+	rb.rwMutex.Lock()
+	defer rb.rwMutex.Unlock()
+	if rb.fileName == "" || !rb.dirty {
+		return nil
+	}
+
+	body := rb.encode()
+	head := make([]byte, ROARING_HEAD_LEN)
+	copy(head, ROARING_MAGIC)
+	binary.LittleEndian.PutUint32(head[8:], ROARING_VERSION)
+	binary.LittleEndian.PutUint32(head[12:], crc32.ChecksumIEEE(body))
+	binary.LittleEndian.PutUint64(head[16:], uint64(len(body)))
+
+	tmpName := rb.fileName + ".tmp"
+	fout, err := os.OpenFile(tmpName, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fout.Write(append(head, body...)); err != nil {
+		fout.Close()
+		return err
+	}
+	if err := fout.Sync(); err != nil {
+		fout.Close()
+		return err
+	}
+	if err := fout.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, rb.fileName); err != nil {
+		return err
+	}
+	rb.dirty = false
+	return nil
+}
+
+func (rb *Roaring) Close() error {
+	return rb.Sync()
+}
+
+//二分查找桶
+func (rb *Roaring) find(key uint16) (int, bool) {
+	i := sort.Search(len(rb.keys), func(i int) bool { return rb.keys[i] >= key })
+	return i, i < len(rb.keys) && rb.keys[i] == key
+}
+
+//不加锁的Set
+func (rb *Roaring) add(idx uint32) {
+	key := uint16(idx >> 16)
+	i, found := rb.find(key)
+	if !found {
+		rb.keys = append(rb.keys, 0)
+		copy(rb.keys[i+1:], rb.keys[i:])
+		rb.keys[i] = key
+		rb.containers = append(rb.containers, nil)
+		copy(rb.containers[i+1:], rb.containers[i:])
+		rb.containers[i] = &container{}
+	}
+	rb.containers[i].add(uint16(idx))
+}
+
+func (rb *Roaring) encode() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(len(rb.keys)))
+	for i, c := range rb.containers {
+		binary.Write(buf, binary.LittleEndian, rb.keys[i])
+		binary.Write(buf, binary.LittleEndian, uint32(c.card))
+		if c.words == nil {
+			binary.Write(buf, binary.LittleEndian, c.array)
+		} else {
+			binary.Write(buf, binary.LittleEndian, c.words)
+		}
+	}
+	return buf.Bytes()
+}
+
+func (rb *Roaring) decode(data []byte) error {
+	reader := bytes.NewReader(data)
+	var cnt uint32
+	if err := binary.Read(reader, binary.LittleEndian, &cnt); err != nil {
+		return err
+	}
+	rb.keys = make([]uint16, cnt)
+	rb.containers = make([]*container, cnt)
+	for i := range rb.keys {
+		var card uint32
+		if err := binary.Read(reader, binary.LittleEndian, &rb.keys[i]); err != nil {
+			return err
+		}
+		if err := binary.Read(reader, binary.LittleEndian, &card); err != nil {
+			return err
+		}
+		c := &container{card: int(card)}
+		if card <= ARRAY_MAX_CNT {
+			c.array = make([]uint16, card)
+			if err := binary.Read(reader, binary.LittleEndian, c.array); err != nil {
+				return err
+			}
+		} else {
+			c.words = make([]uint64, BITMAP_WORD_CNT)
+			if err := binary.Read(reader, binary.LittleEndian, c.words); err != nil {
+				return err
+			}
+		}
+		rb.containers[i] = c
+	}
+	return nil
+}
+
+func (c *container) contains(low uint16) bool {
+	if c.words != nil {
+		return c.words[low >> 6] & (1 << (low & 63)) != 0
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= low })
+	return i < len(c.array) && c.array[i] == low
+}
+
+func (c *container) add(low uint16) {
+	if c.words != nil {
+		w, mask := low >> 6, uint64(1) << (low & 63)
+		if c.words[w] & mask == 0 {
+			c.words[w] |= mask
+			c.card++
+		}
+		return
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= low })
+	if i < len(c.array) && c.array[i] == low {
+		return
+	}
+	c.array = append(c.array, 0)
+	copy(c.array[i+1:], c.array[i:])
+	c.array[i] = low
+	c.card++
+	if c.card > ARRAY_MAX_CNT {
+		c.toWords()
+	}
+}
+
+func (c *container) remove(low uint16) {
+	if c.words != nil {
+		w, mask := low >> 6, uint64(1) << (low & 63)
+		if c.words[w] & mask != 0 {
+			c.words[w] &^= mask
+			c.card--
+			if c.card <= ARRAY_MAX_CNT {
+				c.toArray()
+			}
+		}
+		return
+	}
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= low })
+	if i < len(c.array) && c.array[i] == low {
+		c.array = append(c.array[:i], c.array[i+1:]...)
+		c.card--
+	}
+}
+
+//数组转位图
+func (c *container) toWords() {
+	c.words = make([]uint64, BITMAP_WORD_CNT)
+	for _, low := range c.array {
+		c.words[low >> 6] |= 1 << (low & 63)
+	}
+	c.array = nil
+}
+
+//位图转数组
+func (c *container) toArray() {
+	c.array = make([]uint16, 0, c.card)
+	for w, word := range c.words {
+		for word != 0 {
+			c.array = append(c.array, uint16(w * 64 + bits.TrailingZeros64(word)))
+			word &= word - 1
+		}
+	}
+	c.words = nil
+}
+
+func (c *container) clone() *container {
+	ret := &container{card: c.card}
+	if c.words != nil {
+		ret.words = append([]uint64{}, c.words...)
+	} else {
+		ret.array = append([]uint16{}, c.array...)
+	}
+	return ret
+}
+
+func (c *container) and(other *container) *container {
+	ret := &container{}
+	if c.words != nil && other.words != nil {
+		ret.words = make([]uint64, BITMAP_WORD_CNT)
+		for i := range ret.words {
+			ret.words[i] = c.words[i] & other.words[i]
+			ret.card += bits.OnesCount64(ret.words[i])
+		}
+		if ret.card <= ARRAY_MAX_CNT {
+			ret.toArray()
+		}
+		return ret
+	}
+	//至少有一个是数组, 结果一定不超过数组的大小
+	a, b := c, other
+	if a.words != nil {
+		a, b = b, a
+	}
+	for _, low := range a.array {
+		if b.contains(low) {
+			ret.array = append(ret.array, low)
+		}
+	}
+	ret.card = len(ret.array)
+	return ret
+}
+
+func (c *container) or(other *container) *container {
+	ret := c.clone()
+	if other.words != nil {
+		if ret.words == nil {
+			ret.toWords()
+		}
+		ret.card = 0
+		for i := range ret.words {
+			ret.words[i] |= other.words[i]
+			ret.card += bits.OnesCount64(ret.words[i])
+		}
+		return ret
+	}
+	for _, low := range other.array {
+		ret.add(low)
+	}
+	return ret
+}
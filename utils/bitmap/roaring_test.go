@@ -0,0 +1,126 @@
+package bitmap
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestRoaringSetGet(t *testing.T) {
+	rb := NewRoaring()
+	//稀疏的桶和稠密的桶
+	for i := uint64(0); i < 10000; i++ {
+		rb.Set(i * 3)
+	}
+	rb.Set(1 << 20)
+	rb.Set(ROARING_MAX_NUM - 1)
+	if rb.Set(ROARING_MAX_NUM) {
+		panic("Should be out of range")
+	}
+	if rb.Count() != 10002 || !rb.IsSet(9999 * 3) || rb.IsSet(9999 * 3 + 1) || !rb.IsSet(1 << 20) || !rb.IsSet(ROARING_MAX_NUM - 1) {
+		panic(fmt.Sprintf("Wrong roaring: %v", rb.Count()))
+	}
+	if rb.containers[0].words == nil {
+		panic("Should be words container")
+	}
+
+	//清除之后数量回落, 位图转换回数组
+	for i := uint64(0); i < 10000; i += 2 {
+		rb.Clear(i * 3)
+	}
+	if rb.Count() != 5002 || rb.IsSet(0) || !rb.IsSet(3) || rb.containers[0].words == nil {
+		panic(fmt.Sprintf("Wrong roaring: %v", rb.Count()))
+	}
+	for i := uint64(1); i < 2000; i += 2 {
+		rb.Clear(i * 3)
+	}
+	if rb.Count() != 4002 || rb.IsSet(3) || !rb.IsSet(2001 * 3) || rb.containers[0].words != nil {
+		panic(fmt.Sprintf("Wrong roaring: %v", rb.Count()))
+	}
+	rb.Clear(1 << 20)
+	if len(rb.keys) != 2 {
+		panic("Empty container should be removed")
+	}
+
+	//有序遍历
+	var prev int64 = -1
+	cnt := 0
+	rb.ForEach(func(idx uint32) bool {
+		if int64(idx) <= prev {
+			panic("Not in order")
+		}
+		prev = int64(idx)
+		cnt++
+		return true
+	})
+	if cnt != 4001 {
+		panic(fmt.Sprintf("Wrong foreach: %v", cnt))
+	}
+}
+
+func TestRoaringAndOr(t *testing.T) {
+	a, b := NewRoaring(), NewRoaring()
+	for i := uint64(0); i < 100000; i++ {
+		if i % 2 == 0 {
+			a.Set(i)
+		}
+		if i % 3 == 0 {
+			b.Set(i)
+		}
+	}
+	and, or := a.And(b), a.Or(b)
+	for i := uint64(0); i < 100000; i++ {
+		if and.IsSet(i) != (i % 6 == 0) || or.IsSet(i) != (i % 2 == 0 || i % 3 == 0) {
+			panic(fmt.Sprintf("Wrong and/or: %v", i))
+		}
+	}
+	if and.Count() != 16667 || or.Count() != 66667 {
+		panic(fmt.Sprintf("Wrong count: %v, %v", and.Count(), or.Count()))
+	}
+}
+
+func TestRoaringPersist(t *testing.T) {
+	fileName := "/tmp/roaring.dat"
+	os.Remove(fileName)
+
+	rb := NewRoaringFile(fileName)
+	for i := uint64(0); i < 5000; i++ {
+		rb.Set(i * 7)
+	}
+	if err := rb.Close(); err != nil {
+		panic(err)
+	}
+	rb, err := LoadRoaring(fileName)
+	if err != nil {
+		panic(err)
+	}
+	if rb.Count() != 5000 || !rb.IsSet(4999 * 7) || rb.IsSet(1) {
+		panic(fmt.Sprintf("Wrong load: %v", rb.Count()))
+	}
+
+	//损坏的文件
+	f, _ := os.OpenFile(fileName, os.O_WRONLY, 0644)
+	f.WriteAt([]byte{0xFF}, ROARING_HEAD_LEN + 10)
+	f.Close()
+	if _, err := LoadRoaring(fileName); err == nil {
+		panic("Should be corrupted")
+	}
+
+	//老的mmap位图自动转换
+	os.Remove(fileName)
+	bm := NewBitmap(fileName, 64)
+	bm.Set(3)
+	bm.Set(63)
+	bm.Close()
+	rb, err = LoadRoaring(fileName)
+	if err != nil {
+		panic(err)
+	}
+	if rb.Count() != 2 || !rb.IsSet(3) || !rb.IsSet(63) {
+		panic(fmt.Sprintf("Wrong legacy load: %v", rb.Count()))
+	}
+	rb, err = LoadRoaring(fileName)
+	if err != nil || rb.Count() != 2 {
+		panic("Legacy bitmap should be converted")
+	}
+}
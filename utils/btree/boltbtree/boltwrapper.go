@@ -145,6 +145,27 @@ func (br *BoltWrapper) MutiSet(bucketName string, kv map[string]string) error {
 	return nil
 }
 
+//批量删除, 不存在的key忽略
+func (br *BoltWrapper) MutiDel(bucketName string, keys []string) error {
+
+	if err := br.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return errors.New(fmt.Sprintf("Bucketname[%v] not found", bucketName))
+		}
+		for _, k := range keys {
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Errln("Bolt MutiDel Error:", err)
+		return err
+	}
+	return nil
+}
+
 //更新一个对象(以 json 形式)
 func (br *BoltWrapper) SetObj(bucketName, key string, obj interface{}) error {
 
@@ -271,6 +292,27 @@ func (br *BoltWrapper) GetFristKV(bucketName string) (string, string, error) {
 	return string(k), string(v), nil
 }
 
+//按key的顺序遍历, f返回false则停止
+func (br *BoltWrapper) ForEach(bucketName string, f func(key, value string) bool) error {
+	if err := br.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketName))
+		if b == nil {
+			return errors.New(fmt.Sprintf("Bucketname[%v] not found", bucketName))
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !f(string(k), string(v)) {
+				break
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Errln("ForEach Error:", err)
+		return err
+	}
+	return nil
+}
+
 //Close
 func (br *BoltWrapper) CloseDB() error {
 	return br.db.Close()
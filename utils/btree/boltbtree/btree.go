@@ -31,11 +31,25 @@ func NewBoltBTree(filename string) *BoltBTree {
 
 }
 
+//打开B+树文件, 出错时返回错误而不是退出, 用于校验等场景
+func OpenBoltBTree(filename string) (*BoltBTree, error) {
+	wrapper, err := NewBoltWrapper(filename, 0666, 5 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltBTree{filename: filename, wrapper: wrapper}, nil
+}
+
 //增加一棵树, 底层对应 => 一个wrapper.Table => 一个bolt.bucket
 func (bt *BoltBTree) AddTree(treeName string) error {
 	return bt.wrapper.CreateBucket(treeName)
 }
 
+//删除一棵树
+func (bt *BoltBTree) DelTree(treeName string) error {
+	return bt.wrapper.DeleteBucket(treeName)
+}
+
 //Set
 func (bt *BoltBTree) Set(treeName, key, val string) error {
 	return bt.wrapper.Set(treeName, key, val)
@@ -46,6 +60,11 @@ func (bt *BoltBTree) MutiSet(treeName string, kv map[string]string) error {
 	return bt.wrapper.MutiSet(treeName, kv)
 }
 
+//Multi Delete
+func (bt *BoltBTree) MutiDel(treeName string, keys []string) error {
+	return bt.wrapper.MutiDel(treeName, keys)
+}
+
 //get int
 func (bt *BoltBTree) GetInt(treeName, key string) (int64, bool) {
 	vstr, ok := bt.wrapper.Get(treeName, key)
@@ -112,6 +131,11 @@ func (db *BoltBTree) GetNextKV(treeName, key string) (string, uint32, bool) {
 
 }
 
+//遍历整棵树
+func (db *BoltBTree) ForEach(treeName string, f func(key, value string) bool) error {
+	return db.wrapper.ForEach(treeName, f)
+}
+
 func (db *BoltBTree) HasTree(treeName string) bool {
 	return db.wrapper.HasBucket(treeName)
 }
@@ -60,6 +60,28 @@ func TestMultiSet(t *testing.T) {
 	t.Log("\n\n")
 }
 
+func TestMultiDel(t *testing.T) {
+	tree := GetBoltWrapperInstance()
+	err := tree.MutiSet("first", map[string]string {
+		"dd": "1",
+		"ff": "2",
+	})
+	if err != nil {
+		panic(err)
+	}
+	if err := tree.MutiDel("first", []string{"dd", "ff", "not exist"}); err != nil {
+		panic(err)
+	}
+	if _, ok := tree.Get("first", "dd"); ok {
+		panic("dd should be deleted")
+	}
+	if _, ok := tree.Get("first", "ff"); ok {
+		panic("ff should be deleted")
+	}
+
+	t.Log("\n\n")
+}
+
 func TestDisplayBucket(t *testing.T) {
 	tree := GetBoltWrapperInstance()
 	tree.DisplayBucket("first")
@@ -7,13 +7,16 @@ import "github.com/hq-cml/spider-engine/utils/btree/boltbtree"
  */
 type Btree interface {
 	AddTree(treeName string) error
+	DelTree(treeName string) error
 	Set(treeName, key, value string) error
 	MutiSet(treeName string, kv map[string]string) error
+	MutiDel(treeName string, keys []string) error
 	GetInt(treeName, key string) (int64, bool)
 	GetStr(treeName, key string) (string, bool)
 	Inc(treeName, key string) error
 	GetFristKV(treeName string) (string, uint32, bool)
 	GetNextKV(treeName, key string) (string, uint32, bool)
+	ForEach(treeName string, f func(key, value string) bool) error
 	HasTree(treeName string) bool
 	Close() error
 	Display(treeName string) error
@@ -24,3 +27,12 @@ type Btree interface {
 func NewBtree(treeClass, path string) Btree {
 	return boltbtree.NewBoltBTree(path)
 }
+
+//打开已有的B+树文件, 出错时返回错误
+func OpenBtree(treeClass, path string) (Btree, error) {
+	bt, err := boltbtree.OpenBoltBTree(path)
+	if err != nil {
+		return nil, err
+	}
+	return bt, nil
+}
@@ -1,6 +1,7 @@
 package helper
 
 import (
+	"io"
 	"os"
 	"io/ioutil"
 	"github.com/hq-cml/spider-engine/utils/log"
@@ -73,4 +74,43 @@ func Remove(path string) error {
 	}
 	log.Info("Remove: ", path)
 	return nil
-}
\ No newline at end of file
+}
+// 复制文件, 并刷盘
+// Note：
+//   覆盖写，目标文件已存在则清空
+func CopyFile(src, dst string) error {
+	fin, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+
+	fout, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(fout, fin); err != nil {
+		fout.Close()
+		return err
+	}
+	if err = fout.Sync(); err != nil {
+		fout.Close()
+		return err
+	}
+	return fout.Close()
+}
+
+// 硬链接文件, 失败(比如跨设备)则退化为复制
+// Note：
+//   仅用于落地之后不会再变化的文件, 否则源文件的修改会同时影响到目标文件
+func LinkOrCopy(src, dst string) error {
+	if Exist(dst) {
+		if err := os.Remove(dst); err != nil {
+			return err
+		}
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return CopyFile(src, dst)
+}
@@ -1,6 +1,9 @@
 package helper
 
-import "testing"
+import (
+	"os"
+	"testing"
+)
 
 func TestFileOp(t *testing.T) {
 	err := OverWriteToFile([]byte("Hello world"), "/tmp/tmpFile")
@@ -33,4 +36,55 @@ func TestTime(t *testing.T) {
 	if s != "2019-10-10 00:01:01" {
 		t.Error("not same")
 	}
-}
\ No newline at end of file
+}
+func TestManifest(t *testing.T) {
+	path := "/tmp/tmpManifest.meta"
+	RemoveManifest(path)
+
+	//老格式的json兼容读取
+	if err := OverWriteToFile([]byte(`{"v":0}`), path); err != nil {
+		t.Error("Write err:", err)
+	}
+	if data, err := ReadManifest(path); err != nil || string(data) != `{"v":0}` {
+		t.Error("Read old format err:", err)
+	}
+
+	if err := WriteManifest([]byte(`{"v":1}`), path); err != nil {
+		t.Error("Write err:", err)
+	}
+	if err := WriteManifest([]byte(`{"v":2}`), path); err != nil {
+		t.Error("Write err:", err)
+	}
+	if data, err := ReadManifest(path); err != nil || string(data) != `{"v":2}` {
+		t.Error("Read err:", err, string(data))
+	}
+	if _, version, _ := readManifestFile(path); version != 2 {
+		t.Error("Wrong version:", version)
+	}
+
+	//当前版本损坏, 回退到上一个版本
+	OverWriteToFile([]byte(MANIFEST_MAGIC + " 3 00000000 7\n{\"v\":3"), path)
+	if data, err := ReadManifest(path); err != nil || string(data) != `{"v":1}` {
+		t.Error("Fallback err:", err, string(data))
+	}
+	//损坏的版本不会覆盖上一个版本
+	if err := WriteManifest([]byte(`{"v":4}`), path); err != nil {
+		t.Error("Write err:", err)
+	}
+	if data, _, _ := readManifestFile(path + MANIFEST_PREV_SUFFIX); string(data) != `{"v":1}` {
+		t.Error("Wrong prev:", string(data))
+	}
+
+	//改名过程中崩溃, 当前版本不存在
+	os.Remove(path)
+	if !ManifestExist(path) {
+		t.Error("Should exist")
+	}
+	if data, err := ReadManifest(path); err != nil || string(data) != `{"v":1}` {
+		t.Error("Fallback err:", err, string(data))
+	}
+
+	if err := RemoveManifest(path); err != nil || ManifestExist(path) {
+		t.Error("Remove err:", err)
+	}
+}
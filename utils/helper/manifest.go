@@ -0,0 +1,137 @@
+package helper
+
+/*
+ * 元信息(manifest)文件的原子读写
+ * 写入时先写临时文件并fsync, 然后把当前版本改名为.prev, 再把临时文件改名为正式文件, 最后fsync目录
+ * 文件头记录版本号、crc和长度, 读取时校验, 当前版本损坏(或者改名过程中崩溃导致不存在)则回退到.prev
+ *
+ * 文件格式：
+ *     SPIDER-MANIFEST <version> <crc32> <len>\n<data>
+ * 老版本直接写json, 没有文件头, 读取时仍然兼容
+ */
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"github.com/hq-cml/spider-engine/utils/log"
+)
+
+const (
+	MANIFEST_MAGIC       = "SPIDER-MANIFEST"
+	MANIFEST_TMP_SUFFIX  = ".tmp"
+	MANIFEST_PREV_SUFFIX = ".prev"
+)
+
+//原子的写入元信息
+func WriteManifest(data []byte, filePath string) error {
+	//当前版本完好才保留为上一个版本, 否则保留原有的.prev
+	_, version, curErr := readManifestFile(filePath)
+	header := fmt.Sprintf("%v %v %08x %v\n", MANIFEST_MAGIC, version + 1, crc32.ChecksumIEEE(data), len(data))
+
+	//写临时文件并刷盘
+	tmpPath := filePath + MANIFEST_TMP_SUFFIX
+	fout, err := os.OpenFile(tmpPath, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fout.Write(append([]byte(header), data...)); err != nil {
+		fout.Close()
+		return err
+	}
+	if err := fout.Sync(); err != nil {
+		fout.Close()
+		return err
+	}
+	if err := fout.Close(); err != nil {
+		return err
+	}
+
+	//切换版本
+	if curErr == nil {
+		if err := os.Rename(filePath, filePath + MANIFEST_PREV_SUFFIX); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filePath))
+}
+
+//读取元信息, 当前版本不可用则回退到上一个版本
+func ReadManifest(filePath string) ([]byte, error) {
+	data, _, err := readManifestFile(filePath)
+	if err == nil {
+		return data, nil
+	}
+	log.Warnf("Manifest %v error: %v. Try the previous one", filePath, err)
+	data, _, prevErr := readManifestFile(filePath + MANIFEST_PREV_SUFFIX)
+	if prevErr != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+//元信息是否存在(包括上一个版本)
+func ManifestExist(filePath string) bool {
+	return Exist(filePath) || Exist(filePath + MANIFEST_PREV_SUFFIX)
+}
+
+//删除元信息的全部版本, 不存在的忽略
+func RemoveManifest(filePath string) error {
+	for _, path := range []string{filePath, filePath + MANIFEST_TMP_SUFFIX, filePath + MANIFEST_PREV_SUFFIX} {
+		if Exist(path) {
+			if err := Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//读取并校验一个元信息文件, 返回数据和版本号
+func readManifestFile(filePath string) ([]byte, uint64, error) {
+	buffer, err := ReadFile(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	//老格式, 没有文件头
+	if !strings.HasPrefix(string(buffer), MANIFEST_MAGIC + " ") {
+		if !json.Valid(buffer) {
+			return nil, 0, errors.New("Invalid manifest: " + filePath)
+		}
+		return buffer, 0, nil
+	}
+
+	pos := strings.IndexByte(string(buffer), '\n')
+	if pos < 0 {
+		return nil, 0, errors.New("Invalid manifest header: " + filePath)
+	}
+	var magic string
+	var version uint64
+	var crc uint32
+	var length int
+	if _, err := fmt.Sscanf(string(buffer[:pos]), "%s %d %x %d", &magic, &version, &crc, &length); err != nil {
+		return nil, 0, errors.New("Invalid manifest header: " + filePath)
+	}
+	data := buffer[pos + 1:]
+	if len(data) != length || crc32.ChecksumIEEE(data) != crc {
+		return nil, 0, errors.New("Manifest checksum error: " + filePath)
+	}
+	return data, version, nil
+}
+
+//目录刷盘, 保证改名操作落地
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}
@@ -86,6 +86,32 @@ func NewMmap(filePath string, load bool, size uint64) (*Mmap, error) {
 	return mmp, nil
 }
 
+//不建立映射, 只读取文件首部校验innerIdx, 返回innerIdx
+//innerIdx必须落在[HEADER_LEN, 文件大小]之间, 否则说明文件损坏(比如磁盘满时写了一半)
+func CheckFile(filePath string) (uint64, error) {
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.Size() < HEADER_LEN {
+		return 0, fmt.Errorf("File too short: %v", fi.Size())
+	}
+	header := make([]byte, HEADER_LEN)
+	if _, err := fd.ReadAt(header, 0); err != nil {
+		return 0, err
+	}
+	innerIdx := binary.LittleEndian.Uint64(header)
+	if innerIdx < HEADER_LEN || innerIdx > uint64(fi.Size()) {
+		return innerIdx, fmt.Errorf("Invalid innerIdx: %v, file size: %v", innerIdx, fi.Size())
+	}
+	return innerIdx, nil
+}
+
 //谨慎使用, 最好通过程序自动增加
 func (mmp *Mmap) SetInnerIdx(idx uint64) {
 	mmp.innerIdx = idx